@@ -14,6 +14,7 @@ import (
 	"time"
 
 	model "github.com/DataDog/agent-payload/process"
+	"github.com/DataDog/datadog-agent/pkg/process/checks"
 	"github.com/DataDog/datadog-agent/pkg/process/config"
 	"github.com/DataDog/datadog-agent/pkg/process/util"
 )
@@ -46,7 +47,15 @@ const (
   Docker socket: {{.Status.DockerSocket}}{{end}}
   Number of processes: {{.Status.ProcessCount}}
   Number of containers: {{.Status.ContainerCount}}
-  Queue length: {{.Status.QueueSize}}
+  Queue length: {{.Status.QueueSize}}{{with .Status.DockerProxyFilter}}
+
+  Docker proxy filter: {{if .Enabled}}enabled{{else}}disabled{{end}}{{if .Error}}
+    Error: {{.Error}}{{end}}{{if .Enabled}}
+    Proxies: {{.Proxies}}{{range .Targets}}
+      pid {{.PID}}: {{.Target}}, proxy IP {{if .ProxyIP}}{{.ProxyIP}}{{else}}unknown{{end}}{{end}}{{if .TruncatedTargets}}
+      and {{.TruncatedTargets}} more{{end}}
+    Last refresh: {{if .LastRefresh}}{{.LastRefresh}} (took {{.LastRefreshDuration}}){{else}}never{{end}}
+    Last run: {{.LastRun.Dropped}} connections dropped out of {{.LastRun.Examined}}, {{.LastRun.ProxyIPDiscoveries}} proxy IPs discovered, {{.LastRun.ProxyIPMismatches}} proxy IP mismatches{{end}}{{end}}
 
   Logs: {{.Status.Config.LogFile}}{{if .Status.ProxyURL}}
   HttpProxy: {{.Status.ProxyURL}}{{end}}{{if ne .Status.ContainerID ""}}
@@ -148,6 +157,30 @@ func publishQueueSize() interface{} {
 	return infoQueueSize
 }
 
+func publishDockerProxyFilter() interface{} {
+	status := checks.Connections.ProxyFilterStatus()
+	if !status.Enabled && status.Error == "" {
+		// the connections check isn't running
+		return nil
+	}
+	return status
+}
+
+// serveDockerProxyFlare writes the state of the docker-proxy filter of the connections check, shipped in the
+// flares of the agent
+func serveDockerProxyFlare(w http.ResponseWriter, _ *http.Request) {
+	flare := checks.Connections.ProxyFilterFlare()
+	if !flare.Status.Enabled && flare.Status.Error == "" {
+		http.Error(w, "the connections check isn't running", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(flare); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
 func publishContainerID() interface{} {
 	cgroupFile := "/proc/self/cgroup"
 	if !util.PathExists(cgroupFile) {
@@ -212,6 +245,8 @@ type StatusInfo struct {
 	QueueSize       int                    `json:"queue_size"`
 	ContainerID     string                 `json:"container_id"`
 	ProxyURL        string                 `json:"proxy_url"`
+	// DockerProxyFilter is nil if the connections check isn't running
+	DockerProxyFilter *checks.ProxyFilterStatus `json:"docker_proxy_filter"`
 }
 
 func initInfo(conf *config.AgentConfig) error {
@@ -235,6 +270,7 @@ func initInfo(conf *config.AgentConfig) error {
 		expvar.Publish("container_count", expvar.Func(publishContainerCount))
 		expvar.Publish("queue_size", expvar.Func(publishQueueSize))
 		expvar.Publish("container_id", expvar.Func(publishContainerID))
+		expvar.Publish("docker_proxy_filter", expvar.Func(publishDockerProxyFilter))
 		c := *conf
 		var buf []byte
 		buf, err = json.Marshal(&c)
@@ -137,3 +137,54 @@ func TestError(t *testing.T) {
 
 	assert.Equal(errInfo, info)
 }
+
+func TestInfoDockerProxyFilter(t *testing.T) {
+	assert := assert.New(t)
+	conf := config.NewDefaultAgentConfig(false)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"config":{"HostName":"ubuntu-1404.vagrantup.com","LogFile":"/var/log/datadog/process-agent.log"},` +
+			`"pid":485,"uptime":3464,"memstats":{"Alloc":2096792},"version":{"Version":"0.99.0"},` +
+			`"last_collect_time":"2017-09-28 07:10:16","process_count":84,"docker_proxy_filter":{"enabled":true,"proxies":3,` +
+			`"targets":[{"pid":1201,"target":"172.17.0.2:80","proxy_ip":"172.17.0.1"},{"pid":1202,"target":"[fd00::3]:443","proxy_ip":""}],` +
+			`"truncated_targets":1,"last_refresh":"2017-09-28 07:10:15","last_refresh_duration":12500000,` +
+			`"last_run":{"Examined":120,"Dropped":8,"Proxies":3,"ProxyIPDiscoveries":1,"ProxyIPMismatches":0}}}`))
+	}))
+	defer server.Close()
+
+	assert.NoError(initInfo(conf))
+	var buf bytes.Buffer
+	assert.NoError(Info(&buf, conf, server.URL))
+	assert.Equal(`=========================================
+Processes and Containers Agent (v 0.99.0)
+=========================================
+
+  Pid: 485
+  Hostname: ubuntu-1404.vagrantup.com
+  Uptime: 3464 seconds
+  Mem alloc: 2096792 bytes
+
+  Last collection time: 2017-09-28 07:10:16
+  Number of processes: 84
+  Number of containers: 0
+  Queue length: 0
+
+  Docker proxy filter: enabled
+    Proxies: 3
+      pid 1201: 172.17.0.2:80, proxy IP 172.17.0.1
+      pid 1202: [fd00::3]:443, proxy IP unknown
+      and 1 more
+    Last refresh: 2017-09-28 07:10:15 (took 12.5ms)
+    Last run: 8 connections dropped out of 120, 1 proxy IPs discovered, 0 proxy IP mismatches
+
+  Logs: /var/log/datadog/process-agent.log
+
+`, buf.String())
+}
+
+func TestServeDockerProxyFlare(t *testing.T) {
+	// the connections check isn't running
+	rec := httptest.NewRecorder()
+	serveDockerProxyFlare(rec, httptest.NewRequest(http.MethodGet, "/debug/dockerproxy", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
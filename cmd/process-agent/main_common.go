@@ -163,7 +163,8 @@ func runAgent(exit chan bool) {
 		return
 	}
 
-	// Run a profile server.
+	// Run a profile server, which also serves the state of the docker-proxy filter for the flares
+	http.HandleFunc("/debug/dockerproxy", serveDockerProxyFlare)
 	go func() {
 		http.ListenAndServe(fmt.Sprintf("localhost:%d", cfg.ProcessExpVarPort), nil)
 	}()
@@ -43,6 +43,9 @@ const (
 
 	// DefaultBatchWait is the default HTTP batch wait in second for logs
 	DefaultBatchWait = 5
+
+	// DefaultProcessExpVarPort is the default port the process-agent serves its expvars on
+	DefaultProcessExpVarPort = 6062
 )
 
 var overrideVars = make(map[string]interface{})
@@ -16,7 +16,9 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
+	neturl "net/url"
 	"os"
 	"path/filepath"
 	"regexp"
@@ -39,6 +41,7 @@ import (
 
 const (
 	routineDumpFilename = "go-routine-dump.log"
+	dockerProxyFilename = "dockerproxy.json"
 
 	// Maximum size for the root directory name
 	directoryNameMaxSize = 32
@@ -48,6 +51,10 @@ var (
 	pprofURL = fmt.Sprintf("http://127.0.0.1:%s/debug/pprof/goroutine?debug=2",
 		config.Datadog.GetString("expvar_port"))
 
+	// dockerProxyURL is where the process-agent serves the state of its docker-proxy filter, the URL being
+	// built from the process-agent expvar port if empty
+	dockerProxyURL string
+
 	// Match .yaml and .yml to ship configuration files in the flare.
 	cnfFileExtRx = regexp.MustCompile(`(?i)\.ya?ml`)
 
@@ -199,6 +206,11 @@ func createArchive(zipFilePath string, local bool, confSearchPaths SearchPaths,
 		log.Errorf("Could not collect go routine stack traces: %s", err)
 	}
 
+	err = zipDockerProxy(tempDir, hostname)
+	if err != nil {
+		log.Errorf("Could not zip docker-proxy filter state: %s", err)
+	}
+
 	if config.IsContainerized() {
 		err = zipDockerSelfInspect(tempDir, hostname)
 		if err != nil {
@@ -677,3 +689,77 @@ func getSystemProbePath(ddCfgFilePath string) string {
 	path := filepath.Dir(ddCfgFilePath)
 	return filepath.Join(path, "system-probe.yaml")
 }
+
+// zipDockerProxy writes the state of the docker-proxy filter of the process-agent: the proxies it tracks,
+// the connections it lately matched against them and the errors it met. Nothing is written if the process-agent
+// isn't listening or its connections check isn't running, the errors met retrieving the state being written in
+// its place otherwise.
+func zipDockerProxy(tempDir, hostname string) error {
+	url := dockerProxyURL
+	if url == "" {
+		port := config.DefaultProcessExpVarPort
+		if config.Datadog.IsSet("process_config.expvar_port") {
+			port = config.Datadog.GetInt("process_config.expvar_port")
+		}
+		url = fmt.Sprintf("http://127.0.0.1:%d/debug/dockerproxy", port)
+	}
+
+	client := http.Client{Timeout: 4 * time.Second}
+	resp, err := client.Get(url)
+	if isDialError(err) {
+		return nil
+	}
+	var state []byte
+	if err != nil {
+		state = []byte(fmt.Sprintf("Error retrieving docker-proxy filter state: %v", err))
+	} else {
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			return nil
+		}
+		if state, err = readDockerProxyState(resp, url); err != nil {
+			state = []byte(err.Error())
+		}
+	}
+
+	f := filepath.Join(tempDir, hostname, dockerProxyFilename)
+	err = ensureParentDirsExist(f)
+	if err != nil {
+		return err
+	}
+
+	w, err := newRedactingWriter(f, os.ModePerm, true)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	_, err = w.Write(state)
+	return err
+}
+
+// readDockerProxyState returns the indented state of the docker-proxy filter served in the given response
+func readDockerProxyState(resp *http.Response, url string) ([]byte, error) {
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading docker-proxy filter state: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Got response %s from %s:\n%s", resp.Status, url, string(body))
+	}
+	var state bytes.Buffer
+	if err := json.Indent(&state, body, "", "  "); err != nil {
+		return nil, fmt.Errorf("Error decoding docker-proxy filter state: %v", err)
+	}
+	return state.Bytes(), nil
+}
+
+// isDialError returns true if the given error of an HTTP request is a failure to connect, e.g. because nothing
+// listens on the requested port
+func isDialError(err error) bool {
+	if urlErr, ok := err.(*neturl.Error); ok {
+		err = urlErr.Err
+	}
+	opErr, ok := err.(*net.OpError)
+	return ok && opErr.Op == "dial"
+}
@@ -11,6 +11,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
@@ -246,3 +247,56 @@ func TestCleanDirectoryName(t *testing.T) {
 	assert.Len(t, cleanedHostname, directoryNameMaxSize)
 	assert.True(t, !directoryNameFilter.MatchString(cleanedHostname))
 }
+
+func TestZipDockerProxy(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/debug/dockerproxy":
+		case "/failing":
+			http.Error(w, "filter unavailable", http.StatusInternalServerError)
+			return
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{"status":{"enabled":true,"proxies":1},"proxies":[{"PID":1201}],"decisions":[],"recent_errors":[]}`))
+	}))
+	defer ts.Close()
+	defer func() { dockerProxyURL = "" }()
+
+	dir, err := ioutil.TempDir("", "TestZipDockerProxy")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	dockerProxyURL = ts.URL + "/debug/dockerproxy"
+	assert.NoError(t, zipDockerProxy(dir, "test"))
+	content, err := ioutil.ReadFile(filepath.Join(dir, "test", dockerProxyFilename))
+	assert.NoError(t, err)
+	assert.Contains(t, string(content), `"proxies": [`)
+	assert.Contains(t, string(content), `"PID": 1201`)
+
+	// nothing is written while the connections check isn't running
+	assert.NoError(t, os.RemoveAll(filepath.Join(dir, "test")))
+	dockerProxyURL = ts.URL + "/not/running"
+	assert.NoError(t, zipDockerProxy(dir, "test"))
+	_, err = os.Stat(filepath.Join(dir, "test", dockerProxyFilename))
+	assert.True(t, os.IsNotExist(err))
+
+	// the errors met retrieving the state are written in its place
+	dockerProxyURL = ts.URL + "/failing"
+	assert.NoError(t, zipDockerProxy(dir, "test"))
+	content, err = ioutil.ReadFile(filepath.Join(dir, "test", dockerProxyFilename))
+	assert.NoError(t, err)
+	assert.Contains(t, string(content), "500 Internal Server Error")
+	assert.Contains(t, string(content), "filter unavailable")
+
+	// nothing is written either while the process-agent isn't listening
+	assert.NoError(t, os.RemoveAll(filepath.Join(dir, "test")))
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	dockerProxyURL = "http://" + listener.Addr().String() + "/debug/dockerproxy"
+	listener.Close()
+	assert.NoError(t, zipDockerProxy(dir, "test"))
+	_, err = os.Stat(filepath.Join(dir, "test", dockerProxyFilename))
+	assert.True(t, os.IsNotExist(err))
+}
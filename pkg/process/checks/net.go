@@ -4,12 +4,17 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 
 	model "github.com/DataDog/agent-payload/process"
 	"github.com/DataDog/datadog-agent/pkg/ebpf"
 	"github.com/DataDog/datadog-agent/pkg/process/config"
+	"github.com/DataDog/datadog-agent/pkg/process/dockerproxy"
 	"github.com/DataDog/datadog-agent/pkg/process/net"
+	procutil "github.com/DataDog/datadog-agent/pkg/process/util"
 	"github.com/DataDog/datadog-agent/pkg/util"
 	"github.com/DataDog/datadog-agent/pkg/util/log"
 )
@@ -26,6 +31,72 @@ var (
 type ConnectionsCheck struct {
 	tracerClientID string
 	networkID      string
+	proxyFilter    *dockerproxy.Filter
+	// proxySource lists the processes the docker-proxy instances are detected from, it is the source of proxyFilter
+	proxySource dockerproxy.ProcessSource
+	// proxyRefreshInterval is the minimum interval between two listings of the processes of proxySource
+	proxyRefreshInterval time.Duration
+
+	// proxyStatusMux guards the filter for the status as well as the state of the latest run below
+	proxyStatusMux sync.RWMutex
+	// proxyFilterErr is the error listing the processes of proxySource on the latest run, if any
+	proxyFilterErr error
+	// proxyRefreshTime is when the proxies were last refreshed, and proxyRefreshDuration how long it took
+	// to list the processes and refresh the proxies
+	proxyRefreshTime     time.Time
+	proxyRefreshDuration time.Duration
+}
+
+// maxStatusProxies is the number of proxies listed by ProxyFilterStatus
+const maxStatusProxies = 10
+
+// proxyDecisionLogSize is the number of connections matched against a docker-proxy kept for the flares
+const proxyDecisionLogSize = 200
+
+// podmanRecognizer recognizes the rootlessport proxies on the hosts running Podman, it is only replaced by tests
+var podmanRecognizer = dockerproxy.PodmanRecognizer
+
+// proxyFilterModes are the modes of the docker-proxy filter, as configured
+var proxyFilterModes = map[string]dockerproxy.Mode{
+	"drop":      dockerproxy.DropMode,
+	"translate": dockerproxy.TranslateMode,
+	"mark":      dockerproxy.MarkMode,
+	"merge":     dockerproxy.MergeMode,
+}
+
+// ProxyFilterStatus is the state of the docker-proxy filter of the connections check, as reported by the status
+type ProxyFilterStatus struct {
+	Enabled bool `json:"enabled"`
+	// Error is the error listing the processes on the latest run, if any
+	Error   string `json:"error,omitempty"`
+	Proxies int    `json:"proxies"`
+	// Targets lists the first maxStatusProxies proxies by PID, TruncatedTargets being the number of the other ones
+	Targets          []ProxyFilterTarget `json:"targets"`
+	TruncatedTargets int                 `json:"truncated_targets"`
+	// LastRefresh is empty until the proxies are refreshed by a check run
+	LastRefresh         string               `json:"last_refresh"`
+	LastRefreshDuration time.Duration        `json:"last_refresh_duration"`
+	LastRun             dockerproxy.RunStats `json:"last_run"`
+	// Stats are the counters since the filter was created, e.g. the proxies whose IP is still undiscovered
+	Stats dockerproxy.Stats `json:"stats"`
+}
+
+// ProxyFilterTarget is a proxy tracked by the docker-proxy filter, as reported by the status
+type ProxyFilterTarget struct {
+	PID    int32  `json:"pid"`
+	Target string `json:"target"`
+	// ProxyIP is empty until discovered
+	ProxyIP string `json:"proxy_ip"`
+}
+
+// ProxyFilterFlare is the state of the docker-proxy filter shipped in the flares, to debug mis-filtered connections
+type ProxyFilterFlare struct {
+	Status ProxyFilterStatus `json:"status"`
+	// Proxies is the whole table of the proxies tracked
+	Proxies []dockerproxy.ProxyInfo `json:"proxies"`
+	// Decisions are the latest connections matched against a proxy, the oldest first
+	Decisions    []dockerproxy.Decision    `json:"decisions"`
+	RecentErrors []dockerproxy.RecentError `json:"recent_errors"`
 }
 
 // Init initializes a ConnectionsCheck instance.
@@ -43,6 +114,8 @@ func (c *ConnectionsCheck) Init(cfg *config.AgentConfig, _ *model.SystemInfo) {
 	}
 	c.networkID = networkID
 
+	c.initProxyFilter(cfg.DockerProxyFilter, dockerproxy.SystemProcessSource)
+
 	// Run the check one time on init to register the client on the system probe
 	_, _ = c.Run(cfg, 0)
 }
@@ -73,6 +146,8 @@ func (c *ConnectionsCheck) Run(cfg *config.AgentConfig, groupID int32) ([]model.
 		return nil, err
 	}
 
+	c.filterProxyConnections(conns)
+
 	log.Debugf("collected connections in %s", time.Since(start))
 	return batchConnections(cfg, groupID, c.enrichConnections(conns.Conns), conns.Dns, c.networkID), nil
 }
@@ -89,6 +164,152 @@ func (c *ConnectionsCheck) getConnections() (*model.Connections, error) {
 	return tu.GetConnections(c.tracerClientID)
 }
 
+// initProxyFilter creates the filter of the docker-proxy connections as configured, the proxies being detected
+// from the processes listed by the given source. No filter is created if it is disabled, the processes not being
+// listed at all.
+func (c *ConnectionsCheck) initProxyFilter(cfg config.DockerProxyFilterConfig, source dockerproxy.ProcessSource) {
+	if !cfg.Enabled {
+		log.Info("docker-proxy filter disabled, docker-proxy connections will be reported twice")
+		return
+	}
+
+	// the addresses of the host are read from its procfs, as the agent may run in its own network namespace
+	opts := []dockerproxy.Option{
+		dockerproxy.WithHostIPsFunc(dockerproxy.ProcHostIPs(procutil.GetProcRoot())),
+		dockerproxy.WithDecisionLog(proxyDecisionLogSize),
+	}
+	// the processes are only scanned for rootlessport on Podman hosts
+	if root := filepath.Dir(procutil.GetProcRoot()); dockerproxy.DetectPodman(root) {
+		log.Infof("podman detected under %s, filtering the rootlessport connections", root)
+		opts = append(opts, dockerproxy.WithRecognizers(podmanRecognizer))
+	}
+	if mode, ok := proxyFilterModes[cfg.Mode]; ok {
+		opts = append(opts, dockerproxy.WithMode(mode))
+	} else if cfg.Mode != "" {
+		log.Warnf("unknown docker-proxy filter mode %q, dropping the docker-proxy connections", cfg.Mode)
+	}
+	if len(cfg.BinaryNames) > 0 {
+		opts = append(opts, dockerproxy.WithBinaryNames(append(dockerproxy.RecognizedBinaryNames(), cfg.BinaryNames...)...))
+	}
+
+	filter, err := dockerproxy.NewFilterWithError(source, opts...)
+	if err != nil {
+		log.Warnf("could not initialize docker-proxy filter, docker-proxy connections will be reported twice: %s", err)
+	}
+
+	c.proxyStatusMux.Lock()
+	c.proxyFilter = filter
+	c.proxyStatusMux.Unlock()
+	// the filter narrows the processes listed down to the binaries it recognizes, see dockerproxy.BinariesProcessSource
+	c.proxySource = filter.Source()
+	c.proxyRefreshInterval = cfg.RefreshInterval
+	c.setProxyFilterError(err)
+}
+
+// ProxyFilterError returns the error listing the processes the docker-proxy instances are detected from on the
+// latest run, or nil if they were listed. The connections going through the proxies that couldn't be detected
+// are reported twice.
+func (c *ConnectionsCheck) ProxyFilterError() error {
+	c.proxyStatusMux.RLock()
+	defer c.proxyStatusMux.RUnlock()
+	return c.proxyFilterErr
+}
+
+func (c *ConnectionsCheck) setProxyFilterError(err error) {
+	c.proxyStatusMux.Lock()
+	defer c.proxyStatusMux.Unlock()
+	c.proxyFilterErr = err
+}
+
+// ProxyFilterStatus returns the state of the docker-proxy filter. The filter isn't enabled until the check is
+// initialized, or if it couldn't be.
+func (c *ConnectionsCheck) ProxyFilterStatus() ProxyFilterStatus {
+	c.proxyStatusMux.RLock()
+	defer c.proxyStatusMux.RUnlock()
+
+	status := ProxyFilterStatus{Enabled: c.proxyFilter != nil}
+	if c.proxyFilterErr != nil {
+		status.Error = c.proxyFilterErr.Error()
+	}
+	if !status.Enabled {
+		return status
+	}
+
+	proxies := c.proxyFilter.Proxies()
+	status.Proxies = len(proxies)
+	if len(proxies) > maxStatusProxies {
+		status.TruncatedTargets = len(proxies) - maxStatusProxies
+		proxies = proxies[:maxStatusProxies]
+	}
+	status.Targets = make([]ProxyFilterTarget, 0, len(proxies))
+	for _, p := range proxies {
+		status.Targets = append(status.Targets, ProxyFilterTarget{PID: p.PID, Target: formatProxyAddr(p.Target), ProxyIP: p.IP})
+	}
+
+	if !c.proxyRefreshTime.IsZero() {
+		status.LastRefresh = c.proxyRefreshTime.Format("2006-01-02 15:04:05")
+	}
+	status.LastRefreshDuration = c.proxyRefreshDuration
+	status.LastRun = c.proxyFilter.LastRunStats()
+	status.Stats = c.proxyFilter.Stats()
+	return status
+}
+
+// ProxyFilterFlare returns the state of the docker-proxy filter to ship in the flares, see ProxyFilterStatus
+func (c *ConnectionsCheck) ProxyFilterFlare() ProxyFilterFlare {
+	flare := ProxyFilterFlare{Status: c.ProxyFilterStatus()}
+
+	c.proxyStatusMux.RLock()
+	filter := c.proxyFilter
+	c.proxyStatusMux.RUnlock()
+	if filter == nil {
+		return flare
+	}
+
+	flare.Proxies = filter.Proxies()
+	flare.Decisions = filter.Decisions()
+	flare.RecentErrors = filter.RecentErrors()
+	return flare
+}
+
+// formatProxyAddr formats the given address as ip:port, the IPv6 ones being bracketed
+func formatProxyAddr(addr model.Addr) string {
+	if strings.Contains(addr.Ip, ":") {
+		return fmt.Sprintf("[%s]:%d", addr.Ip, addr.Port)
+	}
+	return fmt.Sprintf("%s:%d", addr.Ip, addr.Port)
+}
+
+// filterProxyConnections removes the connections going through docker-proxy, as they duplicate
+// the connections between the clients and the containers
+func (c *ConnectionsCheck) filterProxyConnections(conns *model.Connections) {
+	if c.proxyFilter == nil {
+		return
+	}
+
+	// the refresh time is only written here, so it can be read without the lock
+	if start := time.Now(); c.proxyRefreshInterval == 0 || start.Sub(c.proxyRefreshTime) >= c.proxyRefreshInterval {
+		procs, err := c.proxySource.AllProcesses()
+		if err != nil {
+			log.Warnf("could not refresh docker-proxy filter: %s", err)
+		} else {
+			c.proxyFilter.Refresh(procs)
+		}
+
+		c.proxyStatusMux.Lock()
+		c.proxyFilterErr = err
+		if err == nil {
+			c.proxyRefreshTime, c.proxyRefreshDuration = start, time.Since(start)
+		}
+		c.proxyStatusMux.Unlock()
+	}
+
+	c.proxyFilter.FilterInPlace(conns)
+	run := c.proxyFilter.LastRunStats()
+	log.Debugf("docker-proxy filter dropped %d out of %d connections, %d proxies tracked, %d proxy IPs discovered, %d proxy IP mismatches",
+		run.Dropped, run.Examined, run.Proxies, run.ProxyIPDiscoveries, run.ProxyIPMismatches)
+}
+
 func (c *ConnectionsCheck) enrichConnections(conns []*model.Connection) []*model.Connection {
 	// Process create-times required to construct unique process hash keys on the backend
 	createTimeForPID := Process.createTimesforPIDs(connectionPIDs(conns))
@@ -121,6 +342,9 @@ func batchConnections(
 
 		batchDNS := make(map[string]*model.DNSEntry)
 		for _, c := range batchConns { // We only want to include DNS entries relevant to this batch of connections
+			if c.Raddr == nil {
+				continue
+			}
 			if entries, ok := dns[c.Raddr.Ip]; ok {
 				batchDNS[c.Raddr.Ip] = entries
 			}
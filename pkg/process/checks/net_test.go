@@ -1,13 +1,20 @@
 package checks
 
 import (
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
 	model "github.com/DataDog/agent-payload/process"
 	"github.com/DataDog/datadog-agent/pkg/process/config"
+	"github.com/DataDog/datadog-agent/pkg/process/dockerproxy"
+	"github.com/DataDog/gopsutil/process"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func makeConnection(pid int32) *model.Connection {
@@ -143,3 +150,308 @@ func TestNetworkConnectionBatchingWithDNS(t *testing.T) {
 	}
 	assert.Equal(t, 4, total)
 }
+
+// fakeProcessSource lists the given processes, or fails with the given error, counting the listings
+type fakeProcessSource struct {
+	procs    map[int32]*process.FilledProcess
+	err      error
+	listings int
+}
+
+func (s *fakeProcessSource) AllProcesses() (map[int32]*process.FilledProcess, error) {
+	s.listings++
+	return s.procs, s.err
+}
+
+// fakeBinariesProcessSource is a dockerproxy.BinariesProcessSource only listing the processes running the binaries
+// it is asked for, the recognized ones when listing all of them
+type fakeBinariesProcessSource struct {
+	procs map[int32]*process.FilledProcess
+}
+
+func (s *fakeBinariesProcessSource) AllProcesses() (map[int32]*process.FilledProcess, error) {
+	return s.ProcessesOf(dockerproxy.RecognizedBinaryNames())
+}
+
+func (s *fakeBinariesProcessSource) ProcessesOf(binaryNames []string) (map[int32]*process.FilledProcess, error) {
+	procs := make(map[int32]*process.FilledProcess)
+	for pid, p := range s.procs {
+		for _, name := range binaryNames {
+			if filepath.Base(p.Cmdline[0]) == name {
+				procs[pid] = p
+			}
+		}
+	}
+	return procs, nil
+}
+
+func defaultProxyFilterConfig() config.DockerProxyFilterConfig {
+	return config.NewDefaultAgentConfig(false).DockerProxyFilter
+}
+
+func TestConnectionsProxyFilterConfig(t *testing.T) {
+	newSource := func() *fakeProcessSource {
+		return &fakeProcessSource{procs: map[int32]*process.FilledProcess{
+			1: {Pid: 1, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-ip", "10.0.0.5", "-host-port", "8080", "-container-ip", "172.17.0.2", "-container-port", "80"}},
+			2: {Pid: 2, Cmdline: []string{"/opt/bin/my-proxy-shim", "-proto", "tcp", "-host-port", "8081", "-container-ip", "172.17.0.3", "-container-port", "80"}},
+		}}
+	}
+	newConns := func() *model.Connections {
+		return &model.Connections{Conns: []*model.Connection{
+			{Pid: 1, Laddr: &model.Addr{Ip: "10.0.0.5", Port: 8080}, Raddr: &model.Addr{Ip: "10.0.0.9", Port: 50000}, Direction: model.ConnectionDirection_incoming},
+			{Pid: 1, Laddr: &model.Addr{Ip: "172.17.0.1", Port: 34567}, Raddr: &model.Addr{Ip: "172.17.0.2", Port: 80}, Direction: model.ConnectionDirection_outgoing},
+		}}
+	}
+
+	// disabled: the processes aren't even listed
+	cfg := defaultProxyFilterConfig()
+	cfg.Enabled = false
+	source := newSource()
+	c := &ConnectionsCheck{}
+	c.initProxyFilter(cfg, source)
+	assert.Nil(t, c.proxyFilter)
+	assert.Equal(t, 0, source.listings)
+	conns := newConns()
+	c.filterProxyConnections(conns)
+	assert.Len(t, conns.Conns, 2)
+	assert.False(t, c.ProxyFilterStatus().Enabled)
+
+	// dropped by default
+	c = &ConnectionsCheck{}
+	c.initProxyFilter(defaultProxyFilterConfig(), newSource())
+	conns = newConns()
+	c.filterProxyConnections(conns)
+	assert.Empty(t, conns.Conns)
+	assert.Equal(t, 1, c.proxyFilter.ProxyCount())
+
+	// the client leg is rewritten to the container in translate mode
+	cfg = defaultProxyFilterConfig()
+	cfg.Mode = "translate"
+	c = &ConnectionsCheck{}
+	c.initProxyFilter(cfg, newSource())
+	conns = newConns()
+	c.filterProxyConnections(conns)
+	if assert.Len(t, conns.Conns, 1) {
+		assert.Equal(t, "172.17.0.2", conns.Conns[0].Laddr.Ip)
+	}
+
+	// kept in mark mode
+	cfg.Mode = "mark"
+	c = &ConnectionsCheck{}
+	c.initProxyFilter(cfg, newSource())
+	conns = newConns()
+	c.filterProxyConnections(conns)
+	assert.Len(t, conns.Conns, 2)
+	assert.Equal(t, uint64(2), c.proxyFilter.Stats().Marked)
+
+	// dropped if the mode is unknown
+	cfg.Mode = "bogus"
+	c = &ConnectionsCheck{}
+	c.initProxyFilter(cfg, newSource())
+	conns = newConns()
+	c.filterProxyConnections(conns)
+	assert.Empty(t, conns.Conns)
+
+	// the extra binaries are recognized along with docker-proxy
+	cfg = defaultProxyFilterConfig()
+	cfg.BinaryNames = []string{"my-proxy-shim"}
+	c = &ConnectionsCheck{}
+	c.initProxyFilter(cfg, newSource())
+	assert.Equal(t, 2, c.proxyFilter.ProxyCount())
+
+	// the processes are listed on every run by default, at most once per refresh interval otherwise
+	source = newSource()
+	c = &ConnectionsCheck{}
+	c.initProxyFilter(defaultProxyFilterConfig(), source)
+	c.filterProxyConnections(newConns())
+	c.filterProxyConnections(newConns())
+	assert.Equal(t, 3, source.listings)
+
+	cfg = defaultProxyFilterConfig()
+	cfg.RefreshInterval = time.Hour
+	source = newSource()
+	c = &ConnectionsCheck{}
+	c.initProxyFilter(cfg, source)
+	c.filterProxyConnections(newConns())
+	c.filterProxyConnections(newConns())
+	assert.Equal(t, 2, source.listings)
+}
+
+func TestConnectionsProxyFilterBinaryNames(t *testing.T) {
+	cfg := defaultProxyFilterConfig()
+	cfg.BinaryNames = []string{"my-proxy-shim"}
+	c := &ConnectionsCheck{}
+	c.initProxyFilter(cfg, &fakeBinariesProcessSource{procs: map[int32]*process.FilledProcess{
+		1: {Pid: 1, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-port", "8080", "-container-ip", "172.17.0.2", "-container-port", "80"}},
+		2: {Pid: 2, Cmdline: []string{"/opt/bin/my-proxy-shim", "-proto", "tcp", "-host-port", "8081", "-container-ip", "172.17.0.3", "-container-port", "80"}},
+	}})
+
+	// the custom proxies are still tracked once refreshed by the check runs
+	for run := 0; run < 2; run++ {
+		conns := &model.Connections{Conns: []*model.Connection{
+			{Pid: 2, Laddr: &model.Addr{Ip: "172.17.0.1", Port: 34567}, Raddr: &model.Addr{Ip: "172.17.0.3", Port: 80}, Direction: model.ConnectionDirection_outgoing},
+		}}
+		c.filterProxyConnections(conns)
+		assert.Empty(t, conns.Conns, "run %d", run)
+		assert.Equal(t, 2, c.proxyFilter.ProxyCount(), "run %d", run)
+	}
+}
+
+func TestConnectionsProxyFilterPodman(t *testing.T) {
+	root, err := ioutil.TempDir("", "podman-host")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "run", "podman"), 0755))
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "proc"), 0755))
+	os.Setenv("HOST_PROC", filepath.Join(root, "proc"))
+	defer os.Unsetenv("HOST_PROC")
+
+	// rootlessport forwards 0.0.0.0:8080 to a container
+	defer func(recognizer dockerproxy.Recognizer) { podmanRecognizer = recognizer }(podmanRecognizer)
+	podmanRecognizer.List = func(_ int32, _ []string) ([]dockerproxy.Forwarding, error) {
+		return []dockerproxy.Forwarding{
+			{Proto: "tcp", Host: model.Addr{Ip: "0.0.0.0", Port: 8080}, Targets: []model.Addr{{Ip: "10.88.0.5", Port: 80}}},
+		}, nil
+	}
+
+	c := &ConnectionsCheck{}
+	c.initProxyFilter(defaultProxyFilterConfig(), &fakeBinariesProcessSource{procs: map[int32]*process.FilledProcess{
+		1: {Pid: 1, Cmdline: []string{"rootlessport"}},
+	}})
+
+	// the rootlessport proxies are still tracked once refreshed by the check runs
+	for run := 0; run < 2; run++ {
+		conns := &model.Connections{Conns: []*model.Connection{
+			{Pid: 1, Laddr: &model.Addr{Ip: "127.0.0.1", Port: 8080}, Raddr: &model.Addr{Ip: "127.0.0.1", Port: 50000}, Direction: model.ConnectionDirection_incoming},
+		}}
+		c.filterProxyConnections(conns)
+		assert.Empty(t, conns.Conns, "run %d", run)
+		assert.Equal(t, 1, c.proxyFilter.ProxyCount(), "run %d", run)
+	}
+}
+
+func TestConnectionsProxyFilterMarkMode(t *testing.T) {
+	cfg := defaultProxyFilterConfig()
+	cfg.Mode = "mark"
+	c := &ConnectionsCheck{}
+	c.initProxyFilter(cfg, &fakeProcessSource{procs: map[int32]*process.FilledProcess{
+		1: {Pid: 1, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-port", "8080", "-container-ip", "172.17.0.2", "-container-port", "80"}},
+	}})
+
+	// the proxied connection, then an unrelated one
+	newConns := func() []*model.Connection {
+		return []*model.Connection{
+			{Pid: 1, Laddr: &model.Addr{Ip: "172.17.0.1", Port: 34567}, Raddr: &model.Addr{Ip: "172.17.0.2", Port: 80}, Direction: model.ConnectionDirection_outgoing},
+			{Pid: 2, Laddr: &model.Addr{Ip: "10.0.0.5", Port: 40000}, Raddr: &model.Addr{Ip: "10.0.0.42", Port: 443}, Direction: model.ConnectionDirection_outgoing},
+		}
+	}
+
+	Process.lastCtrIDForPID = map[int32]string{1: "1", 2: "2"}
+	Process.lastRun = time.Now()
+	agentCfg := config.NewDefaultAgentConfig(false)
+
+	// the intake receives the proxied connections unchanged, the payload model having no field to flag them
+	conns := &model.Connections{Conns: newConns()}
+	c.filterProxyConnections(conns)
+	chunks := batchConnections(agentCfg, 0, conns.Conns, conns.Dns, "nid")
+	if assert.Len(t, chunks, 1) {
+		assert.Equal(t, newConns(), chunks[0].(*model.CollectorConnections).Connections)
+	}
+
+	// they are only annotated in the state of the filter, for the status and the flares
+	flare := c.ProxyFilterFlare()
+	assert.Equal(t, uint64(1), flare.Status.Stats.Marked)
+	if assert.Len(t, flare.Decisions, 1) {
+		assert.Equal(t, "marked", flare.Decisions[0].Action)
+		assert.Equal(t, int32(1), flare.Decisions[0].PID)
+	}
+}
+
+func TestConnectionsProxyFilterError(t *testing.T) {
+	source := &fakeProcessSource{err: errors.New("permission denied")}
+
+	c := &ConnectionsCheck{}
+	c.initProxyFilter(defaultProxyFilterConfig(), source)
+	assert.EqualError(t, c.ProxyFilterError(), "permission denied")
+
+	// the error is cleared once the processes are listed
+	source.procs, source.err = map[int32]*process.FilledProcess{
+		1: {Pid: 1, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-port", "8080", "-container-ip", "172.17.0.2", "-container-port", "80"}},
+	}, nil
+	conns := &model.Connections{Conns: []*model.Connection{
+		{Pid: 2, Laddr: &model.Addr{Ip: "172.17.0.2", Port: 80}, Raddr: &model.Addr{Ip: "172.17.0.1", Port: 34567}},
+		{Pid: 1, Laddr: &model.Addr{Ip: "172.17.0.1", Port: 34567}, Raddr: &model.Addr{Ip: "172.17.0.2", Port: 80}},
+	}}
+	c.filterProxyConnections(conns)
+	assert.NoError(t, c.ProxyFilterError())
+	assert.Empty(t, conns.Conns)
+
+	// and reported again if the processes can't be listed anymore, the proxies already detected being kept
+	source.err = errors.New("permission denied")
+	c.filterProxyConnections(&model.Connections{})
+	assert.EqualError(t, c.ProxyFilterError(), "permission denied")
+	assert.Equal(t, 1, c.proxyFilter.ProxyCount())
+}
+
+func TestConnectionsProxyFilterStatus(t *testing.T) {
+	c := &ConnectionsCheck{}
+	assert.Equal(t, ProxyFilterStatus{}, c.ProxyFilterStatus())
+
+	procs := make(map[int32]*process.FilledProcess)
+	for pid := int32(1); pid <= 12; pid++ {
+		procs[pid] = &process.FilledProcess{Pid: pid, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-port", fmt.Sprint(8080 + pid),
+			"-container-ip", fmt.Sprintf("172.17.0.%d", pid+1), "-container-port", "80"}}
+	}
+	procs[2].Cmdline[6] = "fd00::3"
+	c.initProxyFilter(defaultProxyFilterConfig(), &fakeProcessSource{procs: procs})
+	status := c.ProxyFilterStatus()
+	assert.True(t, status.Enabled)
+	assert.Equal(t, "", status.LastRefresh)
+
+	c.filterProxyConnections(&model.Connections{Conns: []*model.Connection{
+		{Pid: 1, Laddr: &model.Addr{Ip: "172.17.0.1", Port: 34567}, Raddr: &model.Addr{Ip: "172.17.0.2", Port: 80}},
+		{Pid: 20, Laddr: &model.Addr{Ip: "10.0.0.1", Port: 6379}, Raddr: &model.Addr{Ip: "10.0.0.2", Port: 50000}},
+	}})
+	status = c.ProxyFilterStatus()
+	assert.True(t, status.Enabled)
+	assert.Equal(t, "", status.Error)
+	assert.Equal(t, 12, status.Proxies)
+	assert.Len(t, status.Targets, maxStatusProxies)
+	assert.Equal(t, 2, status.TruncatedTargets)
+	assert.Equal(t, ProxyFilterTarget{PID: 1, Target: "172.17.0.2:80", ProxyIP: "172.17.0.1"}, status.Targets[0])
+	assert.Equal(t, ProxyFilterTarget{PID: 2, Target: "[fd00::3]:80"}, status.Targets[1])
+	assert.NotEqual(t, "", status.LastRefresh)
+	assert.Equal(t, uint64(2), status.LastRun.Examined)
+	assert.Equal(t, uint64(1), status.LastRun.Dropped)
+	assert.Equal(t, uint64(12), status.LastRun.Proxies)
+	assert.Equal(t, uint64(1), status.Stats.Dropped)
+	assert.Equal(t, uint64(1), status.Stats.Discovered)
+	assert.Equal(t, uint64(11), status.Stats.Undiscovered)
+}
+
+func TestConnectionsProxyFilterFlare(t *testing.T) {
+	c := &ConnectionsCheck{}
+	assert.Equal(t, ProxyFilterFlare{}, c.ProxyFilterFlare())
+
+	c.initProxyFilter(defaultProxyFilterConfig(), &fakeProcessSource{procs: map[int32]*process.FilledProcess{
+		1: {Pid: 1, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-port", "8080", "-container-ip", "172.17.0.2", "-container-port", "80"}},
+		2: {Pid: 2, Cmdline: []string{"docker-proxy", "-container-ip", "172.17.0.3", "-container-port", "abc"}},
+	}})
+	c.filterProxyConnections(&model.Connections{Conns: []*model.Connection{
+		{Pid: 1, Laddr: &model.Addr{Ip: "172.17.0.1", Port: 34567}, Raddr: &model.Addr{Ip: "172.17.0.2", Port: 80}},
+	}})
+
+	flare := c.ProxyFilterFlare()
+	assert.True(t, flare.Status.Enabled)
+	if assert.Len(t, flare.Proxies, 1) {
+		assert.Equal(t, int32(1), flare.Proxies[0].PID)
+		assert.Equal(t, uint64(1), flare.Proxies[0].Matched)
+	}
+	if assert.Len(t, flare.Decisions, 1) {
+		assert.Equal(t, "dropped", flare.Decisions[0].Action)
+		assert.Equal(t, "172.17.0.1", flare.Decisions[0].ProxyIP)
+	}
+	if assert.Len(t, flare.RecentErrors, 1) {
+		assert.Contains(t, flare.RecentErrors[0].Message, "pid=2")
+	}
+}
@@ -45,6 +45,20 @@ type WindowsConfig struct {
 	AddNewArgs bool
 }
 
+// DockerProxyFilterConfig stores the configuration of the filter removing the connections going through
+// docker-proxy from the connections check.
+type DockerProxyFilterConfig struct {
+	// Controls whether the docker-proxy connections are filtered, if not they are reported along with the
+	// connections they forward
+	Enabled bool
+	// What the filter does with the docker-proxy connections: drop, translate, mark or merge
+	Mode string
+	// Minimum interval between two scans of the processes for docker-proxy instances, 0 to scan on every check run
+	RefreshInterval time.Duration
+	// Basenames of binaries recognized as docker-proxy along with the default ones, e.g. custom proxy shims
+	BinaryNames []string
+}
+
 // APIEndpoint is a single endpoint where process data will be submitted.
 type APIEndpoint struct {
 	APIKey   string
@@ -94,6 +108,7 @@ type AgentConfig struct {
 	ClosedChannelSize              int
 	MaxClosedConnectionsBuffered   int
 	MaxConnectionsStateBuffered    int
+	DockerProxyFilter              DockerProxyFilterConfig
 
 	// Orchestrator collection configuration
 	OrchestrationCollectionEnabled bool
@@ -179,7 +194,7 @@ func NewDefaultAgentConfig(canAccessContainers bool) *AgentConfig {
 		AllowRealTime:         true,
 		HostName:              "",
 		Transport:             NewDefaultTransport(),
-		ProcessExpVarPort:     6062,
+		ProcessExpVarPort:     config.DefaultProcessExpVarPort,
 
 		// Statsd for internal instrumentation
 		StatsdHost: "127.0.0.1",
@@ -198,6 +213,10 @@ func NewDefaultAgentConfig(canAccessContainers bool) *AgentConfig {
 		ClosedChannelSize:            500,
 		ConntrackShortTermBufferSize: defaultConntrackShortTermBufferSize,
 		ConntrackMaxStateSize:        defaultMaxTrackedConnections,
+		DockerProxyFilter: DockerProxyFilterConfig{
+			Enabled: true,
+			Mode:    "drop",
+		},
 
 		// Check config
 		EnabledChecks: enabledChecks,
@@ -162,6 +162,7 @@ func TestDefaultConfig(t *testing.T) {
 	assert.Equal("info", agentConfig.LogLevel)
 	assert.Equal(true, agentConfig.AllowRealTime)
 	assert.Equal(true, agentConfig.Scrubber.Enabled)
+	assert.Equal(DockerProxyFilterConfig{Enabled: true, Mode: "drop"}, agentConfig.DockerProxyFilter)
 
 	os.Setenv("DOCKER_DD_AGENT", "yes")
 	agentConfig = NewDefaultAgentConfig(false)
@@ -200,6 +201,12 @@ func TestAgentConfigYamlAndSystemProbeConfig(t *testing.T) {
 	assert.Equal(false, agentConfig.Scrubber.Enabled)
 	assert.Equal(5065, agentConfig.ProcessExpVarPort)
 	assert.True(agentConfig.DisableDNSInspection)
+	assert.Equal(DockerProxyFilterConfig{
+		Enabled:         false,
+		Mode:            "translate",
+		RefreshInterval: time.Minute,
+		BinaryNames:     []string{"my-proxy-shim"},
+	}, agentConfig.DockerProxyFilter)
 
 	agentConfig, err = NewAgentConfig(
 		"test",
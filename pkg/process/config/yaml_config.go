@@ -309,6 +309,25 @@ func (a *AgentConfig) loadProcessYamlConfig(path string) error {
 		}
 	}
 
+	// Filter of the connections going through docker-proxy, which duplicate the ones between the clients and
+	// the containers
+	if k := key(ns, "docker_proxy_filter", "enabled"); config.Datadog.IsSet(k) {
+		a.DockerProxyFilter.Enabled = config.Datadog.GetBool(k)
+	}
+	if mode := config.Datadog.GetString(key(ns, "docker_proxy_filter", "mode")); mode != "" {
+		a.DockerProxyFilter.Mode = strings.ToLower(mode)
+	}
+	if k := key(ns, "docker_proxy_filter", "refresh_interval"); config.Datadog.IsSet(k) {
+		if interval := config.Datadog.GetInt(k); interval >= 0 {
+			a.DockerProxyFilter.RefreshInterval = time.Duration(interval) * time.Second
+		} else {
+			log.Warnf("Ignoring invalid %s: %d", k, interval)
+		}
+	}
+	if k := key(ns, "docker_proxy_filter", "binary_names"); config.Datadog.IsSet(k) {
+		a.DockerProxyFilter.BinaryNames = config.Datadog.GetStringSlice(k)
+	}
+
 	// Used to override container source auto-detection.
 	// "docker", "ecs_fargate", "kubelet", etc
 	if containerSource := config.Datadog.GetString(key(ns, "container_source")); containerSource != "" {
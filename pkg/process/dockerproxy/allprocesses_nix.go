@@ -0,0 +1,34 @@
+// +build !windows
+
+package dockerproxy
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/DataDog/gopsutil/process"
+)
+
+// allProcesses lists the processes running one of the given binaries from procfs, or every process if procfs
+// can't be scanned
+func allProcesses(binaryNames []string) (map[int32]*process.FilledProcess, error) {
+	procs, err := scanProcesses(hostProc(), binaryNames)
+	if err != nil {
+		return process.AllProcesses()
+	}
+	return procs, nil
+}
+
+// hostProc returns where the procfs of the host is mounted
+func hostProc() string {
+	if v := os.Getenv("HOST_PROC"); v != "" {
+		return v
+	}
+	return "/proc"
+}
+
+// binaryName returns the name of the binary referred to by the given path, without any `.exe` extension
+func binaryName(path string) string {
+	return filepath.Base(strings.TrimSuffix(path, ".exe"))
+}
@@ -0,0 +1,103 @@
+// +build windows
+
+package dockerproxy
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/DataDog/gopsutil/process"
+	"github.com/StackExchange/wmi"
+)
+
+type win32Process struct {
+	Name           string
+	ExecutablePath *string
+	CommandLine    *string
+	ProcessID      uint32
+	CreationDate   *time.Time
+}
+
+// wqlEscaper escapes the characters of a WQL string literal
+var wqlEscaper = strings.NewReplacer(`\`, `\\`, `'`, `\'`)
+
+// allProcesses only returns the processes running one of the given binaries, as filling every process of the host
+// through WMI is expensive. Their create time is the one of their CreationDate, so that reused PIDs are detected.
+func allProcesses(binaryNames []string) (map[int32]*process.FilledProcess, error) {
+	if len(binaryNames) == 0 {
+		return map[int32]*process.FilledProcess{}, nil
+	}
+
+	var dst []win32Process
+	q := wmi.CreateQuery(&dst, processNamesCondition(binaryNames))
+	if err := wmi.Query(q, &dst); err != nil {
+		return nil, err
+	}
+
+	procs := make(map[int32]*process.FilledProcess, len(dst))
+	for _, p := range dst {
+		fp := &process.FilledProcess{
+			Pid:  int32(p.ProcessID),
+			Name: p.Name,
+		}
+		if p.ExecutablePath != nil {
+			fp.Exe = *p.ExecutablePath
+		}
+		if p.CommandLine != nil {
+			fp.Cmdline = splitCommandLine(*p.CommandLine)
+		}
+		if p.CreationDate != nil {
+			fp.CreateTime = p.CreationDate.UnixNano() / int64(time.Millisecond)
+		}
+		procs[fp.Pid] = fp
+	}
+
+	return procs, nil
+}
+
+// processNamesCondition returns the WQL condition matching the processes running one of the given binaries, whose
+// names are escaped as they are configurable
+func processNamesCondition(binaryNames []string) string {
+	names := make([]string, 0, len(binaryNames))
+	for _, name := range binaryNames {
+		names = append(names, fmt.Sprintf("Name = '%s.exe'", wqlEscaper.Replace(name)))
+	}
+	return "WHERE " + strings.Join(names, " OR ")
+}
+
+// binaryName returns the lowercased name of the binary referred to by the given path, without any `.exe` extension,
+// as paths are case-insensitive on Windows
+func binaryName(path string) string {
+	return strings.TrimSuffix(strings.ToLower(filepath.Base(path)), ".exe")
+}
+
+// splitCommandLine splits a Windows command line into its arguments, keeping quoted arguments together
+func splitCommandLine(cmdline string) []string {
+	var (
+		args    []string
+		current strings.Builder
+		quoted  bool
+	)
+
+	for _, r := range cmdline {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case r == ' ' && !quoted:
+			if current.Len() > 0 {
+				args = append(args, current.String())
+				current.Reset()
+			}
+		default:
+			current.WriteRune(r)
+		}
+	}
+
+	if current.Len() > 0 {
+		args = append(args, current.String())
+	}
+
+	return args
+}
@@ -0,0 +1,222 @@
+package dockerproxy
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+
+	model "github.com/DataDog/agent-payload/process"
+)
+
+// maxRecentErrors is the number of errors returned by RecentErrors
+const maxRecentErrors = 20
+
+// sampleScale is the range the sampling rate of WithSampledTracing is scaled to, see decisionSampler
+const sampleScale = 1 << 32
+
+// Decision is a connection matched against a proxy by the filter, see WithDecisionLog
+type Decision struct {
+	Time time.Time
+	// Action is what the filter did with the connection: dropped, translated, marked or merged
+	Action       string
+	PID          int32
+	Proto        string
+	Laddr, Raddr model.Addr
+	ProxyPID     int32
+	// Target is the target of the proxy at the TargetSide end, or its first one
+	Target model.Addr
+	// Leg is the leg of the proxy the connection was matched as: client leg, target leg or owned connection
+	Leg string
+	// TargetSide is the end of the connection having the address of a target of the proxy, local or remote,
+	// or an empty string if neither has
+	TargetSide string
+	// ProxyIP is the IP of the proxy towards that target (or its first one) when the connection was matched,
+	// empty if it wasn't discovered yet
+	ProxyIP string
+}
+
+// RecentError is an error met by the filter while detecting the proxies, see RecentErrors
+type RecentError struct {
+	Time    time.Time
+	Message string
+}
+
+// decisionLog is a ring buffer of the latest decisions of a filter. It has its own lock so that reading it
+// never waits for the filter.
+type decisionLog struct {
+	mux       sync.Mutex
+	decisions []Decision
+	// next is the index the next decision is written at once the buffer is full
+	next int
+}
+
+func newDecisionLog(size int) *decisionLog {
+	return &decisionLog{decisions: make([]Decision, 0, size)}
+}
+
+// add appends the given decisions, only the last ones being kept if there are more than the buffer holds
+func (l *decisionLog) add(decisions []Decision) {
+	if len(decisions) == 0 {
+		return
+	}
+
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	size := cap(l.decisions)
+	if len(decisions) > size {
+		decisions = decisions[len(decisions)-size:]
+	}
+	for _, d := range decisions {
+		if len(l.decisions) < size {
+			l.decisions = append(l.decisions, d)
+			continue
+		}
+		l.decisions[l.next] = d
+		l.next = (l.next + 1) % size
+	}
+}
+
+// snapshot returns a copy of the decisions, the oldest first
+func (l *decisionLog) snapshot() []Decision {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	snapshot := make([]Decision, 0, len(l.decisions))
+	snapshot = append(snapshot, l.decisions[l.next:]...)
+	return append(snapshot, l.decisions[:l.next]...)
+}
+
+// Decisions returns the latest connections matched against a proxy, the oldest first, or nil unless the
+// filter was created with WithDecisionLog. The filter isn't blocked while they are copied.
+func (f *Filter) Decisions() []Decision {
+	if f.decisions == nil {
+		return nil
+	}
+	return f.decisions.snapshot()
+}
+
+// RecentErrors returns the latest errors met while detecting the proxies (malformed cmdlines, processes
+// that couldn't be listed by the background refresher), the oldest first
+func (f *Filter) RecentErrors() []RecentError {
+	f.errorsMux.Lock()
+	defer f.errorsMux.Unlock()
+
+	return append([]RecentError(nil), f.recentErrors...)
+}
+
+// recordError keeps the given error for RecentErrors, forgetting the oldest one once there are maxRecentErrors
+func (f *Filter) recordError(format string, params ...interface{}) {
+	f.errorsMux.Lock()
+	defer f.errorsMux.Unlock()
+
+	if len(f.recentErrors) == maxRecentErrors {
+		copy(f.recentErrors, f.recentErrors[1:])
+		f.recentErrors = f.recentErrors[:maxRecentErrors-1]
+	}
+	f.recentErrors = append(f.recentErrors, RecentError{Time: f.now(), Message: fmt.Sprintf(format, params...)})
+}
+
+// decisionSampler selects the decisions logged by the sampled tracing, see WithSampledTracing. A connection is
+// sampled from the hash of its tuple, so that the decisions about a sampled connection are logged on every run.
+type decisionSampler struct {
+	// threshold is the sampling rate scaled to sampleScale
+	threshold uint64
+	// maxPerRun is the number of decisions logged per run at most, 0 if unlimited
+	maxPerRun uint64
+}
+
+func newDecisionSampler(rate float64, maxPerRun int) *decisionSampler {
+	if rate > 1 {
+		rate = 1
+	}
+	s := &decisionSampler{threshold: uint64(rate * sampleScale)}
+	if maxPerRun > 0 {
+		s.maxPerRun = uint64(maxPerRun)
+	}
+	return s
+}
+
+// sample returns true if the decision about the given connection is to be logged, counting it in the given run
+func (s *decisionSampler) sample(c *model.Connection, run *RunStats) bool {
+	if s.maxPerRun > 0 && run.Traced >= s.maxPerRun {
+		return false
+	}
+	if connectionHash(c)%sampleScale >= s.threshold {
+		return false
+	}
+
+	run.Traced++
+	return true
+}
+
+// connectionHash returns the hash of the tuple of the given connection: its FNV-1a hash, mixed by the finalizer
+// of murmur3 as the tuples of a host mostly differ by their last bytes, which FNV-1a alone barely spreads
+func connectionHash(c *model.Connection) uint64 {
+	h := fnv.New64a()
+	var buf [16]byte
+	_, _ = io.WriteString(h, connectionProto(c))
+	_, _ = h.Write(strconv.AppendInt(buf[:0], int64(c.Pid), 10))
+	for _, addr := range []*model.Addr{c.Laddr, c.Raddr} {
+		_, _ = io.WriteString(h, addr.Ip)
+		_, _ = h.Write(strconv.AppendInt(buf[:0], int64(addr.Port), 10))
+	}
+
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// logSampled logs the given decision selected by the sampled tracing
+func (f *Filter) logSampled(d Decision) {
+	proxyIP := d.ProxyIP
+	if proxyIP == "" {
+		proxyIP = "unknown"
+	}
+
+	if d.Action == "kept" {
+		f.logger.Debugf("sampled decision: kept %s connection pid=%d %s -> %s, its %s address is target=%s of docker-proxy "+
+			"with pid=%d but its peer isn't the proxy ip=%s", d.Proto, d.PID, formatAddr(&d.Laddr), formatAddr(&d.Raddr),
+			d.TargetSide, formatAddr(&d.Target), d.ProxyPID, proxyIP)
+		return
+	}
+
+	side := "neither address"
+	if d.TargetSide != "" {
+		side = "the " + d.TargetSide + " address"
+	}
+	f.logger.Debugf("sampled decision: %s %s connection pid=%d %s -> %s, %s of docker-proxy with pid=%d target=%s "+
+		"matched by %s, proxy ip=%s", d.Action, d.Proto, d.PID, formatAddr(&d.Laddr), formatAddr(&d.Raddr),
+		d.Leg, d.ProxyPID, formatAddr(&d.Target), side, proxyIP)
+}
+
+// newDecision returns the decision about the given connection matched as the given leg of the proxy
+func newDecision(now int64, action string, c *model.Connection, p *proxy, leg leg) Decision {
+	d := Decision{
+		Time:     time.Unix(0, now),
+		Action:   action,
+		PID:      c.Pid,
+		Proto:    connectionProto(c),
+		Laddr:    *c.Laddr,
+		Raddr:    *c.Raddr,
+		ProxyPID: p.pid,
+		Target:   p.target,
+		Leg:      leg.String(),
+		ProxyIP:  p.ip,
+	}
+
+	switch laddr, raddr := canonicalAddr(c.Laddr), canonicalAddr(c.Raddr); {
+	case p.hasTarget(laddr):
+		d.TargetSide, d.Target, d.ProxyIP = "local", laddr, *p.ipFor(laddr)
+	case p.hasTarget(raddr):
+		d.TargetSide, d.Target, d.ProxyIP = "remote", raddr, *p.ipFor(raddr)
+	}
+	return d
+}
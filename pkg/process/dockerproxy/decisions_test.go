@@ -0,0 +1,213 @@
+package dockerproxy
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	model "github.com/DataDog/agent-payload/process"
+	"github.com/DataDog/gopsutil/process"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecisionLog(t *testing.T) {
+	decisions := func(pids ...int32) []Decision {
+		var decisions []Decision
+		for _, pid := range pids {
+			decisions = append(decisions, Decision{PID: pid})
+		}
+		return decisions
+	}
+
+	l := newDecisionLog(3)
+	assert.Empty(t, l.snapshot())
+
+	l.add(decisions(1, 2))
+	assert.Equal(t, decisions(1, 2), l.snapshot())
+
+	// the oldest decisions are overwritten
+	l.add(decisions(3, 4))
+	assert.Equal(t, decisions(2, 3, 4), l.snapshot())
+	l.add(decisions(5))
+	assert.Equal(t, decisions(3, 4, 5), l.snapshot())
+
+	// only the last decisions of a large batch are kept
+	l.add(decisions(6, 7, 8, 9, 10))
+	assert.Equal(t, decisions(8, 9, 10), l.snapshot())
+
+	// the snapshot is a copy
+	snapshot := l.snapshot()
+	snapshot[0].PID = 100
+	assert.Equal(t, decisions(8, 9, 10), l.snapshot())
+}
+
+func TestFilterDecisions(t *testing.T) {
+	load := func(f *Filter) {
+		f.now = func() time.Time { return time.Unix(1577836800, 0) }
+		f.LoadProxies(map[int32]*process.FilledProcess{
+			1: {Pid: 1, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-ip", "10.0.0.5", "-host-port", "8080", "-container-ip", "172.17.0.2", "-container-port", "80"}},
+		})
+	}
+	payload := func() *model.Connections {
+		return &model.Connections{Conns: []*model.Connection{
+			{Pid: 1, Laddr: &model.Addr{Ip: "172.17.0.1", Port: 34567}, Raddr: &model.Addr{Ip: "172.17.0.2", Port: 80}, Direction: model.ConnectionDirection_outgoing},
+			{Pid: 1, Laddr: &model.Addr{Ip: "10.0.0.5", Port: 8080}, Raddr: &model.Addr{Ip: "10.0.0.9", Port: 50000}, Direction: model.ConnectionDirection_incoming},
+			{Pid: 2, Laddr: &model.Addr{Ip: "10.0.0.1", Port: 6379}, Raddr: &model.Addr{Ip: "10.0.0.2", Port: 50000}},
+		}}
+	}
+
+	f := newFilter()
+	load(f)
+	f.Filter(payload())
+	assert.Nil(t, f.Decisions())
+
+	f = newFilter(WithDecisionLog(10))
+	load(f)
+	assert.Equal(t, 2, f.Filter(payload()))
+	assert.Equal(t, []Decision{
+		{Time: time.Unix(1577836800, 0), Action: "dropped", PID: 1, Proto: "tcp", Laddr: model.Addr{Ip: "172.17.0.1", Port: 34567},
+			Raddr: model.Addr{Ip: "172.17.0.2", Port: 80}, ProxyPID: 1, Target: model.Addr{Ip: "172.17.0.2", Port: 80}, Leg: "target leg",
+			TargetSide: "remote", ProxyIP: "172.17.0.1"},
+		{Time: time.Unix(1577836800, 0), Action: "dropped", PID: 1, Proto: "tcp", Laddr: model.Addr{Ip: "10.0.0.5", Port: 8080},
+			Raddr: model.Addr{Ip: "10.0.0.9", Port: 50000}, ProxyPID: 1, Target: model.Addr{Ip: "172.17.0.2", Port: 80}, Leg: "client leg",
+			ProxyIP: "172.17.0.1"},
+	}, f.Decisions())
+
+	// the rewritten connections are recorded as they were matched
+	f = newFilter(WithDecisionLog(10), WithMode(TranslateMode))
+	load(f)
+	f.Filter(payload())
+	if decisions := f.Decisions(); assert.Len(t, decisions, 2) {
+		assert.Equal(t, "translated", decisions[1].Action)
+		assert.Equal(t, model.Addr{Ip: "10.0.0.5", Port: 8080}, decisions[1].Laddr)
+	}
+	assert.Equal(t, uint64(2), f.Proxies()[0].Matched)
+}
+
+func TestDecisionsConcurrentFilter(t *testing.T) {
+	f := NewFilter(nil, WithDecisionLog(5))
+	f.LoadProxies(map[int32]*process.FilledProcess{
+		1: {Pid: 1, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-port", "8080", "-container-ip", "172.17.0.2", "-container-port", "80"}},
+	})
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			f.Filter(&model.Connections{Conns: []*model.Connection{
+				{Pid: 1, Laddr: &model.Addr{Ip: "172.17.0.1", Port: int32(30000 + i)}, Raddr: &model.Addr{Ip: "172.17.0.2", Port: 80}},
+			}})
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			assert.True(t, len(f.Decisions()) <= 5)
+		}
+	}()
+	wg.Wait()
+	assert.Len(t, f.Decisions(), 5)
+}
+
+func TestRecentErrors(t *testing.T) {
+	f := newFilter()
+	assert.Empty(t, f.RecentErrors())
+
+	procs := make(map[int32]*process.FilledProcess)
+	for pid := int32(1); pid <= maxRecentErrors+5; pid++ {
+		procs[pid] = &process.FilledProcess{Pid: pid, Cmdline: []string{"docker-proxy", "-container-ip", "172.17.0.2", "-container-port", "abc"}}
+	}
+	f.LoadProxies(procs)
+
+	errors := f.RecentErrors()
+	assert.Len(t, errors, maxRecentErrors)
+	for _, err := range errors {
+		assert.Contains(t, err.Message, `invalid container port "abc"`)
+	}
+
+	// the malformed cmdlines are recorded as often as they are logged
+	f.LoadProxies(procs)
+	assert.Equal(t, errors, f.RecentErrors())
+
+	// the oldest errors are forgotten
+	f.LoadProxies(map[int32]*process.FilledProcess{
+		100: {Pid: 100, Cmdline: []string{"docker-proxy", "-container-ip", "172.17.0.256", "-container-port", "80"}},
+	})
+	errors = f.RecentErrors()
+	assert.Len(t, errors, maxRecentErrors)
+	assert.Equal(t, fmt.Sprintf("skipping docker-proxy with pid=100: %s", `invalid container ip "172.17.0.256"`), errors[maxRecentErrors-1].Message)
+}
+
+func TestSampledTracing(t *testing.T) {
+	procs := map[int32]*process.FilledProcess{
+		1: {Pid: 1, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-ip", "10.0.0.5", "-host-port", "8080", "-container-ip", "172.17.0.2", "-container-port", "80"}},
+	}
+	payload := func(n int) *model.Connections {
+		payload := &model.Connections{Conns: []*model.Connection{
+			{Pid: 1, Laddr: &model.Addr{Ip: "172.17.0.1", Port: 34567}, Raddr: &model.Addr{Ip: "172.17.0.2", Port: 80}, Direction: model.ConnectionDirection_outgoing},
+			// to the target from another IP than the proxy one
+			{Pid: 2, Laddr: &model.Addr{Ip: "172.17.0.2", Port: 80}, Raddr: &model.Addr{Ip: "172.17.0.5", Port: 50000}, Direction: model.ConnectionDirection_incoming},
+		}}
+		for i := 0; i < n; i++ {
+			payload.Conns = append(payload.Conns, &model.Connection{Pid: 1, Laddr: &model.Addr{Ip: "10.0.0.5", Port: 8080},
+				Raddr: &model.Addr{Ip: "10.0.0.9", Port: int32(50000 + i)}, Direction: model.ConnectionDirection_incoming})
+		}
+		return payload
+	}
+
+	logger := &quietLogger{}
+	sampled := func(f *Filter, n int) []string {
+		logger.messages = nil
+		f.Filter(payload(n))
+		var sampled []string
+		for _, msg := range logger.messages["debug"] {
+			if strings.HasPrefix(msg, "sampled decision: ") {
+				sampled = append(sampled, msg)
+			}
+		}
+		return sampled
+	}
+
+	f := newFilter(WithLogger(logger), WithSampledTracing(1, 0))
+	f.LoadProxies(procs)
+	assert.Equal(t, []string{
+		"sampled decision: dropped tcp connection pid=1 172.17.0.1:34567 -> 172.17.0.2:80, target leg of docker-proxy with pid=1 " +
+			"target=172.17.0.2:80 matched by the remote address, proxy ip=172.17.0.1",
+		"sampled decision: kept tcp connection pid=2 172.17.0.2:80 -> 172.17.0.5:50000, its local address is target=172.17.0.2:80 " +
+			"of docker-proxy with pid=1 but its peer isn't the proxy ip=172.17.0.1",
+		"sampled decision: dropped tcp connection pid=1 10.0.0.5:8080 -> 10.0.0.9:50000, client leg of docker-proxy with pid=1 " +
+			"target=172.17.0.2:80 matched by neither address, proxy ip=172.17.0.1",
+	}, sampled(f, 1))
+	assert.Equal(t, uint64(3), f.LastRunStats().Traced)
+
+	// the sampled connections only depend on their tuple
+	f = newFilter(WithLogger(logger), WithSampledTracing(0.1, 0))
+	f.LoadProxies(procs)
+	first := sampled(f, 1000)
+	assert.True(t, len(first) > 60 && len(first) < 140, "%d decisions sampled", len(first))
+	assert.Equal(t, first, sampled(f, 1000))
+	assert.Equal(t, uint64(len(first)), f.LastRunStats().Traced)
+
+	// no more decisions than the cap are logged per run
+	f = newFilter(WithLogger(logger), WithSampledTracing(1, 5))
+	f.LoadProxies(procs)
+	assert.Len(t, sampled(f, 1000), 5)
+	assert.Len(t, sampled(f, 1000), 5)
+
+	// nothing is sampled unless enabled and logged
+	f = newFilter(WithLogger(logger))
+	f.LoadProxies(procs)
+	assert.Empty(t, sampled(f, 1000))
+	info := &infoLogger{}
+	f = newFilter(WithLogger(info), WithSampledTracing(1, 0))
+	f.LoadProxies(procs)
+	info.messages = nil
+	f.Filter(payload(10))
+	for _, msg := range info.messages["debug"] {
+		assert.NotContains(t, msg, "sampled decision")
+	}
+	assert.Equal(t, uint64(0), f.LastRunStats().Traced)
+}
@@ -0,0 +1,2777 @@
+package dockerproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	model "github.com/DataDog/agent-payload/process"
+	"github.com/DataDog/gopsutil/process"
+)
+
+// ProxyBinaryNames lists the names of the binaries forwarding published ports to containers that are recognized
+// by default, see RegisterRecognizer to recognize more of them and WithBinaryNames.
+var ProxyBinaryNames = append(append(append([]string{}, DockerProxyRecognizer.Binaries...), RootlesskitRecognizer.Binaries...),
+	Slirp4netnsRecognizer.Binaries...)
+
+// malformedLogInterval is the minimum interval between two warnings about the same malformed docker-proxy
+const malformedLogInterval = 10 * time.Minute
+
+// loadBatchSize is the number of processes inspected between two checks of the cancellation of a load or refresh
+const loadBatchSize = 256
+
+// errUnixSocketTarget is returned by extractProxyInfo for the proxies forwarding to a unix domain socket,
+// which are accounted for apart from the malformed ones
+var errUnixSocketTarget = errors.New("forwards to a unix domain socket")
+
+// errNoForwardedPort is returned by extractProxyInfo for the proxies whose forwardings are listed at runtime but
+// which don't forward any port yet, which aren't kept in the negative cache as they may forward some later
+var errNoForwardedPort = errors.New("forwards no port")
+
+// ErrUnsupportedPlatform is returned by NewFilterWithError when given a feature only implemented on linux, such as
+// WithActiveDiscovery, on another platform. The filter it returns works without that feature.
+var ErrUnsupportedPlatform = errors.New("only supported on linux")
+
+// loadLogSample is the number of new proxies logged at debug level after a load, see logLoad
+const loadLogSample = 10
+
+const (
+	// undiscoveredRefreshes is the number of refreshes after which a proxy whose IP is still unknown is
+	// considered as undiscoverable, see warnUndiscovered
+	undiscoveredRefreshes = 3
+	// undiscoveredRatio is the ratio of undiscoverable proxies over which warnUndiscovered warns
+	undiscoveredRatio = 0.5
+)
+
+// DefaultRefreshInterval is the interval at which a started Filter rescans the processes by default
+const DefaultRefreshInterval = 2 * time.Minute
+
+// DefaultParallelThreshold is the number of connections from which a payload is matched by several workers by default
+const DefaultParallelThreshold = 50000
+
+// wildcardIPs are the host addresses docker-proxy binds to when listening on all interfaces,
+// the IPv4 one coming first
+var wildcardIPs = []string{"0.0.0.0", "::"}
+
+// wildcardKeyIPs are the wildcardIPs in the form of the IPs of addrKey
+var wildcardKeyIPs = [][net.IPv6len]byte{
+	{10: 0xff, 11: 0xff},
+	{},
+}
+
+type proxy struct {
+	// lastMatched is the time, in nanoseconds since the epoch, the proxy was last matched against a connection
+	// or registered. It is accessed atomically as connections are matched under the read lock, and must stay
+	// 64-bit aligned.
+	lastMatched int64
+	// matched is the number of connections matched against the proxy, it is accessed atomically as well
+	matched uint64
+
+	pid int32
+	// createTime is the creation time of the docker-proxy process, used to detect PID reuse
+	createTime int64
+	ip         string
+	target     model.Addr
+	// extraTargets are the targets following the first one when docker-proxy is invoked with several
+	// -container-ip flags, e.g. for dual-stack containers
+	extraTargets []model.Addr
+	// extraHosts are the addresses the proxy listens on besides host when it forwards several ports (e.g.
+	// slirp4netns), each one forwarding to the extra target of the same rank
+	extraHosts []model.Addr
+	// altIP is the proxy IP towards the targets whose address family differs from the first target's one
+	altIP string
+	// netns is the network namespace the proxy connects to its targets from, 0 if unknown
+	netns uint32
+	// host is the address docker-proxy listens on; its Ip may be a wildcard address
+	host model.Addr
+	// proto is the protocol forwarded by docker-proxy, or an empty string if unknown
+	proto string
+	// lastSeen is the last time the docker-proxy process was part of a scan
+	lastSeen time.Time
+	// static is set for the proxies registered through AddProxy, which are only ever removed by RemoveProxy
+	static bool
+	// wrapped is set for the proxies detected from the cmdline of the shell or wrapper running them, see
+	// unwrapCmdline. Such a process forking the proxy forwards the same ports without owning its sockets, so it
+	// yields to the proxy it runs.
+	wrapped bool
+	// ipConflictLogged is set once we warned about a connection disagreeing with the discovered ip
+	ipConflictLogged bool
+	// refreshes is the number of refreshes the proxy was part of
+	refreshes int
+}
+
+// socket is a connected socket of a process
+type socket struct {
+	laddr, raddr model.Addr
+}
+
+// localAddr is an address of a network namespace along with the subnet it was assigned on
+type localAddr struct {
+	ip     net.IP
+	subnet *net.IPNet
+}
+
+// proxyKey indexes proxies by address and protocol. The anyProto proto matches connections of any protocol.
+// Targets are indexed in the network namespace of their proxy if known, as container addresses are only unique
+// within a namespace, and with a zero netns in any case.
+// Its fields are fixed-size so that hashing it, which is done several times per connection, doesn't involve strings.
+type proxyKey struct {
+	addr  addrKey
+	proto protoKey
+	netns uint32
+}
+
+// addrKey is the form of an address used by proxyKey, IPv4 addresses being held as IPv4-mapped IPv6 ones
+type addrKey struct {
+	ip   [net.IPv6len]byte
+	port int32
+}
+
+// protoKey is the form of a protocol used by proxyKey, as wide as its other fields so that proxyKey has no padding
+// and is hashed at once
+type protoKey uint32
+
+const (
+	anyProto protoKey = iota
+	tcpProto
+	udpProto
+	// otherProto stands for the protocols connections can't have, e.g. sctp
+	otherProto
+)
+
+// Mode selects what a Filter does with the connections going through a docker-proxy
+type Mode int
+
+const (
+	// DropMode removes every connection going through a docker-proxy from the payloads
+	DropMode Mode = iota
+	// TranslateMode rewrites the client -> docker-proxy connections into connections to the container target
+	// the docker-proxy forwards them to, and only removes the redundant docker-proxy -> container connections
+	TranslateMode
+	// MarkMode leaves every connection in the payloads, the ones going through a docker-proxy being reported
+	// to the MarkFunc of the filter, see WithMarkFunc. It is the mode keeping the proxied connections visible:
+	// they are annotated out of band, through the MarkFunc, the Marked counter and the decision log, as the
+	// payload model has no field to flag them, so the payloads are sent unchanged.
+	MarkMode
+	// MergeMode pairs the client -> docker-proxy and docker-proxy -> container connections of a docker-proxy
+	// going to the same target and replaces them with a single client -> container connection, the legs that
+	// can't be paired unambiguously within a payload being removed as in DropMode
+	MergeMode
+)
+
+// Mark describes a docker-proxy intermediate connection left in a payload in MarkMode
+type Mark struct {
+	// ProxyPID is the PID of the docker-proxy the connection goes through
+	ProxyPID int32
+	// Target is the container address the docker-proxy forwards to
+	Target model.Addr
+}
+
+// MarkFunc is called in MarkMode for every connection going through a docker-proxy.
+// It is called while the filter is locked, so it must not call the filter back.
+type MarkFunc func(c *model.Connection, m Mark)
+
+// DropFunc is called for every connection dropped from a payload, along with the proxy it was matched against,
+// see WithOnDrop. It is called from the goroutine filtering the payload while the filter is locked, so it must not
+// call the filter back, and concurrent calls to Filter may call it concurrently.
+type DropFunc func(c *model.Connection, matched ProxyInfo)
+
+// leg identifies the side of a docker-proxy a connection belongs to
+type leg int
+
+const (
+	// noLeg is for the connections not going through a docker-proxy
+	noLeg leg = iota
+	// clientLeg is client -> docker-proxy, as seen by docker-proxy
+	clientLeg
+	// targetLeg is docker-proxy -> container, as seen by either end
+	targetLeg
+	// ownedLeg is any other connection of a docker-proxy process, only matched if WithDropProxyOwned is set
+	ownedLeg
+)
+
+func (l leg) String() string {
+	switch l {
+	case clientLeg:
+		return "client leg"
+	case targetLeg:
+		return "target leg"
+	case ownedLeg:
+		return "owned connection"
+	default:
+		return "no leg"
+	}
+}
+
+// ProxyInfo describes a proxy tracked by a Filter
+type ProxyInfo struct {
+	PID int32
+	// IP is the IP the proxy connects to its target from, empty if not discovered yet
+	IP string
+	// Target is the container address the proxy forwards to
+	Target model.Addr
+	// Host is the address the proxy listens on
+	Host model.Addr
+	// Proto is the protocol forwarded by the proxy, empty if unknown
+	Proto string
+	// Discovered is true if the IP of the proxy is known
+	Discovered bool
+	// LastSeen is the last time the proxy process was part of a scan, or the time it was registered through AddProxy
+	LastSeen time.Time
+	// LastMatched is the last time a connection went through the proxy, or the time it was first tracked if none did
+	LastMatched time.Time
+	// Matched is the number of connections matched against the proxy
+	Matched uint64
+}
+
+// Stats holds cumulative counters about the connections examined by a Filter and the proxies it tracks
+type Stats struct {
+	// Examined is the number of connections of the payloads given to the filter
+	Examined uint64
+	// Dropped is the number of connections removed from the payloads because they go through a proxy
+	Dropped uint64
+	// Kept is the number of connections left in the payloads
+	Kept uint64
+	// Translated is the number of kept connections rewritten in TranslateMode
+	Translated uint64
+	// Marked is the number of kept connections reported as going through a proxy in MarkMode
+	Marked uint64
+	// Merged is the number of kept connections made of two legs of a proxy in MergeMode
+	Merged uint64
+	// DroppedOwned is the number of dropped connections that only matched because their process is a proxy,
+	// see WithDropProxyOwned. They are also counted in Dropped.
+	DroppedOwned uint64
+	// Deduplicated is the number of dropped connections duplicating another connection of their payload,
+	// see WithDedup. They are also counted in Dropped.
+	Deduplicated uint64
+
+	// Proxies is the number of proxies currently tracked, see ProxyCount
+	Proxies uint64
+	// ProxyInsertions is the number of proxies that started being tracked
+	ProxyInsertions uint64
+	// ProxyEvictions is the number of proxies evicted while their process may still run: the ones that
+	// expired (see WithTTL and ExpireStale) and the least recently matched ones over the limit of WithMaxProxies
+	ProxyEvictions uint64
+	// ProxyLookups is the number of connections looked up against the tracked proxies
+	ProxyLookups uint64
+	// Discovered is the number of tracked proxies whose IP is known
+	Discovered uint64
+	// Undiscovered is the number of tracked proxies whose IP is still unknown, the connections of the containers
+	// towards them being kept in the payloads. The proxies forwarding to a loopback target, whose IP is never
+	// learned, are counted in neither.
+	Undiscovered uint64
+	// UnixSocketProxies is the number of running proxies forwarding to a unix domain socket, which aren't tracked
+	// as their connections can't be filtered
+	UnixSocketProxies uint64
+	// ProxyIPDiscoveries is the number of proxy IPs (or targets, for the proxies detected without their cmdline)
+	// discovered, whether from the payloads or from the proxy processes
+	ProxyIPDiscoveries uint64
+	// ProxyIPMismatches is the number of connections looked up whose address is a target of a proxy, but whose
+	// peer doesn't have the IP of that proxy. A high number hints at a proxy IP wrongly discovered.
+	ProxyIPMismatches uint64
+}
+
+// RunStats are the counters of a single call filtering payloads, see LastRunStats
+type RunStats struct {
+	// Examined is the number of connections of the payloads
+	Examined uint64
+	// Dropped is the number of connections removed from the payloads
+	Dropped uint64
+	// Proxies is the number of proxies tracked when the payloads were filtered
+	Proxies uint64
+	// ProxyIPDiscoveries is the number of proxy IPs discovered from the payloads
+	ProxyIPDiscoveries uint64
+	// ProxyIPMismatches is the number of connections to a target of a proxy from another IP than the proxy one,
+	// see Stats
+	ProxyIPMismatches uint64
+	// Traced is the number of decisions logged by the sampled tracing, see WithSampledTracing
+	Traced uint64
+}
+
+// Filter keeps track of every docker-proxy instance and filters network traffic going through them.
+// It is safe for concurrent use: payloads may be filtered while the tracked proxies are updated from other
+// goroutines (e.g. through LoadProxies, Refresh or the background refresher started by Start), the proxies
+// being only mutated under the write lock, including when their IP is discovered from a payload.
+type Filter struct {
+	// the counters are accessed atomically and must stay 64-bit aligned
+	dropped      uint64
+	kept         uint64
+	translated   uint64
+	marked       uint64
+	merged       uint64
+	droppedOwned uint64
+	deduplicated uint64
+	insertions   uint64
+	evictions    uint64
+	lookups      uint64
+	examined     uint64
+	discoveries  uint64
+	mismatches   uint64
+
+	// lastRunMux guards lastRun, the counters of the latest call filtering payloads
+	lastRunMux sync.Mutex
+	lastRun    RunStats
+
+	// mux guards the proxy maps below as well as the proxies they hold
+	mux sync.RWMutex
+
+	proxyByTarget   map[proxyKey]*proxy
+	proxyByHostAddr map[proxyKey]*proxy
+	proxyByPID      map[int32]*proxy
+
+	// binaryNames are the basenames of the binaries recognized as proxies, nil for the ones of the registered
+	// recognizers
+	binaryNames []string
+	// recognizers are the recognizers of WithRecognizers, looked up before the registered ones
+	recognizers []Recognizer
+	// exactBinaryPath is the only executable path recognized as a proxy if not empty, see WithExactBinaryPath
+	exactBinaryPath string
+
+	logger   Logger
+	mode     Mode
+	markFunc MarkFunc
+	// onDrop is called for every dropped connection if set, see WithOnDrop
+	onDrop DropFunc
+	// dropOwned makes every connection of a docker-proxy process match, whatever its addresses
+	dropOwned bool
+	// dedup removes the duplicate connections left in the payloads once filtered
+	dedup bool
+	// hostPortMatching indexes the targets with the host port of their proxy as well, see WithHostPortMatching
+	hostPortMatching bool
+
+	// hostIPs are the addresses of the host, see WithHostIPs, nil if unknown
+	hostIPs map[string]struct{}
+	// hostIPsFunc lists the addresses of the host on every refresh, see WithHostIPsFunc
+	hostIPsFunc func() ([]string, error)
+
+	// workers is the number of goroutines matching the payloads of at least parallelThreshold connections,
+	// see WithParallelism
+	workers           int
+	parallelThreshold int
+
+	// procRoot is where the sockets of the proxies are read from, empty if active discovery is disabled
+	procRoot string
+
+	// now returns the current time, it is only replaced by tests
+	now func() time.Time
+
+	// ttl is the duration after which proxies that weren't part of any scan are evicted, 0 if disabled
+	ttl time.Duration
+
+	// maxProxies is the number of proxies tracked over which the least recently matched ones are evicted,
+	// 0 if unlimited
+	maxProxies int
+	// maxProxiesOnce ensures we only warn once about the limit of tracked proxies being reached
+	maxProxiesOnce sync.Once
+
+	// undiscoveredWarned is set while we warned about too many proxies whose IP is unknown, see warnUndiscovered
+	undiscoveredWarned bool
+
+	// source is rescanned by the background refresher
+	source ProcessSource
+	// refreshInterval is the interval the background refresher is started with by NewFilter, 0 if it isn't
+	refreshInterval time.Duration
+
+	// refreshMux guards the lifecycle of the background refresher
+	refreshMux sync.Mutex
+	exit       chan struct{}
+	refreshWG  sync.WaitGroup
+
+	// degradedOnce ensures we only log once about docker-proxy instances detected without their cmdline
+	degradedOnce sync.Once
+
+	// notProxies maps the PIDs known not to be proxies to their create time, nil if the negative cache is disabled
+	notProxies map[int32]int64
+
+	// malformedPIDs holds the time we last logged about docker-proxy PIDs whose cmdline could not be parsed,
+	// so that we log at most once per PID every malformedLogInterval
+	malformedPIDs map[int32]time.Time
+
+	// unixSocketProxies maps the PIDs of the proxies forwarding to a unix domain socket to their create time
+	unixSocketProxies map[int32]int64
+
+	// decisions holds the latest connections matched against a proxy, nil unless WithDecisionLog is given
+	decisions *decisionLog
+	// sampler selects the decisions logged, nil unless WithSampledTracing is given
+	sampler *decisionSampler
+	// errorsMux guards recentErrors, the latest errors met while detecting the proxies
+	errorsMux    sync.Mutex
+	recentErrors []RecentError
+}
+
+// ProcessSource enumerates the running processes the docker-proxy instances are detected from
+type ProcessSource interface {
+	AllProcesses() (map[int32]*process.FilledProcess, error)
+}
+
+// BinariesProcessSource is a ProcessSource able to only list the processes running one of the given binaries, as
+// SystemProcessSource does. The filters given one list the processes of the binaries they recognize from it, see
+// WithBinaryNames and WithRecognizers, while AllProcesses only lists the ones of the registered recognizers.
+type BinariesProcessSource interface {
+	ProcessSource
+	ProcessesOf(binaryNames []string) (map[int32]*process.FilledProcess, error)
+}
+
+type systemProcessSource struct{}
+
+func (systemProcessSource) AllProcesses() (map[int32]*process.FilledProcess, error) {
+	return allProcesses(RecognizedBinaryNames())
+}
+
+func (systemProcessSource) ProcessesOf(binaryNames []string) (map[int32]*process.FilledProcess, error) {
+	return allProcesses(binaryNames)
+}
+
+// binariesProcessSource lists the processes running the binaries recognized by a filter from a BinariesProcessSource.
+// binaryNames are the ones of WithBinaryNames, nil to list the ones of the registered recognizers at the time, and
+// extraNames the ones of WithRecognizers.
+type binariesProcessSource struct {
+	source      BinariesProcessSource
+	binaryNames []string
+	extraNames  []string
+}
+
+func (s binariesProcessSource) AllProcesses() (map[int32]*process.FilledProcess, error) {
+	names := s.binaryNames
+	if names == nil {
+		names = RecognizedBinaryNames()
+	}
+	return s.source.ProcessesOf(append(append([]string{}, names...), s.extraNames...))
+}
+
+// SystemProcessSource is the BinariesProcessSource walking the processes of the host, except on platforms without
+// procfs (e.g. darwin) where every process is listed. On linux, the processes are identified from /proc (or
+// HOST_PROC) without filling every process of the host.
+var SystemProcessSource ProcessSource = systemProcessSource{}
+
+// Option configures a Filter
+type Option func(*Filter)
+
+// WithBinaryNames replaces the basenames of the binaries recognized as proxies, which default to the binaries of
+// the registered recognizers, see RegisterRecognizer. It lets users running custom proxy shims opt in, the binaries
+// without a recognizer being expected to take the docker-proxy flags.
+func WithBinaryNames(names ...string) Option {
+	return func(f *Filter) {
+		f.binaryNames = append([]string{}, names...)
+	}
+}
+
+// WithRecognizers makes the filter recognize the binaries of the given recognizers as proxies too, on top of the
+// registered ones or the ones of WithBinaryNames, without affecting other filters as RegisterRecognizer does. They
+// are looked up before the registered recognizers.
+func WithRecognizers(recognizers ...Recognizer) Option {
+	return func(f *Filter) {
+		f.recognizers = append(f.recognizers, recognizers...)
+	}
+}
+
+// WithExactBinaryPath only recognizes the processes executing the binary at exactly the given path (e.g.
+// /usr/bin/docker-proxy) as proxies, instead of any binary with a recognized basename, so that a process merely
+// named like a proxy can't have the connections of others dropped. The path is compared to the resolved executable
+// path, or to argv[0] when it isn't available, never to the process name. The binary must still be recognized,
+// see WithBinaryNames for custom ones. The commands run by shells and wrappers aren't resolved, so the proxies
+// they run are only recognized from their own process.
+func WithExactBinaryPath(path string) Option {
+	return func(f *Filter) {
+		f.exactBinaryPath = path
+	}
+}
+
+// WithMode selects what the filter does with the connections going through a docker-proxy, DropMode by default
+func WithMode(mode Mode) Option {
+	return func(f *Filter) {
+		f.mode = mode
+	}
+}
+
+// WithMarkFunc selects MarkMode, reporting the connections going through a docker-proxy to the given function
+func WithMarkFunc(markFunc MarkFunc) Option {
+	return func(f *Filter) {
+		f.mode = MarkMode
+		f.markFunc = markFunc
+	}
+}
+
+// WithOnDrop makes the filter report every connection it drops from the payloads to the given function, along with
+// the proxy it goes through. The translated, merged and deduplicated connections aren't reported.
+func WithOnDrop(onDrop DropFunc) Option {
+	return func(f *Filter) {
+		f.onDrop = onDrop
+	}
+}
+
+// WithDropProxyOwned makes the filter match every connection owned by a docker-proxy process, including the
+// ones that don't involve its target (e.g. health checks or DNS lookups). It is disabled by default.
+func WithDropProxyOwned() Option {
+	return func(f *Filter) {
+		f.dropOwned = true
+	}
+}
+
+// WithHostPortMatching makes the filter match the connections to a target of a proxy observed with the host port
+// of the proxy instead of the container one, as some bridge configurations report the target legs on the host
+// side of the NAT. The targets are indexed with the host port as well, the actual targets of other proxies
+// taking precedence. It is disabled by default.
+func WithHostPortMatching() Option {
+	return func(f *Filter) {
+		f.hostPortMatching = true
+	}
+}
+
+// WithHostIPs gives the filter the addresses of the host. Until the IP a proxy connects to its target from is
+// discovered, the connections between any of those addresses and the target are considered as going through
+// the proxy, which spares the proxy legs seen by the containers from being reported right after startup.
+// The proxies listening on a wildcard address then only match the connections to those addresses.
+// See WithHostIPsFunc for addresses changing over time.
+func WithHostIPs(ips ...string) Option {
+	return func(f *Filter) {
+		f.setHostIPs(ips)
+	}
+}
+
+// WithHostIPsFunc is like WithHostIPs, the addresses of the host being listed by the given function every time
+// the proxies are loaded or refreshed, e.g. ProcHostIPs.
+func WithHostIPsFunc(hostIPsFunc func() ([]string, error)) Option {
+	return func(f *Filter) {
+		f.hostIPsFunc = hostIPsFunc
+	}
+}
+
+// HostIPs returns the addresses of the network interfaces of the network namespace of the agent, which are the ones
+// of the host unless the agent runs in a container, see WithHostIPsFunc and ProcHostIPs
+func HostIPs() ([]string, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+
+	ips := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok {
+			ips = append(ips, ipNet.IP.String())
+		}
+	}
+	return ips, nil
+}
+
+// ProcHostIPs returns a function listing the addresses of the host from the procfs mounted at procRoot (e.g. /proc,
+// or the host's one when running in a container), see WithHostIPsFunc. Unlike HostIPs, which lists the addresses of
+// the network namespace of the agent, it lists the ones of the network namespace of the init process of the host. It
+// fails if they can't be read, e.g. on platforms without procfs: the wildcard proxies are then matched on any address
+// until they are listed.
+func ProcHostIPs(procRoot string) func() ([]string, error) {
+	return func() ([]string, error) {
+		return procHostIPs(procRoot)
+	}
+}
+
+// WithActiveDiscovery makes the filter read the sockets of the proxies whose IP is still unknown from the given
+// procfs (e.g. /proc, or the host's one when running in a container), rather than waiting for a connection
+// towards their target to be part of a payload. Their network namespace is read from there as well.
+// The proxies are looked at as soon as they are loaded: their IP is taken from the sockets connected to their
+// targets, or else from the address their network namespace has on the subnet of their targets. The IPs left
+// unknown are still discovered from the connections of the payloads.
+// Reading the sockets of another process requires elevated privileges. It is only supported on linux, see
+// ErrUnsupportedPlatform.
+func WithActiveDiscovery(procRoot string) Option {
+	return func(f *Filter) {
+		f.procRoot = procRoot
+	}
+}
+
+// WithDedup makes the filter remove the connections sharing their protocol, local and remote addresses with
+// a previous connection of the payload once the proxy legs are filtered. Chained proxies (e.g. the proxies of a
+// Docker-in-Docker daemon behind the host ones) can leave a single flow reported twice.
+func WithDedup() Option {
+	return func(f *Filter) {
+		f.dedup = true
+	}
+}
+
+// WithParallelism makes the filter match the connections of the payloads holding at least threshold of them
+// across the given number of goroutines, the other payloads being matched serially. It defaults to GOMAXPROCS
+// workers and DefaultParallelThreshold, and a single worker disables parallel matching.
+func WithParallelism(workers, threshold int) Option {
+	return func(f *Filter) {
+		f.workers = workers
+		f.parallelThreshold = threshold
+	}
+}
+
+// WithLogger makes the filter log through the given logger rather than the agent's logger
+func WithLogger(logger Logger) Option {
+	return func(f *Filter) {
+		f.logger = logger
+	}
+}
+
+// WithNegativeCache makes the filter remember the processes that aren't proxies, identified by their PID and
+// create time, so that they aren't inspected again on every scan. A process exec'ing a proxy binary after
+// having been scanned is then never detected, which is why the cache is opt-in.
+func WithNegativeCache() Option {
+	return func(f *Filter) {
+		f.notProxies = make(map[int32]int64)
+	}
+}
+
+// WithDecisionLog makes the filter keep the last size connections it matched against a proxy, along with what
+// it did with them, see Decisions. Keeping them costs a copy of every matched connection.
+func WithDecisionLog(size int) Option {
+	return func(f *Filter) {
+		if size > 0 {
+			f.decisions = newDecisionLog(size)
+		}
+	}
+}
+
+// WithSampledTracing makes the filter log a sample of its decisions at debug level: the connections it drops,
+// along with the target of the proxy they matched, the end of the connection that matched it and the proxy IP,
+// as well as the connections it keeps although they have a target of a proxy at one end, as the IP at their other
+// end isn't the proxy IP. The given rate, between 0 and 1, is the fraction of the connections sampled, picked from
+// the hash of their tuple so that the decisions about a connection are logged on every run. If maxPerRun is
+// positive, no more than maxPerRun decisions are logged per call filtering payloads, see RunStats.Traced.
+func WithSampledTracing(rate float64, maxPerRun int) Option {
+	return func(f *Filter) {
+		if rate > 0 {
+			f.sampler = newDecisionSampler(rate, maxPerRun)
+		}
+	}
+}
+
+// WithTTL makes the filter keep the proxies missing from a scan until they haven't been seen for the given
+// duration, instead of evicting them right away. It prevents transient scan failures from flapping proxies.
+func WithTTL(ttl time.Duration) Option {
+	return func(f *Filter) {
+		f.ttl = ttl
+	}
+}
+
+// WithMaxProxies bounds the number of proxies tracked by the filter: once more are detected, the least recently
+// matched ones are evicted, and the connections going through them are kept in the payloads until they are
+// tracked again. Proxies registered through AddProxy are never evicted. 0, the default, means no limit.
+func WithMaxProxies(max int) Option {
+	return func(f *Filter) {
+		f.maxProxies = max
+	}
+}
+
+// WithProcessSource sets the source the docker-proxy instances are detected from, which defaults to
+// SystemProcessSource. A source given to NewFilter takes precedence.
+func WithProcessSource(source ProcessSource) Option {
+	return func(f *Filter) {
+		if source != nil {
+			f.source = source
+		}
+	}
+}
+
+// WithRefreshInterval makes NewFilter start the background refresher once the initial scan is done, even if it
+// failed, see Start. Stop must be called to release it.
+func WithRefreshInterval(interval time.Duration) Option {
+	return func(f *Filter) {
+		f.refreshInterval = interval
+	}
+}
+
+// NewFilter instantiates a new filter loaded with the docker-proxy instances found in the given source.
+// The options are applied before the initial scan. The source of WithProcessSource, or else SystemProcessSource,
+// is used if source is nil. Errors listing the processes are logged, see NewFilterWithError to handle them.
+func NewFilter(source ProcessSource, opts ...Option) *Filter {
+	filter, err := NewFilterWithError(source, opts...)
+	if err != nil {
+		filter.logger.Warnf("error initiating proxy filter: %s", err)
+	}
+	return filter
+}
+
+// NewFilterWithError is like NewFilter but returns the error listing the processes, if any, or else
+// ErrUnsupportedPlatform if it was given a feature the platform doesn't support.
+// The returned filter is usable even if an error is returned: it tracks no proxy until it is refreshed.
+func NewFilterWithError(source ProcessSource, opts ...Option) (*Filter, error) {
+	filter := newFilter(opts...)
+	var unsupported error
+	if filter.procRoot != "" && !procfsSupported {
+		filter.procRoot = ""
+		unsupported = ErrUnsupportedPlatform
+	}
+	if source != nil {
+		filter.source = source
+	}
+	if source, ok := filter.source.(BinariesProcessSource); ok && (filter.binaryNames != nil || filter.recognizers != nil) {
+		filter.source = binariesProcessSource{
+			source:      source,
+			binaryNames: filter.binaryNames,
+			extraNames:  recognizerBinaries(filter.recognizers),
+		}
+	}
+
+	procs, err := filter.source.AllProcesses()
+	if err == nil {
+		filter.LoadProxies(procs)
+		err = unsupported
+	}
+
+	if filter.refreshInterval > 0 {
+		filter.Start(filter.refreshInterval)
+	}
+	return filter, err
+}
+
+func newFilter(opts ...Option) *Filter {
+	f := &Filter{
+		proxyByTarget:   make(map[proxyKey]*proxy),
+		proxyByHostAddr: make(map[proxyKey]*proxy),
+		proxyByPID:      make(map[int32]*proxy),
+		logger:          agentLogger{},
+		source:          SystemProcessSource,
+		malformedPIDs:   make(map[int32]time.Time),
+		now:             time.Now,
+
+		unixSocketProxies: make(map[int32]int64),
+
+		workers:           runtime.GOMAXPROCS(0),
+		parallelThreshold: DefaultParallelThreshold,
+	}
+
+	for _, opt := range opts {
+		opt(f)
+	}
+	return f
+}
+
+// LoadProxies by inspecting processes information. Proxies are only ever added (or updated) by LoadProxies,
+// use Refresh to also evict the proxies that aren't running anymore. Once the proxies are loaded, callers
+// keeping track of the processes can apply their changes through LoadProxiesDelta instead.
+func (f *Filter) LoadProxies(procs map[int32]*process.FilledProcess) {
+	// the background context is never cancelled
+	_ = f.LoadProxiesContext(context.Background(), procs)
+}
+
+// LoadProxiesContext is LoadProxies, giving up once the given context is cancelled, in which case the context
+// error is returned. The processes are inspected before any proxy is updated, so a cancelled load leaves the
+// tracked proxies untouched.
+func (f *Filter) LoadProxiesContext(ctx context.Context, procs map[int32]*process.FilledProcess) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	next, err := f.extractProxies(ctx, procs)
+	if err != nil {
+		return err
+	}
+
+	f.refreshHostIPs()
+
+	before := len(f.proxyByPID)
+	var added []*proxy
+	for _, p := range procs {
+		f.evictReusedPID(p)
+		if proxy, ok := next[p.Pid]; ok && f.addProxy(proxy) {
+			added = append(added, proxy)
+		}
+	}
+	f.evictExpired(f.now())
+	f.evictLeastRecentlyMatched()
+	f.logLoad(before, added)
+	return nil
+}
+
+// extractProxies returns the proxies among the given processes by PID, checking whether the given context
+// was cancelled every loadBatchSize processes. The caller must hold the write lock.
+func (f *Filter) extractProxies(ctx context.Context, procs map[int32]*process.FilledProcess) (map[int32]*proxy, error) {
+	proxies := make(map[int32]*proxy)
+	inspected := 0
+	for _, p := range procs {
+		if inspected%loadBatchSize == 0 {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+		}
+		inspected++
+
+		if proxy := f.extractProxy(p); proxy != nil {
+			proxies[p.Pid] = proxy
+		}
+	}
+
+	// the last batch may have been inspected after the cancellation
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return proxies, nil
+}
+
+// logLoad logs a single summary line about a load that changed the tracked proxies, given how many were tracked
+// before and the ones added. Every new proxy is also logged at trace level, or else a sample of them at debug
+// level, the whole set being listed on demand by Proxies.
+func (f *Filter) logLoad(before int, added []*proxy) {
+	after := len(f.proxyByPID)
+	removed := before + len(added) - after
+	if len(added) == 0 && removed == 0 {
+		return
+	}
+	f.logger.Infof("loaded %d docker-proxy instances, %d new, %d removed", after, len(added), removed)
+
+	if traceEnabled(f.logger) {
+		for _, p := range added {
+			f.logger.Tracef("detected docker-proxy with pid=%d proto=%s host.ip=%s host.port=%d target.ip=%s target.port=%d",
+				p.pid, p.proto, p.host.Ip, p.host.Port, p.target.Ip, p.target.Port)
+		}
+		return
+	}
+	if len(added) == 0 || !debugEnabled(f.logger) {
+		return
+	}
+
+	sample := added
+	if len(sample) > loadLogSample {
+		sample = sample[:loadLogSample]
+	}
+	entries := make([]string, 0, len(sample))
+	for _, p := range sample {
+		entries = append(entries, fmt.Sprintf("pid=%d %s %s -> %s", p.pid, p.proto, formatAddr(&p.host), formatAddr(&p.target)))
+	}
+	f.logger.Debugf("new docker-proxy instances (%d of %d): %s", len(sample), len(added), strings.Join(entries, ", "))
+}
+
+// Proxies returns a snapshot of the proxies currently tracked, ordered by PID.
+// The snapshot is a copy: it's safe to call concurrently with Filter, and it isn't updated afterwards.
+func (f *Filter) Proxies() []ProxyInfo {
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+
+	proxies := make([]ProxyInfo, 0, len(f.proxyByPID))
+	for _, p := range f.proxyByPID {
+		proxies = append(proxies, p.info())
+	}
+
+	sort.Slice(proxies, func(i, j int) bool {
+		return proxies[i].PID < proxies[j].PID
+	})
+	return proxies
+}
+
+// lookupProtos are the protocols LookupProxy looks the targets up with, in order
+var lookupProtos = []protoKey{tcpProto, udpProto, anyProto, otherProto}
+
+// LookupProxy returns the proxy forwarding to the given container address, as a copy, and true if there is one.
+// The address is looked up among the targets of the proxies whatever their protocol, the ones forwarding tcp
+// being preferred, then udp, then the ones whose protocol is unknown. It's safe to call concurrently with Filter.
+func (f *Filter) LookupProxy(addr model.Addr) (ProxyInfo, bool) {
+	key, ok := newAddrKey(canonicalAddr(&addr))
+	if !ok {
+		return ProxyInfo{}, false
+	}
+
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+
+	for _, proto := range lookupProtos {
+		if p, ok := f.proxyByTarget[proxyKey{addr: key, proto: proto}]; ok {
+			return p.info(), true
+		}
+	}
+	return ProxyInfo{}, false
+}
+
+// IsProxyPID returns true if the given PID is the one of a proxy currently tracked
+func (f *Filter) IsProxyPID(pid int32) bool {
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+
+	_, ok := f.proxyByPID[pid]
+	return ok
+}
+
+// info returns the description of the proxy, the caller must hold the lock
+func (p *proxy) info() ProxyInfo {
+	return ProxyInfo{
+		PID:         p.pid,
+		IP:          p.ip,
+		Target:      p.target,
+		Host:        p.host,
+		Proto:       p.proto,
+		Discovered:  p.ip != "",
+		LastSeen:    p.lastSeen,
+		LastMatched: time.Unix(0, atomic.LoadInt64(&p.lastMatched)),
+		Matched:     atomic.LoadUint64(&p.matched),
+	}
+}
+
+// refreshHostIPs lists the addresses of the host again, if they are listed by a function.
+// The previous addresses are kept if they can't be listed.
+func (f *Filter) refreshHostIPs() {
+	if f.hostIPsFunc == nil {
+		return
+	}
+
+	ips, err := f.hostIPsFunc()
+	if err != nil {
+		f.logger.Debugf("could not list the host IPs: %s", err)
+		return
+	}
+	f.setHostIPs(ips)
+}
+
+func (f *Filter) setHostIPs(ips []string) {
+	f.hostIPs = make(map[string]struct{}, len(ips))
+	for _, ip := range ips {
+		f.hostIPs[canonicalIP(ip)] = struct{}{}
+	}
+}
+
+// Source returns the source the processes are listed from on every refresh, the one given to NewFilter unless it is
+// a BinariesProcessSource: it then only lists the binaries recognized by the filter. Embedders refreshing the filter
+// themselves must list the processes from it, the proxies missing from a refresh being evicted.
+func (f *Filter) Source() ProcessSource {
+	return f.source
+}
+
+// ProxyCount returns the number of docker-proxy instances currently tracked
+func (f *Filter) ProxyCount() int {
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+
+	return len(f.proxyByPID)
+}
+
+// Refresh reconciles the tracked proxies with the given snapshot of the running processes: unlike
+// LoadProxies, it evicts every proxy whose process isn't part of the snapshot anymore, or that hasn't been
+// part of any snapshot for the TTL if one is set. Proxies that are still running keep the proxy IP
+// discovered for them. It is meant to be called on every check run.
+// The whole diff is applied at once under the lock, so that Filter never observes a half-updated set of
+// proxies, e.g. while every docker-proxy is being respawned by a restarting dockerd.
+func (f *Filter) Refresh(procs map[int32]*process.FilledProcess) {
+	// the background context is never cancelled
+	_ = f.RefreshContext(context.Background(), procs)
+}
+
+// RefreshContext is Refresh, giving up once the given context is cancelled, in which case the context error
+// is returned. Like for LoadProxiesContext, a cancelled refresh leaves the tracked proxies untouched.
+func (f *Filter) RefreshContext(ctx context.Context, procs map[int32]*process.FilledProcess) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	next, err := f.extractProxies(ctx, procs)
+	if err != nil {
+		return err
+	}
+
+	f.refreshHostIPs()
+
+	for pid := range f.malformedPIDs {
+		if _, ok := procs[pid]; !ok {
+			delete(f.malformedPIDs, pid)
+		}
+	}
+	for pid := range f.unixSocketProxies {
+		if _, ok := procs[pid]; !ok {
+			delete(f.unixSocketProxies, pid)
+		}
+	}
+
+	// exited processes are only pruned from the negative cache once it outgrows the snapshot,
+	// which bounds its size without walking it on every refresh
+	if len(f.notProxies) > len(procs) {
+		for pid := range f.notProxies {
+			if _, ok := procs[pid]; !ok {
+				delete(f.notProxies, pid)
+			}
+		}
+	}
+
+	var stale []*proxy
+	for pid, existing := range f.proxyByPID {
+		proxy, isProxy := next[pid]
+		_, running := procs[pid]
+		switch {
+		case existing.static:
+		case isProxy && proxy.createTime == existing.createTime:
+		case !running && f.ttl > 0:
+			// kept until it expires
+		default:
+			// exited, reused or not a docker-proxy anymore
+			stale = append(stale, existing)
+		}
+	}
+
+	before := len(f.proxyByPID)
+	trace := traceEnabled(f.logger)
+	for _, proxy := range stale {
+		if trace {
+			f.logger.Tracef("evicting docker-proxy with pid=%d", proxy.pid)
+		}
+		f.removeProxy(proxy)
+	}
+	var added []*proxy
+	for _, proxy := range next {
+		if f.addProxy(proxy) {
+			added = append(added, proxy)
+		}
+		proxy.refreshes++
+	}
+
+	f.evictExpired(f.now())
+	f.evictLeastRecentlyMatched()
+	f.logLoad(before, added)
+	f.warnUndiscovered()
+	return nil
+}
+
+// warnUndiscovered warns once if the IP of a large share of the proxies is still unknown after several refreshes,
+// which hints at connections missing from the payloads (e.g. an unsupported network setup). It warns again once
+// the share went back under the threshold in between.
+func (f *Filter) warnUndiscovered() {
+	settled, undiscovered := 0, 0
+	for _, p := range f.proxyByPID {
+		if p.refreshes < undiscoveredRefreshes || isLoopback(p.target.Ip) {
+			continue
+		}
+		settled++
+		if p.ip == "" {
+			undiscovered++
+		}
+	}
+
+	over := settled > 0 && float64(undiscovered) >= undiscoveredRatio*float64(settled)
+	if over && !f.undiscoveredWarned {
+		f.logger.Warnf("the IP of %d out of %d docker-proxy instances is still unknown after %d refreshes, the connections "+
+			"of their containers towards them are reported twice: are the connections of docker-proxy towards "+
+			"the containers collected?", undiscovered, settled, undiscoveredRefreshes)
+	}
+	f.undiscoveredWarned = over
+}
+
+// HandleProcessEvents updates the tracked proxies from the processes started and exited since the last
+// update, sparing a full rescan of the processes to callers already keeping track of them.
+func (f *Filter) HandleProcessEvents(started []*process.FilledProcess, exitedPids []int32) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	before := len(f.proxyByPID)
+	trace := traceEnabled(f.logger)
+	for _, pid := range exitedPids {
+		delete(f.malformedPIDs, pid)
+		delete(f.notProxies, pid)
+		delete(f.unixSocketProxies, pid)
+		if proxy, ok := f.proxyByPID[pid]; ok && !proxy.static {
+			if trace {
+				f.logger.Tracef("evicting docker-proxy with pid=%d", pid)
+			}
+			f.removeProxy(proxy)
+		}
+	}
+
+	var added []*proxy
+	for _, p := range started {
+		f.evictReusedPID(p)
+		if proxy := f.extractProxy(p); proxy != nil && f.addProxy(proxy) {
+			added = append(added, proxy)
+		}
+	}
+	f.evictExpired(f.now())
+	f.evictLeastRecentlyMatched()
+	f.logLoad(before, added)
+}
+
+// LoadProxiesDelta is HandleProcessEvents for callers diffing process tables: only the added processes are
+// inspected, and the proxies of the removed PIDs are evicted. The added processes may reuse removed PIDs.
+func (f *Filter) LoadProxiesDelta(added map[int32]*process.FilledProcess, removedPids []int32) {
+	started := make([]*process.FilledProcess, 0, len(added))
+	for _, p := range added {
+		started = append(started, p)
+	}
+	f.HandleProcessEvents(started, removedPids)
+}
+
+// evictExpired evicts the proxies that haven't been seen for the TTL, if any, and returns how many were evicted
+func (f *Filter) evictExpired(now time.Time) int {
+	if f.ttl == 0 {
+		return 0
+	}
+
+	evicted := 0
+	for pid, proxy := range f.proxyByPID {
+		if !proxy.static && now.Sub(proxy.lastSeen) > f.ttl {
+			f.logger.Tracef("evicting docker-proxy with pid=%d: not seen since %s", pid, proxy.lastSeen)
+			f.removeProxy(proxy)
+			evicted++
+		}
+	}
+
+	if evicted > 0 {
+		atomic.AddUint64(&f.evictions, uint64(evicted))
+		f.logger.Debugf("evicted %d docker-proxy instances not seen for %s", evicted, f.ttl)
+	}
+	return evicted
+}
+
+// evictLeastRecentlyMatched evicts the least recently matched proxies over the limit set by WithMaxProxies, if
+// any, and returns how many were evicted. The proxies registered through AddProxy are left out.
+func (f *Filter) evictLeastRecentlyMatched() int {
+	if f.maxProxies <= 0 || len(f.proxyByPID) <= f.maxProxies {
+		return 0
+	}
+
+	candidates := make([]*proxy, 0, len(f.proxyByPID))
+	for _, proxy := range f.proxyByPID {
+		if !proxy.static {
+			candidates = append(candidates, proxy)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return atomic.LoadInt64(&candidates[i].lastMatched) < atomic.LoadInt64(&candidates[j].lastMatched)
+	})
+
+	evicted := len(f.proxyByPID) - f.maxProxies
+	if evicted > len(candidates) {
+		evicted = len(candidates)
+	}
+	for _, proxy := range candidates[:evicted] {
+		f.logger.Tracef("evicting docker-proxy with pid=%d: over the limit of %d tracked proxies", proxy.pid, f.maxProxies)
+		f.removeProxy(proxy)
+	}
+
+	atomic.AddUint64(&f.evictions, uint64(evicted))
+	f.maxProxiesOnce.Do(func() {
+		f.logger.Warnf("more than %d docker-proxy instances are running, the least recently matched ones are not tracked "+
+			"and their connections may be reported twice: consider raising the limit of tracked proxies", f.maxProxies)
+	})
+	return evicted
+}
+
+// ExpireStale evicts the proxies that haven't matched any connection for more than maxAge since they were
+// registered, and returns how many were evicted. It bounds the number of proxies tracked by embedders that
+// can't refresh the filter, e.g. when their process source is unavailable. Proxies registered through
+// AddProxy are only removed by RemoveProxy.
+func (f *Filter) ExpireStale(maxAge time.Duration) int {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	now := f.now()
+	evicted := 0
+	for pid, proxy := range f.proxyByPID {
+		lastMatched := time.Unix(0, atomic.LoadInt64(&proxy.lastMatched))
+		if !proxy.static && now.Sub(lastMatched) > maxAge {
+			f.logger.Tracef("evicting docker-proxy with pid=%d: not matched since %s", pid, lastMatched)
+			f.removeProxy(proxy)
+			evicted++
+		}
+	}
+
+	if evicted > 0 {
+		atomic.AddUint64(&f.evictions, uint64(evicted))
+		f.logger.Debugf("evicted %d docker-proxy instances not matched for %s", evicted, maxAge)
+	}
+	return evicted
+}
+
+// AddProxy registers a proxy from authoritative port-mapping information rather than from its cmdline.
+// If proxyIP is known, the connections going through the proxy are filtered without having to discover
+// it from the traffic first. Proxies registered this way override the ones detected from the processes
+// for the same PID and are only removed by RemoveProxy.
+func (f *Filter) AddProxy(pid int32, proxyIP string, target model.Addr) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	if existing, ok := f.proxyByPID[pid]; ok {
+		f.removeProxy(existing)
+	}
+
+	f.addProxy(&proxy{
+		pid:    pid,
+		ip:     canonicalIP(proxyIP),
+		target: canonicalAddr(&target),
+		static: true,
+	})
+	f.evictLeastRecentlyMatched()
+}
+
+// RemoveProxy stops tracking the proxy with the given PID, whether it was detected or registered
+// through AddProxy
+func (f *Filter) RemoveProxy(pid int32) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	if proxy, ok := f.proxyByPID[pid]; ok {
+		f.removeProxy(proxy)
+	}
+}
+
+// Reset stops tracking every proxy, including the ones registered through AddProxy, and forgets the processes known
+// not to be proxies, while keeping the configuration of the filter as well as its counters. It is meant to start over after a Docker daemon
+// restart, the proxies being tracked again by the next refresh.
+func (f *Filter) Reset() {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	f.proxyByTarget = make(map[proxyKey]*proxy)
+	f.proxyByHostAddr = make(map[proxyKey]*proxy)
+	f.proxyByPID = make(map[int32]*proxy)
+	f.malformedPIDs = make(map[int32]time.Time)
+	f.unixSocketProxies = make(map[int32]int64)
+	if f.notProxies != nil {
+		f.notProxies = make(map[int32]int64)
+	}
+}
+
+// Clone returns an independent copy of the filter: the proxies it tracks are copied, so that the copy keeps
+// filtering against the same proxies whatever happens to the filter afterwards, e.g. to filter a whole collection
+// cycle consistently while the filter refreshes. The options are carried over, but the counters of the copy start
+// from zero and its background refresher isn't started.
+func (f *Filter) Clone() *Filter {
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+
+	c := &Filter{
+		proxyByTarget:     make(map[proxyKey]*proxy, len(f.proxyByTarget)),
+		proxyByHostAddr:   make(map[proxyKey]*proxy, len(f.proxyByHostAddr)),
+		proxyByPID:        make(map[int32]*proxy, len(f.proxyByPID)),
+		binaryNames:       f.binaryNames,
+		recognizers:       f.recognizers,
+		exactBinaryPath:   f.exactBinaryPath,
+		logger:            f.logger,
+		mode:              f.mode,
+		markFunc:          f.markFunc,
+		onDrop:            f.onDrop,
+		dropOwned:         f.dropOwned,
+		hostPortMatching:  f.hostPortMatching,
+		dedup:             f.dedup,
+		hostIPsFunc:       f.hostIPsFunc,
+		workers:           f.workers,
+		parallelThreshold: f.parallelThreshold,
+		procRoot:          f.procRoot,
+		now:               f.now,
+		ttl:               f.ttl,
+		maxProxies:        f.maxProxies,
+		source:            f.source,
+		refreshInterval:   f.refreshInterval,
+		malformedPIDs:     make(map[int32]time.Time, len(f.malformedPIDs)),
+		unixSocketProxies: make(map[int32]int64, len(f.unixSocketProxies)),
+	}
+
+	// the proxies are shared by the maps, each of them is copied once
+	copies := make(map[*proxy]*proxy, len(f.proxyByPID))
+	copyOf := func(p *proxy) *proxy {
+		if cp, ok := copies[p]; ok {
+			return cp
+		}
+		cp := &proxy{}
+		*cp = *p
+		cp.lastMatched = atomic.LoadInt64(&p.lastMatched)
+		cp.matched = atomic.LoadUint64(&p.matched)
+		if p.extraTargets != nil {
+			cp.extraTargets = append([]model.Addr(nil), p.extraTargets...)
+		}
+		if p.extraHosts != nil {
+			cp.extraHosts = append([]model.Addr(nil), p.extraHosts...)
+		}
+		copies[p] = cp
+		return cp
+	}
+	for pid, p := range f.proxyByPID {
+		c.proxyByPID[pid] = copyOf(p)
+	}
+	for key, p := range f.proxyByTarget {
+		c.proxyByTarget[key] = copyOf(p)
+	}
+	for key, p := range f.proxyByHostAddr {
+		c.proxyByHostAddr[key] = copyOf(p)
+	}
+
+	if f.hostIPs != nil {
+		c.hostIPs = make(map[string]struct{}, len(f.hostIPs))
+		for ip := range f.hostIPs {
+			c.hostIPs[ip] = struct{}{}
+		}
+	}
+	if f.notProxies != nil {
+		c.notProxies = make(map[int32]int64, len(f.notProxies))
+		for pid, createTime := range f.notProxies {
+			c.notProxies[pid] = createTime
+		}
+	}
+	for pid, t := range f.malformedPIDs {
+		c.malformedPIDs[pid] = t
+	}
+	for pid, createTime := range f.unixSocketProxies {
+		c.unixSocketProxies[pid] = createTime
+	}
+	c.undiscoveredWarned = f.undiscoveredWarned
+	if f.decisions != nil {
+		c.decisions = newDecisionLog(cap(f.decisions.decisions))
+	}
+	c.sampler = f.sampler
+	c.recentErrors = f.RecentErrors()
+	return c
+}
+
+// evictReusedPID evicts the proxy known for the PID of the given process if that PID has since been reused
+// by another process, so that nothing learned about the previous process is trusted anymore.
+// It returns true if a proxy was evicted.
+func (f *Filter) evictReusedPID(p *process.FilledProcess) bool {
+	existing, ok := f.proxyByPID[p.Pid]
+	if !ok || existing.static || existing.createTime == p.CreateTime {
+		return false
+	}
+
+	f.logger.Tracef("evicting docker-proxy with pid=%d: pid was reused (create time %d != %d)", p.Pid, p.CreateTime, existing.createTime)
+	f.removeProxy(existing)
+	return true
+}
+
+// Start runs a background goroutine rescanning the process source every interval (DefaultRefreshInterval
+// if interval isn't positive) to track the docker-proxy instances started and stopped after the filter
+// was created. Calling Start on a started filter is a no-op. Stop must be called to release the goroutine.
+func (f *Filter) Start(interval time.Duration) {
+	f.refreshMux.Lock()
+	defer f.refreshMux.Unlock()
+
+	if f.exit != nil {
+		return
+	}
+
+	if interval <= 0 {
+		interval = DefaultRefreshInterval
+	}
+
+	f.exit = make(chan struct{})
+	f.refreshWG.Add(1)
+	go f.refreshLoop(interval, f.exit)
+}
+
+// Stop stops the background refresher started by Start and waits for it to return
+func (f *Filter) Stop() {
+	f.refreshMux.Lock()
+	defer f.refreshMux.Unlock()
+
+	if f.exit == nil {
+		return
+	}
+
+	close(f.exit)
+	f.refreshWG.Wait()
+	f.exit = nil
+}
+
+func (f *Filter) refreshLoop(interval time.Duration, exit <-chan struct{}) {
+	defer f.refreshWG.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	// an ongoing refresh is given up once the refresher is stopped
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-exit:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	for {
+		select {
+		case <-ticker.C:
+			procs, err := f.source.AllProcesses()
+			if err != nil {
+				f.logger.Warnf("error refreshing proxy filter: %s", err)
+				f.recordError("error refreshing proxy filter: %s", err)
+				f.mux.Lock()
+				f.evictExpired(f.now())
+				f.mux.Unlock()
+				continue
+			}
+			if err := f.RefreshContext(ctx, procs); err != nil {
+				f.logger.Debugf("proxy filter refresh given up: %s", err)
+			}
+		case <-exit:
+			return
+		}
+	}
+}
+
+// extractProxy returns the proxy information of the given process, logging about malformed docker-proxy cmdlines
+// at most once per PID every malformedLogInterval. Processes in the negative cache aren't inspected.
+func (f *Filter) extractProxy(p *process.FilledProcess) *proxy {
+	if createTime, ok := f.notProxies[p.Pid]; ok {
+		if createTime == p.CreateTime {
+			return nil
+		}
+		// the PID was reused
+		delete(f.notProxies, p.Pid)
+	}
+
+	proxy, err := f.extractProxyInfo(p)
+	if proxy == nil && err == nil && f.notProxies != nil {
+		f.notProxies[p.Pid] = p.CreateTime
+	}
+
+	if err == errNoForwardedPort {
+		return nil
+	}
+	if err == errUnixSocketTarget {
+		if createTime, ok := f.unixSocketProxies[p.Pid]; !ok || createTime != p.CreateTime {
+			f.unixSocketProxies[p.Pid] = p.CreateTime
+			f.logger.Debugf("not tracking docker-proxy with pid=%d: it %s, its connections can't be filtered", p.Pid, err)
+		}
+		return nil
+	}
+	// the PID may have been reused
+	delete(f.unixSocketProxies, p.Pid)
+
+	if err != nil {
+		if last, ok := f.malformedPIDs[p.Pid]; !ok || f.now().Sub(last) >= malformedLogInterval {
+			f.malformedPIDs[p.Pid] = f.now()
+			f.logger.Warnf("skipping docker-proxy with pid=%d: %s", p.Pid, err)
+			f.recordError("skipping docker-proxy with pid=%d: %s", p.Pid, err)
+		}
+		return nil
+	}
+
+	if proxy != nil && f.procRoot != "" {
+		if proxy.netns, err = procNetNS(f.procRoot, p.Pid); err != nil {
+			f.logger.Debugf("could not read the netns of docker-proxy with pid=%d: %s", p.Pid, err)
+		}
+	}
+
+	if proxy != nil && proxy.target.Ip == "" {
+		f.degradedOnce.Do(func() {
+			f.logger.Infof("the cmdline of docker-proxy with pid=%d is not readable (hidepid or insufficient permissions?), "+
+				"docker-proxy targets will be detected from their connections instead", p.Pid)
+		})
+	}
+
+	return proxy
+}
+
+// addProxy indexes the given proxy, replacing any proxy previously known for the same PID unless it was
+// registered through AddProxy. The proxy IP discovered for the previous proxy is kept if both forward to the same target.
+// It returns true if no proxy was known for the PID. A proxy detected from the cmdline of a shell or a wrapper
+// isn't added while the proxy it forks is tracked, and is replaced by that proxy once it is.
+func (f *Filter) addProxy(proxy *proxy) bool {
+	if forked := f.forkedProxy(proxy); forked != nil {
+		if proxy.wrapped {
+			if existing, ok := f.proxyByPID[proxy.pid]; ok && !existing.static {
+				f.removeProxy(existing)
+			}
+			return false
+		}
+		f.removeProxy(forked)
+	}
+
+	proxy.lastSeen = f.now()
+	proxy.lastMatched = proxy.lastSeen.UnixNano()
+	existing, replaced := f.proxyByPID[proxy.pid]
+	if replaced {
+		if existing.static {
+			return false
+		}
+		proxy.lastMatched = atomic.LoadInt64(&existing.lastMatched)
+		proxy.matched = atomic.LoadUint64(&existing.matched)
+		if proxy.target.Ip == "" {
+			// the target of a proxy without cmdline is only known once discovered
+			proxy.target, proxy.proto = existing.target, existing.proto
+		}
+		if existing.sameTargets(proxy) && existing.proto == proxy.proto {
+			proxy.ip, proxy.altIP = existing.ip, existing.altIP
+		}
+		if proxy.netns == 0 {
+			proxy.netns = existing.netns
+		}
+		proxy.refreshes = existing.refreshes
+		f.removeProxy(existing)
+	} else {
+		atomic.AddUint64(&f.insertions, 1)
+	}
+
+	if f.procRoot != "" && !proxy.static && proxy.target.Ip != "" && proxy.ip == "" && !isLoopback(proxy.target.Ip) {
+		// the connected sockets are only there while a client is being served, unlike the addresses
+		f.discoverProxyIPFromSockets(proxy)
+		f.discoverProxyIPFromAddrs(proxy)
+	}
+
+	f.proxyByPID[proxy.pid] = proxy
+	f.addTargets(proxy)
+	for _, host := range append([]model.Addr{proxy.host}, proxy.extraHosts...) {
+		if key, ok := newAddrKey(host); ok && host.Port != 0 {
+			f.proxyByHostAddr[proxyKey{addr: key, proto: newProtoKey(proxy.proto)}] = proxy
+		}
+	}
+	return !replaced
+}
+
+// forkedProxy returns the tracked proxy of another PID forwarding to the same targets as the given one if exactly
+// one of them was detected from the cmdline of a shell or a wrapper, which then forks the other one
+func (f *Filter) forkedProxy(proxy *proxy) *proxy {
+	key, ok := newAddrKey(proxy.target)
+	if !ok || proxy.target.Ip == "" {
+		return nil
+	}
+	other, ok := f.proxyByTarget[proxyKey{addr: key, proto: newProtoKey(proxy.proto)}]
+	if !ok || other.pid == proxy.pid || other.static || other.wrapped == proxy.wrapped || !other.sameTargets(proxy) {
+		return nil
+	}
+	return other
+}
+
+// removeProxy removes the given proxy from every index
+func (f *Filter) removeProxy(proxy *proxy) {
+	delete(f.proxyByPID, proxy.pid)
+
+	f.removeTargets(proxy)
+
+	for _, host := range append([]model.Addr{proxy.host}, proxy.extraHosts...) {
+		if key, ok := newAddrKey(host); ok {
+			hostKey := proxyKey{addr: key, proto: newProtoKey(proxy.proto)}
+			if f.proxyByHostAddr[hostKey] == proxy {
+				delete(f.proxyByHostAddr, hostKey)
+			}
+		}
+	}
+}
+
+// addTargets indexes the targets of the given proxy
+func (f *Filter) addTargets(proxy *proxy) {
+	if proxy.target.Ip == "" {
+		return
+	}
+
+	proto := newProtoKey(proxy.proto)
+	for _, target := range append([]model.Addr{proxy.target}, proxy.extraTargets...) {
+		key, ok := newAddrKey(target)
+		if !ok {
+			continue
+		}
+		f.proxyByTarget[proxyKey{addr: key, proto: proto}] = proxy
+		if proxy.netns != 0 {
+			f.proxyByTarget[proxyKey{addr: key, proto: proto, netns: proxy.netns}] = proxy
+		}
+	}
+
+	for _, target := range f.hostPortTargets(proxy) {
+		key, ok := newAddrKey(target)
+		if !ok {
+			continue
+		}
+		for _, k := range []proxyKey{{addr: key, proto: proto}, {addr: key, proto: proto, netns: proxy.netns}} {
+			if _, ok := f.proxyByTarget[k]; !ok {
+				f.proxyByTarget[k] = proxy
+			}
+		}
+	}
+}
+
+// hostPortTargets returns the targets of the given proxy with its host port instead of their port, see
+// WithHostPortMatching, or nil if they aren't indexed
+func (f *Filter) hostPortTargets(proxy *proxy) []model.Addr {
+	if !f.hostPortMatching || proxy.host.Port == 0 {
+		return nil
+	}
+
+	var targets []model.Addr
+	for i, target := range append([]model.Addr{proxy.target}, proxy.extraTargets...) {
+		port := proxy.host.Port
+		if i > 0 && i <= len(proxy.extraHosts) {
+			port = proxy.extraHosts[i-1].Port
+		}
+		if target.Port != port {
+			targets = append(targets, model.Addr{Ip: target.Ip, Port: port})
+		}
+	}
+	return targets
+}
+
+// isTarget returns true if the given address is a target of the given proxy, with the host port of the proxy
+// as well if the filter matches it, see WithHostPortMatching
+func (f *Filter) isTarget(p *proxy, addr model.Addr) bool {
+	if p.hasTarget(addr) {
+		return true
+	}
+	for _, target := range f.hostPortTargets(p) {
+		if addr == target {
+			return true
+		}
+	}
+	return false
+}
+
+// removeTargets removes the targets of a proxy from the index, unless they were since claimed by another proxy
+func (f *Filter) removeTargets(proxy *proxy) {
+	proto := newProtoKey(proxy.proto)
+	for _, target := range append(append([]model.Addr{proxy.target}, proxy.extraTargets...), f.hostPortTargets(proxy)...) {
+		addr, ok := newAddrKey(target)
+		if !ok {
+			continue
+		}
+		for _, key := range []proxyKey{
+			{addr: addr, proto: proto},
+			{addr: addr, proto: proto, netns: proxy.netns},
+		} {
+			if f.proxyByTarget[key] == proxy {
+				delete(f.proxyByTarget, key)
+			}
+		}
+	}
+}
+
+// setNetNS sets the network namespace of the given proxy and indexes its targets in it
+func (f *Filter) setNetNS(p *proxy, netns uint32) {
+	f.removeTargets(p)
+	p.netns = netns
+	f.addTargets(p)
+	f.logger.Debugf("discovered netns=%d for docker-proxy with pid=%d", netns, p.pid)
+}
+
+// Filter all connections that have a docker-proxy at one end, or rewrite the client ones in TranslateMode,
+// or mark them in MarkMode, or merge them in MergeMode. The payload is modified in place and the number of dropped connections
+// (or of marked ones in MarkMode) is returned. The DNS entries only referenced by dropped connections are removed
+// from the payload as well.
+// The remaining connections keep their order in a new slice, the backing array of the original payload.Conns
+// being left untouched, see FilterInPlace to spare that allocation.
+func (f *Filter) Filter(payload *model.Connections) int {
+	n, _ := f.filter(payload, false, false)
+	return n
+}
+
+// FilterInPlace is like Filter but compacts the remaining connections within the backing array of payload.Conns,
+// keeping their order, and clears the rest of it. Callers must not hold on to the original slice.
+func (f *Filter) FilterInPlace(payload *model.Connections) int {
+	n, _ := f.filter(payload, false, true)
+	return n
+}
+
+// FilterWithDropped is like Filter but returns the connections removed from the payload. The returned slice
+// is allocated for this call only, so it can be retained by the caller.
+func (f *Filter) FilterWithDropped(payload *model.Connections) []*model.Connection {
+	_, dropped := f.filter(payload, true, false)
+	return dropped
+}
+
+// FilterAll filters each of the given payloads like Filter and returns the total number of dropped connections
+// (or of marked ones in MarkMode). The proxies are discovered from every payload under the write lock, then the
+// payloads are filtered under the read lock, each lock being acquired once for the whole batch rather than twice
+// per payload. This spares the lock churn of agents filtering several payloads per check run, while the callers
+// only matching connections still run along the filtering.
+func (f *Filter) FilterAll(payloads []*model.Connections) int {
+	var run RunStats
+	peers, ok := f.discoverAll(payloads, &run)
+	if !ok {
+		f.setLastRun(run)
+		return 0
+	}
+
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+
+	total := 0
+	for i, payload := range payloads {
+		n, _ := f.filterLocked(payload, peers[i], false, false, &run)
+		total += n
+	}
+	run.Proxies = uint64(len(f.proxyByPID))
+	f.setLastRun(run)
+	return total
+}
+
+// discoverAll discovers the proxy IPs from each of the given payloads like discoverProxyIPs, returning the loopback
+// peers of each of them. It returns false if there isn't any proxy to filter against, the payloads being kept whole.
+func (f *Filter) discoverAll(payloads []*model.Connections, run *RunStats) ([]loopbackPeers, bool) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	peers := make([]loopbackPeers, len(payloads))
+	for i, payload := range payloads {
+		var ok bool
+		if peers[i], ok = f.discoverProxyIPsLocked(payload, run); !ok {
+			for _, payload := range payloads {
+				f.keepAll(payload, run)
+			}
+			return nil, false
+		}
+	}
+	return peers, true
+}
+
+func (f *Filter) filter(payload *model.Connections, collectDropped, inPlace bool) (int, []*model.Connection) {
+	var run RunStats
+	peers, ok := f.discoverProxyIPs(payload, &run)
+	if !ok {
+		f.keepAll(payload, &run)
+		f.setLastRun(run)
+		return 0, nil
+	}
+
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+
+	n, dropped := f.filterLocked(payload, peers, collectDropped, inPlace, &run)
+	run.Proxies = uint64(len(f.proxyByPID))
+	f.setLastRun(run)
+	return n, dropped
+}
+
+// keepAll accounts for the connections of a payload kept without being looked up, as no proxy is tracked
+func (f *Filter) keepAll(payload *model.Connections, run *RunStats) {
+	atomic.AddUint64(&f.examined, uint64(len(payload.Conns)))
+	atomic.AddUint64(&f.kept, uint64(len(payload.Conns)))
+	run.Examined += uint64(len(payload.Conns))
+}
+
+// setLastRun records the counters of the latest call filtering payloads
+func (f *Filter) setLastRun(run RunStats) {
+	f.lastRunMux.Lock()
+	f.lastRun = run
+	f.lastRunMux.Unlock()
+}
+
+// filterLocked is filter once the proxy IPs and the loopback peers are discovered from the payload, the caller must
+// hold the lock. The counters of the payload are added to the given ones of the run.
+func (f *Filter) filterLocked(payload *model.Connections, peers loopbackPeers, collectDropped, inPlace bool, run *RunStats) (int, []*model.Connection) {
+	var pairs map[*model.Connection]*model.Connection
+	var consumed map[*model.Connection]struct{}
+	if f.mode == MergeMode {
+		pairs, consumed = f.pairLegs(payload.Conns)
+	}
+
+	// the removed connections are also needed to prune the DNS entries
+	collectDropped = collectDropped || len(payload.Dns) > 0
+
+	var removed []*model.Connection
+	var decisions []Decision
+	translated, marked, merged, droppedOwned, mismatches := 0, 0, 0, 0, 0
+	now := f.now().UnixNano()
+	trace := traceEnabled(f.logger)
+	sampler := f.sampler
+	if sampler != nil && !debugEnabled(f.logger) {
+		sampler = nil
+	}
+	original := payload.Conns
+	atomic.AddUint64(&f.lookups, uint64(len(original)))
+	matches := f.matchAll(original, peers)
+	var filtered []*model.Connection
+	if inPlace {
+		// the write index never overtakes the read one
+		filtered = original[:0]
+	} else {
+		filtered = make([]*model.Connection, 0, len(original))
+	}
+	for i, c := range original {
+		var p *proxy
+		var leg leg
+		var mismatch bool
+		if matches != nil {
+			p, leg, mismatch = matches[i].proxy, matches[i].leg, matches[i].ipMismatch
+		} else {
+			p, leg, mismatch = f.matchConn(c, peers)
+		}
+		if mismatch {
+			mismatches++
+			if leg == noLeg && sampler != nil && sampler.sample(c, run) {
+				if p := f.targetProxy(c); p != nil {
+					f.logSampled(newDecision(now, "kept", c, p, leg))
+				}
+			}
+		}
+		if leg != noLeg {
+			atomic.StoreInt64(&p.lastMatched, now)
+			atomic.AddUint64(&p.matched, 1)
+		}
+
+		switch {
+		case leg == noLeg:
+		case f.mode == MarkMode:
+			if f.decisions != nil {
+				decisions = append(decisions, newDecision(now, "marked", c, p, leg))
+			}
+			if f.markFunc != nil {
+				f.markFunc(c, Mark{ProxyPID: p.pid, Target: p.target})
+			}
+			marked++
+		case leg == clientLeg && f.mode == TranslateMode:
+			if f.decisions != nil {
+				decisions = append(decisions, newDecision(now, "translated", c, p, leg))
+			}
+			translate(c, p)
+			translated++
+		case leg == clientLeg && pairs[c] != nil:
+			if f.decisions != nil {
+				decisions = append(decisions, newDecision(now, "merged", c, p, leg))
+			}
+			if collectDropped {
+				removed = append(removed, c)
+			}
+			c = merge(c, pairs[c], p)
+			merged++
+		case isConsumed(consumed, c):
+			// the upstream leg is part of a merged connection, it isn't reported as dropped
+			if f.decisions != nil {
+				decisions = append(decisions, newDecision(now, "merged", c, p, leg))
+			}
+			if collectDropped {
+				removed = append(removed, c)
+			}
+			continue
+		default:
+			sampled := sampler != nil && sampler.sample(c, run)
+			if f.decisions != nil || sampled {
+				d := newDecision(now, "dropped", c, p, leg)
+				if f.decisions != nil {
+					decisions = append(decisions, d)
+				}
+				if sampled {
+					f.logSampled(d)
+				}
+			}
+			if leg == ownedLeg {
+				droppedOwned++
+			}
+			if trace {
+				f.traceDropped(c, p, leg)
+			}
+			if collectDropped {
+				removed = append(removed, c)
+			}
+			if f.onDrop != nil {
+				f.onDrop(c, p.info())
+			}
+			continue
+		}
+
+		filtered = append(filtered, c)
+	}
+
+	deduplicated := 0
+	if f.dedup {
+		filtered, removed, deduplicated = dedup(filtered, removed, collectDropped)
+	}
+
+	if inPlace {
+		// release the dropped connections
+		for i := len(filtered); i < len(original); i++ {
+			original[i] = nil
+		}
+	}
+
+	dropped := len(original) - len(filtered)
+	atomic.AddUint64(&f.examined, uint64(len(original)))
+	atomic.AddUint64(&f.mismatches, uint64(mismatches))
+	atomic.AddUint64(&f.dropped, uint64(dropped))
+	atomic.AddUint64(&f.kept, uint64(len(filtered)))
+	atomic.AddUint64(&f.translated, uint64(translated))
+	atomic.AddUint64(&f.marked, uint64(marked))
+	atomic.AddUint64(&f.merged, uint64(merged))
+	atomic.AddUint64(&f.droppedOwned, uint64(droppedOwned))
+	atomic.AddUint64(&f.deduplicated, uint64(deduplicated))
+	run.Examined += uint64(len(original))
+	run.Dropped += uint64(dropped)
+	run.ProxyIPMismatches += uint64(mismatches)
+
+	if f.decisions != nil {
+		f.decisions.add(decisions)
+	}
+
+	payload.Conns = filtered
+	pruneDNS(payload, removed)
+	if f.mode == MarkMode {
+		return marked, removed
+	}
+	return dropped, removed
+}
+
+// traceDropped logs the given connection dropped as the given leg of the given proxy
+func (f *Filter) traceDropped(c *model.Connection, p *proxy, leg leg) {
+	f.logger.Tracef("dropping %s connection pid=%d %s -> %s, %s of docker-proxy with pid=%d target=%s",
+		connectionProto(c), c.Pid, formatAddr(c.Laddr), formatAddr(c.Raddr), leg, p.pid, formatAddr(&p.target))
+}
+
+// connectionMatch is the proxy a connection goes through and which of its legs it is
+type connectionMatch struct {
+	proxy      *proxy
+	leg        leg
+	ipMismatch bool
+}
+
+// matchAll matches the given connections across the workers of the filter, returning their matches in the same
+// order, or nil if they are too few to be worth it, in which case they are to be matched serially.
+// The caller must hold the lock: the proxies are then only read, as discovery happens before under the write lock.
+func (f *Filter) matchAll(conns []*model.Connection, peers loopbackPeers) []connectionMatch {
+	if f.workers <= 1 || len(conns) < f.parallelThreshold {
+		return nil
+	}
+
+	matches := make([]connectionMatch, len(conns))
+	shardSize := (len(conns) + f.workers - 1) / f.workers
+
+	var wg sync.WaitGroup
+	for start := 0; start < len(conns); start += shardSize {
+		end := start + shardSize
+		if end > len(conns) {
+			end = len(conns)
+		}
+
+		wg.Add(1)
+		go func(start, end int) {
+			defer wg.Done()
+			for i := start; i < end; i++ {
+				matches[i].proxy, matches[i].leg, matches[i].ipMismatch = f.matchConn(conns[i], peers)
+			}
+		}(start, end)
+	}
+	wg.Wait()
+	return matches
+}
+
+// connectionKey identifies a connection by its protocol and addresses
+type connectionKey struct {
+	proto        string
+	laddr, raddr model.Addr
+}
+
+// dedup removes the connections whose key was already seen from the given ones, in place, appending them
+// to removed if collectDropped is set. It returns the remaining connections, removed and the number of duplicates.
+func dedup(conns, removed []*model.Connection, collectDropped bool) ([]*model.Connection, []*model.Connection, int) {
+	seen := make(map[connectionKey]struct{}, len(conns))
+	deduped := conns[:0]
+	for _, c := range conns {
+		if !hasAddrs(c) {
+			deduped = append(deduped, c)
+			continue
+		}
+
+		key := connectionKey{proto: connectionProto(c), laddr: canonicalAddr(c.Laddr), raddr: canonicalAddr(c.Raddr)}
+		if _, ok := seen[key]; ok {
+			if collectDropped {
+				removed = append(removed, c)
+			}
+			continue
+		}
+		seen[key] = struct{}{}
+		deduped = append(deduped, c)
+	}
+	return deduped, removed, len(conns) - len(deduped)
+}
+
+// pruneDNS removes the DNS entries of the remote addresses of the given removed connections,
+// unless they are still referenced by a connection of the payload
+func pruneDNS(payload *model.Connections, removed []*model.Connection) {
+	if len(payload.Dns) == 0 || len(removed) == 0 {
+		return
+	}
+
+	referenced := make(map[string]struct{}, len(payload.Conns))
+	for _, c := range payload.Conns {
+		if c.Raddr != nil {
+			referenced[c.Raddr.Ip] = struct{}{}
+		}
+	}
+
+	for _, c := range removed {
+		if c.Raddr == nil {
+			continue
+		}
+		if _, ok := referenced[c.Raddr.Ip]; !ok {
+			delete(payload.Dns, c.Raddr.Ip)
+		}
+	}
+}
+
+// Stats returns the cumulative counters of the connections examined by the filter, along with the number of
+// proxies it tracks
+func (f *Filter) Stats() Stats {
+	f.mux.RLock()
+	proxies, unixSocketProxies := len(f.proxyByPID), len(f.unixSocketProxies)
+	discovered, undiscovered := 0, 0
+	for _, p := range f.proxyByPID {
+		switch {
+		case isLoopback(p.target.Ip):
+		case p.ip != "":
+			discovered++
+		default:
+			undiscovered++
+		}
+	}
+	f.mux.RUnlock()
+
+	return Stats{
+		Examined:     atomic.LoadUint64(&f.examined),
+		Dropped:      atomic.LoadUint64(&f.dropped),
+		Kept:         atomic.LoadUint64(&f.kept),
+		Translated:   atomic.LoadUint64(&f.translated),
+		Marked:       atomic.LoadUint64(&f.marked),
+		Merged:       atomic.LoadUint64(&f.merged),
+		DroppedOwned: atomic.LoadUint64(&f.droppedOwned),
+		Deduplicated: atomic.LoadUint64(&f.deduplicated),
+
+		Proxies:         uint64(proxies),
+		ProxyInsertions: atomic.LoadUint64(&f.insertions),
+		ProxyEvictions:  atomic.LoadUint64(&f.evictions),
+		ProxyLookups:    atomic.LoadUint64(&f.lookups),
+		Discovered:      uint64(discovered),
+		Undiscovered:    uint64(undiscovered),
+
+		UnixSocketProxies:  uint64(unixSocketProxies),
+		ProxyIPDiscoveries: atomic.LoadUint64(&f.discoveries),
+		ProxyIPMismatches:  atomic.LoadUint64(&f.mismatches),
+	}
+}
+
+// LastRunStats returns the counters of the latest call filtering payloads (Filter, FilterInPlace, FilterWithDropped
+// or FilterAll), or zero counters if none did since the filter was created or its stats were reset.
+// With several goroutines filtering payloads concurrently, it's the call that completed last.
+func (f *Filter) LastRunStats() RunStats {
+	f.lastRunMux.Lock()
+	defer f.lastRunMux.Unlock()
+
+	return f.lastRun
+}
+
+// ResetStats resets the cumulative counters returned by Stats, and the ones of LastRunStats. The number of
+// proxies tracked, and of the ones with a known IP, aren't counters and are unaffected.
+func (f *Filter) ResetStats() {
+	for _, counter := range []*uint64{
+		&f.examined, &f.dropped, &f.kept, &f.translated, &f.marked, &f.merged, &f.droppedOwned, &f.deduplicated,
+		&f.insertions, &f.evictions, &f.lookups, &f.discoveries, &f.mismatches,
+	} {
+		atomic.StoreUint64(counter, 0)
+	}
+	f.setLastRun(RunStats{})
+}
+
+// discoverProxyIPs discovers the IPs of the proxies involved in the given payload, and returns the loopback addresses
+// the proxies connected to their targets from in it. It returns false if there isn't any proxy to filter against.
+func (f *Filter) discoverProxyIPs(payload *model.Connections, run *RunStats) (loopbackPeers, bool) {
+	// discovery mutates the proxies, so we need to hold the write lock
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	return f.discoverProxyIPsLocked(payload, run)
+}
+
+// discoverProxyIPsLocked is discoverProxyIPs without locking, the caller must hold the write lock.
+// The discoveries are added to the given counters of the run.
+func (f *Filter) discoverProxyIPsLocked(payload *model.Connections, run *RunStats) (loopbackPeers, bool) {
+	if len(f.proxyByPID) == 0 {
+		return nil, false
+	}
+
+	// discoveries only ever happen under the write lock
+	before := atomic.LoadUint64(&f.discoveries)
+	defer func() {
+		run.ProxyIPDiscoveries += atomic.LoadUint64(&f.discoveries) - before
+	}()
+
+	var peers loopbackPeers
+	var undiscovered map[*proxy]struct{}
+	for _, c := range payload.Conns {
+		p, ok := f.proxyByPID[c.Pid]
+		if !ok || !hasAddrs(c) {
+			continue
+		}
+
+		if p.netns == 0 && c.NetNS != 0 {
+			f.setNetNS(p, c.NetNS)
+		}
+		f.discoverProxyIP(p, c, &peers)
+		if f.procRoot != "" && p.target.Ip != "" && p.ip == "" && !isLoopback(p.target.Ip) {
+			if undiscovered == nil {
+				undiscovered = make(map[*proxy]struct{})
+			}
+			undiscovered[p] = struct{}{}
+		}
+	}
+
+	// the proxies with connections in the payload are likely connected to their target right now
+	for p := range undiscovered {
+		if p.ip == "" {
+			f.discoverProxyIPFromSockets(p)
+		}
+	}
+
+	return peers, true
+}
+
+// discoverProxyIPFromSockets discovers the IP of a proxy from the sockets it connected to its targets with
+func (f *Filter) discoverProxyIPFromSockets(p *proxy) {
+	sockets, err := procSockets(f.procRoot, p.pid)
+	if err != nil {
+		f.logger.Debugf("could not read the sockets of docker-proxy with pid=%d: %s", p.pid, err)
+		return
+	}
+
+	for _, s := range sockets {
+		if proxyIP := p.ipFor(s.raddr); f.isTarget(p, s.raddr) && *proxyIP == "" && !isLoopback(s.laddr.Ip) && s.laddr.Ip != s.raddr.Ip {
+			*proxyIP = s.laddr.Ip
+			atomic.AddUint64(&f.discoveries, 1)
+			f.logger.Debugf("discovered proxy ip=%s for docker-proxy with pid=%d from its sockets", s.laddr.Ip, p.pid)
+		}
+	}
+}
+
+// discoverProxyIPFromAddrs discovers the IPs of a proxy still unknown from the addresses of its network namespace,
+// as the proxy connects to a target from its address on the subnet of the target, e.g. the IP of the docker0 bridge
+func (f *Filter) discoverProxyIPFromAddrs(p *proxy) {
+	addrs, err := procLocalAddrs(f.procRoot, p.pid)
+	if err != nil {
+		f.logger.Debugf("could not read the addresses of docker-proxy with pid=%d: %s", p.pid, err)
+		return
+	}
+
+	for _, target := range append([]model.Addr{p.target}, p.extraTargets...) {
+		proxyIP := p.ipFor(target)
+		if *proxyIP != "" {
+			continue
+		}
+		if ip := sourceIP(addrs, target.Ip); ip != "" {
+			*proxyIP = ip
+			atomic.AddUint64(&f.discoveries, 1)
+			f.logger.Debugf("discovered proxy ip=%s for docker-proxy with pid=%d from its addresses", ip, p.pid)
+		}
+	}
+}
+
+// sourceIP returns the address the given target IP is reached from, which is the one of the most specific
+// subnet holding the target, or an empty string if the target isn't on any subnet of the addresses
+func sourceIP(addrs []localAddr, targetIP string) string {
+	target := net.ParseIP(targetIP)
+	if target == nil || target.IsLoopback() {
+		return ""
+	}
+
+	var best *localAddr
+	for i, addr := range addrs {
+		if addr.subnet.Contains(target) && !addr.ip.Equal(target) && (best == nil || prefixLen(addr.subnet) > prefixLen(best.subnet)) {
+			best = &addrs[i]
+		}
+	}
+	if best == nil {
+		return ""
+	}
+	return canonicalIP(best.ip.String())
+}
+
+// prefixLen returns the prefix length of the given subnet
+func prefixLen(subnet *net.IPNet) int {
+	ones, _ := subnet.Mask.Size()
+	return ones
+}
+
+// discoverProxyIP discovers the IP of a proxy from a connection it established towards one of its targets, the
+// loopback addresses it connected from being added to the given peers instead
+func (f *Filter) discoverProxyIP(p *proxy, c *model.Connection, peers *loopbackPeers) {
+	if p.target.Ip == "" {
+		f.discoverProxyTarget(p, c)
+		return
+	}
+
+	// the connection accepted by the docker-proxy listener has the host address as local address
+	if !p.forwards(c) || !mayBe(c, model.ConnectionDirection_outgoing) {
+		return
+	}
+
+	// Match connection matching the following pattern, both the IP and the port of one of the targets must match:
+	// proxy_ip:random_port -> target_ip:target_port
+	target := canonicalAddr(c.Raddr)
+	if !f.isTarget(p, target) {
+		return
+	}
+
+	ip, proxyIP := canonicalIP(c.Laddr.Ip), p.ipFor(target)
+	if isLoopback(ip) {
+		// every local process shares the loopback IPs, which are never learned as proxy IPs
+		peers.add(model.Addr{Ip: ip, Port: c.Laddr.Port}, p)
+		return
+	}
+	if ip == target.Ip {
+		// hairpin connection of the container to its own published port
+		return
+	}
+
+	switch {
+	case *proxyIP == "":
+		*proxyIP = ip
+		atomic.AddUint64(&f.discoveries, 1)
+		f.logger.Debugf("discovered proxy ip=%s for docker-proxy with pid=%d", ip, p.pid)
+	case *proxyIP != ip && !p.ipConflictLogged:
+		// the first discovered IP is kept
+		p.ipConflictLogged = true
+		f.logger.Warnf("docker-proxy with pid=%d connected to %s:%d from ip=%s, keeping the previously discovered proxy ip=%s",
+			p.pid, target.Ip, target.Port, ip, *proxyIP)
+	}
+}
+
+// discoverProxyTarget discovers the target of a proxy detected without its cmdline, from the connection
+// it established towards the container: proxy_ip:random_port -> target_ip:target_port
+func (f *Filter) discoverProxyTarget(p *proxy, c *model.Connection) {
+	// hairpin connections of a container to its own published port have the container IP at both ends
+	if c.Direction != model.ConnectionDirection_outgoing || canonicalIP(c.Laddr.Ip) == canonicalIP(c.Raddr.Ip) {
+		return
+	}
+
+	p.target = canonicalAddr(c.Raddr)
+	p.proto = connectionProto(c)
+	p.ip = canonicalIP(c.Laddr.Ip)
+	f.addTargets(p)
+	atomic.AddUint64(&f.discoveries, 1)
+
+	f.logger.Debugf("discovered target ip=%s port=%d and proxy ip=%s for docker-proxy with pid=%d", p.target.Ip, p.target.Port, p.ip, p.pid)
+}
+
+// IsProxied returns true if the given connection goes through a docker-proxy instance, without
+// modifying any payload nor learning anything from the connection but the proxy being in use, see ExpireStale.
+// A connection is considered proxied if either of its ends is a docker-proxy socket:
+//   - its local address is the address a docker-proxy listens on, it is owned by that docker-proxy and
+//     it is incoming (client -> docker-proxy leg, as seen by docker-proxy)
+//   - its local address is a docker-proxy target, its remote address is the proxy IP and it is incoming
+//     (docker-proxy -> container leg, as seen by the container)
+//   - its remote address is a docker-proxy target, it is owned by that docker-proxy and it is outgoing
+//     (docker-proxy -> container leg, as seen by docker-proxy)
+//
+// Connections whose direction is unknown (e.g. UDP ones) match whatever the expected direction. Those
+// are also matched in the last case if their local address is the proxy IP, whichever process owns them.
+// The proxy IPs are only known once discovered by Filter, so the second case never matches before that unless
+// the filter was given the host IPs, see WithHostIPs.
+//
+// A docker-proxy given a specific host IP (e.g. -host-ip 127.0.0.1) only listens on that IP. One given a wildcard
+// host IP (0.0.0.0, ::, or no -host-ip at all) listens on every interface, so the first case matches whichever
+// local IP the connection was accepted on, the IPv6 wildcard also matching IPv4 clients. If the host IPs are
+// known, wildcard bindings only match them and the loopback IPs. Whatever the host binding, the proxy IP is the
+// address docker-proxy connects to its targets from and never is a loopback IP, as every local process shares
+// those: the connections from a loopback address only match the second case while the proxy holds that address.
+//
+// A connection carrying an IP translation (e.g. one to a service IP DNATed to a container) that matches none of
+// these cases is matched against the targets again with its translated addresses.
+func (f *Filter) IsProxied(c *model.Connection) bool {
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+
+	return f.isProxied(c)
+}
+
+// isProxied is IsProxied without locking, the caller must hold the lock
+func (f *Filter) isProxied(c *model.Connection) bool {
+	atomic.AddUint64(&f.lookups, 1)
+	p, leg := f.match(c)
+	if leg == noLeg {
+		return false
+	}
+
+	atomic.StoreInt64(&p.lastMatched, f.now().UnixNano())
+	atomic.AddUint64(&p.matched, 1)
+	return true
+}
+
+// match returns the docker-proxy the given connection goes through and which of its legs it is, see IsProxied
+func (f *Filter) match(c *model.Connection) (*proxy, leg) {
+	p, leg, _ := f.matchConn(c, nil)
+	return p, leg
+}
+
+// matchConn is match, also returning true if the connection has a target of a proxy at one end but another IP
+// than the proxy one at the other end. A connection whose addresses don't match is matched again against the
+// targets through its IP translation if it has one, see translatedAddrs.
+func (f *Filter) matchConn(c *model.Connection, peers loopbackPeers) (*proxy, leg, bool) {
+	if !hasAddrs(c) {
+		// malformed connection
+		return nil, noLeg, false
+	}
+
+	p, leg, mismatch := f.matchAddrs(c, canonicalAddr(c.Laddr), canonicalAddr(c.Raddr), peers)
+	if leg != noLeg {
+		return p, leg, false
+	}
+
+	if laddr, raddr, ok := translatedAddrs(c); ok {
+		// only the targets are looked up, the published addresses being the ones NAT translates from
+		if p, leg, _ := f.matchAddrs(c, laddr, raddr, peers); leg == targetLeg {
+			return p, leg, false
+		}
+	}
+
+	p, leg = f.matchOwned(c)
+	return p, leg, mismatch
+}
+
+// matchAddrs matches the given connection as if it had the given canonical addresses, see matchConn
+func (f *Filter) matchAddrs(c *model.Connection, laddr, raddr model.Addr, peers loopbackPeers) (*proxy, leg, bool) {
+	proto := newProtoKey(connectionProto(c))
+	lkey, lok := newAddrKey(laddr)
+	rkey, rok := newAddrKey(raddr)
+	if !lok || !rok {
+		// the addresses whose IP is invalid can't match any proxy
+		return nil, noLeg, false
+	}
+
+	// client -> host_ip:host_port, as seen by the docker-proxy listener
+	if p, ok := f.lookupHostAddr(laddr, lkey, proto); ok && p.pid == c.Pid && mayBe(c, model.ConnectionDirection_incoming) {
+		return p, clientLeg, false
+	}
+
+	mismatch := false
+	// the container end of the connection isn't in the namespace of the proxy
+	if p, ok := f.lookup(f.proxyByTarget, lkey, proto, 0); ok {
+		if !f.fromProxyIP(p, laddr, raddr, peers) {
+			mismatch = true
+		} else if mayBe(c, model.ConnectionDirection_incoming) {
+			return p, targetLeg, false
+		}
+	} else if p, ok := f.lookupTarget(rkey, proto, c.NetNS); ok && mayBe(c, model.ConnectionDirection_outgoing) {
+		// proxy_ip:random_port -> target_ip:target_port, which can be matched through the PID
+		// even if the proxy IP hasn't been discovered yet. Without a direction to tell the proxy's
+		// connections apart, any connection from the proxy IP is matched.
+		if p.pid == c.Pid {
+			return p, targetLeg, false
+		}
+		if !hasDirection(c) {
+			if f.fromProxyIP(p, raddr, laddr, peers) {
+				return p, targetLeg, false
+			}
+			mismatch = true
+		}
+	}
+
+	return nil, noLeg, mismatch
+}
+
+// translatedAddrs returns the canonical local and remote addresses of the given connection once NAT translated,
+// e.g. the container a connection to a service IP was forwarded to. Conntrack stores them as the reply tuple,
+// whose source is the translated remote end and whose destination the translated local end. It returns false if
+// the connection has no IP translation, as in the payloads of older system-probes, or one that changes nothing.
+func translatedAddrs(c *model.Connection) (model.Addr, model.Addr, bool) {
+	t := c.IpTranslation
+	if t == nil || t.ReplSrcIP == "" || t.ReplDstIP == "" {
+		return model.Addr{}, model.Addr{}, false
+	}
+
+	laddr := canonicalAddr(&model.Addr{Ip: t.ReplDstIP, Port: t.ReplDstPort})
+	raddr := canonicalAddr(&model.Addr{Ip: t.ReplSrcIP, Port: t.ReplSrcPort})
+	if laddr == canonicalAddr(c.Laddr) && raddr == canonicalAddr(c.Raddr) {
+		return model.Addr{}, model.Addr{}, false
+	}
+	return laddr, raddr, true
+}
+
+// targetProxy returns the proxy having a target at either end of the given connection, nil if there is none,
+// whatever the IP at its other end
+func (f *Filter) targetProxy(c *model.Connection) *proxy {
+	proto := newProtoKey(connectionProto(c))
+	if key, ok := newAddrKey(canonicalAddr(c.Laddr)); ok {
+		if p, ok := f.lookup(f.proxyByTarget, key, proto, 0); ok {
+			return p
+		}
+	}
+	if key, ok := newAddrKey(canonicalAddr(c.Raddr)); ok {
+		if p, ok := f.lookupTarget(key, proto, c.NetNS); ok {
+			return p
+		}
+	}
+	return nil
+}
+
+// matchOwned matches the connections of the proxies, see WithDropProxyOwned
+func (f *Filter) matchOwned(c *model.Connection) (*proxy, leg) {
+	if p, ok := f.proxyByPID[c.Pid]; ok && f.dropOwned {
+		return p, ownedLeg
+	}
+
+	return nil, noLeg
+}
+
+// fromProxyIP returns true if the given peer address, connected to the given target of the proxy, has the proxy IP.
+// Any of the host IPs is accepted as long as the proxy IP towards the target hasn't been discovered. Loopback
+// peers must be one of the given addresses the proxy connected to its targets from in the payload.
+func (f *Filter) fromProxyIP(p *proxy, target, peer model.Addr, peers loopbackPeers) bool {
+	if isLoopback(peer.Ip) {
+		return peers[peer] == p
+	}
+
+	if proxyIP := *p.ipFor(target); proxyIP != "" {
+		return peer.Ip == proxyIP
+	}
+	_, ok := f.hostIPs[peer.Ip]
+	return ok
+}
+
+// loopbackPeers maps the loopback addresses the proxies connected to their targets from in a payload to those
+// proxies, as loopback IPs can't identify a proxy by themselves. It is discovered from each payload along with the
+// proxy IPs, and nil if the proxies didn't connect from any loopback address.
+type loopbackPeers map[model.Addr]*proxy
+
+// add records that the given proxy connected to one of its targets from the given loopback address
+func (peers *loopbackPeers) add(addr model.Addr, p *proxy) {
+	if *peers == nil {
+		*peers = make(loopbackPeers)
+	}
+	(*peers)[addr] = p
+}
+
+// legPair holds the legs of a proxy towards one of its targets within a payload, see pairLegs
+type legPair struct {
+	clients   []*model.Connection
+	upstreams []*model.Connection
+}
+
+// legPairKey identifies the connections of a proxy towards one of its targets
+type legPairKey struct {
+	proxy  *proxy
+	target model.Addr
+}
+
+// pairLegs pairs the client -> docker-proxy connections of a payload with the docker-proxy -> container ones,
+// as seen by the proxies, on the proxy and the target they go to. The client legs are returned along with the
+// upstream leg they are paired with, and the paired upstream legs in a set. A pairing is ambiguous if several
+// client or upstream legs go through the same proxy to the same target, those legs are left unpaired.
+func (f *Filter) pairLegs(conns []*model.Connection) (map[*model.Connection]*model.Connection, map[*model.Connection]struct{}) {
+	legs := make(map[legPairKey]*legPair)
+	add := func(key legPairKey) *legPair {
+		pair := legs[key]
+		if pair == nil {
+			pair = &legPair{}
+			legs[key] = pair
+		}
+		return pair
+	}
+	for _, c := range conns {
+		p, leg := f.match(c)
+		switch {
+		case leg == clientLeg:
+			pair := add(legPairKey{proxy: p, target: p.targetFor(canonicalAddr(c.Laddr))})
+			pair.clients = append(pair.clients, c)
+		case leg == targetLeg && c.Pid == p.pid && f.isTarget(p, canonicalAddr(c.Raddr)):
+			pair := add(legPairKey{proxy: p, target: canonicalAddr(c.Raddr)})
+			pair.upstreams = append(pair.upstreams, c)
+		}
+	}
+
+	pairs := make(map[*model.Connection]*model.Connection)
+	consumed := make(map[*model.Connection]struct{})
+	for _, pair := range legs {
+		if len(pair.clients) == 1 && len(pair.upstreams) == 1 {
+			pairs[pair.clients[0]] = pair.upstreams[0]
+			consumed[pair.upstreams[0]] = struct{}{}
+		}
+	}
+	return pairs, consumed
+}
+
+// isConsumed returns true if the given connection is an upstream leg paired by pairLegs
+func isConsumed(consumed map[*model.Connection]struct{}, c *model.Connection) bool {
+	_, ok := consumed[c]
+	return ok
+}
+
+// merge returns a client -> container connection standing for the given client leg of a docker-proxy and
+// its upstream leg. Its counters are the sum of the ones of both legs, except for the retransmits
+// which are the client leg ones.
+func merge(client, upstream *model.Connection, p *proxy) *model.Connection {
+	merged := *client
+	translate(&merged, p)
+	merged.LastBytesSent += upstream.LastBytesSent
+	merged.LastBytesReceived += upstream.LastBytesReceived
+	merged.TotalBytesSent += upstream.TotalBytesSent
+	merged.TotalBytesReceived += upstream.TotalBytesReceived
+	return &merged
+}
+
+// translate rewrites the local address of a client leg to the container target the docker-proxy forwards it to.
+// Its IP translation holds the client as the source of the reply tuple, and the published address the client
+// connected to as its destination.
+func translate(c *model.Connection, p *proxy) {
+	c.IpTranslation = &model.IPTranslation{
+		ReplSrcIP:   c.Raddr.Ip,
+		ReplSrcPort: c.Raddr.Port,
+		ReplDstIP:   c.Laddr.Ip,
+		ReplDstPort: c.Laddr.Port,
+	}
+	target := p.targetFor(canonicalAddr(c.Laddr))
+	c.Laddr = &model.Addr{Ip: target.Ip, Port: target.Port}
+}
+
+// lookupHostAddr returns the proxy listening on the given address, whose key is given as well, taking wildcard
+// bindings into account. If the addresses of the host are known, wildcard bindings only match them.
+func (f *Filter) lookupHostAddr(addr model.Addr, key addrKey, proto protoKey) (*proxy, bool) {
+	if p, ok := f.lookup(f.proxyByHostAddr, key, proto, 0); ok {
+		return p, true
+	}
+
+	if _, ok := f.hostIPs[addr.Ip]; f.hostIPs != nil && !ok && !isLoopback(addr.Ip) {
+		return nil, false
+	}
+
+	// an IPv4 client may also reach a docker-proxy listening on the IPv6 wildcard address
+	wildcards := wildcardKeyIPs
+	if strings.Contains(addr.Ip, ":") {
+		wildcards = wildcardKeyIPs[1:]
+	}
+
+	for _, ip := range wildcards {
+		if p, ok := f.lookup(f.proxyByHostAddr, addrKey{ip: ip, port: key.port}, proto, 0); ok {
+			return p, true
+		}
+	}
+
+	return nil, false
+}
+
+// lookupTarget returns the proxy forwarding to the given target in the given network namespace, 0 if unknown.
+// Proxies whose namespace is unknown match connections of any namespace.
+func (f *Filter) lookupTarget(addr addrKey, proto protoKey, netns uint32) (*proxy, bool) {
+	if netns != 0 {
+		if p, ok := f.lookup(f.proxyByTarget, addr, proto, netns); ok {
+			return p, true
+		}
+	}
+
+	p, ok := f.lookup(f.proxyByTarget, addr, proto, 0)
+	if ok && netns != 0 && p.netns != 0 && p.netns != netns {
+		// the same address in another namespace
+		return nil, false
+	}
+	return p, ok
+}
+
+// lookup returns the proxy indexed by the given address, preferring proxies forwarding
+// the given protocol over the ones for which the protocol is unknown
+func (f *Filter) lookup(index map[proxyKey]*proxy, addr addrKey, proto protoKey, netns uint32) (*proxy, bool) {
+	if proto != anyProto {
+		if p, ok := index[proxyKey{addr: addr, proto: proto, netns: netns}]; ok {
+			return p, true
+		}
+	}
+
+	p, ok := index[proxyKey{addr: addr, netns: netns}]
+	return p, ok
+}
+
+// targetFor returns the target the proxy forwards the connections accepted on the given canonical host address to
+func (p *proxy) targetFor(host model.Addr) model.Addr {
+	for i, extraHost := range p.extraHosts {
+		if extraHost.Port == host.Port && (extraHost.Ip == host.Ip || containsString(wildcardIPs, extraHost.Ip)) {
+			return p.extraTargets[i]
+		}
+	}
+	return p.target
+}
+
+// hasTarget returns true if the given address is one of the targets of the proxy
+func (p *proxy) hasTarget(addr model.Addr) bool {
+	if addr == p.target {
+		return true
+	}
+	for _, target := range p.extraTargets {
+		if addr == target {
+			return true
+		}
+	}
+	return false
+}
+
+// sameTargets returns true if both proxies forward to the same targets
+func (p *proxy) sameTargets(other *proxy) bool {
+	if p.target != other.target || len(p.extraTargets) != len(other.extraTargets) {
+		return false
+	}
+	for i, target := range p.extraTargets {
+		if other.extraTargets[i] != target {
+			return false
+		}
+	}
+	return true
+}
+
+// ipFor returns the proxy IP towards the given target, as the proxy connects to targets of another address family
+// than the first one from another IP
+func (p *proxy) ipFor(target model.Addr) *string {
+	if isIPv6(target.Ip) != isIPv6(p.target.Ip) {
+		return &p.altIP
+	}
+	return &p.ip
+}
+
+// forwards returns true if the proxy may forward traffic of the connection's protocol
+func (p *proxy) forwards(c *model.Connection) bool {
+	return p.proto == "" || p.proto == connectionProto(c)
+}
+
+// hasAddrs returns true if both addresses of the connection are set
+func hasAddrs(c *model.Connection) bool {
+	return c.Laddr != nil && c.Raddr != nil
+}
+
+// hasDirection returns true if the direction of the connection is known to be either incoming or outgoing
+func hasDirection(c *model.Connection) bool {
+	return c.Direction == model.ConnectionDirection_incoming || c.Direction == model.ConnectionDirection_outgoing
+}
+
+// mayBe returns true if the connection may have been established in the given direction,
+// which is always the case of the connections whose direction is unknown
+func mayBe(c *model.Connection, direction model.ConnectionDirection) bool {
+	return !hasDirection(c) || c.Direction == direction
+}
+
+// newProtoKey returns the key of the given protocol
+func newProtoKey(proto string) protoKey {
+	switch proto {
+	case "":
+		return anyProto
+	case "tcp":
+		return tcpProto
+	case "udp":
+		return udpProto
+	default:
+		return otherProto
+	}
+}
+
+func connectionProto(c *model.Connection) string {
+	switch c.Type {
+	case model.ConnectionType_tcp:
+		return "tcp"
+	case model.ConnectionType_udp:
+		return "udp"
+	default:
+		return ""
+	}
+}
+
+// normalizeIP returns the canonical textual representation of the given IP, or an empty string if it
+// isn't a valid address. IPv6 literals may be enclosed in brackets, IPv4-mapped IPv6 addresses are
+// represented in their dotted-quad form, and leading zeros of IPv4 octets are interpreted as decimal.
+func normalizeIP(ip string) string {
+	if strings.HasPrefix(ip, "[") && strings.HasSuffix(ip, "]") {
+		ip = ip[1 : len(ip)-1]
+	}
+
+	if strings.Count(ip, ".") == 3 && !strings.Contains(ip, ":") {
+		octets := strings.Split(ip, ".")
+		for i, o := range octets {
+			if len(o) > 1 {
+				octets[i] = strings.TrimLeft(o, "0")
+				if octets[i] == "" {
+					octets[i] = "0"
+				}
+			}
+		}
+		ip = strings.Join(octets, ".")
+	}
+
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ""
+	}
+
+	return parsed.String()
+}
+
+// canonicalIP normalizes an IP coming from a connection, leaving it untouched if it can't be parsed
+func canonicalIP(ip string) string {
+	// connection addresses are overwhelmingly canonical IPv4 addresses already, spare the allocations
+	// of their normalization
+	if isCanonicalIPv4(ip) {
+		return ip
+	}
+
+	if normalized := normalizeIP(ip); normalized != "" {
+		return normalized
+	}
+	return ip
+}
+
+// isCanonicalIPv4 returns true if the given string is a dotted-decimal IPv4 address without leading zeros
+func isCanonicalIPv4(ip string) bool {
+	octets, value, digits := 0, 0, 0
+	for i := 0; i < len(ip); i++ {
+		switch c := ip[i]; {
+		case c >= '0' && c <= '9':
+			if digits > 0 && value == 0 {
+				// leading zero
+				return false
+			}
+			value = value*10 + int(c-'0')
+			digits++
+			if value > 255 {
+				return false
+			}
+		case c == '.' && digits > 0:
+			octets++
+			value, digits = 0, 0
+		default:
+			return false
+		}
+	}
+	return octets == 3 && digits > 0
+}
+
+// isLoopback returns true if the given canonical IP is a loopback address
+func isLoopback(ip string) bool {
+	return strings.HasPrefix(ip, "127.") || ip == "::1"
+}
+
+// isIPv6 returns true if the given canonical IP is an IPv6 address
+func isIPv6(ip string) bool {
+	return strings.Contains(ip, ":")
+}
+
+// newAddrKey returns the key of the given address, or false if its IP is invalid
+func newAddrKey(addr model.Addr) (addrKey, bool) {
+	key := addrKey{port: addr.Port}
+	// spare the allocations of net.ParseIP for the IPv4 addresses
+	if parseIPv4(addr.Ip, &key.ip) {
+		return key, true
+	}
+
+	ip := net.ParseIP(addr.Ip)
+	if ip == nil {
+		return addrKey{}, false
+	}
+	copy(key.ip[:], ip.To16())
+	return key, true
+}
+
+// parseIPv4 parses the given dotted-decimal IPv4 address into its IPv4-mapped IPv6 form, returning false
+// if it isn't one
+func parseIPv4(s string, ip *[net.IPv6len]byte) bool {
+	octet, value, digits := 0, 0, 0
+	for i := 0; i <= len(s); i++ {
+		if i == len(s) || s[i] == '.' {
+			if digits == 0 || octet == net.IPv4len {
+				return false
+			}
+			ip[12+octet] = byte(value)
+			octet, value, digits = octet+1, 0, 0
+			continue
+		}
+
+		if s[i] < '0' || s[i] > '9' || digits == 3 {
+			return false
+		}
+		value = value*10 + int(s[i]-'0')
+		if value > 255 {
+			return false
+		}
+		digits++
+	}
+	if octet != net.IPv4len {
+		return false
+	}
+
+	ip[10], ip[11] = 0xff, 0xff
+	return true
+}
+
+// formatAddr formats the given address as ip:port, or [ip]:port for IPv6 ones
+func formatAddr(addr *model.Addr) string {
+	return net.JoinHostPort(addr.Ip, strconv.Itoa(int(addr.Port)))
+}
+
+func canonicalAddr(addr *model.Addr) model.Addr {
+	return model.Addr{Ip: canonicalIP(addr.Ip), Port: addr.Port}
+}
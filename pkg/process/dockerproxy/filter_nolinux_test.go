@@ -0,0 +1,25 @@
+// +build !linux
+
+package dockerproxy
+
+import (
+	"testing"
+
+	"github.com/DataDog/gopsutil/process"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewFilterUnsupportedPlatform(t *testing.T) {
+	source := &fakeProcessSource{procs: map[int32]*process.FilledProcess{
+		1: {Pid: 1, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-port", "8080", "-container-ip", "172.17.0.2", "-container-port", "80"}},
+	}}
+
+	f, err := NewFilterWithError(source, WithActiveDiscovery("/proc"))
+	assert.Equal(t, ErrUnsupportedPlatform, err)
+	// the filter works without active discovery
+	assert.Equal(t, "", f.procRoot)
+	assert.Len(t, f.proxyByPID, 1)
+
+	_, err = procSockets("/proc", 1)
+	assert.Equal(t, ErrUnsupportedPlatform, err)
+}
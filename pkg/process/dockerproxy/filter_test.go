@@ -0,0 +1,3171 @@
+package dockerproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	model "github.com/DataDog/agent-payload/process"
+	"github.com/DataDog/gopsutil/process"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExtractProxyInfo(t *testing.T) {
+	for _, tc := range []struct {
+		cmdline  []string
+		expected *proxy
+	}{
+		{
+			cmdline:  []string{"docker-proxy", "-proto", "tcp", "-host-ip", "0.0.0.0", "-host-port", "8080", "-container-ip", "172.17.0.2", "-container-port", "80"},
+			expected: &proxy{pid: 1, proto: "tcp", host: model.Addr{Ip: "0.0.0.0", Port: 8080}, target: model.Addr{Ip: "172.17.0.2", Port: 80}},
+		},
+		{
+			cmdline:  []string{"/usr/bin/docker-proxy", "-proto", "tcp", "-host-ip", "10.0.0.5", "-host-port", "8080", "-container-ip", "172.17.0.2", "-container-port", "80"},
+			expected: &proxy{pid: 1, proto: "tcp", host: model.Addr{Ip: "10.0.0.5", Port: 8080}, target: model.Addr{Ip: "172.17.0.2", Port: 80}},
+		},
+		{
+			cmdline:  []string{"/usr/bin/docker-proxy", "-container-ip", "172.17.0.3", "-container-port", "443", "-proto", "tcp"},
+			expected: &proxy{pid: 1, proto: "tcp", host: model.Addr{Ip: "0.0.0.0"}, target: model.Addr{Ip: "172.17.0.3", Port: 443}},
+		},
+		{
+			cmdline:  []string{"docker-proxy.exe", "-container-ip", "172.17.0.2", "-container-port", "80"},
+			expected: &proxy{pid: 1, host: model.Addr{Ip: "0.0.0.0"}, target: model.Addr{Ip: "172.17.0.2", Port: 80}},
+		},
+		{
+			// run by a shell or a wrapper, see unwrapCmdline
+			cmdline:  []string{"/bin/sh", "-c", "exec /usr/bin/docker-proxy -proto tcp -host-port 8080 -container-ip 172.17.0.2 -container-port 80"},
+			expected: &proxy{pid: 1, proto: "tcp", host: model.Addr{Ip: "0.0.0.0", Port: 8080}, target: model.Addr{Ip: "172.17.0.2", Port: 80}, wrapped: true},
+		},
+		{
+			cmdline:  []string{"bash", "-c", "sleep 1 && docker-proxy -proto tcp -host-port 8080 -container-ip 172.17.0.2 -container-port 80"},
+			expected: &proxy{pid: 1, proto: "tcp", host: model.Addr{Ip: "0.0.0.0", Port: 8080}, target: model.Addr{Ip: "172.17.0.2", Port: 80}, wrapped: true},
+		},
+		{
+			cmdline:  []string{"env", "DEBUG=1", "rootlesskit-docker-proxy", "-proto", "tcp", "-host-port", "8080", "-container-ip", "172.17.0.2", "-container-port", "80"},
+			expected: &proxy{pid: 1, proto: "tcp", host: model.Addr{Ip: "0.0.0.0", Port: 8080}, target: model.Addr{Ip: "172.17.0.2", Port: 80}, wrapped: true},
+		},
+		{
+			cmdline:  []string{"/usr/bin/dockerd", "-container-ip", "172.17.0.2", "-container-port", "80"},
+			expected: nil,
+		},
+		{
+			cmdline:  []string{"docker-proxy", "-host-port", "8080", "-container-ip", "172.17.0.2"},
+			expected: nil,
+		},
+		{
+			cmdline:  []string{"docker-proxy", "-host-port", "8080", "-container-port", "80"},
+			expected: nil,
+		},
+		{
+			cmdline:  []string{"docker-proxy", "-container-ip", "172.17.0.2", "-container-port", "0"},
+			expected: nil,
+		},
+		{
+			cmdline:  []string{},
+			expected: nil,
+		},
+	} {
+		p := &process.FilledProcess{Pid: 1, Cmdline: tc.cmdline}
+		proxy, err := newFilter().extractProxyInfo(p)
+		assert.NoError(t, err)
+		assert.Equal(t, tc.expected, proxy, "cmdline: %v", tc.cmdline)
+	}
+}
+
+func TestExtractProxyInfoBinaryVariants(t *testing.T) {
+	for _, tc := range []struct {
+		exe     string
+		argv0   string
+		isProxy bool
+	}{
+		{exe: "/usr/bin/docker-proxy", argv0: "/usr/bin/docker-proxy", isProxy: true},
+		{exe: "/usr/libexec/docker/docker-proxy-current", argv0: "/usr/libexec/docker/docker-proxy-current", isProxy: true},
+		{exe: "/usr/bin/balena-engine-proxy", argv0: "balena-engine-proxy", isProxy: true},
+		{exe: "/usr/bin/rootlesskit-docker-proxy", argv0: "rootlesskit-docker-proxy", isProxy: true},
+		// symlinked binary: argv[0] differs from the resolved executable path
+		{exe: "/usr/libexec/docker/docker-proxy-current", argv0: "/usr/local/bin/dp", isProxy: true},
+		// exe can't be resolved (e.g. insufficient permissions)
+		{exe: "", argv0: "/usr/bin/docker-proxy", isProxy: true},
+		{exe: "/usr/bin/dockerd", argv0: "/usr/bin/dockerd", isProxy: false},
+		{exe: "/usr/bin/docker-proxy/nginx", argv0: "nginx", isProxy: false},
+		// unrelated binaries whose name merely ends with docker-proxy
+		{exe: "/usr/local/bin/check-docker-proxy", argv0: "check-docker-proxy", isProxy: false},
+		{exe: "", argv0: "/opt/scripts/check-docker-proxy", isProxy: false},
+		// the resolved executable is authoritative over argv[0]
+		{exe: "/usr/bin/python3", argv0: "docker-proxy", isProxy: false},
+	} {
+		p := &process.FilledProcess{
+			Pid:     1,
+			Exe:     tc.exe,
+			Cmdline: []string{tc.argv0, "-container-ip", "172.17.0.2", "-container-port", "80"},
+		}
+		proxy, err := newFilter().extractProxyInfo(p)
+		assert.NoError(t, err)
+		assert.Equal(t, tc.isProxy, proxy != nil, "exe=%s argv0=%s", tc.exe, tc.argv0)
+	}
+}
+
+func TestExtractProxyInfoFalsePositives(t *testing.T) {
+	for _, p := range []*process.FilledProcess{
+		{Pid: 1, Exe: "/bin/sh", Cmdline: []string{"sh", "-c", "pgrep -f docker-proxy -container-ip 172.17.0.2 -container-port 80"}},
+		{Pid: 1, Exe: "/usr/bin/pgrep", Cmdline: []string{"pgrep", "-f", "docker-proxy", "-container-ip", "172.17.0.2", "-container-port", "80"}},
+		{Pid: 1, Exe: "/usr/local/bin/check-docker-proxy", Cmdline: []string{"check-docker-proxy", "-container-ip", "172.17.0.2", "-container-port", "80"}},
+		// both target flags are required
+		{Pid: 1, Exe: "/usr/bin/docker-proxy", Cmdline: []string{"docker-proxy", "-container-ip", "172.17.0.2"}},
+		// merely mentioning docker-proxy in the arguments of a command, even of a shell or a wrapper
+		{Pid: 1, Cmdline: []string{"grep", "/usr/bin/docker-proxy", "-container-ip", "172.17.0.2", "-container-port", "80"}},
+		{Pid: 1, Cmdline: []string{"vim", "docker-proxy", "-container-ip", "172.17.0.2", "-container-port", "80"}},
+		{Pid: 1, Cmdline: []string{"sh", "/etc/docker-proxy", "-container-ip", "172.17.0.2", "-container-port", "80"}},
+		{Pid: 1, Cmdline: []string{"sh", "-c", "echo docker-proxy -container-ip 172.17.0.2 -container-port 80"}},
+		{Pid: 1, Cmdline: []string{"env", "--name=docker-proxy", "nginx", "-container-ip", "172.17.0.2", "-container-port", "80"}},
+		{Pid: 1, Cmdline: []string{"env", "PROXY=docker-proxy", "-container-ip", "172.17.0.2", "-container-port", "80"}},
+	} {
+		proxy, err := newFilter().extractProxyInfo(p)
+		assert.NoError(t, err)
+		assert.Nil(t, proxy, "cmdline: %v", p.Cmdline)
+	}
+}
+
+func TestExtractProxyInfoFlagForms(t *testing.T) {
+	expected := &proxy{pid: 1, proto: "tcp", host: model.Addr{Ip: "0.0.0.0", Port: 8080}, target: model.Addr{Ip: "172.17.0.3", Port: 8080}}
+
+	for _, cmdline := range [][]string{
+		{"docker-proxy", "-proto", "tcp", "-host-port=8080", "-container-ip=172.17.0.3", "-container-port=8080"},
+		{"docker-proxy", "-proto=tcp", "-host-port", "8080", "-container-ip=172.17.0.3", "-container-port", "8080"},
+		{"docker-proxy", "-proto", "tcp", "-host-port=8080", "-container-ip", "172.17.0.3", "-container-port=8080"},
+		{"docker-proxy", "-proto=tcp", "-host-ip=0.0.0.0", "-host-port", "8080", "-container-ip=172.17.0.3 ", "-container-port", "8080 "},
+	} {
+		p := &process.FilledProcess{Pid: 1, Cmdline: cmdline}
+		proxy, err := newFilter().extractProxyInfo(p)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, proxy, "cmdline: %v", cmdline)
+	}
+}
+
+func TestExtractProxyInfoMixedFlagStyles(t *testing.T) {
+	for _, tc := range []struct {
+		cmdline []string
+		host    model.Addr
+		target  model.Addr
+	}{
+		{
+			cmdline: []string{"docker-proxy", "-host-ip=10.0.0.5", "-host-port", "8443", "-container-ip", "10.0.0.1", "-container-port=443"},
+			host:    model.Addr{Ip: "10.0.0.5", Port: 8443},
+			target:  model.Addr{Ip: "10.0.0.1", Port: 443},
+		},
+		{
+			cmdline: []string{"docker-proxy", "-host-ip", "10.0.0.5", "-host-port=8443", "-container-ip=10.0.0.1", "-container-port", "443"},
+			host:    model.Addr{Ip: "10.0.0.5", Port: 8443},
+			target:  model.Addr{Ip: "10.0.0.1", Port: 443},
+		},
+		{
+			cmdline: []string{"docker-proxy", "-container-port=5432", "-host-ip", "127.0.0.1", "-container-ip=10.0.0.2", "-host-port=15432"},
+			host:    model.Addr{Ip: "127.0.0.1", Port: 15432},
+			target:  model.Addr{Ip: "10.0.0.2", Port: 5432},
+		},
+	} {
+		p := &process.FilledProcess{Pid: 1, Cmdline: tc.cmdline}
+		proxy, err := newFilter().extractProxyInfo(p)
+		assert.NoError(t, err)
+		if assert.NotNil(t, proxy, "cmdline: %v", tc.cmdline) {
+			assert.Equal(t, tc.host, proxy.host, "cmdline: %v", tc.cmdline)
+			assert.Equal(t, tc.target, proxy.target, "cmdline: %v", tc.cmdline)
+		}
+	}
+}
+
+func TestExtractProxyInfoDoubleDashFlags(t *testing.T) {
+	expected := &proxy{pid: 1, proto: "tcp", host: model.Addr{Ip: "0.0.0.0", Port: 5432}, target: model.Addr{Ip: "10.88.0.5", Port: 5432}}
+
+	for _, cmdline := range [][]string{
+		{"docker-proxy", "--proto", "tcp", "--host-port", "5432", "--container-ip", "10.88.0.5", "--container-port", "5432"},
+		{"docker-proxy", "-proto", "tcp", "--host-port=5432", "--container-ip", "10.88.0.5", "-container-port", "5432"},
+		{"docker-proxy", "--proto=tcp", "-host-port", "5432", "-container-ip=10.88.0.5", "--container-port=5432"},
+	} {
+		p := &process.FilledProcess{Pid: 1, Cmdline: cmdline}
+		proxy, err := newFilter().extractProxyInfo(p)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, proxy, "cmdline: %v", cmdline)
+	}
+
+	// flags that merely contain a known flag name must not be matched
+	p := &process.FilledProcess{Pid: 1, Cmdline: []string{"docker-proxy", "-not-container-ip", "10.88.0.5", "--not-container-port", "5432"}}
+	proxy, err := newFilter().extractProxyInfo(p)
+	assert.NoError(t, err)
+	assert.Nil(t, proxy)
+}
+
+// TestExtractProxyInfoMobyReleases tracks the cmdlines docker-proxy is started with across Moby releases
+func TestExtractProxyInfoMobyReleases(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		cmdline  []string
+		expected *proxy
+	}{
+		{
+			name:     "1.13 to 27.x",
+			cmdline:  []string{"/usr/bin/docker-proxy", "-proto", "tcp", "-host-ip", "0.0.0.0", "-host-port", "8080", "-container-ip", "172.17.0.2", "-container-port", "80"},
+			expected: &proxy{pid: 1, proto: "tcp", host: model.Addr{Ip: "0.0.0.0", Port: 8080}, target: model.Addr{Ip: "172.17.0.2", Port: 80}},
+		},
+		{
+			name:     "20.10 IPv6",
+			cmdline:  []string{"/usr/bin/docker-proxy", "-proto", "tcp", "-host-ip", "::", "-host-port", "8080", "-container-ip", "fd00::2", "-container-port", "80"},
+			expected: &proxy{pid: 1, proto: "tcp", host: model.Addr{Ip: "::", Port: 8080}, target: model.Addr{Ip: "fd00::2", Port: 80}},
+		},
+		{
+			name:     "28.x listen fd",
+			cmdline:  []string{"/usr/bin/docker-proxy", "-proto", "tcp", "-host-ip", "0.0.0.0", "-host-port", "8080", "-container-ip", "172.17.0.2", "-container-port", "80", "-use-listen-fd"},
+			expected: &proxy{pid: 1, proto: "tcp", host: model.Addr{Ip: "0.0.0.0", Port: 8080}, target: model.Addr{Ip: "172.17.0.2", Port: 80}},
+		},
+		{
+			name:     "28.x listen fd, udp",
+			cmdline:  []string{"/usr/libexec/docker/docker-proxy", "-proto", "udp", "-host-ip", "127.0.0.1", "-host-port", "5353", "-container-ip", "172.18.0.3", "-container-port", "53", "-use-listen-fd"},
+			expected: &proxy{pid: 1, proto: "udp", host: model.Addr{Ip: "127.0.0.1", Port: 5353}, target: model.Addr{Ip: "172.18.0.3", Port: 53}},
+		},
+		{
+			name:     "listen fd without host flags",
+			cmdline:  []string{"docker-proxy", "-use-listen-fd", "-proto", "tcp", "-container-ip", "172.17.0.2", "-container-port", "80"},
+			expected: &proxy{pid: 1, proto: "tcp", host: model.Addr{Ip: "0.0.0.0"}, target: model.Addr{Ip: "172.17.0.2", Port: 80}},
+		},
+		{
+			name:     "explicit listen fd value",
+			cmdline:  []string{"docker-proxy", "-use-listen-fd=true", "-container-ip", "172.17.0.2", "-container-port", "80"},
+			expected: &proxy{pid: 1, host: model.Addr{Ip: "0.0.0.0"}, target: model.Addr{Ip: "172.17.0.2", Port: 80}},
+		},
+	} {
+		proxy, err := newFilter().extractProxyInfo(&process.FilledProcess{Pid: 1, Cmdline: tc.cmdline})
+		assert.NoError(t, err, tc.name)
+		assert.Equal(t, tc.expected, proxy, tc.name)
+	}
+
+	// the proxy legs towards the container are matched without the host flags
+	f := newFilter()
+	f.LoadProxies(map[int32]*process.FilledProcess{
+		1: {Pid: 1, Cmdline: []string{"docker-proxy", "-use-listen-fd", "-proto", "tcp", "-container-ip", "172.17.0.2", "-container-port", "80"}},
+	})
+	assert.Empty(t, f.proxyByHostAddr)
+	payload := &model.Connections{Conns: []*model.Connection{
+		{Pid: 1, Laddr: &model.Addr{Ip: "172.17.0.1", Port: 34567}, Raddr: &model.Addr{Ip: "172.17.0.2", Port: 80}},
+		{Pid: 3, Laddr: &model.Addr{Ip: "172.17.0.2", Port: 80}, Raddr: &model.Addr{Ip: "172.17.0.1", Port: 34567}},
+	}}
+	assert.Equal(t, 2, f.Filter(payload))
+}
+
+func TestExtractProxyInfoTruncated(t *testing.T) {
+	for _, cmdline := range [][]string{
+		{"docker-proxy", "-container-ip", "172.17.0.2", "-container-port"},
+		{"docker-proxy", "-container-port", "80", "-container-ip"},
+		{"docker-proxy", "-container-ip=", "-container-port=80"},
+	} {
+		p := &process.FilledProcess{Pid: 1, Cmdline: cmdline}
+		assert.NotPanics(t, func() {
+			proxy, err := newFilter().extractProxyInfo(p)
+			assert.Error(t, err)
+			assert.Nil(t, proxy)
+		}, "cmdline: %v", cmdline)
+	}
+}
+
+func TestExtractProxyInfoInvalidValues(t *testing.T) {
+	for _, cmdline := range [][]string{
+		{"docker-proxy", "-proto", "tcp", "-host-port", "8080", "-container-ip", "172.17.0.2", "-container-port", "abc"},
+		{"docker-proxy", "-container-port", "abc", "-container-ip", "172.17.0.2"},
+		{"docker-proxy", "-container-ip", "172.17.0.2", "-container-port", "80", "-host-port", "80a"},
+		{"docker-proxy", "-container-ip", "172.17.0.2", "-container-port", "65536"},
+		{"docker-proxy", "-container-ip", "172.17.0.256", "-container-port", "80"},
+	} {
+		proxy, err := newFilter().extractProxyInfo(&process.FilledProcess{Pid: 1, Cmdline: cmdline})
+		assert.Error(t, err, "cmdline: %v", cmdline)
+		assert.Nil(t, proxy, "cmdline: %v", cmdline)
+	}
+}
+
+func TestExtractProxyInfoInvalidContainerIP(t *testing.T) {
+	// the values are trimmed, a blank one being missing
+	for _, ip := range []string{"", " ", "\t", "not-an-ip", "172.17.0", "172.17.0.2.1", "fd00:::2", "[172.17.0.2"} {
+		cmdline := []string{"docker-proxy", "-proto", "tcp", "-host-port", "8080", "-container-ip=" + ip, "-container-port", "80"}
+		proxy, err := newFilter().extractProxyInfo(&process.FilledProcess{Pid: 1, Cmdline: cmdline})
+		assert.Error(t, err, "container ip: %q", ip)
+		assert.Nil(t, proxy, "container ip: %q", ip)
+
+		// the rejected proxies are logged, and never indexed
+		logger := &recordingLogger{}
+		f := newFilter(WithLogger(logger))
+		f.LoadProxies(map[int32]*process.FilledProcess{1: {Pid: 1, Cmdline: cmdline}})
+		assert.Equal(t, 0, f.ProxyCount())
+		assert.Empty(t, f.proxyByTarget)
+		if assert.Len(t, logger.messages["warn"], 1, "container ip: %q", ip) {
+			assert.Contains(t, logger.messages["warn"][0], "skipping docker-proxy with pid=1")
+		}
+	}
+}
+
+func TestExtractProxyInfoReversedFlags(t *testing.T) {
+	expected := &proxy{pid: 1, proto: "udp", host: model.Addr{Ip: "10.0.0.5", Port: 5353}, target: model.Addr{Ip: "172.17.0.2", Port: 53}}
+
+	for _, cmdline := range [][]string{
+		{"docker-proxy", "-container-port", "53", "-container-ip", "172.17.0.2", "-host-port", "5353", "-host-ip", "10.0.0.5", "-proto", "udp"},
+		{"docker-proxy", "-use-listen-fd", "-container-port", "53", "-container-ip", "172.17.0.2", "-host-port", "5353", "-host-ip", "10.0.0.5", "-proto", "udp"},
+		// the value of the last flag is the very last token
+		{"docker-proxy", "-proto", "udp", "-host-ip", "10.0.0.5", "-host-port", "5353", "-container-ip", "172.17.0.2", "-container-port", "53"},
+	} {
+		proxy, err := newFilter().extractProxyInfo(&process.FilledProcess{Pid: 1, Cmdline: cmdline})
+		assert.NoError(t, err)
+		assert.Equal(t, expected, proxy, "cmdline: %v", cmdline)
+	}
+}
+
+func TestExtractProxyInfoUnixSocket(t *testing.T) {
+	for _, cmdline := range [][]string{
+		{"docker-proxy", "-proto", "tcp", "-host-ip", "0.0.0.0", "-host-port", "8080", "-container-proto", "unix", "-container-socket", "/run/app.sock"},
+		{"docker-proxy", "-proto", "tcp", "-host-port", "8080", "-container-socket=/run/app.sock"},
+		{"docker-proxy", "-proto", "tcp", "-host-port", "8080", "-container-proto", "UNIX"},
+	} {
+		fwd, err := parseDockerProxyCmdline(cmdline)
+		assert.NoError(t, err)
+		assert.True(t, fwd.UnixSocket, "cmdline: %v", cmdline)
+
+		proxy, err := newFilter().extractProxyInfo(&process.FilledProcess{Pid: 1, Cmdline: cmdline})
+		assert.Equal(t, errUnixSocketTarget, err, "cmdline: %v", cmdline)
+		assert.Nil(t, proxy)
+	}
+
+	fwd, err := parseDockerProxyCmdline([]string{"docker-proxy", "-container-socket=/run/app.sock"})
+	assert.NoError(t, err)
+	assert.Equal(t, "/run/app.sock", fwd.SocketPath)
+
+	// the unix socket proxies are accounted for apart from the malformed ones
+	logger := &recordingLogger{}
+	f := newFilter(WithLogger(logger))
+	procs := map[int32]*process.FilledProcess{
+		1: {Pid: 1, CreateTime: 1, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-port", "8080", "-container-proto", "unix", "-container-socket", "/run/app.sock"}},
+		2: {Pid: 2, CreateTime: 2, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-port", "8081", "-container-ip", "172.17.0.2", "-container-port", "80"}},
+		3: {Pid: 3, CreateTime: 3, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-port", "8082", "-container-ip", "172.17.0.3", "-container-port", "abc"}},
+	}
+	f.Refresh(procs)
+	f.Refresh(procs)
+	assert.Equal(t, 1, f.ProxyCount())
+	assert.Equal(t, uint64(1), f.Stats().UnixSocketProxies)
+	assert.NotContains(t, f.malformedPIDs, int32(1))
+	assert.Contains(t, f.malformedPIDs, int32(3))
+	assert.Len(t, logger.messages["warn"], 1)
+	assert.Len(t, logger.messages["debug"], 1)
+	assert.Contains(t, logger.messages["debug"][0], "not tracking docker-proxy with pid=1: it forwards to a unix domain socket")
+
+	// the PID is reused by another process
+	procs[1] = &process.FilledProcess{Pid: 1, CreateTime: 10, Cmdline: []string{"nginx"}}
+	f.LoadProxies(procs)
+	assert.Equal(t, uint64(0), f.Stats().UnixSocketProxies)
+
+	// or the proxy exits
+	procs[1] = &process.FilledProcess{Pid: 1, CreateTime: 11, Cmdline: []string{"docker-proxy", "-container-socket", "/run/app.sock"}}
+	f.HandleProcessEvents([]*process.FilledProcess{procs[1]}, nil)
+	assert.Equal(t, uint64(1), f.Stats().UnixSocketProxies)
+	f.HandleProcessEvents(nil, []int32{1})
+	assert.Equal(t, uint64(0), f.Stats().UnixSocketProxies)
+	f.HandleProcessEvents([]*process.FilledProcess{procs[1]}, nil)
+	delete(procs, 1)
+	f.Refresh(procs)
+	assert.Equal(t, uint64(0), f.Stats().UnixSocketProxies)
+}
+
+func TestExtractProxyInfoWithoutFlags(t *testing.T) {
+	for _, p := range []*process.FilledProcess{
+		{Pid: 1, Cmdline: []string{"docker-proxy"}},
+		{Pid: 1, Cmdline: []string{"docker-proxy", ""}},
+		{Pid: 1, Cmdline: []string{""}},
+		{Pid: 1, Exe: "/usr/bin/rootlesskit", Cmdline: []string{"rootlesskit"}},
+		// kernel thread
+		{Pid: 2, Name: "kthreadd"},
+	} {
+		f := newFilter()
+		assert.NotPanics(t, func() {
+			proxy, err := f.extractProxyInfo(p)
+			assert.NoError(t, err)
+			assert.Nil(t, proxy)
+
+			f.LoadProxies(map[int32]*process.FilledProcess{p.Pid: p})
+		}, "cmdline: %q", p.Cmdline)
+		assert.Empty(t, f.proxyByPID)
+		assert.Empty(t, f.proxyByTarget)
+		assert.Empty(t, f.proxyByHostAddr)
+	}
+}
+
+func TestLoadProxiesSkipsMalformed(t *testing.T) {
+	procs := map[int32]*process.FilledProcess{
+		1: {Pid: 1, Cmdline: []string{"docker-proxy", "-container-ip=172.17.0.2", "-container-port=abc"}},
+		2: {Pid: 2, Cmdline: []string{"docker-proxy", "-container-ip=172.17.0.3", "-container-port=80"}},
+	}
+
+	_, err := newFilter().extractProxyInfo(procs[1])
+	assert.Error(t, err)
+
+	f := newFilter()
+	f.LoadProxies(procs)
+	f.LoadProxies(procs)
+
+	assert.Len(t, f.proxyByPID, 1)
+	assert.Contains(t, f.proxyByPID, int32(2))
+	assert.Contains(t, f.malformedPIDs, int32(1))
+}
+
+func TestProxyFilter(t *testing.T) {
+	procs := map[int32]*process.FilledProcess{
+		1: {Pid: 1, Cmdline: []string{"/usr/bin/docker-proxy", "-proto", "tcp", "-host-ip", "0.0.0.0", "-host-port", "8080", "-container-ip", "172.17.0.2", "-container-port", "80"}},
+		2: {Pid: 2, Cmdline: []string{"/usr/bin/redis-server", "*:6379"}},
+	}
+
+	f := newFilter()
+	f.LoadProxies(procs)
+
+	proxyToContainer := &model.Connection{
+		Pid:   1,
+		Laddr: &model.Addr{Ip: "172.17.0.1", Port: 34567},
+		Raddr: &model.Addr{Ip: "172.17.0.2", Port: 80},
+	}
+	containerToProxy := &model.Connection{
+		Pid:   3,
+		Laddr: &model.Addr{Ip: "172.17.0.2", Port: 80},
+		Raddr: &model.Addr{Ip: "172.17.0.1", Port: 34567},
+	}
+	unrelated := &model.Connection{
+		Pid:   2,
+		Laddr: &model.Addr{Ip: "10.0.0.1", Port: 6379},
+		Raddr: &model.Addr{Ip: "10.0.0.2", Port: 50000},
+	}
+
+	payload := &model.Connections{Conns: []*model.Connection{proxyToContainer, containerToProxy, unrelated}}
+	assert.Equal(t, 2, f.Filter(payload))
+	assert.Equal(t, []*model.Connection{unrelated}, payload.Conns)
+
+	payload = &model.Connections{Conns: []*model.Connection{containerToProxy, unrelated}}
+	assert.Equal(t, 1, f.Filter(payload))
+	assert.Equal(t, Stats{Examined: 5, Dropped: 3, Kept: 2, Proxies: 1, ProxyInsertions: 1, ProxyLookups: 5, Discovered: 1, ProxyIPDiscoveries: 1}, f.Stats())
+}
+
+func TestProxyFilterHostAddr(t *testing.T) {
+	procs := map[int32]*process.FilledProcess{
+		1: {Pid: 1, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-ip", "0.0.0.0", "-host-port", "8080", "-container-ip", "172.17.0.2", "-container-port", "80"}},
+	}
+
+	f := newFilter()
+	f.LoadProxies(procs)
+
+	clientToProxy := &model.Connection{
+		Pid:   1,
+		Laddr: &model.Addr{Ip: "10.0.0.5", Port: 8080},
+		Raddr: &model.Addr{Ip: "10.0.0.42", Port: 51234},
+	}
+	proxyToContainer := &model.Connection{
+		Pid:   1,
+		Laddr: &model.Addr{Ip: "172.17.0.1", Port: 34567},
+		Raddr: &model.Addr{Ip: "172.17.0.2", Port: 80},
+	}
+	otherListener := &model.Connection{
+		Pid:   2,
+		Laddr: &model.Addr{Ip: "10.0.0.5", Port: 8081},
+		Raddr: &model.Addr{Ip: "10.0.0.42", Port: 51235},
+	}
+
+	// both legs are identified without waiting for the proxy IP to be discovered
+	assert.True(t, f.isProxied(clientToProxy))
+	assert.True(t, f.isProxied(proxyToContainer))
+	assert.False(t, f.isProxied(otherListener))
+}
+
+func TestProxyFilterHostWildcard(t *testing.T) {
+	procs := map[int32]*process.FilledProcess{
+		// listens on every interface
+		1: {Pid: 1, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-ip", "0.0.0.0", "-host-port", "8080", "-container-ip", "172.17.0.2", "-container-port", "80"}},
+		// only listens on the loopback interface
+		2: {Pid: 2, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-ip", "127.0.0.1", "-host-port", "9090", "-container-ip", "172.17.0.3", "-container-port", "90"}},
+	}
+
+	f := newFilter()
+	f.LoadProxies(procs)
+	assert.Equal(t, model.Addr{Ip: "0.0.0.0", Port: 8080}, f.proxyByPID[1].host)
+	assert.Equal(t, model.Addr{Ip: "127.0.0.1", Port: 9090}, f.proxyByPID[2].host)
+
+	for _, tc := range []struct {
+		name    string
+		conn    *model.Connection
+		proxied bool
+	}{
+		{
+			name:    "wildcard host ip, external interface",
+			conn:    &model.Connection{Pid: 1, Laddr: &model.Addr{Ip: "10.0.0.5", Port: 8080}, Raddr: &model.Addr{Ip: "10.0.0.42", Port: 50000}},
+			proxied: true,
+		},
+		{
+			name:    "wildcard host ip, loopback interface",
+			conn:    &model.Connection{Pid: 1, Laddr: &model.Addr{Ip: "127.0.0.1", Port: 8080}, Raddr: &model.Addr{Ip: "127.0.0.1", Port: 50001}},
+			proxied: true,
+		},
+		{
+			name:    "wildcard host ip, bridge interface",
+			conn:    &model.Connection{Pid: 1, Laddr: &model.Addr{Ip: "172.17.0.1", Port: 8080}, Raddr: &model.Addr{Ip: "172.17.0.4", Port: 50002}},
+			proxied: true,
+		},
+		{
+			name:    "wildcard host ip, other port",
+			conn:    &model.Connection{Pid: 1, Laddr: &model.Addr{Ip: "10.0.0.5", Port: 8081}, Raddr: &model.Addr{Ip: "10.0.0.42", Port: 50003}},
+			proxied: false,
+		},
+		{
+			name:    "wildcard host ip, other process",
+			conn:    &model.Connection{Pid: 3, Laddr: &model.Addr{Ip: "10.0.0.5", Port: 8080}, Raddr: &model.Addr{Ip: "10.0.0.42", Port: 50004}},
+			proxied: false,
+		},
+		{
+			name:    "specific host ip",
+			conn:    &model.Connection{Pid: 2, Laddr: &model.Addr{Ip: "127.0.0.1", Port: 9090}, Raddr: &model.Addr{Ip: "127.0.0.1", Port: 50005}},
+			proxied: true,
+		},
+		{
+			name:    "specific host ip, other interface",
+			conn:    &model.Connection{Pid: 2, Laddr: &model.Addr{Ip: "10.0.0.5", Port: 9090}, Raddr: &model.Addr{Ip: "10.0.0.42", Port: 50006}},
+			proxied: false,
+		},
+	} {
+		assert.Equal(t, tc.proxied, f.IsProxied(tc.conn), tc.name)
+	}
+}
+
+func TestProxyFilterProtocol(t *testing.T) {
+	procs := map[int32]*process.FilledProcess{
+		1: {Pid: 1, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-ip", "0.0.0.0", "-host-port", "53", "-container-ip", "172.17.0.2", "-container-port", "53"}},
+		2: {Pid: 2, Cmdline: []string{"docker-proxy", "-proto", "udp", "-host-ip", "0.0.0.0", "-host-port", "53", "-container-ip", "172.17.0.2", "-container-port", "53"}},
+		3: {Pid: 3, Cmdline: []string{"docker-proxy", "-proto", "udp", "-host-ip", "0.0.0.0", "-host-port", "5353", "-container-ip", "172.17.0.3", "-container-port", "5353"}},
+		4: {Pid: 4, Cmdline: []string{"docker-proxy", "-host-ip", "0.0.0.0", "-host-port", "8080", "-container-ip", "172.17.0.4", "-container-port", "80"}},
+	}
+
+	f := newFilter()
+	f.LoadProxies(procs)
+	assert.Len(t, f.proxyByPID, 4)
+
+	f.Filter(&model.Connections{Conns: []*model.Connection{
+		{Pid: 1, Type: model.ConnectionType_tcp, Laddr: &model.Addr{Ip: "172.17.0.1", Port: 40000}, Raddr: &model.Addr{Ip: "172.17.0.2", Port: 53}},
+		{Pid: 2, Type: model.ConnectionType_udp, Laddr: &model.Addr{Ip: "172.17.0.1", Port: 40001}, Raddr: &model.Addr{Ip: "172.17.0.2", Port: 53}},
+		{Pid: 3, Type: model.ConnectionType_udp, Laddr: &model.Addr{Ip: "172.17.0.1", Port: 40002}, Raddr: &model.Addr{Ip: "172.17.0.3", Port: 5353}},
+		{Pid: 4, Type: model.ConnectionType_tcp, Laddr: &model.Addr{Ip: "172.17.0.1", Port: 40003}, Raddr: &model.Addr{Ip: "172.17.0.4", Port: 80}},
+	}})
+
+	for _, tc := range []struct {
+		name    string
+		conn    *model.Connection
+		proxied bool
+	}{
+		{
+			name:    "tcp container leg",
+			conn:    &model.Connection{Pid: 10, Type: model.ConnectionType_tcp, Laddr: &model.Addr{Ip: "172.17.0.2", Port: 53}, Raddr: &model.Addr{Ip: "172.17.0.1", Port: 40000}},
+			proxied: true,
+		},
+		{
+			name:    "udp container leg",
+			conn:    &model.Connection{Pid: 10, Type: model.ConnectionType_udp, Laddr: &model.Addr{Ip: "172.17.0.2", Port: 53}, Raddr: &model.Addr{Ip: "172.17.0.1", Port: 40001}},
+			proxied: true,
+		},
+		{
+			name:    "tcp client leg",
+			conn:    &model.Connection{Pid: 1, Type: model.ConnectionType_tcp, Laddr: &model.Addr{Ip: "10.0.0.5", Port: 53}, Raddr: &model.Addr{Ip: "10.0.0.42", Port: 50000}},
+			proxied: true,
+		},
+		{
+			name:    "udp client leg",
+			conn:    &model.Connection{Pid: 2, Type: model.ConnectionType_udp, Laddr: &model.Addr{Ip: "10.0.0.5", Port: 53}, Raddr: &model.Addr{Ip: "10.0.0.42", Port: 50000}},
+			proxied: true,
+		},
+		{
+			name:    "tcp connection to a udp-only target",
+			conn:    &model.Connection{Pid: 10, Type: model.ConnectionType_tcp, Laddr: &model.Addr{Ip: "172.17.0.3", Port: 5353}, Raddr: &model.Addr{Ip: "172.17.0.1", Port: 40002}},
+			proxied: false,
+		},
+		{
+			name:    "tcp connection on a udp-only host port",
+			conn:    &model.Connection{Pid: 3, Type: model.ConnectionType_tcp, Laddr: &model.Addr{Ip: "10.0.0.5", Port: 5353}, Raddr: &model.Addr{Ip: "10.0.0.42", Port: 50000}},
+			proxied: false,
+		},
+		{
+			name:    "udp connection through a proxy without protocol",
+			conn:    &model.Connection{Pid: 10, Type: model.ConnectionType_udp, Laddr: &model.Addr{Ip: "172.17.0.4", Port: 80}, Raddr: &model.Addr{Ip: "172.17.0.1", Port: 40003}},
+			proxied: true,
+		},
+	} {
+		assert.Equal(t, tc.proxied, f.isProxied(tc.conn), tc.name)
+	}
+}
+
+func TestProxyFilterUDPNotFilteredByTCPProxy(t *testing.T) {
+	procs := map[int32]*process.FilledProcess{
+		1: {Pid: 1, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-ip", "0.0.0.0", "-host-port", "8125", "-container-ip", "172.17.0.2", "-container-port", "8125"}},
+	}
+
+	f := newFilter()
+	f.LoadProxies(procs)
+
+	tcpConn := &model.Connection{Pid: 10, Type: model.ConnectionType_tcp, Laddr: &model.Addr{Ip: "172.17.0.2", Port: 8125}, Raddr: &model.Addr{Ip: "172.17.0.1", Port: 40000}}
+	udpConn := &model.Connection{Pid: 10, Type: model.ConnectionType_udp, Laddr: &model.Addr{Ip: "172.17.0.2", Port: 8125}, Raddr: &model.Addr{Ip: "172.17.0.1", Port: 40000}}
+	payload := &model.Connections{Conns: []*model.Connection{
+		{Pid: 1, Type: model.ConnectionType_tcp, Laddr: &model.Addr{Ip: "172.17.0.1", Port: 40000}, Raddr: &model.Addr{Ip: "172.17.0.2", Port: 8125}},
+		tcpConn,
+		udpConn,
+	}}
+
+	assert.Equal(t, 2, f.Filter(payload))
+	assert.Equal(t, []*model.Connection{udpConn}, payload.Conns)
+}
+
+func TestExtractProxyInfoCanonicalIP(t *testing.T) {
+	for _, tc := range []struct {
+		ip       string
+		expected string
+	}{
+		{ip: "172.17.0.2", expected: "172.17.0.2"},
+		{ip: "::ffff:172.17.0.2", expected: "172.17.0.2"},
+		{ip: "172.017.000.002", expected: "172.17.0.2"},
+		{ip: "FD00:0:0:0:0:0:0:2", expected: "fd00::2"},
+		{ip: "fd00::2", expected: "fd00::2"},
+		{ip: "172.17.0", expected: ""},
+		{ip: "not-an-ip", expected: ""},
+	} {
+		p := &process.FilledProcess{Pid: 1, Cmdline: []string{"docker-proxy", "-container-ip", tc.ip, "-container-port", "80"}}
+		proxy, err := newFilter().extractProxyInfo(p)
+		if tc.expected == "" {
+			assert.Error(t, err, tc.ip)
+			assert.Nil(t, proxy, tc.ip)
+			continue
+		}
+
+		assert.NoError(t, err, tc.ip)
+		if assert.NotNil(t, proxy, tc.ip) {
+			assert.Equal(t, tc.expected, proxy.target.Ip, tc.ip)
+		}
+	}
+}
+
+func TestProxyFilterCanonicalConnectionAddrs(t *testing.T) {
+	procs := map[int32]*process.FilledProcess{
+		1: {Pid: 1, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-port", "8080", "-container-ip", "172.17.0.2", "-container-port", "80"}},
+		2: {Pid: 2, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-port", "8443", "-container-ip", "FD00::2", "-container-port", "443"}},
+	}
+
+	f := newFilter()
+	f.LoadProxies(procs)
+
+	// the tracer reports the proxy -> container legs with IPv4-mapped and uppercase addresses
+	payload := &model.Connections{Conns: []*model.Connection{
+		{Pid: 1, Laddr: &model.Addr{Ip: "::ffff:172.17.0.1", Port: 40000}, Raddr: &model.Addr{Ip: "::ffff:172.17.0.2", Port: 80}},
+		{Pid: 2, Laddr: &model.Addr{Ip: "FD00::1", Port: 40001}, Raddr: &model.Addr{Ip: "fd00:0:0:0:0:0:0:2", Port: 443}},
+	}}
+	f.Filter(payload)
+	assert.Empty(t, payload.Conns)
+
+	assert.Equal(t, "172.17.0.1", f.proxyByPID[1].ip)
+	assert.Equal(t, "fd00::1", f.proxyByPID[2].ip)
+
+	assert.True(t, f.isProxied(&model.Connection{Pid: 3, Laddr: &model.Addr{Ip: "172.17.0.2", Port: 80}, Raddr: &model.Addr{Ip: "::ffff:172.17.0.1", Port: 40000}}))
+	assert.True(t, f.isProxied(&model.Connection{Pid: 3, Laddr: &model.Addr{Ip: "fd00::2", Port: 443}, Raddr: &model.Addr{Ip: "FD00:0::1", Port: 40001}}))
+}
+
+func TestProxyFilterIPv6Forms(t *testing.T) {
+	for _, tc := range []struct {
+		proxyIP string
+		connIP  string
+	}{
+		{proxyIP: "2001:db8:0:0:0:0:0:2", connIP: "2001:db8::2"},
+		{proxyIP: "2001:db8::2", connIP: "2001:0db8:0000:0000:0000:0000:0000:0002"},
+		{proxyIP: "0:0:0:0:0:0:0:1", connIP: "::1"},
+	} {
+		f := newFilter()
+		f.LoadProxies(map[int32]*process.FilledProcess{
+			1: {Pid: 1, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-ip", "::", "-host-port", "8080", "-container-ip", tc.proxyIP, "-container-port", "80"}},
+		})
+
+		assert.True(t, f.isProxied(&model.Connection{
+			Pid:   1,
+			Laddr: &model.Addr{Ip: "2001:db8::1", Port: 40000},
+			Raddr: &model.Addr{Ip: tc.connIP, Port: 80},
+		}), "proxy ip %s, connection ip %s", tc.proxyIP, tc.connIP)
+	}
+}
+
+func TestProxyFilterDualStack(t *testing.T) {
+	procs := map[int32]*process.FilledProcess{
+		1: {Pid: 1, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-ip", "0.0.0.0", "-host-port", "8080", "-container-ip", "172.17.0.2", "-container-port", "80"}},
+		2: {Pid: 2, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-ip", "[::]", "-host-port", "8080", "-container-ip", "[fd00::2]", "-container-port", "80"}},
+	}
+
+	f := newFilter()
+	f.LoadProxies(procs)
+	assert.Len(t, f.proxyByPID, 2)
+	assert.Equal(t, model.Addr{Ip: "::", Port: 8080}, f.proxyByPID[2].host)
+	assert.Equal(t, model.Addr{Ip: "fd00::2", Port: 80}, f.proxyByPID[2].target)
+
+	v4ProxyToContainer := &model.Connection{Pid: 1, Laddr: &model.Addr{Ip: "172.17.0.1", Port: 40000}, Raddr: &model.Addr{Ip: "172.17.0.2", Port: 80}}
+	v6ProxyToContainer := &model.Connection{Pid: 2, Laddr: &model.Addr{Ip: "fd00::1", Port: 40000}, Raddr: &model.Addr{Ip: "fd00::2", Port: 80}}
+	v4Container := &model.Connection{Pid: 3, Laddr: &model.Addr{Ip: "172.17.0.2", Port: 80}, Raddr: &model.Addr{Ip: "172.17.0.1", Port: 40000}}
+	v6Container := &model.Connection{Pid: 3, Laddr: &model.Addr{Ip: "fd00::2", Port: 80}, Raddr: &model.Addr{Ip: "fd00::1", Port: 40000}}
+	v6Client := &model.Connection{Pid: 2, Laddr: &model.Addr{Ip: "2001:db8::5", Port: 8080}, Raddr: &model.Addr{Ip: "2001:db8::42", Port: 50000}}
+	v6Unrelated := &model.Connection{Pid: 4, Laddr: &model.Addr{Ip: "fd00::3", Port: 80}, Raddr: &model.Addr{Ip: "fd00::1", Port: 40000}}
+
+	payload := &model.Connections{Conns: []*model.Connection{v4ProxyToContainer, v6ProxyToContainer, v4Container, v6Container, v6Client, v6Unrelated}}
+	f.Filter(payload)
+
+	assert.Equal(t, "172.17.0.1", f.proxyByPID[1].ip)
+	assert.Equal(t, "fd00::1", f.proxyByPID[2].ip)
+	assert.Equal(t, []*model.Connection{v6Unrelated}, payload.Conns)
+}
+
+func TestProxyFilterConcurrency(t *testing.T) {
+	procs := map[int32]*process.FilledProcess{
+		1: {Pid: 1, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-port", "8080", "-container-ip", "172.17.0.2", "-container-port", "80"}},
+		2: {Pid: 2, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-port", "8081", "-container-ip", "172.17.0.3", "-container-port", "80"}},
+	}
+
+	f := newFilter()
+	f.LoadProxies(procs)
+
+	newPayload := func() *model.Connections {
+		return &model.Connections{Conns: []*model.Connection{
+			{Pid: 1, Laddr: &model.Addr{Ip: "172.17.0.1", Port: 40000}, Raddr: &model.Addr{Ip: "172.17.0.2", Port: 80}},
+			{Pid: 3, Laddr: &model.Addr{Ip: "172.17.0.3", Port: 80}, Raddr: &model.Addr{Ip: "172.17.0.1", Port: 40001}},
+			{Pid: 4, Laddr: &model.Addr{Ip: "10.0.0.1", Port: 6379}, Raddr: &model.Addr{Ip: "10.0.0.2", Port: 50000}},
+		}}
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(4)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				f.LoadProxies(procs)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				f.Refresh(procs)
+				f.HandleProcessEvents([]*process.FilledProcess{procs[1]}, nil)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				f.Filter(newPayload())
+				f.FilterWithDropped(newPayload())
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				for _, c := range newPayload().Conns {
+					f.IsProxied(c)
+				}
+				f.Proxies()
+				f.Stats()
+				f.ExpireStale(time.Hour)
+			}
+		}()
+	}
+	wg.Wait()
+
+	payload := newPayload()
+	f.Filter(payload)
+	assert.Len(t, payload.Conns, 2)
+}
+
+func TestRefresh(t *testing.T) {
+	procs := map[int32]*process.FilledProcess{
+		1: {Pid: 1, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-port", "8080", "-container-ip", "172.17.0.2", "-container-port", "80"}},
+		2: {Pid: 2, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-port", "8081", "-container-ip", "172.17.0.3", "-container-port", "80"}},
+	}
+
+	f := newFilter()
+	f.LoadProxies(procs)
+	f.Filter(&model.Connections{Conns: []*model.Connection{
+		{Pid: 1, Laddr: &model.Addr{Ip: "172.17.0.1", Port: 40000}, Raddr: &model.Addr{Ip: "172.17.0.2", Port: 80}},
+	}})
+	assert.Equal(t, "172.17.0.1", f.proxyByPID[1].ip)
+
+	// the container behind the second proxy was removed
+	delete(procs, 2)
+	f.Refresh(procs)
+
+	assert.Len(t, f.proxyByPID, 1)
+	assert.Len(t, f.proxyByTarget, 1)
+	assert.Len(t, f.proxyByHostAddr, 1)
+	assert.NotContains(t, f.proxyByPID, int32(2))
+	assert.NotContains(t, f.proxyByTarget, testProxyKey(model.Addr{Ip: "172.17.0.3", Port: 80}, "tcp", 0))
+	assert.NotContains(t, f.proxyByHostAddr, testProxyKey(model.Addr{Ip: "0.0.0.0", Port: 8081}, "tcp", 0))
+
+	// the proxy IP discovered for the remaining proxy is preserved
+	assert.Equal(t, "172.17.0.1", f.proxyByPID[1].ip)
+
+	// connections reusing the address of the evicted target aren't dropped anymore
+	reused := &model.Connection{Pid: 30, Laddr: &model.Addr{Ip: "172.17.0.3", Port: 80}, Raddr: &model.Addr{Ip: "172.17.0.1", Port: 40001}}
+	payload := &model.Connections{Conns: []*model.Connection{reused}}
+	assert.Equal(t, 0, f.Filter(payload))
+	assert.Equal(t, []*model.Connection{reused}, payload.Conns)
+
+	// LoadProxies on the other hand never evicts anything
+	f.LoadProxies(map[int32]*process.FilledProcess{})
+	assert.Len(t, f.proxyByPID, 1)
+}
+
+// TestExtractProxyInfoFuzzRegressions holds inputs found while fuzzing extractProxyInfo
+func TestExtractProxyInfoFuzzRegressions(t *testing.T) {
+	for _, cmdline := range []string{
+		"docker-proxy\x00-container-ip\x00172.17.0.2\x00-container-port\x00-5",
+		"docker-proxy\x00-container-ip\x00172.17.0.2\x00-container-port\x0099999999999",
+		"docker-proxy\x00-container-ip\x00172.17.0.2\x00-container-port\x0065536",
+		"docker-proxy\x00-container-ip\x00-container-port\x0080",
+		"docker-proxy\x00-container-ip\x00172.17.0.2\x00-container-port\x00-host-port\x008080",
+		"docker-proxy\x00-container-ip\x00172.17.0\x00.2\x00-container-port\x0080",
+		"docker-proxy\x00-container-ip=172.17.0.2\x01\x00-container-port=80",
+		"docker-proxy\x00-container-ip\x00172.17.0.2\x00-container-port\x0080\x00-host-port\x00+8080",
+		"docker-proxy\x00-container-ip\x00" + strings.Repeat("1", 1<<16) + "\x00-container-port\x0080",
+		"docker-proxy\x00=\x00-=\x00--\x00-\x00",
+	} {
+		p := &process.FilledProcess{Pid: 1, Cmdline: strings.Split(cmdline, "\x00")}
+		assert.NotPanics(t, func() {
+			proxy, _ := newFilter().extractProxyInfo(p)
+			assert.Nil(t, proxy, "cmdline: %q", cmdline)
+		})
+	}
+}
+
+func TestProxyFilterWithoutCmdline(t *testing.T) {
+	procs := map[int32]*process.FilledProcess{
+		// hidepid: neither the cmdline nor the exe can be read
+		1: {Pid: 1, Name: "docker-proxy"},
+		2: {Pid: 2, Name: "nginx"},
+	}
+
+	f := newFilter()
+	f.LoadProxies(procs)
+	assert.Len(t, f.proxyByPID, 1)
+	assert.Empty(t, f.proxyByTarget)
+
+	clientToProxy := &model.Connection{
+		Pid:       1,
+		Direction: model.ConnectionDirection_incoming,
+		Laddr:     &model.Addr{Ip: "10.0.0.5", Port: 8080},
+		Raddr:     &model.Addr{Ip: "10.0.0.42", Port: 51234},
+	}
+	proxyToContainer := &model.Connection{
+		Pid:       1,
+		Direction: model.ConnectionDirection_outgoing,
+		Laddr:     &model.Addr{Ip: "172.17.0.1", Port: 34567},
+		Raddr:     &model.Addr{Ip: "172.17.0.2", Port: 80},
+	}
+	containerToProxy := &model.Connection{
+		Pid:       3,
+		Direction: model.ConnectionDirection_incoming,
+		Laddr:     &model.Addr{Ip: "172.17.0.2", Port: 80},
+		Raddr:     &model.Addr{Ip: "172.17.0.1", Port: 34567},
+	}
+
+	payload := &model.Connections{Conns: []*model.Connection{clientToProxy, proxyToContainer, containerToProxy}}
+	f.Filter(payload)
+	assert.Equal(t, []*model.Connection{clientToProxy}, payload.Conns)
+	assert.Equal(t, model.Addr{Ip: "172.17.0.2", Port: 80}, f.proxyByPID[1].target)
+
+	// the discovered target survives reloads
+	f.LoadProxies(procs)
+	assert.Equal(t, model.Addr{Ip: "172.17.0.2", Port: 80}, f.proxyByPID[1].target)
+	assert.Equal(t, "172.17.0.1", f.proxyByPID[1].ip)
+	assert.Len(t, f.proxyByTarget, 1)
+}
+
+type fakeProcessSource struct {
+	procs map[int32]*process.FilledProcess
+	err   error
+}
+
+func (s *fakeProcessSource) AllProcesses() (map[int32]*process.FilledProcess, error) {
+	return s.procs, s.err
+}
+
+func TestNewFilter(t *testing.T) {
+	f := NewFilter(&fakeProcessSource{procs: map[int32]*process.FilledProcess{
+		1: {Pid: 1, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-port", "8080", "-container-ip", "172.17.0.2", "-container-port", "80"}},
+		2: {Pid: 2, Cmdline: []string{"nginx", "-g", "daemon off;"}},
+	}})
+	assert.Len(t, f.proxyByPID, 1)
+	assert.Contains(t, f.proxyByPID, int32(1))
+
+	// the filter is still usable when the processes can't be listed
+	f = NewFilter(&fakeProcessSource{err: errors.New("permission denied")})
+	assert.Empty(t, f.proxyByPID)
+	payload := &model.Connections{Conns: []*model.Connection{
+		{Pid: 1, Laddr: &model.Addr{Ip: "172.17.0.1", Port: 40000}, Raddr: &model.Addr{Ip: "172.17.0.2", Port: 80}},
+	}}
+	assert.Equal(t, 0, f.Filter(payload))
+	assert.Len(t, payload.Conns, 1)
+}
+
+func TestNewFilterOptions(t *testing.T) {
+	source := &notifyingProcessSource{scans: make(chan struct{}, 1), procs: map[int32]*process.FilledProcess{
+		1: {Pid: 1, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-port", "8080", "-container-ip", "172.17.0.2", "-container-port", "80"}},
+		2: {Pid: 2, Cmdline: []string{"/opt/bin/port-shim", "-proto", "tcp", "-host-port", "8081", "-container-ip", "172.17.0.3", "-container-port", "80"}},
+	}}
+
+	var marks []Mark
+	logger := &recordingLogger{}
+	f, err := NewFilterWithError(nil,
+		WithProcessSource(source),
+		WithBinaryNames("port-shim"),
+		WithMode(MarkMode),
+		WithMarkFunc(func(_ *model.Connection, mark Mark) { marks = append(marks, mark) }),
+		WithLogger(logger),
+		WithRefreshInterval(time.Millisecond),
+	)
+	assert.NoError(t, err)
+	defer f.Stop()
+
+	// the binary names apply to the initial scan
+	<-source.scans
+	f.mux.RLock()
+	assert.Len(t, f.proxyByPID, 1)
+	assert.Contains(t, f.proxyByPID, int32(2))
+	f.mux.RUnlock()
+	assert.Equal(t, []string{"loaded 1 docker-proxy instances, 1 new, 0 removed"}, logger.messages["info"])
+
+	payload := &model.Connections{Conns: []*model.Connection{
+		{Pid: 2, Laddr: &model.Addr{Ip: "172.17.0.1", Port: 40000}, Raddr: &model.Addr{Ip: "172.17.0.3", Port: 80}},
+	}}
+	assert.Equal(t, 1, f.Filter(payload))
+	assert.Len(t, payload.Conns, 1)
+	assert.Equal(t, []Mark{{ProxyPID: 2, Target: model.Addr{Ip: "172.17.0.3", Port: 80}}}, marks)
+
+	// the refresher is running, once the second scan begins the first one was applied
+	source.setProcs(map[int32]*process.FilledProcess{})
+	<-source.scans
+	<-source.scans
+	assert.Equal(t, 0, f.ProxyCount())
+}
+
+func TestLoadProxiesPIDReuse(t *testing.T) {
+	f := newFilter()
+	f.LoadProxies(map[int32]*process.FilledProcess{
+		1: {Pid: 1, CreateTime: 1000, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-port", "8080", "-container-ip", "172.17.0.2", "-container-port", "80"}},
+		2: {Pid: 2, CreateTime: 1000, Name: "docker-proxy"},
+	})
+	f.Filter(&model.Connections{Conns: []*model.Connection{
+		{Pid: 1, Laddr: &model.Addr{Ip: "172.17.0.1", Port: 40000}, Raddr: &model.Addr{Ip: "172.17.0.2", Port: 80}},
+		{Pid: 2, Direction: model.ConnectionDirection_outgoing, Laddr: &model.Addr{Ip: "172.17.0.1", Port: 40001}, Raddr: &model.Addr{Ip: "172.17.0.3", Port: 80}},
+	}})
+	assert.Equal(t, "172.17.0.1", f.proxyByPID[1].ip)
+	assert.Equal(t, model.Addr{Ip: "172.17.0.3", Port: 80}, f.proxyByPID[2].target)
+
+	// both containers were restarted and their PIDs handed to other processes
+	f.LoadProxies(map[int32]*process.FilledProcess{
+		1: {Pid: 1, CreateTime: 2000, Cmdline: []string{"nginx", "-g", "daemon off;"}},
+		2: {Pid: 2, CreateTime: 2000, Name: "docker-proxy"},
+	})
+
+	assert.NotContains(t, f.proxyByPID, int32(1))
+	assert.Empty(t, f.proxyByHostAddr)
+	// nothing learned about the previous process is kept
+	assert.Equal(t, int64(2000), f.proxyByPID[2].createTime)
+	assert.Equal(t, model.Addr{}, f.proxyByPID[2].target)
+	assert.Equal(t, "", f.proxyByPID[2].ip)
+	assert.Empty(t, f.proxyByTarget)
+
+	// connections of the new processes aren't dropped
+	conn := &model.Connection{Pid: 1, Laddr: &model.Addr{Ip: "172.17.0.1", Port: 40000}, Raddr: &model.Addr{Ip: "172.17.0.2", Port: 80}}
+	payload := &model.Connections{Conns: []*model.Connection{conn}}
+	f.Filter(payload)
+	assert.Equal(t, []*model.Connection{conn}, payload.Conns)
+}
+
+func TestFilterWithBinaryNames(t *testing.T) {
+	procs := map[int32]*process.FilledProcess{
+		1: {Pid: 1, Cmdline: []string{"/usr/local/bin/my-proxy-shim", "-proto", "tcp", "-host-port", "8080", "-container-ip", "172.17.0.2", "-container-port", "80"}},
+		2: {Pid: 2, Cmdline: []string{"/usr/bin/docker-proxy", "-proto", "tcp", "-host-port", "8081", "-container-ip", "172.17.0.3", "-container-port", "80"}},
+		3: {Pid: 3, Cmdline: []string{"/usr/local/bin/other-shim", "-proto", "tcp", "-host-port", "8082", "-container-ip", "172.17.0.4", "-container-port", "80"}},
+	}
+
+	f := NewFilter(&fakeProcessSource{procs: procs})
+	assert.Len(t, f.proxyByPID, 1)
+	assert.Contains(t, f.proxyByPID, int32(2))
+
+	f = NewFilter(&fakeProcessSource{procs: procs}, WithBinaryNames("docker-proxy", "my-proxy-shim"))
+	assert.Len(t, f.proxyByPID, 2)
+	assert.Contains(t, f.proxyByPID, int32(1))
+	assert.Contains(t, f.proxyByPID, int32(2))
+	assert.NotContains(t, f.proxyByPID, int32(3))
+
+	f = NewFilter(&fakeProcessSource{procs: procs}, WithBinaryNames("my-proxy-shim"))
+	assert.Len(t, f.proxyByPID, 1)
+	assert.Contains(t, f.proxyByPID, int32(1))
+}
+
+// binariesFakeSource is a BinariesProcessSource only listing the processes whose argv[0] is one of the binaries asked
+// for, the registered ones when listing all of them
+type binariesFakeSource struct {
+	procs map[int32]*process.FilledProcess
+}
+
+func (s binariesFakeSource) AllProcesses() (map[int32]*process.FilledProcess, error) {
+	return s.ProcessesOf(RecognizedBinaryNames())
+}
+
+func (s binariesFakeSource) ProcessesOf(binaryNames []string) (map[int32]*process.FilledProcess, error) {
+	procs := make(map[int32]*process.FilledProcess)
+	for pid, p := range s.procs {
+		if containsString(binaryNames, binaryName(p.Cmdline[0])) {
+			procs[pid] = p
+		}
+	}
+	return procs, nil
+}
+
+func TestFilterBinariesProcessSource(t *testing.T) {
+	source := binariesFakeSource{procs: map[int32]*process.FilledProcess{
+		1: {Pid: 1, Cmdline: []string{"/usr/local/bin/my-proxy-shim", "-proto", "tcp", "-host-port", "8080", "-container-ip", "172.17.0.2", "-container-port", "80"}},
+		2: {Pid: 2, Cmdline: []string{"/usr/bin/docker-proxy", "-proto", "tcp", "-host-port", "8081", "-container-ip", "172.17.0.3", "-container-port", "80"}},
+	}}
+
+	// the source of a filter without custom binaries is kept as is
+	f := NewFilter(source)
+	assert.Equal(t, source, f.Source())
+	assert.Len(t, f.proxyByPID, 1)
+
+	// the filter lists the binaries it recognizes from it, on every refresh
+	f = NewFilter(source, WithBinaryNames("docker-proxy", "my-proxy-shim"))
+	procs, err := f.Source().AllProcesses()
+	assert.NoError(t, err)
+	f.Refresh(procs)
+	assert.Len(t, f.proxyByPID, 2)
+
+	// while its AllProcesses only lists the registered ones
+	procs, err = source.AllProcesses()
+	assert.NoError(t, err)
+	f.Refresh(procs)
+	assert.Len(t, f.proxyByPID, 1)
+	assert.Contains(t, f.proxyByPID, int32(2))
+}
+
+func TestFilterWithExactBinaryPath(t *testing.T) {
+	procs := map[int32]*process.FilledProcess{
+		1: {Pid: 1, Exe: "/usr/bin/docker-proxy", Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-port", "8080", "-container-ip", "172.17.0.2", "-container-port", "80"}},
+		2: {Pid: 2, Cmdline: []string{"/usr/bin/docker-proxy", "-proto", "tcp", "-host-port", "8081", "-container-ip", "172.17.0.3", "-container-port", "80"}},
+		// merely named like a docker-proxy
+		3: {Pid: 3, Exe: "/tmp/docker-proxy", Cmdline: []string{"/usr/bin/docker-proxy", "-proto", "tcp", "-host-port", "8082", "-container-ip", "172.17.0.4", "-container-port", "80"}},
+		4: {Pid: 4, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-port", "8083", "-container-ip", "172.17.0.5", "-container-port", "80"}},
+		5: {Pid: 5, Name: "docker-proxy"},
+		// the commands run by a shell aren't resolved paths
+		6: {Pid: 6, Exe: "/bin/dash", Cmdline: []string{"sh", "-c", "exec /usr/bin/docker-proxy -proto tcp -host-port 8084 -container-ip 172.17.0.6 -container-port 80"}},
+	}
+
+	f := NewFilter(&fakeProcessSource{procs: procs})
+	assert.Len(t, f.proxyByPID, 6)
+
+	f = NewFilter(&fakeProcessSource{procs: procs}, WithExactBinaryPath("/usr/bin/docker-proxy"))
+	assert.Len(t, f.proxyByPID, 2)
+	assert.Contains(t, f.proxyByPID, int32(1))
+	assert.Contains(t, f.proxyByPID, int32(2))
+	assert.True(t, f.IsProxied(&model.Connection{Pid: 1, Laddr: &model.Addr{Ip: "172.17.0.1", Port: 40000}, Raddr: &model.Addr{Ip: "172.17.0.2", Port: 80}}))
+	assert.False(t, f.IsProxied(&model.Connection{Pid: 3, Laddr: &model.Addr{Ip: "172.17.0.1", Port: 40000}, Raddr: &model.Addr{Ip: "172.17.0.4", Port: 80}}))
+
+	// the binary must still be recognized
+	shim := &fakeProcessSource{procs: map[int32]*process.FilledProcess{
+		1: {Pid: 1, Exe: "/opt/bin/my-proxy-shim", Cmdline: []string{"my-proxy-shim", "-container-ip", "172.17.0.2", "-container-port", "80"}},
+	}}
+	f = NewFilter(shim, WithExactBinaryPath("/opt/bin/my-proxy-shim"))
+	assert.Empty(t, f.proxyByPID)
+	f = NewFilter(shim, WithExactBinaryPath("/opt/bin/my-proxy-shim"), WithBinaryNames("my-proxy-shim"))
+	assert.Contains(t, f.proxyByPID, int32(1))
+}
+
+func TestFilterWithHostPortMatching(t *testing.T) {
+	procs := map[int32]*process.FilledProcess{
+		1: {Pid: 1, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-ip", "0.0.0.0", "-host-port", "8080", "-container-ip", "172.17.0.2", "-container-port", "80"}},
+	}
+	// the target legs observed with the host port
+	payload := func() *model.Connections {
+		return &model.Connections{Conns: []*model.Connection{
+			{Pid: 1, Laddr: &model.Addr{Ip: "172.17.0.1", Port: 34567}, Raddr: &model.Addr{Ip: "172.17.0.2", Port: 8080}, Direction: model.ConnectionDirection_outgoing},
+			{Pid: 2, Laddr: &model.Addr{Ip: "172.17.0.2", Port: 8080}, Raddr: &model.Addr{Ip: "172.17.0.1", Port: 34567}, Direction: model.ConnectionDirection_incoming},
+			{Pid: 2, Laddr: &model.Addr{Ip: "172.17.0.2", Port: 8080}, Raddr: &model.Addr{Ip: "172.17.0.9", Port: 50000}, Direction: model.ConnectionDirection_incoming},
+		}}
+	}
+
+	f := newFilter()
+	f.LoadProxies(procs)
+	assert.Equal(t, 0, f.Filter(payload()))
+
+	f = newFilter(WithHostPortMatching())
+	f.LoadProxies(procs)
+	filtered := payload()
+	assert.Equal(t, 2, f.Filter(filtered))
+	assert.Equal(t, "172.17.0.1", f.proxyByPID[1].ip)
+	if assert.Len(t, filtered.Conns, 1) {
+		assert.Equal(t, "172.17.0.9", filtered.Conns[0].Raddr.Ip)
+	}
+
+	// the actual target of another proxy takes precedence, whatever the order the proxies are loaded in
+	procs[2] = &process.FilledProcess{Pid: 2, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-port", "9090", "-container-ip", "172.17.0.2", "-container-port", "8080"}}
+	for i := 0; i < 5; i++ {
+		f = newFilter(WithHostPortMatching())
+		f.LoadProxies(procs)
+		if p, ok := f.LookupProxy(model.Addr{Ip: "172.17.0.2", Port: 8080}); assert.True(t, ok) {
+			assert.Equal(t, int32(2), p.PID)
+		}
+	}
+
+	// the host port targets are removed along with their proxy
+	delete(procs, 2)
+	f.Refresh(procs)
+	delete(procs, 1)
+	f.Refresh(procs)
+	assert.Empty(t, f.proxyByTarget)
+}
+
+func TestIsProxied(t *testing.T) {
+	f := NewFilter(&fakeProcessSource{procs: map[int32]*process.FilledProcess{
+		1: {Pid: 1, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-ip", "0.0.0.0", "-host-port", "8080", "-container-ip", "172.17.0.2", "-container-port", "80"}},
+	}})
+
+	// raddr match: docker-proxy -> container, as seen by docker-proxy
+	proxyToContainer := &model.Connection{Pid: 1, Laddr: &model.Addr{Ip: "172.17.0.1", Port: 40000}, Raddr: &model.Addr{Ip: "172.17.0.2", Port: 80}}
+	assert.True(t, f.IsProxied(proxyToContainer))
+
+	// laddr match: docker-proxy -> container, as seen by the container; only known once the proxy IP is discovered
+	containerToProxy := &model.Connection{Pid: 2, Laddr: &model.Addr{Ip: "172.17.0.2", Port: 80}, Raddr: &model.Addr{Ip: "172.17.0.1", Port: 40000}}
+	assert.False(t, f.IsProxied(containerToProxy))
+	f.Filter(&model.Connections{Conns: []*model.Connection{proxyToContainer}})
+	assert.True(t, f.IsProxied(containerToProxy))
+
+	// an unrelated connection of the container
+	assert.False(t, f.IsProxied(&model.Connection{Pid: 2, Laddr: &model.Addr{Ip: "172.17.0.2", Port: 80}, Raddr: &model.Addr{Ip: "172.17.0.5", Port: 50000}}))
+}
+
+func TestFilterTranslatedConnections(t *testing.T) {
+	f := NewFilter(&fakeProcessSource{procs: map[int32]*process.FilledProcess{
+		1: {Pid: 1, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-port", "8080", "-container-ip", "172.17.0.2", "-container-port", "80"}},
+	}})
+
+	// docker-proxy -> service IP, DNATed to the container
+	translated := func(t *model.IPTranslation) *model.Connection {
+		return &model.Connection{
+			Pid:           1,
+			Laddr:         &model.Addr{Ip: "172.17.0.1", Port: 34567},
+			Raddr:         &model.Addr{Ip: "10.96.0.10", Port: 80},
+			Direction:     model.ConnectionDirection_outgoing,
+			IpTranslation: t,
+		}
+	}
+	dnat := &model.IPTranslation{ReplSrcIP: "172.17.0.2", ReplSrcPort: 80, ReplDstIP: "172.17.0.1", ReplDstPort: 34567}
+	assert.True(t, f.IsProxied(translated(dnat)))
+
+	payload := &model.Connections{Conns: []*model.Connection{
+		translated(dnat),
+		// older payloads don't carry any translation
+		translated(nil),
+		translated(&model.IPTranslation{}),
+		// translated to another container
+		translated(&model.IPTranslation{ReplSrcIP: "172.17.0.3", ReplSrcPort: 80, ReplDstIP: "172.17.0.1", ReplDstPort: 34567}),
+	}}
+	assert.Equal(t, 1, f.Filter(payload))
+	if assert.Len(t, payload.Conns, 3) {
+		assert.Nil(t, payload.Conns[0].IpTranslation)
+		assert.Equal(t, &model.IPTranslation{}, payload.Conns[1].IpTranslation)
+		assert.Equal(t, "172.17.0.3", payload.Conns[2].IpTranslation.ReplSrcIP)
+	}
+
+	// the published address a client connected to only matches untranslated
+	assert.False(t, f.IsProxied(&model.Connection{
+		Pid:           1,
+		Laddr:         &model.Addr{Ip: "172.17.0.2", Port: 80},
+		Raddr:         &model.Addr{Ip: "10.0.0.9", Port: 50000},
+		Direction:     model.ConnectionDirection_incoming,
+		IpTranslation: &model.IPTranslation{ReplSrcIP: "10.0.0.9", ReplSrcPort: 50000, ReplDstIP: "10.0.0.5", ReplDstPort: 8080},
+	}))
+}
+
+// notifyingProcessSource signals every scan on the scans channel, dropping the signals nobody waits for
+type notifyingProcessSource struct {
+	mux   sync.Mutex
+	procs map[int32]*process.FilledProcess
+	scans chan struct{}
+}
+
+func (s *notifyingProcessSource) AllProcesses() (map[int32]*process.FilledProcess, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	select {
+	case s.scans <- struct{}{}:
+	default:
+	}
+	return s.procs, nil
+}
+
+func (s *notifyingProcessSource) setProcs(procs map[int32]*process.FilledProcess) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.procs = procs
+}
+
+func TestFilterStartStop(t *testing.T) {
+	source := &notifyingProcessSource{scans: make(chan struct{}, 1)}
+	f := NewFilter(source)
+	<-source.scans
+	assert.Empty(t, f.proxyByPID)
+
+	// a container is started after the filter was created
+	source.setProcs(map[int32]*process.FilledProcess{
+		1: {Pid: 1, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-port", "8080", "-container-ip", "172.17.0.2", "-container-port", "80"}},
+	})
+
+	f.Start(time.Millisecond)
+	// starting twice doesn't spawn another refresher
+	f.Start(time.Millisecond)
+
+	// once the second scan begins, the first one was applied
+	<-source.scans
+	<-source.scans
+	assert.True(t, f.IsProxied(&model.Connection{Pid: 1, Laddr: &model.Addr{Ip: "172.17.0.1", Port: 40000}, Raddr: &model.Addr{Ip: "172.17.0.2", Port: 80}}))
+
+	// and stopped
+	source.setProcs(map[int32]*process.FilledProcess{})
+	<-source.scans
+	<-source.scans
+	assert.False(t, f.IsProxied(&model.Connection{Pid: 1, Laddr: &model.Addr{Ip: "172.17.0.1", Port: 40000}, Raddr: &model.Addr{Ip: "172.17.0.2", Port: 80}}))
+
+	f.Stop()
+	f.Stop()
+
+	// no scan happens once stopped
+	select {
+	case <-source.scans:
+	default:
+	}
+	time.Sleep(10 * time.Millisecond)
+	select {
+	case <-source.scans:
+		t.Error("the process source was scanned after Stop")
+	default:
+	}
+}
+
+func TestDiscoverProxyIPSameTargetIP(t *testing.T) {
+	f := NewFilter(&fakeProcessSource{procs: map[int32]*process.FilledProcess{
+		1: {Pid: 1, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-port", "8080", "-container-ip", "10.0.0.5", "-container-port", "80"}},
+		2: {Pid: 2, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-port", "8443", "-container-ip", "10.0.0.5", "-container-port", "443"}},
+	}})
+
+	f.Filter(&model.Connections{Conns: []*model.Connection{
+		// the first proxy connects to the target of the second one: it must not be taken into account
+		{Pid: 1, Laddr: &model.Addr{Ip: "10.0.0.100", Port: 40000}, Raddr: &model.Addr{Ip: "10.0.0.5", Port: 443}},
+		{Pid: 2, Laddr: &model.Addr{Ip: "10.0.0.1", Port: 40001}, Raddr: &model.Addr{Ip: "10.0.0.5", Port: 443}},
+	}})
+	assert.Equal(t, "", f.proxyByPID[1].ip)
+	assert.Equal(t, "10.0.0.1", f.proxyByPID[2].ip)
+
+	f.Filter(&model.Connections{Conns: []*model.Connection{
+		{Pid: 1, Laddr: &model.Addr{Ip: "10.0.0.2", Port: 40002}, Raddr: &model.Addr{Ip: "10.0.0.5", Port: 80}},
+		// a conflicting IP doesn't overwrite the discovered one
+		{Pid: 2, Laddr: &model.Addr{Ip: "10.0.0.3", Port: 40003}, Raddr: &model.Addr{Ip: "10.0.0.5", Port: 443}},
+	}})
+	assert.Equal(t, "10.0.0.2", f.proxyByPID[1].ip)
+	assert.Equal(t, "10.0.0.1", f.proxyByPID[2].ip)
+}
+
+func TestHandleProcessEvents(t *testing.T) {
+	f := newFilter()
+	conn := &model.Connection{Pid: 1, Laddr: &model.Addr{Ip: "172.17.0.1", Port: 40000}, Raddr: &model.Addr{Ip: "172.17.0.2", Port: 80}}
+
+	f.HandleProcessEvents([]*process.FilledProcess{
+		{Pid: 1, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-port", "8080", "-container-ip", "172.17.0.2", "-container-port", "80"}},
+		{Pid: 2, Cmdline: []string{"nginx", "-g", "daemon off;"}},
+	}, nil)
+	assert.Len(t, f.proxyByPID, 1)
+	assert.True(t, f.IsProxied(conn))
+
+	f.HandleProcessEvents(nil, []int32{1, 2})
+	assert.Empty(t, f.proxyByPID)
+	assert.Empty(t, f.proxyByTarget)
+	assert.Empty(t, f.proxyByHostAddr)
+	assert.False(t, f.IsProxied(conn))
+}
+
+func TestLoadProxiesDelta(t *testing.T) {
+	f := newFilter()
+	f.LoadProxies(map[int32]*process.FilledProcess{
+		1: {Pid: 1, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-port", "8080", "-container-ip", "172.17.0.2", "-container-port", "80"}},
+		2: {Pid: 2, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-port", "8081", "-container-ip", "172.17.0.3", "-container-port", "80"}},
+		3: {Pid: 3, Cmdline: []string{"nginx", "-g", "daemon off;"}},
+	})
+	unchanged := f.proxyByPID[1]
+
+	// PID 2 exited and was reused by another proxy, while PID 4 started
+	f.LoadProxiesDelta(map[int32]*process.FilledProcess{
+		2: {Pid: 2, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-port", "8082", "-container-ip", "172.17.0.4", "-container-port", "80"}},
+		4: {Pid: 4, Cmdline: []string{"docker-proxy", "-proto", "udp", "-host-port", "53", "-container-ip", "172.17.0.5", "-container-port", "53"}},
+	}, []int32{2, 3})
+
+	assert.Len(t, f.proxyByPID, 3)
+	assert.True(t, unchanged == f.proxyByPID[1])
+	assert.Equal(t, model.Addr{Ip: "172.17.0.4", Port: 80}, f.proxyByPID[2].target)
+	assert.NotContains(t, f.proxyByTarget, testProxyKey(model.Addr{Ip: "172.17.0.3", Port: 80}, "tcp", 0))
+	assert.Contains(t, f.proxyByTarget, testProxyKey(model.Addr{Ip: "172.17.0.4", Port: 80}, "tcp", 0))
+	assert.Contains(t, f.proxyByTarget, testProxyKey(model.Addr{Ip: "172.17.0.5", Port: 53}, "udp", 0))
+	assert.Len(t, f.proxyByHostAddr, 3)
+
+	f.LoadProxiesDelta(nil, []int32{1, 2, 4})
+	assert.Empty(t, f.proxyByPID)
+	assert.Empty(t, f.proxyByTarget)
+	assert.Empty(t, f.proxyByHostAddr)
+}
+
+func TestHandleProcessEventsConcurrency(t *testing.T) {
+	f := newFilter()
+	started := []*process.FilledProcess{
+		{Pid: 1, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-port", "8080", "-container-ip", "172.17.0.2", "-container-port", "80"}},
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			f.HandleProcessEvents(started, nil)
+			f.HandleProcessEvents(nil, []int32{1})
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			f.Filter(&model.Connections{Conns: []*model.Connection{
+				{Pid: 1, Laddr: &model.Addr{Ip: "172.17.0.1", Port: 40000}, Raddr: &model.Addr{Ip: "172.17.0.2", Port: 80}},
+			}})
+		}
+	}()
+	wg.Wait()
+}
+
+func TestProxyCount(t *testing.T) {
+	procs := map[int32]*process.FilledProcess{
+		1: {Pid: 1, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-port", "8080", "-container-ip", "172.17.0.2", "-container-port", "80"}},
+		2: {Pid: 2, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-port", "8081", "-container-ip", "172.17.0.3", "-container-port", "80"}},
+		3: {Pid: 3, Cmdline: []string{"nginx", "-g", "daemon off;"}},
+	}
+
+	f := newFilter()
+	assert.Equal(t, 0, f.ProxyCount())
+
+	f.LoadProxies(procs)
+	assert.Equal(t, 2, f.ProxyCount())
+
+	// loading the same proxies again doesn't count them twice
+	f.LoadProxies(procs)
+	assert.Equal(t, 2, f.ProxyCount())
+
+	delete(procs, 2)
+	f.Refresh(procs)
+	assert.Equal(t, 1, f.ProxyCount())
+
+	f.HandleProcessEvents(nil, []int32{1})
+	assert.Equal(t, 0, f.ProxyCount())
+}
+
+func TestReset(t *testing.T) {
+	logger := &recordingLogger{}
+	f := newFilter(WithLogger(logger), WithMode(TranslateMode), WithNegativeCache())
+	f.LoadProxies(map[int32]*process.FilledProcess{
+		1: {Pid: 1, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-port", "8080", "-container-ip", "172.17.0.2", "-container-port", "80"}},
+		3: {Pid: 3, Cmdline: []string{"nginx", "-g", "daemon off;"}},
+	})
+	f.AddProxy(2, "172.17.0.1", model.Addr{Ip: "172.17.0.3", Port: 80})
+	assert.Equal(t, 2, f.ProxyCount())
+	assert.Contains(t, f.notProxies, int32(3))
+
+	f.Reset()
+	assert.Equal(t, 0, f.ProxyCount())
+	assert.Empty(t, f.notProxies)
+
+	conns := []*model.Connection{
+		{Pid: 1, Laddr: &model.Addr{Ip: "10.0.0.5", Port: 8080}, Raddr: &model.Addr{Ip: "10.0.0.42", Port: 51234}},
+		{Pid: 1, Laddr: &model.Addr{Ip: "172.17.0.1", Port: 34567}, Raddr: &model.Addr{Ip: "172.17.0.2", Port: 80}},
+		{Pid: 4, Laddr: &model.Addr{Ip: "172.17.0.3", Port: 80}, Raddr: &model.Addr{Ip: "172.17.0.1", Port: 34568}},
+	}
+	payload := &model.Connections{Conns: append([]*model.Connection(nil), conns...)}
+	assert.Equal(t, 0, f.Filter(payload))
+	assert.Equal(t, conns, payload.Conns)
+
+	// the configuration is preserved
+	assert.Equal(t, TranslateMode, f.mode)
+	assert.Equal(t, logger, f.logger)
+}
+
+func TestProxies(t *testing.T) {
+	seen := time.Unix(1577836800, 0)
+	now := seen
+	f := newFilter()
+	f.now = func() time.Time { return now }
+	assert.Empty(t, f.Proxies())
+
+	f.LoadProxies(map[int32]*process.FilledProcess{
+		2: {Pid: 2, Cmdline: []string{"docker-proxy", "-proto", "udp", "-host-ip", "10.0.0.5", "-host-port", "53", "-container-ip", "172.17.0.3", "-container-port", "53"}},
+		1: {Pid: 1, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-port", "8080", "-container-ip", "172.17.0.2", "-container-port", "80"}},
+	})
+	matched := now.Add(time.Minute)
+	now = matched
+	f.Filter(&model.Connections{Conns: []*model.Connection{
+		{Pid: 1, Laddr: &model.Addr{Ip: "172.17.0.1", Port: 34567}, Raddr: &model.Addr{Ip: "172.17.0.2", Port: 80}},
+	}})
+
+	proxies := f.Proxies()
+	assert.Equal(t, []ProxyInfo{
+		{PID: 1, IP: "172.17.0.1", Target: model.Addr{Ip: "172.17.0.2", Port: 80}, Host: model.Addr{Ip: "0.0.0.0", Port: 8080}, Proto: "tcp", Discovered: true,
+			LastSeen: seen, LastMatched: matched, Matched: 1},
+		{PID: 2, Target: model.Addr{Ip: "172.17.0.3", Port: 53}, Host: model.Addr{Ip: "10.0.0.5", Port: 53}, Proto: "udp",
+			LastSeen: seen, LastMatched: seen},
+	}, proxies)
+
+	// the snapshot is a copy of the state of the filter
+	proxies[0].IP = "10.0.0.1"
+	proxies[1].Target.Port = 5353
+	assert.Equal(t, "172.17.0.1", f.proxyByPID[1].ip)
+	assert.Equal(t, int32(53), f.proxyByPID[2].target.Port)
+}
+
+func TestLookupProxy(t *testing.T) {
+	f := newFilter()
+	f.LoadProxies(map[int32]*process.FilledProcess{
+		1: {Pid: 1, Cmdline: []string{"docker-proxy", "-proto", "udp", "-host-port", "53", "-container-ip", "172.17.0.2", "-container-port", "53"}},
+		2: {Pid: 2, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-port", "53", "-container-ip", "172.17.0.2", "-container-port", "53"}},
+		3: {Pid: 3, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-port", "8080", "-container-ip", "172.17.0.3", "-container-ip", "fd00::3", "-container-port", "80"}},
+	})
+
+	// the tcp proxy is preferred
+	p, ok := f.LookupProxy(model.Addr{Ip: "172.17.0.2", Port: 53})
+	assert.True(t, ok)
+	assert.Equal(t, int32(2), p.PID)
+	assert.Equal(t, "tcp", p.Proto)
+
+	// IPv4-mapped addresses and extra targets are looked up as well
+	p, ok = f.LookupProxy(model.Addr{Ip: "::ffff:172.17.0.3", Port: 80})
+	assert.True(t, ok)
+	assert.Equal(t, int32(3), p.PID)
+	p, ok = f.LookupProxy(model.Addr{Ip: "fd00::3", Port: 80})
+	assert.True(t, ok)
+	assert.Equal(t, int32(3), p.PID)
+	assert.Equal(t, model.Addr{Ip: "172.17.0.3", Port: 80}, p.Target)
+
+	for _, addr := range []model.Addr{
+		{Ip: "172.17.0.2", Port: 80},
+		{Ip: "172.17.0.4", Port: 53},
+		// host addresses aren't targets
+		{Ip: "0.0.0.0", Port: 8080},
+		{Ip: "not an ip", Port: 53},
+		{},
+	} {
+		_, ok := f.LookupProxy(addr)
+		assert.False(t, ok, addr)
+	}
+
+	// the returned proxy is a copy
+	p.Target.Port = 8080
+	p, _ = f.LookupProxy(model.Addr{Ip: "172.17.0.3", Port: 80})
+	assert.Equal(t, int32(80), p.Target.Port)
+
+	assert.True(t, f.IsProxyPID(1))
+	assert.True(t, f.IsProxyPID(3))
+	assert.False(t, f.IsProxyPID(4))
+	f.RemoveProxy(1)
+	assert.False(t, f.IsProxyPID(1))
+}
+
+func TestProxiesConcurrentFilter(t *testing.T) {
+	f := NewFilter(nil)
+	f.LoadProxies(map[int32]*process.FilledProcess{
+		1: {Pid: 1, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-port", "8080", "-container-ip", "172.17.0.2", "-container-port", "80"}},
+	})
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			f.Filter(&model.Connections{Conns: []*model.Connection{
+				{Pid: 1, Laddr: &model.Addr{Ip: "172.17.0.1", Port: 34567}, Raddr: &model.Addr{Ip: "172.17.0.2", Port: 80}},
+			}})
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			if proxies := f.Proxies(); assert.Len(t, proxies, 1) {
+				assert.Equal(t, int32(1), proxies[0].PID)
+			}
+		}
+	}()
+	wg.Wait()
+}
+
+func TestClone(t *testing.T) {
+	f := newFilter()
+	f.LoadProxies(map[int32]*process.FilledProcess{
+		1: {Pid: 1, CreateTime: 1000, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-ip", "10.0.0.5", "-host-port", "8080", "-container-ip", "172.17.0.2", "-container-port", "80"}},
+		2: {Pid: 2, CreateTime: 1000, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-port", "8081", "-container-ip", "172.17.0.3", "-container-port", "80"}},
+	})
+	f.Filter(&model.Connections{Conns: []*model.Connection{
+		{Pid: 1, Laddr: &model.Addr{Ip: "172.17.0.1", Port: 34567}, Raddr: &model.Addr{Ip: "172.17.0.2", Port: 80}},
+	}})
+
+	clone := f.Clone()
+	assert.Equal(t, f.Proxies(), clone.Proxies())
+	assert.Equal(t, Stats{Proxies: 2, Discovered: 1, Undiscovered: 1}, clone.Stats())
+
+	// the proxies of the original are evicted or discovered, the clone keeps the ones it was created with
+	f.Refresh(map[int32]*process.FilledProcess{
+		2: {Pid: 2, CreateTime: 1000, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-port", "8081", "-container-ip", "172.17.0.3", "-container-port", "80"}},
+	})
+	f.Filter(&model.Connections{Conns: []*model.Connection{
+		{Pid: 2, Laddr: &model.Addr{Ip: "172.17.0.1", Port: 34568}, Raddr: &model.Addr{Ip: "172.17.0.3", Port: 80}},
+	}})
+	f.AddProxy(3, "172.17.0.1", model.Addr{Ip: "172.17.0.4", Port: 80})
+	assert.Equal(t, 2, f.ProxyCount())
+
+	assert.Equal(t, 2, clone.ProxyCount())
+	assert.Len(t, clone.proxyByTarget, 2)
+	assert.Len(t, clone.proxyByHostAddr, 2)
+	assert.Equal(t, "172.17.0.1", clone.proxyByPID[1].ip)
+	assert.Equal(t, "", clone.proxyByPID[2].ip)
+	for _, p := range clone.proxyByTarget {
+		// the maps of the clone share its copies of the proxies
+		assert.True(t, clone.proxyByPID[p.pid] == p)
+	}
+
+	proxyToContainer := &model.Connection{Pid: 1, Laddr: &model.Addr{Ip: "172.17.0.1", Port: 34569}, Raddr: &model.Addr{Ip: "172.17.0.2", Port: 80}}
+	assert.True(t, clone.IsProxied(proxyToContainer))
+	assert.False(t, f.IsProxied(proxyToContainer))
+
+	// and the other way around
+	clone.Reset()
+	assert.Equal(t, 0, clone.ProxyCount())
+	assert.Equal(t, 2, f.ProxyCount())
+}
+
+func TestAddRemoveProxy(t *testing.T) {
+	f := newFilter()
+	f.AddProxy(1, "172.17.0.1", model.Addr{Ip: "172.17.0.2", Port: 80})
+	assert.Equal(t, 1, f.ProxyCount())
+
+	// the proxy IP is known upfront: the container leg is filtered without any discovery
+	containerToProxy := &model.Connection{Pid: 10, Laddr: &model.Addr{Ip: "172.17.0.2", Port: 80}, Raddr: &model.Addr{Ip: "172.17.0.1", Port: 40000}}
+	assert.True(t, f.IsProxied(containerToProxy))
+
+	// registered proxies aren't affected by process scans
+	f.Refresh(map[int32]*process.FilledProcess{
+		1: {Pid: 1, CreateTime: 1000, Cmdline: []string{"nginx", "-g", "daemon off;"}},
+	})
+	f.HandleProcessEvents(nil, []int32{1})
+	assert.True(t, f.IsProxied(containerToProxy))
+
+	f.RemoveProxy(1)
+	assert.Equal(t, 0, f.ProxyCount())
+	assert.Empty(t, f.proxyByTarget)
+	assert.False(t, f.IsProxied(containerToProxy))
+
+	// detected proxies can be removed as well
+	f.LoadProxies(map[int32]*process.FilledProcess{
+		2: {Pid: 2, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-port", "8080", "-container-ip", "172.17.0.3", "-container-port", "80"}},
+	})
+	f.RemoveProxy(2)
+	assert.Equal(t, 0, f.ProxyCount())
+	assert.Empty(t, f.proxyByTarget)
+	assert.Empty(t, f.proxyByHostAddr)
+}
+
+func TestRefreshWithTTL(t *testing.T) {
+	procs := map[int32]*process.FilledProcess{
+		1: {Pid: 1, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-port", "8080", "-container-ip", "172.17.0.2", "-container-port", "80"}},
+		2: {Pid: 2, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-port", "8081", "-container-ip", "172.17.0.3", "-container-port", "80"}},
+	}
+
+	f := newFilter(WithTTL(time.Minute))
+	f.LoadProxies(procs)
+	f.AddProxy(3, "172.17.0.1", model.Addr{Ip: "172.17.0.4", Port: 80})
+	assert.Equal(t, 3, f.ProxyCount())
+
+	// the second proxy is missing from a scan, e.g. because it raced with the scan
+	f.Refresh(map[int32]*process.FilledProcess{1: procs[1]})
+	assert.Equal(t, 3, f.ProxyCount())
+
+	// it is evicted once it hasn't been seen for the TTL
+	f.proxyByPID[1].lastSeen = time.Now().Add(-2 * time.Minute)
+	f.proxyByPID[2].lastSeen = time.Now().Add(-2 * time.Minute)
+	f.proxyByPID[3].lastSeen = time.Now().Add(-2 * time.Minute)
+	f.Refresh(map[int32]*process.FilledProcess{1: procs[1]})
+	assert.Equal(t, 2, f.ProxyCount())
+	assert.Contains(t, f.proxyByPID, int32(1))
+	assert.NotContains(t, f.proxyByPID, int32(2))
+	assert.NotContains(t, f.proxyByTarget, testProxyKey(model.Addr{Ip: "172.17.0.3", Port: 80}, "tcp", 0))
+	// registered proxies never expire
+	assert.Contains(t, f.proxyByPID, int32(3))
+}
+
+type recordingLogger struct {
+	mux      sync.Mutex
+	messages map[string][]string
+}
+
+func (l *recordingLogger) record(level, format string, params ...interface{}) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if l.messages == nil {
+		l.messages = make(map[string][]string)
+	}
+	l.messages[level] = append(l.messages[level], fmt.Sprintf(format, params...))
+}
+
+func (l *recordingLogger) Tracef(f string, params ...interface{}) { l.record("trace", f, params...) }
+func (l *recordingLogger) Debugf(f string, params ...interface{}) { l.record("debug", f, params...) }
+func (l *recordingLogger) Infof(f string, params ...interface{})  { l.record("info", f, params...) }
+func (l *recordingLogger) Warnf(f string, params ...interface{})  { l.record("warn", f, params...) }
+func (l *recordingLogger) Errorf(f string, params ...interface{}) { l.record("error", f, params...) }
+
+// quietLogger is a recordingLogger with trace logging disabled
+type quietLogger struct {
+	recordingLogger
+}
+
+func (l *quietLogger) TraceEnabled() bool { return false }
+
+// infoLogger is a quietLogger with debug logging disabled as well
+type infoLogger struct {
+	quietLogger
+}
+
+func (l *infoLogger) DebugEnabled() bool { return false }
+
+func TestFilterTracesDropped(t *testing.T) {
+	procs := map[int32]*process.FilledProcess{
+		1: {Pid: 1, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-port", "8080", "-container-ip", "fd00::2", "-container-port", "80"}},
+	}
+	newPayload := func() *model.Connections {
+		return &model.Connections{Conns: []*model.Connection{
+			{Pid: 1, Laddr: &model.Addr{Ip: "fd00::1", Port: 40000}, Raddr: &model.Addr{Ip: "fd00::2", Port: 80}},
+			{Pid: 4, Type: model.ConnectionType_udp, Laddr: &model.Addr{Ip: "10.0.0.5", Port: 50000}, Raddr: &model.Addr{Ip: "10.0.0.53", Port: 53}},
+		}}
+	}
+
+	logger := &recordingLogger{}
+	f := newFilter(WithLogger(logger))
+	f.LoadProxies(procs)
+	logger.messages = nil
+	assert.Equal(t, 1, f.Filter(newPayload()))
+	assert.Equal(t, []string{
+		"dropping tcp connection pid=1 [fd00::1]:40000 -> [fd00::2]:80, target leg of docker-proxy with pid=1 target=[fd00::2]:80",
+	}, logger.messages["trace"])
+
+	// nothing is logged unless trace logging is enabled
+	quiet := &quietLogger{}
+	f = newFilter(WithLogger(quiet))
+	f.LoadProxies(procs)
+	quiet.messages = nil
+	assert.Equal(t, 1, f.Filter(newPayload()))
+	assert.Empty(t, quiet.messages["trace"])
+}
+
+func TestFilterWithLogger(t *testing.T) {
+	logger := &recordingLogger{}
+	f := newFilter(WithLogger(logger))
+	f.LoadProxies(map[int32]*process.FilledProcess{
+		1: {Pid: 1, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-port", "8080", "-container-ip", "172.17.0.2", "-container-port", "80"}},
+		2: {Pid: 2, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-port", "8081"}},
+		3: {Pid: 3, Cmdline: []string{"/opt/scripts/check-docker-proxy"}},
+		4: {Pid: 4, Cmdline: []string{"docker-proxy", "-container-ip", "not-an-ip", "-container-port", "80"}},
+	})
+
+	assert.ElementsMatch(t, []string{
+		"ignoring docker-proxy with pid=2: no container target in its cmdline",
+		"ignoring process with pid=3: check-docker-proxy is not a known proxy binary",
+	}, logger.messages["debug"])
+	assert.Equal(t, []string{"loaded 1 docker-proxy instances, 1 new, 0 removed"}, logger.messages["info"])
+	assert.Len(t, logger.messages["warn"], 1)
+	assert.Contains(t, logger.messages["warn"][0], "skipping docker-proxy with pid=4")
+}
+
+func TestLoadLogSummary(t *testing.T) {
+	procs := make(map[int32]*process.FilledProcess)
+	for pid := int32(1); pid <= 25; pid++ {
+		procs[pid] = &process.FilledProcess{Pid: pid, Cmdline: []string{"docker-proxy", "-proto", "tcp",
+			"-host-port", fmt.Sprint(30000 + pid), "-container-ip", "172.17.0.2", "-container-port", fmt.Sprint(30000 + pid)}}
+	}
+
+	// every new proxy is logged at trace level
+	logger := &recordingLogger{}
+	f := newFilter(WithLogger(logger))
+	f.LoadProxies(procs)
+	assert.Equal(t, []string{"loaded 25 docker-proxy instances, 25 new, 0 removed"}, logger.messages["info"])
+	assert.Len(t, logger.messages["trace"], 25)
+	assert.Empty(t, logger.messages["debug"])
+
+	// a sample of them at debug level
+	quiet := &quietLogger{}
+	f = newFilter(WithLogger(quiet))
+	f.LoadProxies(procs)
+	assert.Equal(t, []string{"loaded 25 docker-proxy instances, 25 new, 0 removed"}, quiet.messages["info"])
+	assert.Empty(t, quiet.messages["trace"])
+	if assert.Len(t, quiet.messages["debug"], 1) {
+		assert.True(t, strings.HasPrefix(quiet.messages["debug"][0], "new docker-proxy instances (10 of 25): pid="))
+		assert.Equal(t, 9, strings.Count(quiet.messages["debug"][0], ", "))
+	}
+
+	// and only the summary otherwise
+	info := &infoLogger{}
+	f = newFilter(WithLogger(info))
+	f.LoadProxies(procs)
+	delete(procs, 25)
+	f.Refresh(procs)
+	assert.Equal(t, []string{
+		"loaded 25 docker-proxy instances, 25 new, 0 removed",
+		"loaded 24 docker-proxy instances, 0 new, 1 removed",
+	}, info.messages["info"])
+	assert.Empty(t, info.messages["debug"])
+	assert.Empty(t, info.messages["trace"])
+
+	// nothing is logged if nothing changed
+	f.Refresh(procs)
+	assert.Len(t, info.messages["info"], 2)
+
+	// the whole set of proxies is still available on demand
+	assert.Len(t, f.Proxies(), 24)
+}
+
+func TestDiscoveryStats(t *testing.T) {
+	procs := map[int32]*process.FilledProcess{
+		1: {Pid: 1, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-port", "8080", "-container-ip", "172.17.0.2", "-container-port", "80"}},
+		2: {Pid: 2, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-port", "8081", "-container-ip", "172.17.0.3", "-container-port", "80"}},
+		// the IP of a proxy forwarding to a loopback target is never learned
+		3: {Pid: 3, Exe: "/usr/bin/rootlesskit", Cmdline: []string{"rootlesskit", "--publish", "0.0.0.0:8082:80/tcp", "dockerd"}},
+	}
+	proxyToContainer := func(pid int32, target string) *model.Connection {
+		return &model.Connection{Pid: pid, Laddr: &model.Addr{Ip: "172.17.0.1", Port: 40000 + pid}, Raddr: &model.Addr{Ip: target, Port: 80}}
+	}
+
+	logger := &recordingLogger{}
+	f := newFilter(WithLogger(logger))
+	for i := 0; i < undiscoveredRefreshes-1; i++ {
+		f.Refresh(procs)
+	}
+	stats := f.Stats()
+	assert.Equal(t, uint64(0), stats.Discovered)
+	assert.Equal(t, uint64(2), stats.Undiscovered)
+	assert.Empty(t, logger.messages["warn"])
+
+	// the IPs still unknown after several refreshes are warned about once
+	f.Refresh(procs)
+	f.Refresh(procs)
+	if assert.Len(t, logger.messages["warn"], 1) {
+		assert.True(t, strings.HasPrefix(logger.messages["warn"][0], "the IP of 2 out of 2 docker-proxy instances is still unknown after 3 refreshes"))
+	}
+
+	// the counters move as the IPs are discovered
+	f.Filter(&model.Connections{Conns: []*model.Connection{proxyToContainer(1, "172.17.0.2")}})
+	stats = f.Stats()
+	assert.Equal(t, uint64(1), stats.Discovered)
+	assert.Equal(t, uint64(1), stats.Undiscovered)
+
+	// half of the proxies is still over the threshold
+	f.Refresh(procs)
+	assert.Len(t, logger.messages["warn"], 1)
+
+	f.Filter(&model.Connections{Conns: []*model.Connection{proxyToContainer(2, "172.17.0.3")}})
+	stats = f.Stats()
+	assert.Equal(t, uint64(2), stats.Discovered)
+	assert.Equal(t, uint64(0), stats.Undiscovered)
+	f.Refresh(procs)
+
+	// a new proxy is only accounted for once it was part of several refreshes, and warned about again
+	procs[4] = &process.FilledProcess{Pid: 4, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-port", "8083", "-container-ip", "172.17.0.4", "-container-port", "80"}}
+	procs[5] = &process.FilledProcess{Pid: 5, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-port", "8084", "-container-ip", "172.17.0.5", "-container-port", "80"}}
+	for i := 0; i < undiscoveredRefreshes-1; i++ {
+		f.Refresh(procs)
+	}
+	assert.Len(t, logger.messages["warn"], 1)
+	f.Refresh(procs)
+	if assert.Len(t, logger.messages["warn"], 2) {
+		assert.True(t, strings.HasPrefix(logger.messages["warn"][1], "the IP of 2 out of 4 docker-proxy instances is still unknown"))
+	}
+}
+
+func TestRefreshPreservesProxyIPs(t *testing.T) {
+	procs := map[int32]*process.FilledProcess{
+		1: {Pid: 1, CreateTime: 1000, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-port", "8080", "-container-ip", "172.17.0.2", "-container-port", "80"}},
+	}
+
+	f := newFilter()
+	f.LoadProxies(procs)
+
+	proxyToContainer := &model.Connection{Pid: 1, Laddr: &model.Addr{Ip: "172.17.0.1", Port: 40000}, Raddr: &model.Addr{Ip: "172.17.0.2", Port: 80}}
+	containerToProxy := &model.Connection{Pid: 10, Laddr: &model.Addr{Ip: "172.17.0.2", Port: 80}, Raddr: &model.Addr{Ip: "172.17.0.1", Port: 40000}}
+	payload := &model.Connections{Conns: []*model.Connection{proxyToContainer, containerToProxy}}
+	assert.Equal(t, 2, f.Filter(payload))
+
+	f.Refresh(procs)
+	f.Refresh(procs)
+
+	// the container leg, which can only be matched through the proxy IP, is filtered without rediscovery
+	payload = &model.Connections{Conns: []*model.Connection{containerToProxy}}
+	assert.Equal(t, 1, f.Filter(payload))
+	assert.Empty(t, payload.Conns)
+
+	// a proxy restarted with another target starts over
+	procs[1] = &process.FilledProcess{Pid: 1, CreateTime: 1000, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-port", "8080", "-container-ip", "172.17.0.3", "-container-port", "80"}}
+	f.Refresh(procs)
+	assert.Equal(t, "", f.proxyByPID[1].ip)
+}
+
+func TestNegativeCache(t *testing.T) {
+	f := newFilter(WithNegativeCache())
+	f.Refresh(map[int32]*process.FilledProcess{
+		1: {Pid: 1, CreateTime: 1000, Cmdline: []string{"nginx", "-g", "daemon off;"}},
+	})
+	assert.Equal(t, map[int32]int64{1: 1000}, f.notProxies)
+
+	// the same process isn't inspected again
+	f.Refresh(map[int32]*process.FilledProcess{
+		1: {Pid: 1, CreateTime: 1000, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-port", "8080", "-container-ip", "172.17.0.2", "-container-port", "80"}},
+	})
+	assert.Equal(t, 0, f.ProxyCount())
+
+	// a reused PID is
+	f.Refresh(map[int32]*process.FilledProcess{
+		1: {Pid: 1, CreateTime: 2000, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-port", "8080", "-container-ip", "172.17.0.2", "-container-port", "80"}},
+	})
+	assert.Equal(t, 1, f.ProxyCount())
+	assert.Empty(t, f.notProxies)
+
+	// exited processes are forgotten
+	f.Refresh(map[int32]*process.FilledProcess{
+		2: {Pid: 2, CreateTime: 1000, Cmdline: []string{"nginx", "-g", "daemon off;"}},
+	})
+	assert.Equal(t, map[int32]int64{2: 1000}, f.notProxies)
+	f.HandleProcessEvents(nil, []int32{2})
+	assert.Empty(t, f.notProxies)
+}
+
+func BenchmarkRefresh(b *testing.B) {
+	b.Run("without negative cache", func(b *testing.B) { benchmarkRefresh(b) })
+	b.Run("with negative cache", func(b *testing.B) { benchmarkRefresh(b, WithNegativeCache()) })
+}
+
+func benchmarkRefresh(b *testing.B, opts ...Option) {
+	procs := make(map[int32]*process.FilledProcess, 5000)
+	for i := int32(0); i < 5000; i++ {
+		procs[i] = &process.FilledProcess{
+			Pid:        i,
+			CreateTime: 1000,
+			Exe:        "/usr/bin/python3",
+			Cmdline:    []string{"python3", "/opt/app/worker.py", "--queue", "default", "--concurrency", "4"},
+		}
+	}
+	for i := int32(5000); i < 5050; i++ {
+		procs[i] = &process.FilledProcess{
+			Pid:        i,
+			CreateTime: 1000,
+			Exe:        "/usr/bin/docker-proxy",
+			Cmdline:    []string{"/usr/bin/docker-proxy", "-proto", "tcp", "-host-ip", "0.0.0.0", "-host-port", "8080", "-container-ip", "172.17.0.2", "-container-port", "80"},
+		}
+	}
+
+	f := newFilter(opts...)
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		f.Refresh(procs)
+	}
+}
+
+// cancellingLogger cancels a context once the proxy without target is inspected
+type cancellingLogger struct {
+	recordingLogger
+	cancel context.CancelFunc
+}
+
+func (l *cancellingLogger) Debugf(f string, params ...interface{}) {
+	if strings.Contains(f, "no container target") {
+		l.cancel()
+	}
+	l.recordingLogger.Debugf(f, params...)
+}
+
+func TestRefreshContextCancelled(t *testing.T) {
+	newProcs := func(createTime int64) map[int32]*process.FilledProcess {
+		procs := make(map[int32]*process.FilledProcess)
+		for pid := int32(1); pid <= 4*loadBatchSize; pid++ {
+			procs[pid] = &process.FilledProcess{Pid: pid, CreateTime: createTime, Cmdline: []string{"docker-proxy", "-proto", "tcp",
+				"-host-port", fmt.Sprint(pid), "-container-ip", "172.17.0.2", "-container-port", fmt.Sprint(pid)}}
+		}
+		// the context is cancelled while the processes are inspected
+		procs[1].Cmdline = []string{"docker-proxy", "-proto", "tcp", "-host-port", "1"}
+		return procs
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	logger := &cancellingLogger{cancel: cancel}
+	f := newFilter(WithLogger(logger))
+	f.AddProxy(100000, "172.17.0.1", model.Addr{Ip: "172.17.0.3", Port: 80})
+	f.Refresh(map[int32]*process.FilledProcess{
+		2: {Pid: 2, CreateTime: 1, Cmdline: []string{"docker-proxy", "-proto", "udp", "-host-port", "53", "-container-ip", "172.17.0.4", "-container-port", "53"}},
+	})
+	proxies := f.Proxies()
+
+	// nothing is committed, neither the new proxies nor the evictions
+	assert.Equal(t, context.Canceled, f.RefreshContext(ctx, newProcs(2)))
+	assert.Equal(t, proxies, f.Proxies())
+	assert.Equal(t, context.Canceled, f.LoadProxiesContext(ctx, newProcs(2)))
+	assert.Equal(t, proxies, f.Proxies())
+	assert.Len(t, f.proxyByTarget, 2)
+	assert.Len(t, f.proxyByHostAddr, 1)
+
+	// without cancellation, the whole snapshot is applied
+	assert.NoError(t, f.RefreshContext(context.Background(), newProcs(2)))
+	assert.Equal(t, 4*loadBatchSize, f.ProxyCount())
+	assert.False(t, f.IsProxyPID(1))
+	assert.True(t, f.IsProxyPID(100000))
+	p, ok := f.LookupProxy(model.Addr{Ip: "172.17.0.2", Port: 2})
+	assert.True(t, ok)
+	assert.Equal(t, int32(2), p.PID)
+	_, ok = f.LookupProxy(model.Addr{Ip: "172.17.0.4", Port: 53})
+	assert.False(t, ok)
+}
+
+func TestRefreshDaemonRestart(t *testing.T) {
+	proxyProcs := func(pids ...int32) map[int32]*process.FilledProcess {
+		procs := make(map[int32]*process.FilledProcess)
+		for i, pid := range pids {
+			procs[pid] = &process.FilledProcess{Pid: pid, CreateTime: int64(pid), Cmdline: []string{
+				"docker-proxy", "-proto", "tcp", "-host-port", fmt.Sprint(8080 + i), "-container-ip", fmt.Sprintf("172.17.0.%d", 2+i), "-container-port", "80",
+			}}
+		}
+		return procs
+	}
+
+	logger := &recordingLogger{}
+	f := newFilter(WithLogger(logger))
+	f.Refresh(proxyProcs(1, 2, 3))
+	assert.Equal(t, []string{"loaded 3 docker-proxy instances, 3 new, 0 removed"}, logger.messages["info"])
+
+	// dockerd respawned every docker-proxy but the first one
+	f.Refresh(proxyProcs(1, 12, 13))
+	assert.Equal(t, "loaded 3 docker-proxy instances, 2 new, 2 removed", logger.messages["info"][1])
+	assert.Equal(t, 3, f.ProxyCount())
+	assert.Len(t, f.proxyByTarget, 3)
+	assert.Len(t, f.proxyByHostAddr, 3)
+
+	// the filter never observes a half-updated set of proxies
+	var wg sync.WaitGroup
+	wg.Add(2)
+	done := make(chan struct{})
+	go func() {
+		defer wg.Done()
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			f.Refresh(proxyProcs(21, 22, 23))
+			f.Refresh(proxyProcs(31, 32, 33))
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				assert.Equal(t, 3, f.ProxyCount())
+			}
+		}
+	}()
+	wg.Wait()
+}
+
+func TestNewFilterWithError(t *testing.T) {
+	source := &fakeProcessSource{err: errors.New("permission denied")}
+	f, err := NewFilterWithError(source)
+	assert.EqualError(t, err, "permission denied")
+	assert.NotNil(t, f)
+	assert.Equal(t, 0, f.ProxyCount())
+
+	// the filter can still be refreshed once the processes can be listed
+	f.Refresh(map[int32]*process.FilledProcess{
+		1: {Pid: 1, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-port", "8080", "-container-ip", "172.17.0.2", "-container-port", "80"}},
+	})
+	assert.Equal(t, 1, f.ProxyCount())
+
+	source = &fakeProcessSource{procs: map[int32]*process.FilledProcess{
+		1: {Pid: 1, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-port", "8080", "-container-ip", "172.17.0.2", "-container-port", "80"}},
+	}}
+	f, err = NewFilterWithError(source)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, f.ProxyCount())
+}
+
+func TestFilterTranslateMode(t *testing.T) {
+	f := newFilter(WithMode(TranslateMode))
+	f.LoadProxies(map[int32]*process.FilledProcess{
+		1: {Pid: 1, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-ip", "0.0.0.0", "-host-port", "8080", "-container-ip", "172.17.0.2", "-container-port", "80"}},
+	})
+
+	clientToProxy := &model.Connection{
+		Pid:               1,
+		Laddr:             &model.Addr{Ip: "10.0.0.5", Port: 8080},
+		Raddr:             &model.Addr{Ip: "10.0.0.42", Port: 51234},
+		LastBytesSent:     100,
+		LastBytesReceived: 200,
+	}
+	proxyToContainer := &model.Connection{Pid: 1, Laddr: &model.Addr{Ip: "172.17.0.1", Port: 34567}, Raddr: &model.Addr{Ip: "172.17.0.2", Port: 80}}
+	containerToProxy := &model.Connection{Pid: 3, Laddr: &model.Addr{Ip: "172.17.0.2", Port: 80}, Raddr: &model.Addr{Ip: "172.17.0.1", Port: 34567}}
+	unrelated := &model.Connection{Pid: 4, Laddr: &model.Addr{Ip: "10.0.0.5", Port: 22}, Raddr: &model.Addr{Ip: "10.0.0.42", Port: 51235}}
+
+	payload := &model.Connections{Conns: []*model.Connection{clientToProxy, proxyToContainer, containerToProxy, unrelated}}
+	assert.Equal(t, 2, f.Filter(payload))
+	assert.Equal(t, []*model.Connection{clientToProxy, unrelated}, payload.Conns)
+
+	// the client leg now reports the true service edge, with its counters preserved
+	assert.Equal(t, &model.Addr{Ip: "172.17.0.2", Port: 80}, clientToProxy.Laddr)
+	assert.Equal(t, &model.Addr{Ip: "10.0.0.42", Port: 51234}, clientToProxy.Raddr)
+	assert.Equal(t, &model.IPTranslation{ReplSrcIP: "10.0.0.42", ReplSrcPort: 51234, ReplDstIP: "10.0.0.5", ReplDstPort: 8080}, clientToProxy.IpTranslation)
+	assert.Equal(t, uint64(100), clientToProxy.LastBytesSent)
+	assert.Equal(t, uint64(200), clientToProxy.LastBytesReceived)
+
+	assert.Equal(t, Stats{Examined: 4, Dropped: 2, Kept: 2, Translated: 1, Proxies: 1, ProxyInsertions: 1, ProxyLookups: 4, Discovered: 1, ProxyIPDiscoveries: 1}, f.Stats())
+}
+
+func TestFilterMarkMode(t *testing.T) {
+	procs := map[int32]*process.FilledProcess{
+		1: {Pid: 1, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-ip", "0.0.0.0", "-host-port", "8080", "-container-ip", "172.17.0.2", "-container-port", "80"}},
+	}
+	clientToProxy := &model.Connection{Pid: 1, Laddr: &model.Addr{Ip: "10.0.0.5", Port: 8080}, Raddr: &model.Addr{Ip: "10.0.0.42", Port: 51234}}
+	proxyToContainer := &model.Connection{Pid: 1, Laddr: &model.Addr{Ip: "172.17.0.1", Port: 34567}, Raddr: &model.Addr{Ip: "172.17.0.2", Port: 80}}
+	containerToProxy := &model.Connection{Pid: 3, Laddr: &model.Addr{Ip: "172.17.0.2", Port: 80}, Raddr: &model.Addr{Ip: "172.17.0.1", Port: 34567}}
+	unrelated := &model.Connection{Pid: 4, Laddr: &model.Addr{Ip: "10.0.0.5", Port: 22}, Raddr: &model.Addr{Ip: "10.0.0.42", Port: 51235}}
+	conns := []*model.Connection{clientToProxy, proxyToContainer, containerToProxy, unrelated}
+
+	marks := make(map[*model.Connection]Mark)
+	f := newFilter(WithMarkFunc(func(c *model.Connection, m Mark) { marks[c] = m }))
+	f.LoadProxies(procs)
+
+	payload := &model.Connections{Conns: conns}
+	assert.Equal(t, 3, f.Filter(payload))
+	assert.Equal(t, conns, payload.Conns)
+
+	expected := Mark{ProxyPID: 1, Target: model.Addr{Ip: "172.17.0.2", Port: 80}}
+	assert.Equal(t, map[*model.Connection]Mark{
+		clientToProxy:    expected,
+		proxyToContainer: expected,
+		containerToProxy: expected,
+	}, marks)
+	assert.Equal(t, Stats{Examined: 4, Kept: 4, Marked: 3, Proxies: 1, ProxyInsertions: 1, ProxyLookups: 4, Discovered: 1, ProxyIPDiscoveries: 1}, f.Stats())
+
+	// the connections marked are the ones dropped otherwise
+	f = newFilter()
+	f.LoadProxies(procs)
+	payload = &model.Connections{Conns: conns}
+	assert.Equal(t, 3, f.Filter(payload))
+	assert.Equal(t, []*model.Connection{unrelated}, payload.Conns)
+}
+
+// newBenchmarkFilter returns a Filter tracking 300 proxies and a payload of nbConns connections going through them or not
+func newBenchmarkFilter(nbConns int, opts ...Option) (*Filter, []*model.Connection) {
+	const nbProxies = 300
+
+	procs := make(map[int32]*process.FilledProcess, nbProxies)
+	for i := 0; i < nbProxies; i++ {
+		pid := int32(1000 + i)
+		procs[pid] = &process.FilledProcess{Pid: pid, Cmdline: []string{
+			"docker-proxy", "-proto", "tcp", "-host-ip", "0.0.0.0", "-host-port", fmt.Sprint(10000 + i),
+			"-container-ip", fmt.Sprintf("172.17.%d.%d", i/250, 2+i%250), "-container-port", "80",
+		}}
+	}
+
+	// 10% of the connections go through a proxy, a third of them being seen from each of the three angles
+	conns := make([]*model.Connection, 0, nbConns)
+	for i := 0; i < nbConns; i++ {
+		proxy := i % nbProxies
+		pid := int32(1000 + proxy)
+		target := &model.Addr{Ip: fmt.Sprintf("172.17.%d.%d", proxy/250, 2+proxy%250), Port: 80}
+		ephemeral := int32(30000 + i%30000)
+
+		switch i % 30 {
+		case 0:
+			conns = append(conns, &model.Connection{Pid: pid, Laddr: &model.Addr{Ip: "10.0.0.5", Port: int32(10000 + proxy)}, Raddr: &model.Addr{Ip: "10.0.1.42", Port: ephemeral}})
+		case 1:
+			conns = append(conns, &model.Connection{Pid: pid, Laddr: &model.Addr{Ip: "172.17.0.1", Port: ephemeral}, Raddr: target})
+		case 2:
+			conns = append(conns, &model.Connection{Pid: 50000, Laddr: target, Raddr: &model.Addr{Ip: "172.17.0.1", Port: ephemeral}})
+		default:
+			conns = append(conns, &model.Connection{Pid: int32(20000 + i%500), Laddr: &model.Addr{Ip: "10.0.0.5", Port: ephemeral}, Raddr: &model.Addr{Ip: "10.0.2.10", Port: 443}})
+		}
+	}
+
+	f := newFilter(opts...)
+	f.LoadProxies(procs)
+	return f, conns
+}
+
+func BenchmarkFilter(b *testing.B) {
+	f, conns := newBenchmarkFilter(50000)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		f.Filter(&model.Connections{Conns: conns})
+	}
+}
+
+// BenchmarkFilterBatch compares filtering a batch of small payloads one by one with FilterAll, the share of
+// the locking being the largest for small payloads
+func BenchmarkFilterBatch(b *testing.B) {
+	const payloadSize = 5
+
+	f, conns := newBenchmarkFilter(50000)
+	payloads := make([]*model.Connections, len(conns)/payloadSize)
+	reset := func() {
+		for i := range payloads {
+			payloads[i] = &model.Connections{Conns: conns[i*payloadSize : (i+1)*payloadSize]}
+		}
+	}
+	reset()
+
+	b.Run("Filter", func(b *testing.B) {
+		b.ReportAllocs()
+		for n := 0; n < b.N; n++ {
+			for _, payload := range payloads {
+				f.Filter(payload)
+			}
+			b.StopTimer()
+			reset()
+			b.StartTimer()
+		}
+	})
+
+	b.Run("FilterAll", func(b *testing.B) {
+		b.ReportAllocs()
+		for n := 0; n < b.N; n++ {
+			f.FilterAll(payloads)
+			b.StopTimer()
+			reset()
+			b.StartTimer()
+		}
+	})
+}
+
+func BenchmarkFilterInPlace(b *testing.B) {
+	f, conns := newBenchmarkFilter(50000)
+
+	// the connections are filtered in place
+	buf := make([]*model.Connection, len(conns))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		copy(buf, conns)
+		f.FilterInPlace(&model.Connections{Conns: buf})
+	}
+}
+
+func BenchmarkFilterParallel(b *testing.B) {
+	for _, bc := range []struct {
+		name    string
+		workers int
+	}{
+		{name: "serial", workers: 1},
+		{name: "parallel", workers: runtime.GOMAXPROCS(0)},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			f, conns := newBenchmarkFilter(200000, WithParallelism(bc.workers, 0))
+
+			buf := make([]*model.Connection, len(conns))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				copy(buf, conns)
+				f.FilterInPlace(&model.Connections{Conns: buf})
+			}
+		})
+	}
+}
+
+func BenchmarkIsProxied(b *testing.B) {
+	f, conns := newBenchmarkFilter(50000)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		f.IsProxied(conns[n%len(conns)])
+	}
+}
+
+func BenchmarkFilterWithoutProxies(b *testing.B) {
+	conns := make([]*model.Connection, 50000)
+	for i := range conns {
+		conns[i] = &model.Connection{Pid: int32(20000 + i%500), Laddr: &model.Addr{Ip: "10.0.0.5", Port: int32(30000 + i%30000)}, Raddr: &model.Addr{Ip: "10.0.2.10", Port: 443}}
+	}
+
+	f := newFilter()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		f.Filter(&model.Connections{Conns: conns})
+	}
+}
+
+func TestFilterMergeMode(t *testing.T) {
+	f := newFilter(WithMode(MergeMode))
+	f.LoadProxies(map[int32]*process.FilledProcess{
+		1: {Pid: 1, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-ip", "0.0.0.0", "-host-port", "8080", "-container-ip", "172.17.0.2", "-container-port", "80"}},
+		2: {Pid: 2, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-ip", "0.0.0.0", "-host-port", "8081", "-container-ip", "172.17.0.3", "-container-port", "80"}},
+	})
+
+	clientToProxy := &model.Connection{
+		Pid:               1,
+		Laddr:             &model.Addr{Ip: "10.0.0.5", Port: 8080},
+		Raddr:             &model.Addr{Ip: "10.0.0.42", Port: 51234},
+		LastBytesSent:     1000,
+		LastBytesReceived: 10,
+		LastRetransmits:   3,
+	}
+	proxyToContainer := &model.Connection{
+		Pid:               1,
+		Laddr:             &model.Addr{Ip: "172.17.0.1", Port: 34567},
+		Raddr:             &model.Addr{Ip: "172.17.0.2", Port: 80},
+		LastBytesSent:     10,
+		LastBytesReceived: 1000,
+		LastRetransmits:   1,
+	}
+	containerToProxy := &model.Connection{Pid: 3, Laddr: &model.Addr{Ip: "172.17.0.2", Port: 80}, Raddr: &model.Addr{Ip: "172.17.0.1", Port: 34567}}
+	// the upstream leg of the second proxy is missing from the payload
+	unpairedClient := &model.Connection{Pid: 2, Laddr: &model.Addr{Ip: "10.0.0.5", Port: 8081}, Raddr: &model.Addr{Ip: "10.0.0.42", Port: 51235}}
+	unrelated := &model.Connection{Pid: 4, Laddr: &model.Addr{Ip: "10.0.0.5", Port: 22}, Raddr: &model.Addr{Ip: "10.0.0.42", Port: 51236}}
+
+	payload := &model.Connections{Conns: []*model.Connection{clientToProxy, proxyToContainer, containerToProxy, unpairedClient, unrelated}}
+	f.Filter(payload)
+
+	assert.Len(t, payload.Conns, 2)
+	assert.Equal(t, unrelated, payload.Conns[1])
+	assert.Equal(t, &model.Connection{
+		Pid:               1,
+		Laddr:             &model.Addr{Ip: "172.17.0.2", Port: 80},
+		Raddr:             &model.Addr{Ip: "10.0.0.42", Port: 51234},
+		LastBytesSent:     1010,
+		LastBytesReceived: 1010,
+		LastRetransmits:   3,
+		IpTranslation:     &model.IPTranslation{ReplSrcIP: "10.0.0.42", ReplSrcPort: 51234, ReplDstIP: "10.0.0.5", ReplDstPort: 8080},
+	}, payload.Conns[0])
+
+	// the original connections are left untouched
+	assert.Equal(t, &model.Addr{Ip: "10.0.0.5", Port: 8080}, clientToProxy.Laddr)
+	assert.Equal(t, uint64(1000), clientToProxy.LastBytesSent)
+
+	assert.Equal(t, Stats{Examined: 5, Dropped: 3, Kept: 2, Merged: 1, Proxies: 2, ProxyInsertions: 2, ProxyLookups: 5, Discovered: 1, Undiscovered: 1, ProxyIPDiscoveries: 1}, f.Stats())
+}
+
+func TestFilterMergeModePairing(t *testing.T) {
+	var dropped []*model.Connection
+	f := newFilter(WithMode(MergeMode), WithOnDrop(func(c *model.Connection, _ ProxyInfo) { dropped = append(dropped, c) }))
+	f.LoadProxies(map[int32]*process.FilledProcess{
+		1: {Pid: 1, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-ip", "0.0.0.0", "-host-port", "8080", "-container-ip", "172.17.0.2", "-container-port", "80"}},
+		2: {Pid: 2, Exe: "/usr/bin/rootlesskit", Cmdline: []string{"rootlesskit", "-p", "0.0.0.0:8081:10.0.2.100:80/tcp", "-p", "0.0.0.0:8443:10.0.2.100:443/tcp", "nginx"}},
+	})
+
+	// the legs of a proxy forwarding several ports are paired on their target, whatever their order
+	client443 := &model.Connection{Pid: 2, Laddr: &model.Addr{Ip: "10.0.0.5", Port: 8443}, Raddr: &model.Addr{Ip: "10.0.0.42", Port: 51234}, LastBytesSent: 443}
+	client80 := &model.Connection{Pid: 2, Laddr: &model.Addr{Ip: "10.0.0.5", Port: 8081}, Raddr: &model.Addr{Ip: "10.0.0.42", Port: 51235}, LastBytesSent: 80}
+	upstream80 := &model.Connection{Pid: 2, Laddr: &model.Addr{Ip: "10.0.2.2", Port: 34567}, Raddr: &model.Addr{Ip: "10.0.2.100", Port: 80}, LastBytesSent: 80}
+	upstream443 := &model.Connection{Pid: 2, Laddr: &model.Addr{Ip: "10.0.2.2", Port: 34568}, Raddr: &model.Addr{Ip: "10.0.2.100", Port: 443}, LastBytesSent: 443}
+	// concurrent flows through the same proxy to the same target can't be told apart
+	client1 := &model.Connection{Pid: 1, Laddr: &model.Addr{Ip: "10.0.0.5", Port: 8080}, Raddr: &model.Addr{Ip: "10.0.0.42", Port: 51236}}
+	client2 := &model.Connection{Pid: 1, Laddr: &model.Addr{Ip: "10.0.0.5", Port: 8080}, Raddr: &model.Addr{Ip: "10.0.0.43", Port: 51237}}
+	upstream1 := &model.Connection{Pid: 1, Laddr: &model.Addr{Ip: "172.17.0.1", Port: 34569}, Raddr: &model.Addr{Ip: "172.17.0.2", Port: 80}}
+	upstream2 := &model.Connection{Pid: 1, Laddr: &model.Addr{Ip: "172.17.0.1", Port: 34570}, Raddr: &model.Addr{Ip: "172.17.0.2", Port: 80}}
+
+	payload := &model.Connections{Conns: []*model.Connection{client443, client80, upstream80, upstream443, client1, client2, upstream1, upstream2}}
+	f.Filter(payload)
+
+	if assert.Len(t, payload.Conns, 2) {
+		assert.Equal(t, model.Addr{Ip: "10.0.2.100", Port: 443}, *payload.Conns[0].Laddr)
+		assert.Equal(t, uint64(886), payload.Conns[0].LastBytesSent)
+		assert.Equal(t, model.Addr{Ip: "10.0.2.100", Port: 80}, *payload.Conns[1].Laddr)
+		assert.Equal(t, uint64(160), payload.Conns[1].LastBytesSent)
+	}
+	// the upstream legs consumed by a merge aren't reported as dropped
+	assert.Equal(t, []*model.Connection{client1, client2, upstream1, upstream2}, dropped)
+	assert.Equal(t, uint64(2), f.Stats().Merged)
+}
+
+func TestCanonicalIP(t *testing.T) {
+	for ip, expected := range map[string]string{
+		"172.17.0.2":        "172.17.0.2",
+		"0.0.0.0":           "0.0.0.0",
+		"255.255.255.255":   "255.255.255.255",
+		"172.017.000.002":   "172.17.0.2",
+		"::ffff:172.17.0.1": "172.17.0.1",
+		"FD00:0::1":         "fd00::1",
+		"fd00::1":           "fd00::1",
+		// not IPs, left untouched
+		"256.0.0.1":   "256.0.0.1",
+		"172.17.0":    "172.17.0",
+		"172.17.0.":   "172.17.0.",
+		"172..17.0":   "172..17.0",
+		"172.17.0.2.": "172.17.0.2.",
+		"":            "",
+	} {
+		assert.Equal(t, expected, canonicalIP(ip), ip)
+	}
+}
+
+func TestFilterWithDropped(t *testing.T) {
+	f := newFilter()
+	f.LoadProxies(map[int32]*process.FilledProcess{
+		1: {Pid: 1, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-ip", "0.0.0.0", "-host-port", "8080", "-container-ip", "172.17.0.2", "-container-port", "80"}},
+	})
+
+	clientToProxy := &model.Connection{Pid: 1, Laddr: &model.Addr{Ip: "10.0.0.5", Port: 8080}, Raddr: &model.Addr{Ip: "10.0.0.42", Port: 51234}}
+	proxyToContainer := &model.Connection{Pid: 1, Laddr: &model.Addr{Ip: "172.17.0.1", Port: 34567}, Raddr: &model.Addr{Ip: "172.17.0.2", Port: 80}}
+	unrelated := &model.Connection{Pid: 4, Laddr: &model.Addr{Ip: "10.0.0.5", Port: 22}, Raddr: &model.Addr{Ip: "10.0.0.42", Port: 51235}}
+
+	payload := &model.Connections{Conns: []*model.Connection{clientToProxy, unrelated, proxyToContainer}}
+	dropped := f.FilterWithDropped(payload)
+	assert.Equal(t, []*model.Connection{clientToProxy, proxyToContainer}, dropped)
+	assert.Equal(t, []*model.Connection{unrelated}, payload.Conns)
+
+	// the dropped connections of a call aren't overwritten by the next ones
+	other := &model.Connection{Pid: 1, Laddr: &model.Addr{Ip: "10.0.0.5", Port: 8080}, Raddr: &model.Addr{Ip: "10.0.0.43", Port: 51236}}
+	assert.Equal(t, []*model.Connection{other}, f.FilterWithDropped(&model.Connections{Conns: []*model.Connection{other}}))
+	assert.Equal(t, []*model.Connection{clientToProxy, proxyToContainer}, dropped)
+
+	assert.Empty(t, f.FilterWithDropped(&model.Connections{Conns: []*model.Connection{unrelated}}))
+}
+
+func TestFilterOnDrop(t *testing.T) {
+	var dropped []*model.Connection
+	matched := make(map[*model.Connection]ProxyInfo)
+	onDrop := func(c *model.Connection, p ProxyInfo) {
+		dropped = append(dropped, c)
+		matched[c] = p
+	}
+
+	// the connections are matched by several workers but reported from the filtering goroutine
+	f, conns := newBenchmarkFilter(10000, WithParallelism(4, 1000), WithOnDrop(onDrop))
+	payload := &model.Connections{Conns: conns}
+	kept := make(map[*model.Connection]struct{})
+	n := f.Filter(payload)
+	for _, c := range payload.Conns {
+		kept[c] = struct{}{}
+	}
+	var removed []*model.Connection
+	for _, c := range conns {
+		if _, ok := kept[c]; !ok {
+			removed = append(removed, c)
+		}
+	}
+	assert.Len(t, dropped, n)
+	assert.Equal(t, removed, dropped)
+	for _, c := range dropped {
+		pid := matched[c].PID
+		assert.True(t, pid >= 1000 && pid < 1300, "proxy pid=%d", pid)
+	}
+
+	f = newFilter(WithOnDrop(onDrop))
+	f.LoadProxies(map[int32]*process.FilledProcess{
+		1: {Pid: 1, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-port", "8080", "-container-ip", "172.17.0.2", "-container-port", "80"}},
+	})
+	dropped = nil
+	clientToProxy := &model.Connection{Pid: 1, Laddr: &model.Addr{Ip: "10.0.0.5", Port: 8080}, Raddr: &model.Addr{Ip: "10.0.0.42", Port: 51234}}
+	unrelated := &model.Connection{Pid: 4, Laddr: &model.Addr{Ip: "10.0.0.5", Port: 22}, Raddr: &model.Addr{Ip: "10.0.0.42", Port: 51235}}
+	f.Filter(&model.Connections{Conns: []*model.Connection{clientToProxy, unrelated}})
+	assert.Equal(t, []*model.Connection{clientToProxy}, dropped)
+	assert.Equal(t, int32(1), matched[clientToProxy].PID)
+	assert.Equal(t, model.Addr{Ip: "172.17.0.2", Port: 80}, matched[clientToProxy].Target)
+
+	// the callback is carried by the clones
+	dropped = nil
+	f.Clone().Filter(&model.Connections{Conns: []*model.Connection{clientToProxy, unrelated}})
+	assert.Equal(t, []*model.Connection{clientToProxy}, dropped)
+}
+
+func TestFilterMarkModeOnlyMarksProxied(t *testing.T) {
+	var conns []*model.Connection
+	for i := 0; i < 10; i++ {
+		conns = append(conns, &model.Connection{Pid: int32(100 + i), Laddr: &model.Addr{Ip: "10.0.0.5", Port: int32(2000 + i)}, Raddr: &model.Addr{Ip: "10.0.0.42", Port: 443}})
+	}
+	proxied := &model.Connection{Pid: 1, Laddr: &model.Addr{Ip: "172.17.0.1", Port: 34567}, Raddr: &model.Addr{Ip: "172.17.0.2", Port: 80}}
+	conns = append(conns, proxied)
+
+	var marked []*model.Connection
+	f := newFilter(WithMarkFunc(func(c *model.Connection, _ Mark) { marked = append(marked, c) }))
+	f.LoadProxies(map[int32]*process.FilledProcess{
+		1: {Pid: 1, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-port", "8080", "-container-ip", "172.17.0.2", "-container-port", "80"}},
+	})
+
+	// the default mode still drops the connection
+	assert.Equal(t, DropMode, newFilter().mode)
+
+	payload := &model.Connections{Conns: append([]*model.Connection{}, conns...)}
+	f.Filter(payload)
+	assert.Len(t, payload.Conns, len(conns))
+	assert.Equal(t, []*model.Connection{proxied}, marked)
+}
+
+func TestFilterDropProxyOwned(t *testing.T) {
+	procs := map[int32]*process.FilledProcess{
+		1: {Pid: 1, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-port", "8080", "-container-ip", "172.17.0.2", "-container-port", "80"}},
+	}
+	proxyToContainer := &model.Connection{Pid: 1, Laddr: &model.Addr{Ip: "172.17.0.1", Port: 34567}, Raddr: &model.Addr{Ip: "172.17.0.2", Port: 80}}
+	dnsLookup := &model.Connection{Pid: 1, Type: model.ConnectionType_udp, Laddr: &model.Addr{Ip: "10.0.0.5", Port: 45000}, Raddr: &model.Addr{Ip: "10.0.0.2", Port: 53}}
+	unrelated := &model.Connection{Pid: 4, Laddr: &model.Addr{Ip: "10.0.0.5", Port: 22}, Raddr: &model.Addr{Ip: "10.0.0.42", Port: 51235}}
+
+	// disabled by default
+	f := newFilter()
+	f.LoadProxies(procs)
+	payload := &model.Connections{Conns: []*model.Connection{proxyToContainer, dnsLookup, unrelated}}
+	f.Filter(payload)
+	assert.Equal(t, []*model.Connection{dnsLookup, unrelated}, payload.Conns)
+
+	f = newFilter(WithDropProxyOwned())
+	f.LoadProxies(procs)
+	payload = &model.Connections{Conns: []*model.Connection{proxyToContainer, dnsLookup, unrelated}}
+	assert.Equal(t, 2, f.Filter(payload))
+	assert.Equal(t, []*model.Connection{unrelated}, payload.Conns)
+	assert.Equal(t, Stats{Examined: 3, Dropped: 2, Kept: 1, DroppedOwned: 1, Proxies: 1, ProxyInsertions: 1, ProxyLookups: 3, Discovered: 1, ProxyIPDiscoveries: 1}, f.Stats())
+}
+
+func TestProxyFilterMultipleTargets(t *testing.T) {
+	p := &process.FilledProcess{Pid: 1, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-ip", "::", "-host-port", "8080",
+		"-container-ip", "172.17.0.2", "-container-port", "80", "-container-ip", "fd00::2", "-container-port", "80"}}
+
+	proxy, err := newFilter().extractProxyInfo(p)
+	assert.NoError(t, err)
+	assert.Equal(t, model.Addr{Ip: "172.17.0.2", Port: 80}, proxy.target)
+	assert.Equal(t, []model.Addr{{Ip: "fd00::2", Port: 80}}, proxy.extraTargets)
+
+	logger := &recordingLogger{}
+	f := newFilter(WithLogger(logger))
+	f.LoadProxies(map[int32]*process.FilledProcess{1: p})
+
+	v4ProxyToContainer := &model.Connection{Pid: 1, Laddr: &model.Addr{Ip: "172.17.0.1", Port: 40000}, Raddr: &model.Addr{Ip: "172.17.0.2", Port: 80}}
+	v6ProxyToContainer := &model.Connection{Pid: 1, Laddr: &model.Addr{Ip: "fd00::1", Port: 40001}, Raddr: &model.Addr{Ip: "fd00::2", Port: 80}}
+	v4Container := &model.Connection{Pid: 3, Laddr: &model.Addr{Ip: "172.17.0.2", Port: 80}, Raddr: &model.Addr{Ip: "172.17.0.1", Port: 40000}}
+	v6Container := &model.Connection{Pid: 3, Laddr: &model.Addr{Ip: "fd00::2", Port: 80}, Raddr: &model.Addr{Ip: "fd00::1", Port: 40001}}
+	v6Unrelated := &model.Connection{Pid: 4, Laddr: &model.Addr{Ip: "fd00::3", Port: 80}, Raddr: &model.Addr{Ip: "fd00::1", Port: 40002}}
+
+	payload := &model.Connections{Conns: []*model.Connection{v4ProxyToContainer, v6ProxyToContainer, v4Container, v6Container, v6Unrelated}}
+	assert.Equal(t, 4, f.Filter(payload))
+	assert.Equal(t, []*model.Connection{v6Unrelated}, payload.Conns)
+
+	// each address family has its own proxy ip
+	assert.Equal(t, "172.17.0.1", f.proxyByPID[1].ip)
+	assert.Equal(t, "fd00::1", f.proxyByPID[1].altIP)
+	assert.Empty(t, logger.messages["warn"])
+
+	// every target is unregistered along with the proxy
+	f.RemoveProxy(1)
+	assert.Empty(t, f.proxyByTarget)
+}
+
+func TestProxyFilterDirection(t *testing.T) {
+	f := newFilter()
+	f.LoadProxies(map[int32]*process.FilledProcess{
+		1: {Pid: 1, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-ip", "10.0.0.5", "-host-port", "8080", "-container-ip", "172.17.0.2", "-container-port", "80"}},
+	})
+
+	in, out := model.ConnectionDirection_incoming, model.ConnectionDirection_outgoing
+	clientToProxy := &model.Connection{Pid: 1, Direction: in, Laddr: &model.Addr{Ip: "10.0.0.5", Port: 8080}, Raddr: &model.Addr{Ip: "10.0.0.42", Port: 51234}}
+	proxyToContainer := &model.Connection{Pid: 1, Direction: out, Laddr: &model.Addr{Ip: "172.17.0.1", Port: 34567}, Raddr: &model.Addr{Ip: "172.17.0.2", Port: 80}}
+	containerFromProxy := &model.Connection{Pid: 3, Direction: in, Laddr: &model.Addr{Ip: "172.17.0.2", Port: 80}, Raddr: &model.Addr{Ip: "172.17.0.1", Port: 34567}}
+
+	// connections with the shape of a proxy leg, but established in the wrong direction
+	hostToContainer := &model.Connection{Pid: 4, Direction: out, Laddr: &model.Addr{Ip: "172.17.0.1", Port: 45678}, Raddr: &model.Addr{Ip: "172.17.0.2", Port: 80}}
+	proxyOutgoing := &model.Connection{Pid: 1, Direction: out, Laddr: &model.Addr{Ip: "10.0.0.5", Port: 8080}, Raddr: &model.Addr{Ip: "10.0.0.42", Port: 51234}}
+	containerOutgoing := &model.Connection{Pid: 3, Direction: out, Laddr: &model.Addr{Ip: "172.17.0.2", Port: 80}, Raddr: &model.Addr{Ip: "172.17.0.1", Port: 45678}}
+
+	// same as hostToContainer, but without direction
+	unknownToContainer := &model.Connection{Pid: 4, Laddr: &model.Addr{Ip: "172.17.0.1", Port: 45679}, Raddr: &model.Addr{Ip: "172.17.0.2", Port: 80}}
+
+	payload := &model.Connections{Conns: []*model.Connection{
+		clientToProxy, proxyToContainer, containerFromProxy, hostToContainer, proxyOutgoing, containerOutgoing, unknownToContainer,
+	}}
+	f.Filter(payload)
+
+	assert.Equal(t, "172.17.0.1", f.proxyByPID[1].ip)
+	assert.Equal(t, []*model.Connection{hostToContainer, proxyOutgoing, containerOutgoing}, payload.Conns)
+}
+
+func TestFilterPrunesDNS(t *testing.T) {
+	f := newFilter(WithMode(MergeMode))
+	f.LoadProxies(map[int32]*process.FilledProcess{
+		1: {Pid: 1, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-ip", "10.0.0.5", "-host-port", "8080", "-container-ip", "172.17.0.2", "-container-port", "80"}},
+		2: {Pid: 2, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-ip", "10.0.0.5", "-host-port", "8081", "-container-ip", "172.17.0.3", "-container-port", "80"}},
+	})
+
+	clientToProxy := &model.Connection{Pid: 1, Laddr: &model.Addr{Ip: "10.0.0.5", Port: 8080}, Raddr: &model.Addr{Ip: "10.0.0.42", Port: 51234}}
+	proxyToContainer := &model.Connection{Pid: 1, Laddr: &model.Addr{Ip: "172.17.0.1", Port: 34567}, Raddr: &model.Addr{Ip: "172.17.0.2", Port: 80}}
+	unpairedProxyToContainer := &model.Connection{Pid: 2, Laddr: &model.Addr{Ip: "172.17.0.1", Port: 34568}, Raddr: &model.Addr{Ip: "172.17.0.3", Port: 80}}
+	// another process connecting to a container IP, whose DNS entry must be kept
+	toContainer := &model.Connection{Pid: 3, Laddr: &model.Addr{Ip: "172.18.0.1", Port: 45678}, Raddr: &model.Addr{Ip: "172.17.0.3", Port: 80}}
+	unrelated := &model.Connection{Pid: 4, Laddr: &model.Addr{Ip: "10.0.0.5", Port: 45679}, Raddr: &model.Addr{Ip: "10.0.0.53", Port: 443}}
+
+	payload := &model.Connections{
+		Conns: []*model.Connection{clientToProxy, proxyToContainer, unpairedProxyToContainer, toContainer, unrelated},
+		Dns: map[string]*model.DNSEntry{
+			"10.0.0.42":  {Names: []string{"client.local"}},
+			"172.17.0.2": {Names: []string{"web.docker"}},
+			"172.17.0.3": {Names: []string{"db.docker"}},
+			"10.0.0.53":  {Names: []string{"api.local"}},
+		},
+	}
+	f.Filter(payload)
+
+	assert.Len(t, payload.Conns, 3)
+	assert.Len(t, payload.Dns, 3)
+	assert.NotContains(t, payload.Dns, "172.17.0.2")
+	for ip := range payload.Dns {
+		referenced := false
+		for _, c := range payload.Conns {
+			referenced = referenced || c.Raddr.Ip == ip
+		}
+		assert.True(t, referenced, "dangling DNS entry for %s", ip)
+	}
+}
+
+func TestProxyFilterHostIPsFallback(t *testing.T) {
+	procs := map[int32]*process.FilledProcess{
+		1: {Pid: 1, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-ip", "10.0.0.5", "-host-port", "8080", "-container-ip", "172.17.0.2", "-container-port", "80"}},
+	}
+	// a host with several NICs, two of them being docker bridges
+	hostIPs := []string{"127.0.0.1", "10.0.0.5", "192.168.1.5", "172.17.0.1", "172.18.0.1"}
+
+	containerFromProxy := &model.Connection{Pid: 3, Laddr: &model.Addr{Ip: "172.17.0.2", Port: 80}, Raddr: &model.Addr{Ip: "172.17.0.1", Port: 34567}}
+	containerFromOtherNIC := &model.Connection{Pid: 3, Laddr: &model.Addr{Ip: "172.17.0.2", Port: 80}, Raddr: &model.Addr{Ip: "192.168.1.5", Port: 34568}}
+	containerFromContainer := &model.Connection{Pid: 3, Laddr: &model.Addr{Ip: "172.17.0.2", Port: 80}, Raddr: &model.Addr{Ip: "172.17.0.3", Port: 34569}}
+
+	// without the host IPs, the container legs are only matched once the proxy IP is discovered
+	f := newFilter()
+	f.LoadProxies(procs)
+	assert.False(t, f.IsProxied(containerFromProxy))
+
+	f = newFilter(WithHostIPs(hostIPs...))
+	f.LoadProxies(procs)
+	payload := &model.Connections{Conns: []*model.Connection{containerFromProxy, containerFromOtherNIC, containerFromContainer}}
+	f.Filter(payload)
+	assert.Equal(t, []*model.Connection{containerFromContainer}, payload.Conns)
+
+	// once discovered, only the proxy IP is matched
+	proxyToContainer := &model.Connection{Pid: 1, Laddr: &model.Addr{Ip: "172.17.0.1", Port: 34567}, Raddr: &model.Addr{Ip: "172.17.0.2", Port: 80}}
+	payload = &model.Connections{Conns: []*model.Connection{proxyToContainer, containerFromProxy, containerFromOtherNIC, containerFromContainer}}
+	f.Filter(payload)
+	assert.Equal(t, "172.17.0.1", f.proxyByPID[1].ip)
+	assert.Equal(t, []*model.Connection{containerFromOtherNIC, containerFromContainer}, payload.Conns)
+}
+
+func TestProxyFilterNetNS(t *testing.T) {
+	// two docker daemons (e.g. Docker-in-Docker) publishing containers with the same address
+	f := newFilter()
+	f.LoadProxies(map[int32]*process.FilledProcess{
+		1: {Pid: 1, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-ip", "10.0.0.5", "-host-port", "8080", "-container-ip", "172.17.0.2", "-container-port", "80"}},
+		2: {Pid: 2, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-ip", "172.18.0.2", "-host-port", "8080", "-container-ip", "172.17.0.2", "-container-port", "80"}},
+	})
+
+	proxy1ToContainer := &model.Connection{Pid: 1, NetNS: 100, Laddr: &model.Addr{Ip: "172.17.0.1", Port: 34567}, Raddr: &model.Addr{Ip: "172.17.0.2", Port: 80}}
+	proxy2ToContainer := &model.Connection{Pid: 2, NetNS: 200, Laddr: &model.Addr{Ip: "172.17.0.1", Port: 34568}, Raddr: &model.Addr{Ip: "172.17.0.2", Port: 80}}
+	payload := &model.Connections{Conns: []*model.Connection{proxy1ToContainer, proxy2ToContainer}}
+	assert.Equal(t, 2, f.Filter(payload))
+
+	// both targets are tracked independently
+	assert.Equal(t, uint32(100), f.proxyByPID[1].netns)
+	assert.Equal(t, uint32(200), f.proxyByPID[2].netns)
+	target := model.Addr{Ip: "172.17.0.2", Port: 80}
+	assert.Equal(t, f.proxyByPID[1], f.proxyByTarget[testProxyKey(target, "tcp", 100)])
+	assert.Equal(t, f.proxyByPID[2], f.proxyByTarget[testProxyKey(target, "tcp", 200)])
+
+	// connections from the proxy IP without PID attribution, as seen from each namespace
+	fromNetNS := func(netns uint32) *model.Connection {
+		return &model.Connection{Pid: 5, NetNS: netns, Laddr: &model.Addr{Ip: "172.17.0.1", Port: 45678}, Raddr: &model.Addr{Ip: "172.17.0.2", Port: 80}}
+	}
+	p, leg := f.match(fromNetNS(100))
+	assert.Equal(t, targetLeg, leg)
+	assert.Equal(t, int32(1), p.pid)
+	p, leg = f.match(fromNetNS(200))
+	assert.Equal(t, targetLeg, leg)
+	assert.Equal(t, int32(2), p.pid)
+	// the same tuple in a third namespace has nothing to do with the proxies
+	assert.False(t, f.isProxied(fromNetNS(300)))
+	// without namespace, the connection is still matched
+	assert.True(t, f.isProxied(fromNetNS(0)))
+
+	// the namespace survives refreshes
+	f.Refresh(map[int32]*process.FilledProcess{
+		1: {Pid: 1, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-ip", "10.0.0.5", "-host-port", "8080", "-container-ip", "172.17.0.2", "-container-port", "80"}},
+	})
+	assert.Equal(t, uint32(100), f.proxyByPID[1].netns)
+	assert.False(t, f.isProxied(fromNetNS(200)))
+}
+
+func TestFilterDedup(t *testing.T) {
+	procs := map[int32]*process.FilledProcess{
+		// host docker-proxy forwarding to a Docker-in-Docker container, whose own docker-proxy isn't tracked
+		1: {Pid: 1, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-ip", "10.0.0.5", "-host-port", "8080", "-container-ip", "172.18.0.2", "-container-port", "8080"}},
+	}
+
+	clientToProxy := &model.Connection{Pid: 1, Laddr: &model.Addr{Ip: "10.0.0.5", Port: 8080}, Raddr: &model.Addr{Ip: "10.0.0.42", Port: 51234}}
+	proxyToDinD := &model.Connection{Pid: 1, Laddr: &model.Addr{Ip: "172.18.0.1", Port: 34567}, Raddr: &model.Addr{Ip: "172.18.0.2", Port: 8080}}
+	// the inner proxy leg towards the nested container, reported from both the Docker-in-Docker
+	// network namespace and the nested container one
+	innerProxyToContainer := &model.Connection{Pid: 2, NetNS: 100, Laddr: &model.Addr{Ip: "172.17.0.1", Port: 45678}, Raddr: &model.Addr{Ip: "172.17.0.2", Port: 80}}
+	duplicate := &model.Connection{Pid: 3, NetNS: 200, Laddr: &model.Addr{Ip: "172.17.0.1", Port: 45678}, Raddr: &model.Addr{Ip: "172.17.0.2", Port: 80}}
+	unrelated := &model.Connection{Pid: 4, Laddr: &model.Addr{Ip: "172.17.0.1", Port: 45679}, Raddr: &model.Addr{Ip: "172.17.0.2", Port: 80}}
+
+	conns := []*model.Connection{clientToProxy, proxyToDinD, innerProxyToContainer, duplicate, unrelated}
+
+	// disabled by default
+	f := newFilter()
+	f.LoadProxies(procs)
+	payload := &model.Connections{Conns: append([]*model.Connection(nil), conns...)}
+	f.Filter(payload)
+	assert.Equal(t, []*model.Connection{innerProxyToContainer, duplicate, unrelated}, payload.Conns)
+
+	f = newFilter(WithDedup())
+	f.LoadProxies(procs)
+	payload = &model.Connections{Conns: append([]*model.Connection(nil), conns...)}
+	assert.Equal(t, []*model.Connection{clientToProxy, proxyToDinD, duplicate}, f.FilterWithDropped(payload))
+	assert.Equal(t, []*model.Connection{innerProxyToContainer, unrelated}, payload.Conns)
+	assert.Equal(t, Stats{Examined: 5, Dropped: 3, Kept: 2, Deduplicated: 1, Proxies: 1, ProxyInsertions: 1, ProxyLookups: 5, Discovered: 1, ProxyIPDiscoveries: 1}, f.Stats())
+}
+
+func TestProxyFilterWildcardDiscovery(t *testing.T) {
+	f := newFilter()
+	f.LoadProxies(map[int32]*process.FilledProcess{
+		1: {Pid: 1, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-ip", "0.0.0.0", "-host-port", "8080", "-container-ip", "172.17.0.2", "-container-port", "80"}},
+	})
+
+	// clients reaching the published port on the loopback, a secondary and the bridge interfaces
+	var conns []*model.Connection
+	for i, ip := range []string{"127.0.0.1", "192.168.50.7", "172.17.0.1"} {
+		port := int32(40000 + i)
+		conns = append(conns,
+			&model.Connection{Pid: 1, Laddr: &model.Addr{Ip: ip, Port: 8080}, Raddr: &model.Addr{Ip: "10.0.0.42", Port: 51234 + int32(i)}},
+			&model.Connection{Pid: 1, Laddr: &model.Addr{Ip: "172.17.0.1", Port: port}, Raddr: &model.Addr{Ip: "172.17.0.2", Port: 80}},
+			&model.Connection{Pid: 3, Laddr: &model.Addr{Ip: "172.17.0.2", Port: 80}, Raddr: &model.Addr{Ip: "172.17.0.1", Port: port}},
+		)
+	}
+	unrelated := &model.Connection{Pid: 4, Laddr: &model.Addr{Ip: "192.168.50.7", Port: 8081}, Raddr: &model.Addr{Ip: "10.0.0.42", Port: 51240}}
+	conns = append(conns, unrelated)
+
+	payload := &model.Connections{Conns: conns}
+	assert.Equal(t, 9, f.Filter(payload))
+	assert.Equal(t, []*model.Connection{unrelated}, payload.Conns)
+
+	// the proxy IP is the bridge one whatever the interface the clients connected to
+	assert.Equal(t, "172.17.0.1", f.proxyByPID[1].ip)
+	assert.Equal(t, model.Addr{Ip: "0.0.0.0", Port: 8080}, f.proxyByPID[1].host)
+}
+
+func TestProxyFilterLoopbackPublished(t *testing.T) {
+	f := newFilter(WithHostIPs("127.0.0.1", "10.0.0.5", "172.17.0.1"))
+	f.LoadProxies(map[int32]*process.FilledProcess{
+		// docker run -p 127.0.0.1:5432:5432
+		1: {Pid: 1, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-ip", "127.0.0.1", "-host-port", "5432", "-container-ip", "172.17.0.2", "-container-port", "5432"}},
+		// a loopback target, as with rootless Docker
+		2: {Pid: 2, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-ip", "127.0.0.1", "-host-port", "6379", "-container-ip", "127.0.0.1", "-container-port", "16379"}},
+	})
+
+	clientToProxy1 := &model.Connection{Pid: 1, Laddr: &model.Addr{Ip: "127.0.0.1", Port: 5432}, Raddr: &model.Addr{Ip: "127.0.0.1", Port: 50000}}
+	proxy1ToContainer := &model.Connection{Pid: 1, Laddr: &model.Addr{Ip: "172.17.0.1", Port: 40000}, Raddr: &model.Addr{Ip: "172.17.0.2", Port: 5432}}
+	clientToProxy2 := &model.Connection{Pid: 2, Laddr: &model.Addr{Ip: "127.0.0.1", Port: 6379}, Raddr: &model.Addr{Ip: "127.0.0.1", Port: 50001}}
+	proxy2ToTarget := &model.Connection{Pid: 2, Laddr: &model.Addr{Ip: "127.0.0.1", Port: 40001}, Raddr: &model.Addr{Ip: "127.0.0.1", Port: 16379}}
+	targetFromProxy2 := &model.Connection{Pid: 5, Laddr: &model.Addr{Ip: "127.0.0.1", Port: 16379}, Raddr: &model.Addr{Ip: "127.0.0.1", Port: 40001}}
+
+	// the clients of the published ports, and unrelated loopback traffic hitting the target directly
+	client1 := &model.Connection{Pid: 10, Laddr: &model.Addr{Ip: "127.0.0.1", Port: 50000}, Raddr: &model.Addr{Ip: "127.0.0.1", Port: 5432}}
+	client2 := &model.Connection{Pid: 10, Laddr: &model.Addr{Ip: "127.0.0.1", Port: 50001}, Raddr: &model.Addr{Ip: "127.0.0.1", Port: 6379}}
+	targetFromLocal := &model.Connection{Pid: 5, Laddr: &model.Addr{Ip: "127.0.0.1", Port: 16379}, Raddr: &model.Addr{Ip: "127.0.0.1", Port: 40002}}
+	localToTarget := &model.Connection{Pid: 11, Laddr: &model.Addr{Ip: "127.0.0.1", Port: 40002}, Raddr: &model.Addr{Ip: "127.0.0.1", Port: 16379}}
+	localToProxy1Port := &model.Connection{Pid: 11, Laddr: &model.Addr{Ip: "127.0.0.1", Port: 5432}, Raddr: &model.Addr{Ip: "127.0.0.1", Port: 40003}}
+
+	payload := &model.Connections{Conns: []*model.Connection{
+		clientToProxy1, proxy1ToContainer, clientToProxy2, proxy2ToTarget, targetFromProxy2,
+		client1, client2, targetFromLocal, localToTarget, localToProxy1Port,
+	}}
+	assert.Equal(t, 5, f.Filter(payload))
+	assert.Equal(t, []*model.Connection{client1, client2, targetFromLocal, localToTarget, localToProxy1Port}, payload.Conns)
+
+	// the loopback IP is never learned as a proxy IP
+	assert.Equal(t, "172.17.0.1", f.proxyByPID[1].ip)
+	assert.Equal(t, "", f.proxyByPID[2].ip)
+
+	// once the proxy connection is gone, its peer address isn't associated to the proxy anymore
+	payload = &model.Connections{Conns: []*model.Connection{targetFromProxy2}}
+	assert.Equal(t, 0, f.Filter(payload))
+}
+
+func TestProxyFilterLoopbackConcurrency(t *testing.T) {
+	f := newFilter()
+	f.LoadProxies(map[int32]*process.FilledProcess{
+		1: {Pid: 1, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-ip", "127.0.0.1", "-host-port", "6379", "-container-ip", "127.0.0.1", "-container-port", "16379"}},
+	})
+
+	// the target legs are judged against the loopback peers of their own payload, whatever the concurrent calls
+	proxied := func() *model.Connections {
+		return &model.Connections{Conns: []*model.Connection{
+			{Pid: 1, Laddr: &model.Addr{Ip: "127.0.0.1", Port: 40001}, Raddr: &model.Addr{Ip: "127.0.0.1", Port: 16379}},
+			{Pid: 5, Laddr: &model.Addr{Ip: "127.0.0.1", Port: 16379}, Raddr: &model.Addr{Ip: "127.0.0.1", Port: 40001}},
+		}}
+	}
+	direct := func() *model.Connections {
+		return &model.Connections{Conns: []*model.Connection{
+			{Pid: 11, Laddr: &model.Addr{Ip: "127.0.0.1", Port: 40001}, Raddr: &model.Addr{Ip: "127.0.0.1", Port: 16379}},
+			{Pid: 5, Laddr: &model.Addr{Ip: "127.0.0.1", Port: 16379}, Raddr: &model.Addr{Ip: "127.0.0.1", Port: 40001}},
+		}}
+	}
+
+	// another payload is discovered between the discovery and the filtering of a payload
+	var run RunStats
+	payload := proxied()
+	peers, ok := f.discoverProxyIPs(payload, &run)
+	assert.True(t, ok)
+	_, _ = f.discoverProxyIPs(direct(), &run)
+	f.mux.RLock()
+	n, _ := f.filterLocked(payload, peers, false, false, &run)
+	f.mux.RUnlock()
+	assert.Equal(t, 2, n)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				assert.Equal(t, 2, f.Filter(proxied()))
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				assert.Equal(t, 0, f.Filter(direct()))
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				assert.Equal(t, 2, f.FilterAll([]*model.Connections{direct(), proxied()}))
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestProxyFilterWildcardHostIPs(t *testing.T) {
+	hostIPs := []string{"10.0.0.5", "10.0.0.6", "192.168.1.5", "2001:db8::5"}
+	f := newFilter(WithHostIPsFunc(func() ([]string, error) {
+		return hostIPs, nil
+	}))
+	f.LoadProxies(map[int32]*process.FilledProcess{
+		1: {Pid: 1, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-ip", "0.0.0.0", "-host-port", "8080", "-container-ip", "172.17.0.2", "-container-port", "80"}},
+		2: {Pid: 2, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-ip", "::", "-host-port", "8443", "-container-ip", "fd00::2", "-container-port", "443"}},
+	})
+
+	clientLeg := func(pid int32, ip string, port int32) *model.Connection {
+		return &model.Connection{Pid: pid, Laddr: &model.Addr{Ip: ip, Port: port}, Raddr: &model.Addr{Ip: "10.0.0.42", Port: 51234}}
+	}
+
+	// any address of the host, including secondary ones
+	for _, ip := range []string{"10.0.0.5", "10.0.0.6", "192.168.1.5", "127.0.0.1"} {
+		assert.True(t, f.IsProxied(clientLeg(1, ip, 8080)), ip)
+	}
+	// IPv4 clients reach the IPv6 wildcard too
+	for _, ip := range []string{"2001:db8::5", "10.0.0.5", "::1"} {
+		assert.True(t, f.IsProxied(clientLeg(2, ip, 8443)), ip)
+	}
+
+	// a host IP on another port
+	assert.False(t, f.IsProxied(clientLeg(1, "10.0.0.5", 8081)))
+	assert.False(t, f.IsProxied(clientLeg(2, "2001:db8::5", 8080)))
+	// an address that doesn't belong to the host
+	assert.False(t, f.IsProxied(clientLeg(1, "10.0.0.7", 8080)))
+
+	// addresses added after startup are picked up by the next refresh
+	hostIPs = append(hostIPs, "10.0.0.7")
+	f.Refresh(map[int32]*process.FilledProcess{
+		1: {Pid: 1, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-ip", "0.0.0.0", "-host-port", "8080", "-container-ip", "172.17.0.2", "-container-port", "80"}},
+	})
+	assert.True(t, f.IsProxied(clientLeg(1, "10.0.0.7", 8080)))
+
+	// the previous addresses are kept if they can't be listed anymore
+	f.hostIPsFunc = func() ([]string, error) { return nil, errors.New("no interfaces") }
+	f.Refresh(nil)
+	assert.Contains(t, f.hostIPs, "10.0.0.7")
+}
+
+func TestFilterNilAddrs(t *testing.T) {
+	f := newFilter(WithDedup(), WithDropProxyOwned())
+	f.LoadProxies(map[int32]*process.FilledProcess{
+		1: {Pid: 1, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-port", "8080", "-container-ip", "172.17.0.2", "-container-port", "80"}},
+	})
+
+	noRaddr := &model.Connection{Pid: 1, Laddr: &model.Addr{Ip: "172.17.0.1", Port: 34567}}
+	noLaddr := &model.Connection{Pid: 1, Raddr: &model.Addr{Ip: "172.17.0.2", Port: 80}}
+	noAddrs := &model.Connection{Pid: 3}
+	proxyToContainer := &model.Connection{Pid: 1, Laddr: &model.Addr{Ip: "172.17.0.1", Port: 34567}, Raddr: &model.Addr{Ip: "172.17.0.2", Port: 80}}
+
+	payload := &model.Connections{
+		Conns: []*model.Connection{noRaddr, noLaddr, noAddrs, noAddrs, proxyToContainer},
+		Dns:   map[string]*model.DNSEntry{"172.17.0.2": {Names: []string{"web.docker"}}},
+	}
+	assert.NotPanics(t, func() {
+		assert.Equal(t, 1, f.Filter(payload))
+	})
+	assert.Equal(t, []*model.Connection{noRaddr, noLaddr, noAddrs, noAddrs}, payload.Conns)
+	assert.False(t, f.IsProxied(noRaddr))
+}
+
+func TestProxyFilterHairpin(t *testing.T) {
+	f := newFilter()
+	f.LoadProxies(map[int32]*process.FilledProcess{
+		1: {Pid: 1, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-ip", "10.0.0.5", "-host-port", "8080", "-container-ip", "172.17.0.2", "-container-port", "80"}},
+	})
+
+	// the container dials its own published port: the proxy connects back to it from the container IP
+	containerToPublished := &model.Connection{Pid: 3, Laddr: &model.Addr{Ip: "172.17.0.2", Port: 50000}, Raddr: &model.Addr{Ip: "10.0.0.5", Port: 8080}}
+	hairpinClientLeg := &model.Connection{Pid: 1, Laddr: &model.Addr{Ip: "10.0.0.5", Port: 8080}, Raddr: &model.Addr{Ip: "172.17.0.2", Port: 50000}}
+	hairpinProxyToContainer := &model.Connection{Pid: 1, Laddr: &model.Addr{Ip: "172.17.0.2", Port: 34567}, Raddr: &model.Addr{Ip: "172.17.0.2", Port: 80}}
+
+	payload := &model.Connections{Conns: []*model.Connection{containerToPublished, hairpinClientLeg, hairpinProxyToContainer}}
+	assert.Equal(t, 2, f.Filter(payload))
+	assert.Equal(t, []*model.Connection{containerToPublished}, payload.Conns)
+	assert.Equal(t, "", f.proxyByPID[1].ip)
+
+	// the proxy IP is learned from the genuine proxy connections, and the container traffic isn't mistaken
+	// for proxy traffic
+	proxyToContainer := &model.Connection{Pid: 1, Laddr: &model.Addr{Ip: "172.17.0.1", Port: 34568}, Raddr: &model.Addr{Ip: "172.17.0.2", Port: 80}}
+	containerFromProxy := &model.Connection{Pid: 3, Laddr: &model.Addr{Ip: "172.17.0.2", Port: 80}, Raddr: &model.Addr{Ip: "172.17.0.1", Port: 34568}}
+	containerFromItself := &model.Connection{Pid: 3, Laddr: &model.Addr{Ip: "172.17.0.2", Port: 80}, Raddr: &model.Addr{Ip: "172.17.0.2", Port: 50001}}
+
+	payload = &model.Connections{Conns: []*model.Connection{proxyToContainer, containerFromProxy, containerFromItself}}
+	assert.Equal(t, 2, f.Filter(payload))
+	assert.Equal(t, "172.17.0.1", f.proxyByPID[1].ip)
+	assert.Equal(t, []*model.Connection{containerFromItself}, payload.Conns)
+}
+
+func TestExpireStale(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	f := newFilter()
+	f.now = func() time.Time { return now }
+
+	f.LoadProxies(map[int32]*process.FilledProcess{
+		1: {Pid: 1, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-port", "8080", "-container-ip", "172.17.0.2", "-container-port", "80"}},
+		2: {Pid: 2, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-port", "8081", "-container-ip", "172.17.0.3", "-container-port", "80"}},
+		3: {Pid: 3, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-port", "8082", "-container-ip", "172.17.0.4", "-container-port", "80"}},
+	})
+	f.AddProxy(4, "172.17.0.1", model.Addr{Ip: "172.17.0.5", Port: 80})
+
+	// proxies that were just registered aren't stale
+	assert.Equal(t, 0, f.ExpireStale(time.Minute))
+	assert.Equal(t, 4, f.ProxyCount())
+
+	now = now.Add(50 * time.Second)
+	f.Filter(&model.Connections{Conns: []*model.Connection{
+		{Pid: 1, Laddr: &model.Addr{Ip: "172.17.0.1", Port: 34567}, Raddr: &model.Addr{Ip: "172.17.0.2", Port: 80}},
+	}})
+	assert.True(t, f.IsProxied(&model.Connection{Pid: 2, Laddr: &model.Addr{Ip: "10.0.0.5", Port: 8081}, Raddr: &model.Addr{Ip: "10.0.0.42", Port: 51234}}))
+
+	now = now.Add(50 * time.Second)
+	assert.Equal(t, 1, f.ExpireStale(time.Minute))
+	assert.Contains(t, f.proxyByPID, int32(1))
+	assert.Contains(t, f.proxyByPID, int32(2))
+	assert.NotContains(t, f.proxyByPID, int32(3))
+	// static proxies are only removed by RemoveProxy
+	assert.Contains(t, f.proxyByPID, int32(4))
+
+	// reloading a proxy doesn't reset its last match
+	f.LoadProxies(map[int32]*process.FilledProcess{
+		1: {Pid: 1, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-port", "8080", "-container-ip", "172.17.0.2", "-container-port", "80"}},
+	})
+	now = now.Add(20 * time.Second)
+	assert.Equal(t, 2, f.ExpireStale(time.Minute))
+	assert.Equal(t, 1, f.ProxyCount())
+}
+
+func TestMaxProxies(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	logger := &recordingLogger{}
+	f := newFilter(WithMaxProxies(3), WithLogger(logger))
+	f.now = func() time.Time { return now }
+
+	procs := map[int32]*process.FilledProcess{}
+	for pid := int32(1); pid <= 3; pid++ {
+		procs[pid] = &process.FilledProcess{Pid: pid, Cmdline: []string{"docker-proxy", "-proto", "tcp",
+			"-host-port", fmt.Sprint(8080 + pid), "-container-ip", fmt.Sprintf("172.17.0.%d", pid+1), "-container-port", "80"}}
+	}
+	f.LoadProxies(procs)
+	assert.Equal(t, 3, f.ProxyCount())
+
+	clientToProxy := func(pid int32) *model.Connection {
+		return &model.Connection{Pid: pid, Laddr: &model.Addr{Ip: "10.0.0.5", Port: 8080 + pid}, Raddr: &model.Addr{Ip: "10.0.0.42", Port: 51234}}
+	}
+	now = now.Add(time.Minute)
+	assert.True(t, f.IsProxied(clientToProxy(1)))
+	now = now.Add(time.Minute)
+	assert.True(t, f.IsProxied(clientToProxy(2)))
+
+	// the idle proxy makes room for the new one
+	now = now.Add(time.Minute)
+	f.LoadProxies(map[int32]*process.FilledProcess{
+		4: {Pid: 4, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-port", "8084", "-container-ip", "172.17.0.5", "-container-port", "80"}},
+	})
+	assert.Equal(t, 3, f.ProxyCount())
+	assert.NotContains(t, f.proxyByPID, int32(3))
+
+	// then the least recently matched one
+	f.AddProxy(10, "172.17.0.1", model.Addr{Ip: "172.17.0.10", Port: 80})
+	assert.Equal(t, 3, f.ProxyCount())
+	assert.NotContains(t, f.proxyByPID, int32(1))
+	assert.Contains(t, f.proxyByPID, int32(2))
+	assert.Contains(t, f.proxyByPID, int32(4))
+
+	// static proxies are never evicted, even if they are the least recently matched ones
+	now = now.Add(time.Minute)
+	assert.True(t, f.IsProxied(clientToProxy(2)))
+	now = now.Add(time.Minute)
+	assert.True(t, f.IsProxied(clientToProxy(4)))
+	now = now.Add(time.Minute)
+	f.LoadProxies(map[int32]*process.FilledProcess{
+		5: {Pid: 5, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-port", "8085", "-container-ip", "172.17.0.6", "-container-port", "80"}},
+	})
+	assert.Contains(t, f.proxyByPID, int32(10))
+	assert.NotContains(t, f.proxyByPID, int32(2))
+
+	assert.Equal(t, Stats{Proxies: 3, ProxyInsertions: 6, ProxyEvictions: 3, ProxyLookups: 4, Discovered: 1, Undiscovered: 2}, f.Stats())
+	// reaching the limit is only reported once
+	assert.Len(t, logger.messages["warn"], 1)
+
+	// without limit, every proxy is tracked
+	f = newFilter()
+	f.LoadProxies(procs)
+	f.LoadProxies(map[int32]*process.FilledProcess{
+		4: {Pid: 4, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-port", "8084", "-container-ip", "172.17.0.5", "-container-port", "80"}},
+	})
+	assert.Equal(t, 4, f.ProxyCount())
+	assert.Equal(t, uint64(0), f.Stats().ProxyEvictions)
+}
+
+func TestFilterInPlace(t *testing.T) {
+	f := newFilter()
+	f.LoadProxies(map[int32]*process.FilledProcess{
+		1: {Pid: 1, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-port", "8080", "-container-ip", "172.17.0.2", "-container-port", "80"}},
+	})
+
+	var conns, kept []*model.Connection
+	for i := 0; i < 10; i++ {
+		proxied := &model.Connection{Pid: 1, Laddr: &model.Addr{Ip: "172.17.0.1", Port: int32(40000 + i)}, Raddr: &model.Addr{Ip: "172.17.0.2", Port: 80}}
+		unrelated := &model.Connection{Pid: 4, Laddr: &model.Addr{Ip: "10.0.0.5", Port: int32(50000 + i)}, Raddr: &model.Addr{Ip: "10.0.0.42", Port: 443}}
+		if i%3 == 0 {
+			conns = append(conns, proxied, unrelated)
+		} else {
+			conns = append(conns, unrelated, proxied)
+		}
+		kept = append(kept, unrelated)
+	}
+
+	original := conns
+	payload := &model.Connections{Conns: conns}
+	assert.Equal(t, 10, f.FilterInPlace(payload))
+
+	// the remaining connections keep their relative order, within the original backing array
+	assert.Equal(t, kept, payload.Conns)
+	assert.Equal(t, &original[0], &payload.Conns[0])
+	// and the dropped ones are released
+	for _, c := range original[len(payload.Conns):] {
+		assert.Nil(t, c)
+	}
+}
+
+func TestFilterInPlaceMatchesFilter(t *testing.T) {
+	f, conns := newBenchmarkFilter(50000)
+
+	copied := &model.Connections{Conns: conns}
+	inPlace := &model.Connections{Conns: append([]*model.Connection(nil), conns...)}
+	dropped := f.Filter(copied)
+	assert.True(t, dropped > 0)
+	assert.Equal(t, dropped, f.FilterInPlace(inPlace))
+	assert.Equal(t, copied.Conns, inPlace.Conns)
+
+	// Filter leaves the original connections untouched
+	assert.Len(t, conns, 50000)
+	for _, c := range conns {
+		assert.NotNil(t, c)
+	}
+}
+
+func TestFilterAll(t *testing.T) {
+	batch := func(conns []*model.Connection) []*model.Connections {
+		var payloads []*model.Connections
+		for i := 0; i < len(conns); i += 500 {
+			payloads = append(payloads, &model.Connections{Conns: conns[i : i+500]})
+		}
+		return payloads
+	}
+
+	for _, mode := range []Mode{DropMode, TranslateMode, MarkMode, MergeMode} {
+		single, conns := newBenchmarkFilter(5000, WithMode(mode))
+		singlePayloads := batch(conns)
+		singleDropped := 0
+		for _, payload := range singlePayloads {
+			singleDropped += single.Filter(payload)
+		}
+		assert.True(t, singleDropped > 0, mode)
+
+		bulk, conns := newBenchmarkFilter(5000, WithMode(mode))
+		bulkPayloads := batch(conns)
+		assert.Equal(t, singleDropped, bulk.FilterAll(bulkPayloads), mode)
+		assert.Equal(t, singlePayloads, bulkPayloads, mode)
+		assert.Equal(t, single.Stats(), bulk.Stats(), mode)
+	}
+
+	// the payloads are kept whole without any proxy
+	payloads := []*model.Connections{
+		{Conns: []*model.Connection{{Pid: 1, Laddr: &model.Addr{Ip: "172.17.0.1", Port: 34567}, Raddr: &model.Addr{Ip: "172.17.0.2", Port: 80}}}},
+		{},
+	}
+	f := newFilter()
+	assert.Equal(t, 0, f.FilterAll(payloads))
+	assert.Len(t, payloads[0].Conns, 1)
+	assert.Equal(t, Stats{Examined: 1, Kept: 1}, f.Stats())
+
+	// the readers of the filter aren't blocked while the payloads are filtered
+	filtering, read := make(chan struct{}), make(chan struct{})
+	var once sync.Once
+	f = newFilter(WithOnDrop(func(_ *model.Connection, _ ProxyInfo) {
+		once.Do(func() {
+			close(filtering)
+			select {
+			case <-read:
+			case <-time.After(10 * time.Second):
+				t.Error("the proxies couldn't be read while filtering")
+			}
+		})
+	}))
+	f.LoadProxies(map[int32]*process.FilledProcess{
+		1: {Pid: 1, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-port", "8080", "-container-ip", "172.17.0.2", "-container-port", "80"}},
+	})
+	go func() {
+		<-filtering
+		f.Proxies()
+		close(read)
+	}()
+	assert.Equal(t, 1, f.FilterAll(payloads))
+}
+
+func TestRunStats(t *testing.T) {
+	f := newFilter()
+	assert.Equal(t, RunStats{}, f.LastRunStats())
+
+	f.LoadProxies(map[int32]*process.FilledProcess{
+		1: {Pid: 1, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-port", "8080", "-container-ip", "172.17.0.2", "-container-port", "80"}},
+	})
+	proxyToContainer := &model.Connection{Pid: 1, Laddr: &model.Addr{Ip: "172.17.0.1", Port: 34567}, Raddr: &model.Addr{Ip: "172.17.0.2", Port: 80}, Direction: model.ConnectionDirection_outgoing}
+	containerToProxy := &model.Connection{Pid: 2, Laddr: &model.Addr{Ip: "172.17.0.2", Port: 80}, Raddr: &model.Addr{Ip: "172.17.0.1", Port: 34567}, Direction: model.ConnectionDirection_incoming}
+	// a container of the same network connecting to the target, from another IP than the proxy one
+	containerToContainer := &model.Connection{Pid: 2, Laddr: &model.Addr{Ip: "172.17.0.2", Port: 80}, Raddr: &model.Addr{Ip: "172.17.0.3", Port: 40000}, Direction: model.ConnectionDirection_incoming}
+
+	assert.Equal(t, 2, f.Filter(&model.Connections{Conns: []*model.Connection{proxyToContainer, containerToProxy, containerToContainer}}))
+	assert.Equal(t, RunStats{Examined: 3, Dropped: 2, Proxies: 1, ProxyIPDiscoveries: 1, ProxyIPMismatches: 1}, f.LastRunStats())
+
+	// the counters of the latest run replace the previous ones, the cumulative ones add up
+	assert.Equal(t, 1, f.FilterAll([]*model.Connections{
+		{Conns: []*model.Connection{containerToProxy}},
+		{Conns: []*model.Connection{containerToContainer}},
+	}))
+	assert.Equal(t, RunStats{Examined: 2, Dropped: 1, Proxies: 1, ProxyIPMismatches: 1}, f.LastRunStats())
+	stats := f.Stats()
+	assert.Equal(t, uint64(5), stats.Examined)
+	assert.Equal(t, uint64(3), stats.Dropped)
+	assert.Equal(t, uint64(1), stats.ProxyIPDiscoveries)
+	assert.Equal(t, uint64(2), stats.ProxyIPMismatches)
+
+	f.ResetStats()
+	assert.Equal(t, RunStats{}, f.LastRunStats())
+	assert.Equal(t, Stats{Proxies: 1, Discovered: 1}, f.Stats())
+
+	// the payloads are examined even without any proxy to filter against
+	f.Reset()
+	assert.Equal(t, 0, f.Filter(&model.Connections{Conns: []*model.Connection{containerToContainer}}))
+	assert.Equal(t, RunStats{Examined: 1}, f.LastRunStats())
+}
+
+func TestFilterParallel(t *testing.T) {
+	for _, mode := range []Mode{DropMode, TranslateMode, MergeMode} {
+		serial, conns := newBenchmarkFilter(10000, WithMode(mode), WithParallelism(1, 0))
+		serialPayload := &model.Connections{Conns: conns}
+		serialDropped := serial.Filter(serialPayload)
+
+		parallel, conns := newBenchmarkFilter(10000, WithMode(mode), WithParallelism(4, 1000))
+		parallelPayload := &model.Connections{Conns: conns}
+		assert.Equal(t, serialDropped, parallel.Filter(parallelPayload), mode)
+		assert.Equal(t, serialPayload.Conns, parallelPayload.Conns, mode)
+		assert.Equal(t, serial.Stats(), parallel.Stats(), mode)
+	}
+
+	// payloads below the threshold are matched serially
+	f := newFilter(WithParallelism(4, 10))
+	conns := make([]*model.Connection, 10)
+	for i := range conns {
+		conns[i] = &model.Connection{}
+	}
+	assert.Nil(t, f.matchAll(conns[:9], nil))
+	assert.Len(t, f.matchAll(conns, nil), 10)
+}
+
+// testProxyKey returns the key the proxies of the given address, protocol and netns are indexed by
+func testProxyKey(addr model.Addr, proto string, netns uint32) proxyKey {
+	key, _ := newAddrKey(addr)
+	return proxyKey{addr: key, proto: newProtoKey(proto), netns: netns}
+}
+
+func TestNewAddrKey(t *testing.T) {
+	for _, tc := range []struct {
+		ip       string
+		expected net.IP
+	}{
+		{ip: "172.17.0.2", expected: net.ParseIP("172.17.0.2")},
+		{ip: "0.0.0.0", expected: net.IPv4zero},
+		{ip: "255.255.255.255", expected: net.IPv4bcast},
+		{ip: "::", expected: net.IPv6zero},
+		{ip: "fd00::2", expected: net.ParseIP("fd00::2")},
+		{ip: "::ffff:172.17.0.2", expected: net.ParseIP("172.17.0.2")},
+	} {
+		key, ok := newAddrKey(model.Addr{Ip: tc.ip, Port: 80})
+		assert.True(t, ok, tc.ip)
+		assert.Equal(t, addrKey{ip: toKeyIP(tc.expected), port: 80}, key, tc.ip)
+	}
+
+	for _, invalid := range []string{"", "172.17.0", "172.17.0.2.1", "172.17.0.256", "172.17..2", "172.17.0.2.", "1720.17.0.2", "localhost"} {
+		_, ok := newAddrKey(model.Addr{Ip: invalid, Port: 80})
+		assert.False(t, ok, invalid)
+	}
+
+	// the wildcard keys are the ones of the wildcard IPs
+	for i, ip := range wildcardIPs {
+		key, ok := newAddrKey(model.Addr{Ip: ip})
+		assert.True(t, ok)
+		assert.Equal(t, wildcardKeyIPs[i], key.ip, ip)
+	}
+}
+
+func toKeyIP(ip net.IP) (keyIP [net.IPv6len]byte) {
+	copy(keyIP[:], ip.To16())
+	return keyIP
+}
@@ -0,0 +1,45 @@
+// +build windows
+
+package dockerproxy
+
+import (
+	"testing"
+
+	model "github.com/DataDog/agent-payload/process"
+	"github.com/DataDog/gopsutil/process"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsProxyBinaryWindows(t *testing.T) {
+	assert.True(t, isProxyBinary(`C:\Program Files\Docker\docker-proxy.exe`, ProxyBinaryNames))
+	assert.True(t, isProxyBinary(`c:\program files\docker\Docker-Proxy.EXE`, ProxyBinaryNames))
+	assert.True(t, isProxyBinary(`docker-proxy`, ProxyBinaryNames))
+	assert.False(t, isProxyBinary(`C:\Program Files\Docker\dockerd.exe`, ProxyBinaryNames))
+}
+
+func TestExtractProxyInfoWindows(t *testing.T) {
+	expected := &proxy{pid: 1, proto: "tcp", host: model.Addr{Ip: "0.0.0.0", Port: 8080}, target: model.Addr{Ip: "172.17.0.2", Port: 80}}
+	p := &process.FilledProcess{
+		Pid:     1,
+		Exe:     `C:\Program Files\Docker\docker-proxy.exe`,
+		Cmdline: splitCommandLine(`"C:\Program Files\Docker\docker-proxy.exe" -proto tcp -host-ip 0.0.0.0 -host-port 8080 -container-ip 172.17.0.2 -container-port 80`),
+	}
+
+	proxy, err := newFilter().extractProxyInfo(p)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, proxy)
+}
+
+func TestSplitCommandLine(t *testing.T) {
+	assert.Equal(t,
+		[]string{`C:\Program Files\Docker\docker-proxy.exe`, "-container-ip", "172.17.0.2"},
+		splitCommandLine(`"C:\Program Files\Docker\docker-proxy.exe"  -container-ip 172.17.0.2`),
+	)
+	assert.Empty(t, splitCommandLine(""))
+}
+
+func TestProcessNamesCondition(t *testing.T) {
+	assert.Equal(t, "WHERE Name = 'docker-proxy.exe' OR Name = 'my-proxy.exe'", processNamesCondition([]string{"docker-proxy", "my-proxy"}))
+	// the configured names can't break the query
+	assert.Equal(t, `WHERE Name = 'o\'proxy.exe' OR Name = 'back\\slash.exe'`, processNamesCondition([]string{"o'proxy", `back\slash`}))
+}
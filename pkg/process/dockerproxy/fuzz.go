@@ -0,0 +1,33 @@
+// +build gofuzz
+
+package dockerproxy
+
+import (
+	"strings"
+
+	"github.com/DataDog/gopsutil/process"
+)
+
+// Fuzz is the go-fuzz entry point for the docker-proxy cmdline parser.
+// The input is split on NUL bytes, the same way /proc/<pid>/cmdline is.
+func Fuzz(data []byte) int {
+	p := &process.FilledProcess{
+		Pid:     1,
+		Exe:     "/usr/bin/docker-proxy",
+		Cmdline: strings.Split(string(data), "\x00"),
+	}
+
+	proxy, err := newFilter().extractProxyInfo(p)
+	if err != nil || proxy == nil {
+		return 0
+	}
+
+	if proxy.target.Ip == "" || normalizeIP(proxy.target.Ip) != proxy.target.Ip {
+		panic("proxy registered with an invalid target IP: " + proxy.target.Ip)
+	}
+	if proxy.target.Port <= 0 || proxy.target.Port > 65535 || proxy.host.Port < 0 || proxy.host.Port > 65535 {
+		panic("proxy registered with an invalid port")
+	}
+
+	return 1
+}
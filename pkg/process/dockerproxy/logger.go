@@ -0,0 +1,62 @@
+package dockerproxy
+
+import (
+	"github.com/DataDog/datadog-agent/pkg/util/log"
+	"github.com/cihub/seelog"
+)
+
+// Logger is the logging interface used by a Filter, see WithLogger
+type Logger interface {
+	Tracef(format string, params ...interface{})
+	Debugf(format string, params ...interface{})
+	Infof(format string, params ...interface{})
+	Warnf(format string, params ...interface{})
+	Errorf(format string, params ...interface{})
+}
+
+// TraceLogger is implemented by the loggers telling whether trace logging is enabled, sparing the Filter
+// from building trace lines that would be discarded. Loggers not implementing it are assumed to log traces.
+type TraceLogger interface {
+	TraceEnabled() bool
+}
+
+// DebugLogger is implemented by the loggers telling whether debug logging is enabled, like TraceLogger.
+// Loggers not implementing it are assumed to log debug messages.
+type DebugLogger interface {
+	DebugEnabled() bool
+}
+
+// agentLogger is the default Logger, logging through the agent's logger
+type agentLogger struct{}
+
+func (agentLogger) Tracef(format string, params ...interface{}) { log.Tracef(format, params...) }
+func (agentLogger) Debugf(format string, params ...interface{}) { log.Debugf(format, params...) }
+func (agentLogger) Infof(format string, params ...interface{})  { log.Infof(format, params...) }
+func (agentLogger) Warnf(format string, params ...interface{})  { _ = log.Warnf(format, params...) }
+func (agentLogger) Errorf(format string, params ...interface{}) { _ = log.Errorf(format, params...) }
+
+func (agentLogger) TraceEnabled() bool {
+	lvl, err := log.GetLogLevel()
+	return err == nil && lvl == seelog.TraceLvl
+}
+
+func (agentLogger) DebugEnabled() bool {
+	lvl, err := log.GetLogLevel()
+	return err == nil && lvl <= seelog.DebugLvl
+}
+
+// traceEnabled returns true if the given logger logs traces
+func traceEnabled(logger Logger) bool {
+	if l, ok := logger.(TraceLogger); ok {
+		return l.TraceEnabled()
+	}
+	return true
+}
+
+// debugEnabled returns true if the given logger logs debug messages
+func debugEnabled(logger Logger) bool {
+	if l, ok := logger.(DebugLogger); ok {
+		return l.DebugEnabled()
+	}
+	return true
+}
@@ -0,0 +1,498 @@
+package dockerproxy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	model "github.com/DataDog/agent-payload/process"
+)
+
+// dockerProxyBoolFlags are the flags of docker-proxy that don't take the following argument as value
+var dockerProxyBoolFlags = []string{"-use-listen-fd"}
+
+// parseDockerProxyCmdline parses the flags of docker-proxy and of the binaries sharing them.
+// The -container-ip flag may be repeated, e.g. for dual-stack containers: every container IP is paired with
+// the -container-port flag of the same rank, or with the last one if there are fewer ports than IPs.
+// Only the container flags are required: recent releases may hand docker-proxy its listening socket
+// (-use-listen-fd), in which case the host flags may be omitted and only the proxy legs towards the
+// containers can be matched. A proxy given `-container-proto unix` or a -container-socket path forwards
+// to a unix domain socket instead of a container address.
+func parseDockerProxyCmdline(cmdline []string) (*Forwarding, error) {
+	var args []string
+	if len(cmdline) > 0 {
+		args = cmdline[1:]
+	}
+
+	fwd := &Forwarding{}
+	var targetIPs []string
+	var targetPorts []int32
+	for _, f := range parseFlags(args, dockerProxyBoolFlags...) {
+		flag, value := f.name, f.value
+		switch flag {
+		case "-container-ip", "-container-port", "-container-proto", "-container-socket", "-host-ip", "-host-port", "-proto":
+			// a truncated cmdline (e.g. ending right after a flag) leaves us with an incomplete target
+			if value == "" {
+				return nil, fmt.Errorf("missing value for flag %s", flag)
+			}
+		}
+
+		switch flag {
+		case "-proto":
+			fwd.Proto = strings.ToLower(value)
+		case "-container-ip":
+			ip := normalizeIP(value)
+			if ip == "" {
+				return nil, fmt.Errorf("invalid container ip %q", value)
+			}
+			targetIPs = append(targetIPs, ip)
+		case "-container-port":
+			port, err := parsePort(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid container port %q", value)
+			}
+			targetPorts = append(targetPorts, port)
+		case "-host-ip":
+			if fwd.Host.Ip = normalizeIP(value); fwd.Host.Ip == "" {
+				return nil, fmt.Errorf("invalid host ip %q", value)
+			}
+		case "-host-port":
+			port, err := parsePort(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid host port %q", value)
+			}
+			fwd.Host.Port = port
+		case "-container-proto":
+			fwd.UnixSocket = fwd.UnixSocket || strings.EqualFold(value, "unix")
+		case "-container-socket":
+			fwd.UnixSocket, fwd.SocketPath = true, value
+		}
+	}
+
+	for i, ip := range targetIPs {
+		target := model.Addr{Ip: ip}
+		if len(targetPorts) > 0 {
+			target.Port = targetPorts[len(targetPorts)-1]
+			if i < len(targetPorts) {
+				target.Port = targetPorts[i]
+			}
+		}
+		fwd.Targets = append(fwd.Targets, target)
+	}
+
+	return fwd, nil
+}
+
+// rootlesskitChildIP is the address rootlesskit forwards the published ports to in the child network
+// namespace when the publish spec doesn't name one
+const rootlesskitChildIP = "127.0.0.1"
+
+// rootlesskitBoolFlags are the flags of rootlesskit that don't take the following argument as value
+var rootlesskitBoolFlags = []string{"-debug", "-disable-host-loopback", "-ipv6", "-pidns", "-cgroupns", "-utsns", "-ipcns",
+	"-detach-netns", "-h", "-help", "-v", "-version"}
+
+// parseRootlesskitCmdline parses every `--publish [PARENTIP:]PARENTPORT:[CHILDIP:]CHILDPORT/PROTO` flag of
+// rootlesskit, or returns nil if it publishes no port. Only the flags preceding the command rootlesskit runs are
+// parsed, the following ones being the flags of that command. The child process rootlesskit re-executes itself
+// as (through /proc/self/exe) is ignored, as the parent is the one listening on the published ports.
+func parseRootlesskitCmdline(_ int32, cmdline []string) ([]Forwarding, error) {
+	if len(cmdline) == 0 || cmdline[0] == "/proc/self/exe" {
+		return nil, nil
+	}
+
+	var fwds []Forwarding
+	for _, flag := range parseLeadingFlags(cmdline[1:], rootlesskitBoolFlags...) {
+		if flag.name != "-publish" && flag.name != "-p" {
+			continue
+		}
+
+		if flag.value == "" {
+			return nil, fmt.Errorf("missing value for flag %s", flag.name)
+		}
+		fwd, err := parsePublishSpec(flag.value)
+		if err != nil {
+			return nil, err
+		}
+		fwds = append(fwds, *fwd)
+	}
+	return fwds, nil
+}
+
+// parsePublishSpec parses a rootlesskit port publish spec, e.g. `127.0.0.1:8080:80/tcp` or `[::1]:8080:80/tcp`
+func parsePublishSpec(spec string) (*Forwarding, error) {
+	fwd := &Forwarding{}
+
+	addrs := spec
+	if idx := strings.LastIndexByte(spec, '/'); idx >= 0 {
+		addrs, fwd.Proto = spec[:idx], strings.ToLower(spec[idx+1:])
+	}
+
+	parts := splitPublishSpec(addrs)
+	var parentIP, parentPort, childIP, childPort string
+	switch len(parts) {
+	case 2:
+		parentPort, childPort = parts[0], parts[1]
+	case 3:
+		// either PARENTIP:PARENTPORT:CHILDPORT or PARENTPORT:CHILDIP:CHILDPORT
+		if normalizeIP(parts[0]) != "" {
+			parentIP, parentPort, childPort = parts[0], parts[1], parts[2]
+		} else {
+			parentPort, childIP, childPort = parts[0], parts[1], parts[2]
+		}
+	case 4:
+		parentIP, parentPort, childIP, childPort = parts[0], parts[1], parts[2], parts[3]
+	default:
+		return nil, fmt.Errorf("invalid publish spec %q", spec)
+	}
+
+	if parentIP != "" {
+		if fwd.Host.Ip = normalizeIP(parentIP); fwd.Host.Ip == "" {
+			return nil, fmt.Errorf("invalid parent ip %q", parentIP)
+		}
+	}
+	if childIP == "" {
+		childIP = rootlesskitChildIP
+	}
+	target := model.Addr{Ip: normalizeIP(childIP)}
+	if target.Ip == "" {
+		return nil, fmt.Errorf("invalid child ip %q", childIP)
+	}
+
+	var err error
+	if fwd.Host.Port, err = parsePort(parentPort); err != nil {
+		return nil, fmt.Errorf("invalid parent port %q", parentPort)
+	}
+	if target.Port, err = parsePort(childPort); err != nil {
+		return nil, fmt.Errorf("invalid child port %q", childPort)
+	}
+
+	fwd.Targets = []model.Addr{target}
+	return fwd, nil
+}
+
+// splitPublishSpec splits the addresses of a publish spec on colons, except the ones of bracketed IPv6 addresses
+func splitPublishSpec(addrs string) []string {
+	var parts []string
+	start, bracketed := 0, false
+	for i, c := range addrs {
+		switch c {
+		case '[':
+			bracketed = true
+		case ']':
+			bracketed = false
+		case ':':
+			if !bracketed {
+				parts = append(parts, addrs[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, addrs[start:])
+}
+
+// maxUnwrapDepth is the number of nested shells and wrappers unwrapCmdline looks through at most
+const maxUnwrapDepth = 3
+
+// shellBinaries are the shells whose -c script may run a proxy
+var shellBinaries = []string{"sh", "bash", "dash", "ash", "zsh"}
+
+// wrapperBinaries are the binaries running the command given by their arguments, following their options and,
+// for env, the variables it sets
+var wrapperBinaries = []string{"env", "nohup", "setsid", "tini", "dumb-init"}
+
+// shellSeparators are the words separating the commands of a shell script
+var shellSeparators = []string{";", "&&", "||", "|", "&"}
+
+// scriptSeparators spaces out the separators shell scripts may not put spaces around
+var scriptSeparators = strings.NewReplacer(";", " ; ")
+
+// unwrapCmdline returns the cmdlines of the commands run by a shell through its -c script, e.g. the
+// `docker-proxy -proto tcp ...` part of `sh -c "set -e; exec docker-proxy -proto tcp ..."`, or by a wrapper such
+// as env or tini, or nil if the given cmdline doesn't run any. Only the words at the position of a command
+// (following exec and the variable assignments in a script) are taken as one, the ones merely given as arguments
+// (e.g. `grep docker-proxy`) never being mistaken for a command. The words of a script are split on whitespace,
+// so only the commands whose arguments don't need quoting are returned as run.
+func unwrapCmdline(cmdline []string) [][]string {
+	return unwrapCommands(cmdline, 0)
+}
+
+func unwrapCommands(cmdline []string, depth int) [][]string {
+	if len(cmdline) == 0 || depth > maxUnwrapDepth {
+		return nil
+	}
+
+	var commands [][]string
+	switch name := binaryName(cmdline[0]); {
+	case containsString(shellBinaries, name):
+		script := shellScript(cmdline[1:])
+		words := strings.Fields(scriptSeparators.Replace(script))
+		start := 0
+		for i := 0; i <= len(words); i++ {
+			if i < len(words) && !containsString(shellSeparators, words[i]) {
+				words[i] = strings.Trim(words[i], `"'`)
+				continue
+			}
+			commands = append(commands, commandWords(words[start:i]))
+			start = i + 1
+		}
+	case containsString(wrapperBinaries, name):
+		commands = append(commands, commandWords(cmdline[1:]))
+	default:
+		return nil
+	}
+
+	var unwrapped [][]string
+	for _, command := range commands {
+		switch {
+		case len(command) == 0:
+		case isWrapper(command[0]):
+			unwrapped = append(unwrapped, unwrapCommands(command, depth+1)...)
+		default:
+			unwrapped = append(unwrapped, command)
+		}
+	}
+	return unwrapped
+}
+
+// isWrapper returns true if the given path refers to a shell or to a wrapper, see unwrapCmdline
+func isWrapper(path string) bool {
+	name := binaryName(path)
+	return containsString(shellBinaries, name) || containsString(wrapperBinaries, name)
+}
+
+// shellScript returns the -c script of a shell given the following arguments, or an empty string if it isn't
+// given one. The script is the first argument following the options, one of which is -c, possibly combined with
+// other ones (e.g. -ec).
+func shellScript(args []string) string {
+	withScript := false
+	for _, arg := range args {
+		switch {
+		case arg == "--":
+		case strings.HasPrefix(arg, "--"):
+		case strings.HasPrefix(arg, "-") || strings.HasPrefix(arg, "+"):
+			withScript = withScript || strings.Contains(arg[1:], "c")
+		case withScript:
+			return arg
+		default:
+			// a script file
+			return ""
+		}
+	}
+	return ""
+}
+
+// commandWords returns the given words of a command starting at its name: the options of a wrapper, exec and the
+// variable assignments preceding it are skipped
+func commandWords(words []string) []string {
+	start := 0
+	for start < len(words) && (words[start] == "exec" || strings.HasPrefix(words[start], "-") || isAssignment(words[start])) {
+		start++
+	}
+	return words[start:]
+}
+
+// isAssignment returns true if the given word assigns a variable, e.g. FOO=bar
+func isAssignment(word string) bool {
+	i := strings.IndexByte(word, '=')
+	if i <= 0 {
+		return false
+	}
+	for j, r := range word[:i] {
+		if r != '_' && !unicode.IsLetter(r) && (j == 0 || !unicode.IsDigit(r)) {
+			return false
+		}
+	}
+	return true
+}
+
+// runsBinary returns true if one of the commands run by the shell or the wrapper of the given cmdline executes one
+// of the given binaries, see unwrapCmdline
+func runsBinary(cmdline []string, binaryNames []string) bool {
+	for _, command := range unwrapCmdline(cmdline) {
+		if isProxyBinary(command[0], binaryNames) {
+			return true
+		}
+	}
+	return false
+}
+
+// containsString returns true if the given string is among the given ones
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// parseSocatCmdline parses a socat relay from a listening address to a remote one, e.g.
+// `socat TCP-LISTEN:8080,fork,reuseaddr TCP:10.88.0.5:80`, the addresses being the last two arguments.
+// The host IP is the one of the bind option of the listening address, if any. Relays to hostnames
+// aren't supported as they can't be matched against connections.
+func parseSocatCmdline(cmdline []string) (*Forwarding, error) {
+	if len(cmdline) < 3 {
+		return nil, nil
+	}
+
+	listen, connect := cmdline[len(cmdline)-2], cmdline[len(cmdline)-1]
+	proto, host, ok := parseSocatListenAddr(listen)
+	if !ok {
+		// socat addresses are symmetrical
+		listen, connect = connect, listen
+		if proto, host, ok = parseSocatListenAddr(listen); !ok {
+			return nil, nil
+		}
+	}
+
+	typ, params := splitSocatAddr(connect)
+	if socatProto(typ) != proto || strings.HasSuffix(typ, "-LISTEN") {
+		return nil, nil
+	}
+
+	idx := strings.LastIndexByte(params, ':')
+	if idx < 0 {
+		return nil, fmt.Errorf("invalid socat address %q", connect)
+	}
+	target := model.Addr{Ip: normalizeIP(params[:idx])}
+	if target.Ip == "" {
+		return nil, nil
+	}
+	port, err := parsePort(params[idx+1:])
+	if err != nil {
+		return nil, fmt.Errorf("invalid socat address %q", connect)
+	}
+	target.Port = port
+
+	return &Forwarding{Proto: proto, Host: host, Targets: []model.Addr{target}}, nil
+}
+
+// parseSocatListenAddr parses a listening socat address, e.g. `TCP-LISTEN:8080,fork,bind=10.0.0.5`,
+// returning false if it isn't one
+func parseSocatListenAddr(addr string) (proto string, host model.Addr, ok bool) {
+	typ, params := splitSocatAddr(addr)
+	if !strings.HasSuffix(typ, "-LISTEN") {
+		return "", model.Addr{}, false
+	}
+	if proto = socatProto(typ); proto == "" {
+		return "", model.Addr{}, false
+	}
+
+	options := strings.Split(params, ",")
+	port, err := parsePort(options[0])
+	if err != nil {
+		return "", model.Addr{}, false
+	}
+	host.Port = port
+
+	for _, option := range options[1:] {
+		if strings.HasPrefix(option, "bind=") {
+			host.Ip = normalizeIP(option[len("bind="):])
+		}
+	}
+	return proto, host, true
+}
+
+// splitSocatAddr splits a socat address into its uppercased type, short forms being expanded, and its parameters
+// without the options that follow them, except for listening addresses whose options are kept
+func splitSocatAddr(addr string) (typ, params string) {
+	idx := strings.IndexByte(addr, ':')
+	if idx < 0 {
+		return strings.ToUpper(addr), ""
+	}
+
+	typ, params = strings.ToUpper(addr[:idx]), addr[idx+1:]
+	if strings.HasSuffix(typ, "-L") {
+		typ += "ISTEN"
+	}
+	if strings.HasSuffix(typ, "-CONNECT") {
+		typ = strings.TrimSuffix(typ, "-CONNECT")
+	}
+	if !strings.HasSuffix(typ, "-LISTEN") {
+		if idx := strings.IndexByte(params, ','); idx >= 0 {
+			params = params[:idx]
+		}
+	}
+	return typ, params
+}
+
+// socatProto returns the protocol of a socat address type, or an empty string if it isn't a TCP or UDP one
+func socatProto(typ string) string {
+	typ = strings.TrimSuffix(typ, "-LISTEN")
+	switch typ {
+	case "TCP", "TCP4", "TCP6":
+		return "tcp"
+	case "UDP", "UDP4", "UDP6", "UDP-SENDTO", "UDP4-SENDTO", "UDP6-SENDTO":
+		return "udp"
+	default:
+		return ""
+	}
+}
+
+// cmdlineFlag is a flag of a cmdline along with its value, empty if it has none
+type cmdlineFlag struct {
+	name, value string
+}
+
+// parseFlags walks the flags of the given arguments, pairing each flag with its value. Both the `-flag value`
+// and `-flag=value` forms are supported, and GNU-style `--flag` spellings are normalized to their single-dash
+// form. An argument following a flag is consumed as its value unless it is itself a flag or the flag is one of
+// the given boolean flags, which only take a value in the `-flag=value` form. Other arguments are skipped.
+func parseFlags(args []string, boolFlags ...string) []cmdlineFlag {
+	return walkFlags(args, false, boolFlags)
+}
+
+// parseLeadingFlags is parseFlags stopping at the first argument that is neither a flag nor the value of one, or at
+// `--`, for the binaries running the command given by the arguments following their flags (e.g. rootlesskit)
+func parseLeadingFlags(args []string, boolFlags ...string) []cmdlineFlag {
+	return walkFlags(args, true, boolFlags)
+}
+
+// walkFlags is parseFlags, stopping at the first argument that isn't a flag if leading is set
+func walkFlags(args []string, leading bool, boolFlags []string) []cmdlineFlag {
+	var flags []cmdlineFlag
+	for i := 0; i < len(args); i++ {
+		name := strings.TrimSpace(args[i])
+		if leading && (name == "--" || len(name) < 2 || name[0] != '-') {
+			break
+		}
+		if len(name) < 2 || name[0] != '-' {
+			continue
+		}
+		if strings.HasPrefix(name, "--") {
+			name = name[1:]
+		}
+
+		if idx := strings.IndexByte(name, '='); idx >= 0 {
+			flags = append(flags, cmdlineFlag{name: name[:idx], value: strings.TrimSpace(name[idx+1:])})
+			continue
+		}
+
+		flag := cmdlineFlag{name: name}
+		if !isBoolFlag(name, boolFlags) && i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
+			i++
+			flag.value = strings.TrimSpace(args[i])
+		}
+		flags = append(flags, flag)
+	}
+	return flags
+}
+
+func isBoolFlag(name string, boolFlags []string) bool {
+	for _, flag := range boolFlags {
+		if name == flag {
+			return true
+		}
+	}
+	return false
+}
+
+// parsePort parses a TCP/UDP port number
+func parsePort(value string) (int32, error) {
+	port, err := strconv.ParseUint(value, 10, 16)
+	if err != nil {
+		return 0, err
+	}
+	return int32(port), nil
+}
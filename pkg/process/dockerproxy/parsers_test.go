@@ -0,0 +1,302 @@
+package dockerproxy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	model "github.com/DataDog/agent-payload/process"
+	"github.com/DataDog/gopsutil/process"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExtractProxyInfoRootless(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		exe      string
+		cmdline  []string
+		expected *proxy
+	}{
+		{
+			name:     "rootless docker shim",
+			exe:      "/home/user/bin/rootlesskit-docker-proxy",
+			cmdline:  []string{"/home/user/bin/rootlesskit-docker-proxy", "-proto", "tcp", "-host-ip", "0.0.0.0", "-host-port", "8080", "-container-ip", "172.17.0.2", "-container-port", "80"},
+			expected: &proxy{pid: 1, proto: "tcp", host: model.Addr{Ip: "0.0.0.0", Port: 8080}, target: model.Addr{Ip: "172.17.0.2", Port: 80}},
+		},
+		{
+			name:     "rootlesskit publishing a port",
+			exe:      "/usr/bin/rootlesskit",
+			cmdline:  []string{"rootlesskit", "--net=slirp4netns", "--mtu=65520", "--port-driver=builtin", "--publish", "0.0.0.0:8080:80/tcp", "nginx"},
+			expected: &proxy{pid: 1, proto: "tcp", host: model.Addr{Ip: "0.0.0.0", Port: 8080}, target: model.Addr{Ip: "127.0.0.1", Port: 80}},
+		},
+		{
+			name:     "rootlesskit publishing to a child ip",
+			exe:      "/usr/bin/rootlesskit",
+			cmdline:  []string{"rootlesskit", "--port-driver=slirp4netns", "-p=127.0.0.1:8080:10.0.2.100:80/udp", "nginx"},
+			expected: &proxy{pid: 1, proto: "udp", host: model.Addr{Ip: "127.0.0.1", Port: 8080}, target: model.Addr{Ip: "10.0.2.100", Port: 80}},
+		},
+		{
+			name:     "rootlesskit publishing on all interfaces",
+			exe:      "/usr/bin/rootlesskit",
+			cmdline:  []string{"rootlesskit", "--publish=8080:80/tcp", "nginx"},
+			expected: &proxy{pid: 1, proto: "tcp", host: model.Addr{Ip: "0.0.0.0", Port: 8080}, target: model.Addr{Ip: "127.0.0.1", Port: 80}},
+		},
+		{
+			name:     "rootlesskit publishing ipv6",
+			exe:      "/usr/bin/rootlesskit",
+			cmdline:  []string{"rootlesskit", "--publish", "[::1]:8080:80/tcp", "nginx"},
+			expected: &proxy{pid: 1, proto: "tcp", host: model.Addr{Ip: "::1", Port: 8080}, target: model.Addr{Ip: "127.0.0.1", Port: 80}},
+		},
+		{
+			name:    "rootlesskit as started by dockerd-rootless.sh",
+			exe:     "/usr/bin/rootlesskit",
+			cmdline: []string{"rootlesskit", "--net=slirp4netns", "--mtu=65520", "--slirp4netns-sandbox=auto", "--port-driver=builtin", "--copy-up=/etc", "--propagation=rslave", "dockerd-rootless.sh"},
+		},
+		{
+			name:    "rootlesskit publishing several ports",
+			exe:     "/usr/bin/rootlesskit",
+			cmdline: []string{"rootlesskit", "--debug", "-p", "0.0.0.0:8080:80/tcp", "--publish=127.0.0.1:5353:53/udp", "nginx"},
+			expected: &proxy{pid: 1, host: model.Addr{Ip: "0.0.0.0", Port: 8080}, target: model.Addr{Ip: "127.0.0.1", Port: 80},
+				extraHosts: []model.Addr{{Ip: "127.0.0.1", Port: 5353}}, extraTargets: []model.Addr{{Ip: "127.0.0.1", Port: 53}}},
+		},
+		{
+			// the flags of the command run by rootlesskit aren't its own
+			name:     "rootlesskit running a command taking -p",
+			exe:      "/usr/bin/rootlesskit",
+			cmdline:  []string{"rootlesskit", "--pidns", "--publish", "8080:80/tcp", "dockerd", "-p", "/var/run/docker.pid"},
+			expected: &proxy{pid: 1, proto: "tcp", host: model.Addr{Ip: "0.0.0.0", Port: 8080}, target: model.Addr{Ip: "127.0.0.1", Port: 80}},
+		},
+		{
+			name:    "rootlesskit publishing after --",
+			exe:     "/usr/bin/rootlesskit",
+			cmdline: []string{"rootlesskit", "--net=slirp4netns", "--", "dockerd", "--publish", "8080:80/tcp"},
+		},
+		{
+			name:    "rootlesskit child",
+			exe:     "/usr/bin/rootlesskit",
+			cmdline: []string{"/proc/self/exe", "--net=slirp4netns", "--publish", "0.0.0.0:8080:80/tcp", "nginx"},
+		},
+	} {
+		p := &process.FilledProcess{Pid: 1, Exe: tc.exe, Cmdline: tc.cmdline}
+		proxy, err := newFilter().extractProxyInfo(p)
+		assert.NoError(t, err, tc.name)
+		assert.Equal(t, tc.expected, proxy, tc.name)
+	}
+}
+
+func TestParsePublishSpecErrors(t *testing.T) {
+	for _, spec := range []string{
+		"8080/tcp",
+		"1:2:3:4:5/tcp",
+		"localhost:8080:80/tcp",
+		"0.0.0.0:http:80/tcp",
+		"0.0.0.0:8080:99999/tcp",
+		"8080:not-an-ip:80/tcp",
+	} {
+		_, err := parsePublishSpec(spec)
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestParseSocatCmdline(t *testing.T) {
+	for _, tc := range []struct {
+		cmdline  []string
+		expected *Forwarding
+	}{
+		{
+			cmdline:  []string{"socat", "TCP-LISTEN:8080,fork,reuseaddr", "TCP:10.88.0.5:80"},
+			expected: &Forwarding{Proto: "tcp", Host: model.Addr{Port: 8080}, Targets: []model.Addr{{Ip: "10.88.0.5", Port: 80}}},
+		},
+		{
+			cmdline:  []string{"/usr/bin/socat", "-d", "-d", "tcp4-listen:8080,bind=127.0.0.1,fork", "tcp-connect:10.88.0.5:80,nodelay"},
+			expected: &Forwarding{Proto: "tcp", Host: model.Addr{Ip: "127.0.0.1", Port: 8080}, Targets: []model.Addr{{Ip: "10.88.0.5", Port: 80}}},
+		},
+		{
+			cmdline:  []string{"socat", "UDP6-LISTEN:5353,fork,bind=[::1]", "UDP6:[fd00::5]:53"},
+			expected: &Forwarding{Proto: "udp", Host: model.Addr{Ip: "::1", Port: 5353}, Targets: []model.Addr{{Ip: "fd00::5", Port: 53}}},
+		},
+		{
+			// reversed addresses
+			cmdline:  []string{"socat", "TCP:10.88.0.5:80", "TCP-L:8080,fork"},
+			expected: &Forwarding{Proto: "tcp", Host: model.Addr{Port: 8080}, Targets: []model.Addr{{Ip: "10.88.0.5", Port: 80}}},
+		},
+		// not relaying a listening port to an address
+		{cmdline: []string{"socat", "-", "TCP:10.88.0.5:80"}},
+		{cmdline: []string{"socat", "TCP-LISTEN:8080,fork", "EXEC:/bin/cat"}},
+		{cmdline: []string{"socat", "TCP-LISTEN:8080,fork", "UDP:10.88.0.5:80"}},
+		{cmdline: []string{"socat", "TCP-LISTEN:8080,fork", "TCP:backend.local:80"}},
+		{cmdline: []string{"socat", "TCP-LISTEN:8080"}},
+	} {
+		fwd, err := parseSocatCmdline(tc.cmdline)
+		assert.NoError(t, err, "cmdline: %v", tc.cmdline)
+		assert.Equal(t, tc.expected, fwd, "cmdline: %v", tc.cmdline)
+	}
+
+	_, err := parseSocatCmdline([]string{"socat", "TCP-LISTEN:8080,fork", "TCP:10.88.0.5:http"})
+	assert.Error(t, err)
+}
+
+func TestRegisterRecognizer(t *testing.T) {
+	defer func(registered []Recognizer) {
+		recognizers = registered
+	}(recognizers)
+
+	procs := map[int32]*process.FilledProcess{
+		1: {Pid: 1, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-port", "8080", "-container-ip", "172.17.0.2", "-container-port", "80"}},
+		2: {Pid: 2, Cmdline: []string{"socat", "TCP-LISTEN:8081,fork,reuseaddr", "TCP:10.88.0.5:80"}},
+	}
+
+	f := newFilter()
+	f.LoadProxies(procs)
+	assert.Len(t, f.proxyByPID, 1)
+
+	RegisterRecognizer(SocatRecognizer)
+	assert.Contains(t, RecognizedBinaryNames(), "socat")
+	// the registered recognizers are picked up by the existing filters
+	f.LoadProxies(procs)
+	assert.Len(t, f.proxyByPID, 2)
+
+	payload := &model.Connections{Conns: []*model.Connection{
+		{Pid: 1, Laddr: &model.Addr{Ip: "10.0.0.5", Port: 8080}, Raddr: &model.Addr{Ip: "10.0.0.42", Port: 50000}},
+		{Pid: 1, Laddr: &model.Addr{Ip: "172.17.0.1", Port: 40000}, Raddr: &model.Addr{Ip: "172.17.0.2", Port: 80}},
+		{Pid: 2, Laddr: &model.Addr{Ip: "10.0.0.5", Port: 8081}, Raddr: &model.Addr{Ip: "10.0.0.42", Port: 50001}},
+		{Pid: 2, Laddr: &model.Addr{Ip: "10.88.0.1", Port: 40001}, Raddr: &model.Addr{Ip: "10.88.0.5", Port: 80}},
+	}}
+	assert.Equal(t, 4, f.Filter(payload))
+
+	// the first recognizer registered for a binary wins
+	RegisterRecognizer(Recognizer{Name: "other", Binaries: []string{"docker-proxy"}, Parse: func([]string) (*Forwarding, error) { return nil, nil }})
+	r, ok := lookupRecognizer("docker-proxy")
+	assert.True(t, ok)
+	assert.Equal(t, "docker-proxy", r.Name)
+
+	// the addresses given by the recognizers are normalized
+	RegisterRecognizer(Recognizer{Name: "custom", Binaries: []string{"custom-proxy"}, Parse: func([]string) (*Forwarding, error) {
+		return &Forwarding{Proto: "TCP", Host: model.Addr{Ip: "[::ffff:10.0.0.5]", Port: 9090}, Targets: []model.Addr{{Ip: "010.088.000.006", Port: 90}}}, nil
+	}})
+	p, err := f.extractProxyInfo(&process.FilledProcess{Pid: 3, Cmdline: []string{"custom-proxy"}})
+	assert.NoError(t, err)
+	assert.Equal(t, &proxy{pid: 3, proto: "tcp", host: model.Addr{Ip: "10.0.0.5", Port: 9090}, target: model.Addr{Ip: "10.88.0.6", Port: 90}}, p)
+}
+
+func TestWithRecognizers(t *testing.T) {
+	custom := Recognizer{Name: "custom", Binaries: []string{"custom-proxy"}, Parse: func([]string) (*Forwarding, error) {
+		return &Forwarding{Proto: "tcp", Host: model.Addr{Port: 9090}, Targets: []model.Addr{{Ip: "10.88.0.6", Port: 90}}}, nil
+	}}
+	procs := map[int32]*process.FilledProcess{
+		1: {Pid: 1, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-port", "8080", "-container-ip", "172.17.0.2", "-container-port", "80"}},
+		2: {Pid: 2, Exe: "/usr/bin/custom-proxy", Cmdline: []string{"custom-proxy"}},
+	}
+
+	f := newFilter(WithRecognizers(custom))
+	f.LoadProxies(procs)
+	assert.Len(t, f.proxyByPID, 2)
+	assert.Len(t, f.Clone().proxyByPID, 2)
+
+	// the other filters aren't affected
+	assert.NotContains(t, RecognizedBinaryNames(), "custom-proxy")
+	f = newFilter()
+	f.LoadProxies(procs)
+	assert.Len(t, f.proxyByPID, 1)
+
+	// they are recognized on top of the binaries of WithBinaryNames
+	f = newFilter(WithBinaryNames("other-proxy"), WithRecognizers(custom))
+	f.LoadProxies(procs)
+	if assert.Len(t, f.proxyByPID, 1) {
+		assert.Equal(t, model.Addr{Ip: "10.88.0.6", Port: 90}, f.proxyByPID[2].target)
+	}
+
+	// and the processes running their binaries are listed
+	f, _ = NewFilterWithError(nil, WithRecognizers(custom))
+	assert.Equal(t, binariesProcessSource{source: systemProcessSource{}, extraNames: []string{"custom-proxy"}}, f.Source())
+	f, _ = NewFilterWithError(nil, WithBinaryNames("other-proxy"), WithRecognizers(custom))
+	assert.Equal(t, binariesProcessSource{source: systemProcessSource{}, binaryNames: []string{"other-proxy"}, extraNames: []string{"custom-proxy"}}, f.Source())
+}
+
+func TestDetectPodman(t *testing.T) {
+	root, err := ioutil.TempDir("", "dockerproxy-root")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	assert.False(t, DetectPodman(root))
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "run", "user", "1000"), 0755))
+	assert.False(t, DetectPodman(root))
+
+	// the runtime directory of a rootless user
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "run", "user", "1000", "libpod", "tmp"), 0755))
+	assert.True(t, DetectPodman(root))
+
+	assert.False(t, DetectPodman(filepath.Join(root, "missing")))
+}
+
+func TestUnwrapCmdline(t *testing.T) {
+	for _, tc := range []struct {
+		cmdline  []string
+		expected [][]string
+	}{
+		{
+			cmdline:  []string{"/bin/sh", "-c", "/usr/bin/docker-proxy -proto tcp -host-port 8080"},
+			expected: [][]string{{"/usr/bin/docker-proxy", "-proto", "tcp", "-host-port", "8080"}},
+		},
+		{
+			cmdline:  []string{"bash", "-ec", "set -x; FOO=bar exec docker-proxy -proto 'tcp'; echo exited"},
+			expected: [][]string{{"set", "-x"}, {"docker-proxy", "-proto", "tcp"}, {"echo", "exited"}},
+		},
+		{
+			cmdline:  []string{"/sbin/tini", "--", "env", "-i", "PATH=/usr/bin", "docker-proxy", "-proto", "udp"},
+			expected: [][]string{{"docker-proxy", "-proto", "udp"}},
+		},
+		{
+			cmdline:  []string{"tini", "--", "sh", "-c", "sleep 1 && docker-proxy -proto tcp"},
+			expected: [][]string{{"sleep", "1"}, {"docker-proxy", "-proto", "tcp"}},
+		},
+		// not running a command
+		{cmdline: []string{"docker-proxy", "-proto", "tcp"}},
+		{cmdline: []string{"sh"}},
+		{cmdline: []string{"sh", "-c"}},
+		{cmdline: []string{"sh", "/usr/local/bin/start-docker-proxy.sh"}},
+		{cmdline: []string{"env", "FOO=bar"}},
+		{cmdline: []string{"env", "env", "env", "env", "env", "docker-proxy"}},
+		// the command isn't the one of a wrapper
+		{cmdline: []string{"grep", "docker-proxy"}},
+		{cmdline: []string{"nice", "docker-proxy"}},
+	} {
+		assert.Equal(t, tc.expected, unwrapCmdline(tc.cmdline), "cmdline: %v", tc.cmdline)
+	}
+}
+
+func TestParseFlags(t *testing.T) {
+	for _, tc := range []struct {
+		args      []string
+		boolFlags []string
+		expected  []cmdlineFlag
+	}{
+		{
+			args:     []string{"-proto", "tcp", "--host-port=8080", "-container-ip", " 172.17.0.2 "},
+			expected: []cmdlineFlag{{"-proto", "tcp"}, {"-host-port", "8080"}, {"-container-ip", "172.17.0.2"}},
+		},
+		{
+			// values are never parsed as flags
+			args:     []string{"-host-ip", "-", "-proto", "tcp", "stray", "-container-port"},
+			expected: []cmdlineFlag{{"-host-ip", ""}, {"-proto", "tcp"}, {"-container-port", ""}},
+		},
+		{
+			args:      []string{"-use-listen-fd", "true", "-use-listen-fd=false", "-proto", "udp"},
+			boolFlags: []string{"-use-listen-fd"},
+			expected:  []cmdlineFlag{{"-use-listen-fd", ""}, {"-use-listen-fd", "false"}, {"-proto", "udp"}},
+		},
+		{
+			args: []string{"", "-", "nginx"},
+		},
+	} {
+		assert.Equal(t, tc.expected, parseFlags(tc.args, tc.boolFlags...), "args: %q", tc.args)
+	}
+
+	// the leading flags stop at the first argument that isn't a flag nor the value of one, or at --
+	args := []string{"--debug", "-p", "8080:80/tcp", "dockerd", "-p", "9090"}
+	assert.Equal(t, []cmdlineFlag{{"-debug", ""}, {"-p", "8080:80/tcp"}}, parseLeadingFlags(args, "-debug"))
+	args = []string{"-p", "8080:80/tcp", "--", "-p", "9090:90/tcp"}
+	assert.Equal(t, []cmdlineFlag{{"-p", "8080:80/tcp"}}, parseLeadingFlags(args))
+}
@@ -0,0 +1,139 @@
+package dockerproxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"time"
+
+	model "github.com/DataDog/agent-payload/process"
+)
+
+// podmanAPITimeout bounds the time the containers of a Podman instance are listed in
+const podmanAPITimeout = time.Second
+
+// podmanMaxReply is the size of the replies of the Podman API read at most
+const podmanMaxReply = 4 << 20
+
+// rootlessportChildArgs are the argv[0] of the child process rootlessport re-executes itself as (through
+// /proc/self/exe) in the network namespace of the containers, the latter being the one of Podman 4 and later
+var rootlessportChildArgs = []string{"/proc/self/exe", "rootlessport-child", "containers-rootlessport-child"}
+
+// podmanContainer is a container listed by the Docker compatible API of Podman, which is the same across releases
+type podmanContainer struct {
+	Ports []struct {
+		IP          string `json:"IP"`
+		PrivatePort int32  `json:"PrivatePort"`
+		PublicPort  int32  `json:"PublicPort"`
+		Type        string `json:"Type"`
+	} `json:"Ports"`
+	NetworkSettings struct {
+		Networks map[string]struct {
+			IPAddress string `json:"IPAddress"`
+		} `json:"Networks"`
+	} `json:"NetworkSettings"`
+}
+
+// listeningSocket is a socket of a proxy listening on a published port
+type listeningSocket struct {
+	proto string
+	addr  model.Addr
+}
+
+// isRootlessportChild returns true if the given cmdline is the one of the child process of rootlessport, which
+// runs in another network namespace than the published ports
+func isRootlessportChild(cmdline []string) bool {
+	return len(cmdline) > 0 && (cmdline[0] == rootlessportChildArgs[0] || containsString(rootlessportChildArgs, binaryName(cmdline[0])))
+}
+
+// podmanAPISocket returns the path of the API socket of the Podman instance of the given user
+func podmanAPISocket(uid uint32) string {
+	if uid == 0 {
+		return "/run/podman/podman.sock"
+	}
+	return fmt.Sprintf("/run/user/%d/podman/podman.sock", uid)
+}
+
+// queryPodmanContainers lists the running containers of the Podman instance serving its API on the given unix socket
+func queryPodmanContainers(path string) ([]podmanContainer, error) {
+	client := http.Client{
+		Timeout: podmanAPITimeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", path)
+			},
+		},
+	}
+	resp, err := client.Get("http://podman/containers/json")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body := io.LimitReader(resp.Body, podmanMaxReply)
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(body)
+		return nil, fmt.Errorf("podman api error: %s: %s", resp.Status, msg)
+	}
+	var containers []podmanContainer
+	if err := json.NewDecoder(body).Decode(&containers); err != nil {
+		return nil, fmt.Errorf("invalid podman api reply: %s", err)
+	}
+	return containers, nil
+}
+
+// rootlessportForwardings returns the forwardings of a rootlessport process listening on the given sockets, from the
+// port mappings of the given containers. rootlessport forwards to the IP of the container on its network, or to the
+// guest address of slirp4netns if it has none. The listening sockets without a port mapping are left out, the
+// returned slice only being empty if none has one.
+func rootlessportForwardings(listening []listeningSocket, containers []podmanContainer) []Forwarding {
+	fwds := make([]Forwarding, 0, len(listening))
+	for _, l := range listening {
+		for _, container := range containers {
+			for _, port := range container.Ports {
+				if port.PublicPort != l.addr.Port || port.Type != l.proto || !sameHostIP(port.IP, l.addr.Ip) {
+					continue
+				}
+				fwds = append(fwds, Forwarding{
+					Proto:   l.proto,
+					Host:    l.addr,
+					Targets: []model.Addr{{Ip: container.ip(), Port: port.PrivatePort}},
+				})
+			}
+		}
+	}
+	return fwds
+}
+
+// ip returns the IP of the container on the first of its networks by name having one, or else the guest address
+// of slirp4netns on its default network
+func (c *podmanContainer) ip() string {
+	names := make([]string, 0, len(c.NetworkSettings.Networks))
+	for name := range c.NetworkSettings.Networks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if ip := c.NetworkSettings.Networks[name].IPAddress; ip != "" {
+			return ip
+		}
+	}
+
+	_, network, _ := net.ParseCIDR(slirp4netnsDefaultCIDR)
+	return nthIP(network, 100)
+}
+
+// sameHostIP returns true if the host IP of a port mapping, empty or a wildcard one for every interface, is the
+// given address a proxy listens on
+func sameHostIP(mapped, listening string) bool {
+	if mapped == "" || containsString(wildcardIPs, mapped) {
+		return containsString(wildcardIPs, listening)
+	}
+	return canonicalIP(mapped) == listening
+}
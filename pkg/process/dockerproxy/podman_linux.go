@@ -0,0 +1,48 @@
+// +build linux
+
+package dockerproxy
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// listRootlessportForwards lists the port forwards of a rootlessport process, see rootlessportForwards
+func listRootlessportForwards(pid int32, cmdline []string) ([]Forwarding, error) {
+	return rootlessportForwards(hostProc(), pid, cmdline)
+}
+
+// rootlessportForwards lists the port forwards of a rootlessport process from the ports it listens on, as listed in
+// the procfs mounted at procRoot, and the port mappings of the containers of the Podman instance of its user. The
+// API socket of that instance is reached through the root of the process, as the agent may run in another mount
+// namespace. rootlessport is given its port mappings through a pipe, so they can't be read from its cmdline.
+func rootlessportForwards(procRoot string, pid int32, cmdline []string) ([]Forwarding, error) {
+	if isRootlessportChild(cmdline) {
+		return nil, nil
+	}
+
+	procDir := filepath.Join(procRoot, strconv.Itoa(int(pid)))
+	info, err := os.Stat(procDir)
+	if err != nil {
+		return nil, err
+	}
+	listening, err := procListeningSockets(procRoot, pid)
+	if err != nil {
+		return nil, err
+	}
+	if len(listening) == 0 {
+		return []Forwarding{}, nil
+	}
+
+	var uid uint32
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		uid = stat.Uid
+	}
+	containers, err := queryPodmanContainers(filepath.Join(procDir, "root", podmanAPISocket(uid)))
+	if err != nil {
+		return nil, err
+	}
+	return rootlessportForwardings(listening, containers), nil
+}
@@ -0,0 +1,130 @@
+// +build linux
+
+package dockerproxy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	model "github.com/DataDog/agent-payload/process"
+	"github.com/DataDog/gopsutil/process"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// procNetUDP lists 127.0.0.1:5353 bound without a remote address
+const procNetUDP = procNetHeader +
+	"   0: 0100007F:14E9 00000000:0000 07 00000000:00000000 00:00000000 00000000     0        0 1003 2 0000000000000000 0\n"
+
+// podmanContainersReply lists a container publishing 8080/tcp and 5353/udp on 127.0.0.1, and another one whose
+// published port isn't forwarded by the process
+const podmanContainersReply = `[
+	{
+		"Id": "f3ae1b", "Ports": [
+			{"IP": "", "PrivatePort": 80, "PublicPort": 8080, "Type": "tcp"},
+			{"IP": "127.0.0.1", "PrivatePort": 53, "PublicPort": 5353, "Type": "udp"}
+		],
+		"NetworkSettings": {"Networks": {"podman": {"IPAddress": "10.88.0.5"}}}
+	},
+	{
+		"Id": "7c20d4", "Ports": [{"IP": "0.0.0.0", "PrivatePort": 80, "PublicPort": 9090, "Type": "tcp"}],
+		"NetworkSettings": {"Networks": {"podman": {"IPAddress": "10.88.0.6"}}}
+	}
+]`
+
+// fakePodmanRoot creates a procfs whose process with PID 1 is a rootlessport instance listening on 0.0.0.0:8080 and
+// 127.0.0.1:5353, along with the Podman API socket of its user under its root. The API is served until it is closed.
+func fakePodmanRoot(t *testing.T) (string, *httptest.Server) {
+	root := fakeProcRoot(t)
+	require.NoError(t, os.Symlink("socket:[1003]", filepath.Join(root, "1", "fd", "6")))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(root, "1", "net", "udp"), []byte(procNetUDP), 0644))
+
+	info, err := os.Stat(filepath.Join(root, "1"))
+	require.NoError(t, err)
+	apiSocket := filepath.Join(root, "1", "root", podmanAPISocket(info.Sys().(*syscall.Stat_t).Uid))
+	require.NoError(t, os.MkdirAll(filepath.Dir(apiSocket), 0755))
+	listener, err := net.Listen("unix", apiSocket)
+	require.NoError(t, err)
+
+	api := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/containers/json" {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write([]byte(podmanContainersReply))
+	}))
+	api.Listener = listener
+	api.Start()
+	return root, api
+}
+
+func TestRootlessportForwards(t *testing.T) {
+	root, api := fakePodmanRoot(t)
+	defer os.RemoveAll(root)
+	defer api.Close()
+
+	fwds, err := rootlessportForwards(root, 1, []string{"rootlessport"})
+	assert.NoError(t, err)
+	assert.Equal(t, []Forwarding{
+		{Proto: "tcp", Host: model.Addr{Ip: "0.0.0.0", Port: 8080}, Targets: []model.Addr{{Ip: "10.88.0.5", Port: 80}}},
+		{Proto: "udp", Host: model.Addr{Ip: "127.0.0.1", Port: 5353}, Targets: []model.Addr{{Ip: "10.88.0.5", Port: 53}}},
+	}, fwds)
+
+	// the child runs in the network namespace of the container
+	for _, arg0 := range rootlessportChildArgs {
+		fwds, err = rootlessportForwards(root, 1, []string{arg0})
+		assert.NoError(t, err)
+		assert.Nil(t, fwds, arg0)
+	}
+
+	// each client leg is translated to the target of the port it reached
+	podman := Recognizer{Name: "rootlessport", Binaries: []string{"rootlessport"}, List: func(pid int32, cmdline []string) ([]Forwarding, error) {
+		return rootlessportForwards(root, pid, cmdline)
+	}}
+	f := newFilter(WithMode(TranslateMode), WithRecognizers(podman))
+	f.LoadProxies(map[int32]*process.FilledProcess{1: {Pid: 1, Exe: "/usr/libexec/podman/rootlessport", Cmdline: []string{"rootlessport"}}})
+	payload := &model.Connections{Conns: []*model.Connection{
+		{Pid: 1, Laddr: &model.Addr{Ip: "10.0.0.5", Port: 8080}, Raddr: &model.Addr{Ip: "10.0.0.42", Port: 50000}, Direction: model.ConnectionDirection_incoming},
+		{Pid: 1, Laddr: &model.Addr{Ip: "127.0.0.1", Port: 5353}, Raddr: &model.Addr{Ip: "127.0.0.1", Port: 50001}, Type: model.ConnectionType_udp},
+		// rootlessport only forwards the published ports
+		{Pid: 1, Laddr: &model.Addr{Ip: "10.0.0.5", Port: 40000}, Raddr: &model.Addr{Ip: "93.184.216.34", Port: 443}, Direction: model.ConnectionDirection_outgoing},
+	}}
+	f.Filter(payload)
+	if assert.Len(t, payload.Conns, 3) {
+		assert.Equal(t, model.Addr{Ip: "10.88.0.5", Port: 80}, *payload.Conns[0].Laddr)
+		assert.Equal(t, model.Addr{Ip: "10.88.0.5", Port: 53}, *payload.Conns[1].Laddr)
+		assert.Equal(t, model.Addr{Ip: "10.0.0.5", Port: 40000}, *payload.Conns[2].Laddr)
+	}
+
+	// the errors of the API are reported
+	api.Close()
+	_, err = rootlessportForwards(root, 1, []string{"rootlessport"})
+	assert.Error(t, err)
+}
+
+func TestRootlessportForwardings(t *testing.T) {
+	var containers []podmanContainer
+	require.NoError(t, json.Unmarshal([]byte(podmanContainersReply), &containers))
+	// a container on the slirp4netns network of rootless Podman
+	containers[1].NetworkSettings.Networks = nil
+
+	fwds := rootlessportForwardings([]listeningSocket{
+		{proto: "tcp", addr: model.Addr{Ip: "::", Port: 9090}},
+		// published on another IP
+		{proto: "udp", addr: model.Addr{Ip: "10.0.0.5", Port: 5353}},
+		// published for another protocol
+		{proto: "udp", addr: model.Addr{Ip: "0.0.0.0", Port: 8080}},
+	}, containers)
+	assert.Equal(t, []Forwarding{
+		{Proto: "tcp", Host: model.Addr{Ip: "::", Port: 9090}, Targets: []model.Addr{{Ip: "10.0.2.100", Port: 80}}},
+	}, fwds)
+
+	assert.NotNil(t, rootlessportForwardings(nil, containers))
+}
@@ -0,0 +1,8 @@
+// +build !linux
+
+package dockerproxy
+
+// listRootlessportForwards is only implemented on linux
+func listRootlessportForwards(_ int32, _ []string) ([]Forwarding, error) {
+	return nil, ErrUnsupportedPlatform
+}
@@ -0,0 +1,173 @@
+// +build linux
+
+package dockerproxy
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/DataDog/gopsutil/process"
+)
+
+// commLen is the maximum length of /proc/<pid>/comm, which holds the truncated name of the executed binary
+const commLen = 15
+
+// clockTicks is the number of clock ticks per second the start time of the processes is expressed in,
+// as assumed by gopsutil
+const clockTicks = 100
+
+// scanProcesses lists the processes of the procfs mounted at procRoot running one of the given binaries, directly
+// or through a shell or a wrapper, see unwrapCmdline. Unlike process.AllProcesses, it only reads the comm of every
+// process, and the few files describing the matching ones along with the shells and wrappers. The processes are
+// identified by their comm, so the ones whose binary was renamed at runtime aren't listed.
+func scanProcesses(procRoot string, binaryNames []string) (map[int32]*process.FilledProcess, error) {
+	dir, err := os.Open(procRoot)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = dir.Close() }()
+
+	entries, err := dir.Readdirnames(-1)
+	if err != nil {
+		return nil, err
+	}
+
+	bootTime, err := readBootTime(procRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	comms, wrapperComms := commSet(binaryNames), commSet(append(append([]string{}, shellBinaries...), wrapperBinaries...))
+
+	procs := make(map[int32]*process.FilledProcess)
+	buf := make([]byte, commLen+1)
+	for _, entry := range entries {
+		pid, err := strconv.ParseInt(entry, 10, 32)
+		if err != nil {
+			// not a process
+			continue
+		}
+
+		procDir := filepath.Join(procRoot, entry)
+		n, err := readComm(procDir, buf)
+		if err != nil {
+			// the process exited in the meantime
+			continue
+		}
+		// the conversion of the map keys doesn't allocate
+		_, proxy := comms[string(buf[:n])]
+		_, wrapper := wrapperComms[string(buf[:n])]
+		if !proxy && !wrapper {
+			continue
+		}
+		comm := string(buf[:n])
+
+		p, err := readProcess(procDir, int32(pid), comm, bootTime)
+		if err != nil || (!proxy && !runsBinary(p.Cmdline, binaryNames)) {
+			continue
+		}
+		procs[p.Pid] = p
+	}
+	return procs, nil
+}
+
+// commSet returns the comms of the given binaries, which are truncated to commLen
+func commSet(binaryNames []string) map[string]struct{} {
+	comms := make(map[string]struct{}, len(binaryNames))
+	for _, name := range binaryNames {
+		if len(name) > commLen {
+			name = name[:commLen]
+		}
+		comms[name] = struct{}{}
+	}
+	return comms
+}
+
+// readComm reads the comm of a process into buf, which must hold commLen+1 bytes, returning its length
+func readComm(procDir string, buf []byte) (int, error) {
+	f, err := os.Open(filepath.Join(procDir, "comm"))
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = f.Close() }()
+
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return 0, err
+	}
+	return len(bytes.TrimSuffix(buf[:n], []byte("\n"))), nil
+}
+
+// readProcess reads the fields of a process used to detect proxies from its procfs directory
+func readProcess(procDir string, pid int32, comm string, bootTime int64) (*process.FilledProcess, error) {
+	raw, err := ioutil.ReadFile(filepath.Join(procDir, "cmdline"))
+	if err != nil {
+		return nil, err
+	}
+	var cmdline []string
+	if len(raw) > 0 {
+		cmdline = strings.Split(strings.TrimSuffix(string(raw), "\x00"), "\x00")
+	}
+
+	createTime, err := readCreateTime(procDir, bootTime)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &process.FilledProcess{Pid: pid, Name: comm, Cmdline: cmdline, CreateTime: createTime}
+	// the executable can't be resolved without the privileges to inspect the process
+	p.Exe, _ = os.Readlink(filepath.Join(procDir, "exe"))
+	return p, nil
+}
+
+// readCreateTime returns the creation time of a process in milliseconds since the epoch, the same way gopsutil does
+func readCreateTime(procDir string, bootTime int64) (int64, error) {
+	stat, err := ioutil.ReadFile(filepath.Join(procDir, "stat"))
+	if err != nil {
+		return 0, err
+	}
+
+	// the comm, in parentheses, may contain spaces: the fields that follow start with the state, the third one
+	idx := bytes.LastIndexByte(stat, ')')
+	if idx < 0 {
+		return 0, fmt.Errorf("invalid stat %q", stat)
+	}
+	fields := strings.Fields(string(stat[idx+1:]))
+	// the start time is the 22nd field
+	if len(fields) < 20 {
+		return 0, fmt.Errorf("invalid stat %q", stat)
+	}
+	startTime, err := strconv.ParseInt(fields[19], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid stat %q", stat)
+	}
+
+	return (startTime/clockTicks + bootTime) * 1000, nil
+}
+
+// readBootTime returns the boot time of the host in seconds since the epoch
+func readBootTime(procRoot string) (int64, error) {
+	f, err := os.Open(filepath.Join(procRoot, "stat"))
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = f.Close() }()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := scanner.Text(); strings.HasPrefix(line, "btime ") {
+			return strconv.ParseInt(strings.TrimSpace(line[len("btime "):]), 10, 64)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("no boot time in %s", f.Name())
+}
@@ -0,0 +1,149 @@
+// +build linux
+
+package dockerproxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	model "github.com/DataDog/agent-payload/process"
+	"github.com/DataDog/gopsutil/process"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeFakeProcess adds a process to the procfs mounted at root
+func writeFakeProcess(t testing.TB, root string, pid int, comm string, cmdline []string, startTime int) {
+	procDir := filepath.Join(root, fmt.Sprint(pid))
+	require.NoError(t, os.MkdirAll(procDir, 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(procDir, "comm"), []byte(comm+"\n"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(procDir, "cmdline"), []byte(strings.Join(cmdline, "\x00")+"\x00"), 0644))
+	stat := fmt.Sprintf("%d (%s) S 1 %d %d 0 -1 4194560 1000 0 0 0 10 5 0 0 20 0 8 0 %d 1000000 500 18446744073709551615", pid, comm, pid, pid, startTime)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(procDir, "stat"), []byte(stat), 0644))
+}
+
+// newFakeHostProc creates a procfs holding the boot time of the host
+func newFakeHostProc(t testing.TB) string {
+	root, err := ioutil.TempDir("", "dockerproxy-hostproc")
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(root, "stat"), []byte("cpu  1 2 3 4\nbtime 1600000000\nprocesses 100\n"), 0644))
+	return root
+}
+
+func TestScanProcesses(t *testing.T) {
+	root := newFakeHostProc(t)
+	defer os.RemoveAll(root)
+
+	dockerProxy := []string{"/usr/bin/docker-proxy", "-proto", "tcp", "-host-port", "8080", "-container-ip", "172.17.0.2", "-container-port", "80"}
+	rootlessProxy := []string{"rootlesskit-docker-proxy", "-proto", "tcp", "-host-port", "8081", "-container-ip", "172.17.0.3", "-container-port", "80"}
+	writeFakeProcess(t, root, 10, "docker-proxy", dockerProxy, 12345)
+	// the comm of the processes is truncated
+	writeFakeProcess(t, root, 11, "rootlesskit-doc", rootlessProxy, 200)
+	writeFakeProcess(t, root, 12, "nginx", []string{"nginx", "-g", "daemon off;"}, 300)
+	writeFakeProcess(t, root, 13, "docker-proxy) 1", []string{"docker-proxy"}, 400)
+	// exited while being scanned
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "14"), 0755))
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "self"), 0755))
+
+	procs, err := scanProcesses(root, ProxyBinaryNames)
+	require.NoError(t, err)
+	assert.Equal(t, map[int32]*process.FilledProcess{
+		10: {Pid: 10, Name: "docker-proxy", Cmdline: dockerProxy, CreateTime: (12345/100 + 1600000000) * 1000},
+		11: {Pid: 11, Name: "rootlesskit-doc", Cmdline: rootlessProxy, CreateTime: (200/100 + 1600000000) * 1000},
+	}, procs)
+
+	// the processes listed are enough to load the proxies
+	f := newFilter()
+	f.LoadProxies(procs)
+	assert.Len(t, f.proxyByPID, 2)
+
+	_, err = scanProcesses(filepath.Join(root, "missing"), ProxyBinaryNames)
+	assert.Error(t, err)
+}
+
+func TestScanProcessesWrapped(t *testing.T) {
+	root := newFakeHostProc(t)
+	defer os.RemoveAll(root)
+
+	flags := []string{"-proto", "tcp", "-host-port", "8080", "-container-ip", "172.17.0.2", "-container-port", "80"}
+	// tini forks the docker-proxy it runs
+	tini := append([]string{"tini", "--", "docker-proxy"}, flags...)
+	dockerProxy := append([]string{"docker-proxy"}, flags...)
+	shell := []string{"/bin/sh", "-c", "docker-proxy -proto tcp -host-port 8081 -container-ip 172.17.0.3 -container-port 80"}
+	writeFakeProcess(t, root, 20, "tini", tini, 100)
+	writeFakeProcess(t, root, 21, "docker-proxy", dockerProxy, 100)
+	// the docker-proxy forked by the shell isn't listed
+	writeFakeProcess(t, root, 22, "sh", shell, 100)
+	writeFakeProcess(t, root, 23, "bash", []string{"bash", "-c", "make all"}, 100)
+	writeFakeProcess(t, root, 24, "sh", []string{"sh", "/etc/docker-proxy"}, 100)
+
+	procs, err := scanProcesses(root, ProxyBinaryNames)
+	require.NoError(t, err)
+	assert.Len(t, procs, 3)
+	for _, pid := range []int32{20, 21, 22} {
+		assert.Contains(t, procs, pid)
+	}
+
+	// the proxy owning the sockets is tracked rather than its wrapper, whatever the order they are loaded in
+	for _, first := range []int32{20, 21} {
+		f := newFilter()
+		f.LoadProxies(map[int32]*process.FilledProcess{first: procs[first]})
+		f.LoadProxies(procs)
+		assert.Len(t, f.proxyByPID, 2)
+		assert.NotContains(t, f.proxyByPID, int32(20))
+		if p, ok := f.proxyByPID[22]; assert.True(t, ok) {
+			assert.True(t, p.wrapped)
+		}
+
+		// so the proxy IP is discovered from the connections of the forked proxy
+		f.Filter(&model.Connections{Conns: []*model.Connection{
+			{Pid: 21, Laddr: &model.Addr{Ip: "172.17.0.1", Port: 40000}, Raddr: &model.Addr{Ip: "172.17.0.2", Port: 80}},
+		}})
+		if info, ok := f.LookupProxy(model.Addr{Ip: "172.17.0.2", Port: 80}); assert.True(t, ok) {
+			assert.Equal(t, int32(21), info.PID)
+			assert.Equal(t, "172.17.0.1", info.IP)
+		}
+	}
+}
+
+func TestReadCreateTime(t *testing.T) {
+	root := newFakeHostProc(t)
+	defer os.RemoveAll(root)
+
+	// the comm may hold spaces and parentheses
+	writeFakeProcess(t, root, 10, "a) b (c", []string{"docker-proxy"}, 12345)
+	createTime, err := readCreateTime(filepath.Join(root, "10"), 1600000000)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1600000123000), createTime)
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(root, "10", "stat"), []byte("10 (docker-proxy) S 1"), 0644))
+	_, err = readCreateTime(filepath.Join(root, "10"), 1600000000)
+	assert.Error(t, err)
+}
+
+// BenchmarkScanProcesses scans a host running 8k processes, 10 of them being proxies
+func BenchmarkScanProcesses(b *testing.B) {
+	root := newFakeHostProc(b)
+	defer os.RemoveAll(root)
+
+	for pid := 1; pid <= 8000; pid++ {
+		if pid%800 == 0 {
+			writeFakeProcess(b, root, pid, "docker-proxy", []string{"docker-proxy", "-container-ip", "172.17.0.2", "-container-port", "80"}, pid)
+		} else {
+			writeFakeProcess(b, root, pid, "worker", []string{"/usr/bin/worker", "--id", fmt.Sprint(pid)}, pid)
+		}
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		procs, err := scanProcesses(root, ProxyBinaryNames)
+		if err != nil || len(procs) != 10 {
+			b.Fatalf("unexpected scan: %d processes, %v", len(procs), err)
+		}
+	}
+}
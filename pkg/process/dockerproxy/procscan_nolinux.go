@@ -0,0 +1,12 @@
+// +build !linux
+
+package dockerproxy
+
+import (
+	"github.com/DataDog/gopsutil/process"
+)
+
+// scanProcesses is only implemented on linux
+func scanProcesses(_ string, _ []string) (map[int32]*process.FilledProcess, error) {
+	return nil, ErrUnsupportedPlatform
+}
@@ -0,0 +1,377 @@
+package dockerproxy
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	model "github.com/DataDog/agent-payload/process"
+	"github.com/DataDog/gopsutil/process"
+)
+
+// Recognizer identifies the processes of a family of proxy binaries and extracts what they forward from
+// their cmdline, see RegisterRecognizer
+type Recognizer struct {
+	// Name identifies the recognizer, e.g. docker-proxy
+	Name string
+	// Binaries are the basenames of the binaries the recognizer identifies
+	Binaries []string
+	// Parse extracts what a proxy forwards from its cmdline. It returns nil if the cmdline doesn't describe
+	// any proxy, and an error if it is malformed.
+	Parse func(cmdline []string) (*Forwarding, error)
+	// List lists what a proxy forwarding several ports forwards, from its cmdline or e.g. by querying its API, in
+	// which case Parse isn't used. It is called on every refresh as such proxies may forward other ports at runtime. It returns
+	// nil if the process doesn't describe any proxy, and an error if its forwardings can't be listed.
+	List func(pid int32, cmdline []string) ([]Forwarding, error)
+}
+
+// Forwarding describes what a proxy forwards
+type Forwarding struct {
+	// Proto is the forwarded protocol, e.g. tcp or udp, or an empty string if unknown
+	Proto string
+	// Host is the address the proxy listens on, its IP being empty if it listens on every interface
+	// and its port being 0 if unknown
+	Host model.Addr
+	// Targets are the addresses the proxy forwards to, at least one of them being required
+	Targets []model.Addr
+	// UnixSocket is set if the proxy forwards to a unix domain socket rather than to Targets, at SocketPath
+	// if known. The network tracer doesn't report unix domain sockets, so these proxies can't be filtered.
+	UnixSocket bool
+	SocketPath string
+	// ProxyIP is the IP the proxy connects to the targets from, if known ahead of the connections
+	ProxyIP string
+}
+
+// DockerProxyRecognizer recognizes docker-proxy and the binaries sharing its flags.
+// Rootless Docker (19.03 and later) forwards the published ports through rootlesskit-docker-proxy, which
+// takes the docker-proxy flags.
+var DockerProxyRecognizer = Recognizer{
+	Name: "docker-proxy",
+	Binaries: []string{
+		"docker-proxy",
+		// older Moby packages (e.g. RHEL/CentOS)
+		"docker-proxy-current",
+		// balenaEngine
+		"balena-engine-proxy",
+		"rootlesskit-docker-proxy",
+	},
+	Parse: parseDockerProxyCmdline,
+}
+
+// RootlesskitRecognizer recognizes rootlesskit, which is only supported when ports are published through its
+// --publish flags, as the Docker daemon publishes them through the rootlesskit API instead
+var RootlesskitRecognizer = Recognizer{
+	Name:     "rootlesskit",
+	Binaries: []string{"rootlesskit"},
+	List:     parseRootlesskitCmdline,
+}
+
+// Slirp4netnsRecognizer recognizes slirp4netns, which forwards the published ports of rootless Docker when its
+// slirp4netns port driver is used, as well as the ones of rootless Podman with the slirp4netns port handler. Its
+// port forwards are added at runtime, so they are listed from the API socket given by its --api-socket flag.
+var Slirp4netnsRecognizer = Recognizer{
+	Name:     "slirp4netns",
+	Binaries: []string{"slirp4netns"},
+	List:     listSlirp4netnsForwards,
+}
+
+// SocatRecognizer recognizes socat relaying a listening port to a single address, e.g.
+// `socat TCP-LISTEN:8080,fork TCP:10.88.0.5:80`, as used to publish container ports on hosts without docker-proxy
+// (e.g. containerd ones). It isn't registered by default as socat is a general purpose tool.
+var SocatRecognizer = Recognizer{
+	Name:     "socat",
+	Binaries: []string{"socat"},
+	Parse:    parseSocatCmdline,
+}
+
+// PodmanRecognizer recognizes rootlessport, which forwards the ports published by rootless Podman to the network
+// namespace of the containers. What it forwards isn't on its cmdline, so its port forwards are listed from the ports
+// it listens on and the port mappings served by the Podman API socket of its user, which must be enabled (e.g.
+// through the podman.socket systemd unit). It isn't registered by default, see DetectPodman and WithRecognizers.
+var PodmanRecognizer = Recognizer{
+	Name:     "rootlessport",
+	Binaries: []string{"rootlessport"},
+	List:     listRootlessportForwards,
+}
+
+// podmanPaths are the runtime directories of Podman, relative to the host root, the rootless ones being per user
+var podmanPaths = []string{
+	"run/podman",
+	"run/user/*/libpod",
+	"run/user/*/podman",
+}
+
+// DetectPodman returns true if Podman runs on the host whose root filesystem is mounted at the given path,
+// e.g. / or /host in a container, from its runtime directories
+func DetectPodman(root string) bool {
+	for _, path := range podmanPaths {
+		matches, err := filepath.Glob(filepath.Join(root, path))
+		if err != nil || len(matches) == 0 {
+			continue
+		}
+		if info, err := os.Stat(matches[0]); err == nil && info.IsDir() {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	// recognizersMux guards recognizers
+	recognizersMux sync.RWMutex
+	// recognizers are the registered recognizers, in registration order
+	recognizers = []Recognizer{DockerProxyRecognizer, RootlesskitRecognizer, Slirp4netnsRecognizer}
+)
+
+// RegisterRecognizer makes the filters identify the processes of the binaries of the given recognizer as proxies,
+// unless they were created with WithBinaryNames. DockerProxyRecognizer, RootlesskitRecognizer and
+// Slirp4netnsRecognizer are registered by default. The first recognizer registered for a binary is the one used.
+func RegisterRecognizer(r Recognizer) {
+	recognizersMux.Lock()
+	defer recognizersMux.Unlock()
+
+	recognizers = append(recognizers, r)
+}
+
+// RecognizedBinaryNames returns the basenames of the binaries of the registered recognizers
+func RecognizedBinaryNames() []string {
+	recognizersMux.RLock()
+	defer recognizersMux.RUnlock()
+
+	return recognizerBinaries(recognizers)
+}
+
+// lookupRecognizer returns the first registered recognizer of the given binary
+func lookupRecognizer(binary string) (Recognizer, bool) {
+	recognizersMux.RLock()
+	defer recognizersMux.RUnlock()
+
+	return findRecognizer(recognizers, binary)
+}
+
+// findRecognizer returns the first recognizer of the given binary among the given ones
+func findRecognizer(recognizers []Recognizer, binary string) (Recognizer, bool) {
+	for _, r := range recognizers {
+		for _, name := range r.Binaries {
+			if name == binary {
+				return r, true
+			}
+		}
+	}
+	return Recognizer{}, false
+}
+
+// recognizerBinaries returns the basenames of the binaries of the given recognizers
+func recognizerBinaries(recognizers []Recognizer) []string {
+	var names []string
+	for _, r := range recognizers {
+		names = append(names, r.Binaries...)
+	}
+	return names
+}
+
+// extractProxyInfo returns the proxy information of a docker-proxy process, or nil if the process
+// doesn't run one of the proxy binaries recognized by the filter. An error is returned if the process is a
+// docker-proxy but its arguments could not be parsed. If the cmdline of a docker-proxy can't be read, a proxy
+// without target is returned: its target is then discovered from the connections it establishes.
+func (f *Filter) extractProxyInfo(p *process.FilledProcess) (*proxy, error) {
+	binary, cmdline, wrapped := f.proxyBinary(p)
+	if binary == "" {
+		return nil, nil
+	}
+
+	if len(cmdline) == 0 {
+		return &proxy{pid: p.Pid, createTime: p.CreateTime}, nil
+	}
+
+	// the custom proxy shims of WithBinaryNames take the docker-proxy flags
+	recognizer, ok := f.lookupRecognizer(binary)
+	if !ok {
+		recognizer = DockerProxyRecognizer
+	}
+
+	if recognizer.List != nil {
+		fwds, err := recognizer.List(p.Pid, cmdline)
+		if err != nil || fwds == nil {
+			return nil, err
+		}
+		proxy, err := newListedProxy(fwds)
+		if err != nil || proxy == nil {
+			return nil, err
+		}
+		proxy.pid, proxy.createTime, proxy.wrapped = p.Pid, p.CreateTime, wrapped
+		return proxy, nil
+	}
+
+	fwd, err := recognizer.Parse(cmdline)
+	if err != nil || fwd == nil {
+		return nil, err
+	}
+	if fwd.UnixSocket {
+		return nil, errUnixSocketTarget
+	}
+
+	// a proxy without a complete target can't be matched against any connection
+	if len(fwd.Targets) == 0 || fwd.Targets[0].Ip == "" || fwd.Targets[0].Port == 0 {
+		f.logger.Debugf("ignoring %s with pid=%d: no container target in its cmdline", recognizer.Name, p.Pid)
+		return nil, nil
+	}
+
+	proxy, err := newProxy(fwd)
+	if err != nil {
+		return nil, err
+	}
+
+	// proxies listen on all interfaces when no host IP is given
+	if proxy.host.Ip == "" {
+		proxy.host.Ip = wildcardIPs[0]
+	}
+
+	proxy.pid, proxy.createTime, proxy.wrapped = p.Pid, p.CreateTime, wrapped
+	return proxy, nil
+}
+
+// newProxy returns the proxy forwarding as described, its addresses being normalized
+func newProxy(fwd *Forwarding) (*proxy, error) {
+	proxy := &proxy{proto: strings.ToLower(fwd.Proto), host: fwd.Host}
+	if fwd.Host.Ip != "" {
+		if proxy.host.Ip = normalizeIP(fwd.Host.Ip); proxy.host.Ip == "" {
+			return nil, fmt.Errorf("invalid host ip %q", fwd.Host.Ip)
+		}
+	}
+
+	for i, target := range fwd.Targets {
+		if target.Port == 0 {
+			continue
+		}
+		if ip := normalizeIP(target.Ip); ip != "" {
+			target.Ip = ip
+		} else {
+			return nil, fmt.Errorf("invalid target ip %q", target.Ip)
+		}
+
+		if i == 0 {
+			proxy.target = target
+		} else if !proxy.hasTarget(target) {
+			proxy.extraTargets = append(proxy.extraTargets, target)
+		}
+	}
+	return proxy, nil
+}
+
+// newListedProxy returns the proxy forwarding as listed by the List function of a recognizer, the first complete
+// forwarding being its host and target and the next ones its extra hosts and targets. It returns
+// errNoForwardedPort if none is complete.
+func newListedProxy(fwds []Forwarding) (*proxy, error) {
+	var listed *proxy
+	for i := range fwds {
+		p, err := newProxy(&fwds[i])
+		if err != nil {
+			return nil, err
+		}
+		if p.target.Ip == "" || p.target.Port == 0 || p.host.Port == 0 {
+			continue
+		}
+		// proxies listen on all interfaces when no host IP is given
+		if p.host.Ip == "" {
+			p.host.Ip = wildcardIPs[0]
+		}
+
+		if listed == nil {
+			listed = p
+			if fwds[i].ProxyIP != "" {
+				if listed.ip = normalizeIP(fwds[i].ProxyIP); listed.ip == "" {
+					return nil, fmt.Errorf("invalid proxy ip %q", fwds[i].ProxyIP)
+				}
+			}
+			continue
+		}
+		if p.proto != listed.proto {
+			listed.proto = ""
+		}
+		listed.extraHosts = append(listed.extraHosts, p.host)
+		listed.extraTargets = append(listed.extraTargets, p.target)
+	}
+
+	if listed == nil {
+		return nil, errNoForwardedPort
+	}
+	return listed, nil
+}
+
+// proxyBinary returns the name of the proxy binary executed by the process along with the cmdline of the proxy,
+// or an empty string if it doesn't execute one. The resolved executable path is authoritative, argv[0] and then
+// the process name are only used when it isn't available (e.g. because of insufficient permissions). A process
+// running a shell or a wrapper is a proxy if one of the commands it runs is, e.g. sh -c "exec docker-proxy ...",
+// the cmdline of the proxy then starting at that command and wrapped being true, see unwrapCmdline.
+func (f *Filter) proxyBinary(p *process.FilledProcess) (binary string, cmdline []string, wrapped bool) {
+	path := p.Exe
+	if path == "" && len(p.Cmdline) > 0 {
+		path = p.Cmdline[0]
+	}
+	if path == "" && f.exactBinaryPath == "" {
+		path = p.Name
+	}
+	if f.exactBinaryPath == "" || path == f.exactBinaryPath {
+		if binary := f.recognizedBinary(path); binary != "" {
+			return binary, p.Cmdline, false
+		}
+	}
+	// the commands of a cmdline aren't resolved paths, see WithExactBinaryPath
+	if f.exactBinaryPath == "" {
+		for _, cmdline := range unwrapCmdline(p.Cmdline) {
+			if binary := f.recognizedBinary(cmdline[0]); binary != "" {
+				return binary, cmdline, true
+			}
+		}
+	}
+
+	if name := filepath.Base(path); strings.Contains(name, ProxyBinaryNames[0]) {
+		if f.exactBinaryPath != "" && path != f.exactBinaryPath {
+			f.logger.Debugf("ignoring process with pid=%d: %s is not %s", p.Pid, path, f.exactBinaryPath)
+		} else {
+			f.logger.Debugf("ignoring process with pid=%d: %s is not a known proxy binary", p.Pid, name)
+		}
+	}
+	return "", nil, false
+}
+
+// recognizedBinary returns the name of the proxy binary at the given path, or an empty string if it isn't one
+// recognized by the filter
+func (f *Filter) recognizedBinary(path string) string {
+	name := binaryName(path)
+	if _, ok := findRecognizer(f.recognizers, name); ok {
+		return name
+	}
+	if f.binaryNames == nil {
+		if _, ok := lookupRecognizer(name); ok {
+			return name
+		}
+	} else if isProxyBinary(path, f.binaryNames) {
+		return name
+	}
+	return ""
+}
+
+// lookupRecognizer returns the recognizer of the given binary among the ones of WithRecognizers, and then among
+// the registered ones
+func (f *Filter) lookupRecognizer(binary string) (Recognizer, bool) {
+	if r, ok := findRecognizer(f.recognizers, binary); ok {
+		return r, true
+	}
+	return lookupRecognizer(binary)
+}
+
+// isProxyBinary returns true if the given path refers to one of the given proxy binaries,
+// regardless of whether it was invoked through a relative or an absolute path
+func isProxyBinary(path string, binaryNames []string) bool {
+	name := binaryName(path)
+	for _, proxyName := range binaryNames {
+		if name == proxyName {
+			return true
+		}
+	}
+	return false
+}
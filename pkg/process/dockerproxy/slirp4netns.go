@@ -0,0 +1,121 @@
+package dockerproxy
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	model "github.com/DataDog/agent-payload/process"
+)
+
+// slirp4netnsAPITimeout bounds the time the port forwards of a slirp4netns instance are listed in
+const slirp4netnsAPITimeout = time.Second
+
+// slirp4netnsMaxReply is the size of the replies of the slirp4netns API read at most
+const slirp4netnsMaxReply = 1 << 20
+
+// slirp4netnsDefaultCIDR is the network slirp4netns configures unless given the --cidr flag
+const slirp4netnsDefaultCIDR = "10.0.2.0/24"
+
+// slirp4netnsBoolFlags are the flags of slirp4netns that don't take the following argument as value
+var slirp4netnsBoolFlags = []string{"-c", "-configure", "-6", "-enable-ipv6", "-disable-host-loopback", "-enable-sandbox",
+	"-enable-seccomp", "-disable-dns"}
+
+// slirp4netnsHostfwd is a port forward listed by the API of slirp4netns
+type slirp4netnsHostfwd struct {
+	Proto     string `json:"proto"`
+	HostAddr  string `json:"host_addr"`
+	HostPort  int32  `json:"host_port"`
+	GuestAddr string `json:"guest_addr"`
+	GuestPort int32  `json:"guest_port"`
+}
+
+// parseSlirp4netnsCmdline returns the path of the API socket of slirp4netns, empty if it isn't given the
+// --api-socket flag, and the network it configures in the namespace of the containers
+func parseSlirp4netnsCmdline(cmdline []string) (string, *net.IPNet, error) {
+	if len(cmdline) == 0 {
+		return "", nil, nil
+	}
+
+	apiSocket, cidr := "", slirp4netnsDefaultCIDR
+	for _, flag := range parseFlags(cmdline[1:], slirp4netnsBoolFlags...) {
+		switch flag.name {
+		case "-api-socket", "-a":
+			apiSocket = flag.value
+		case "-cidr":
+			cidr = flag.value
+		}
+	}
+
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil || network.IP.To4() == nil {
+		return "", nil, fmt.Errorf("invalid cidr %q", cidr)
+	}
+	return apiSocket, network, nil
+}
+
+// querySlirp4netnsHostfwds lists the port forwards of the slirp4netns instance serving its API on the given
+// unix socket
+func querySlirp4netnsHostfwds(path string) ([]slirp4netnsHostfwd, error) {
+	conn, err := net.DialTimeout("unix", path, slirp4netnsAPITimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Now().Add(slirp4netnsAPITimeout)); err != nil {
+		return nil, err
+	}
+	if _, err := io.WriteString(conn, `{"execute": "list_hostfwd"}`); err != nil {
+		return nil, err
+	}
+
+	var reply struct {
+		Return struct {
+			Entries []slirp4netnsHostfwd `json:"entries"`
+		} `json:"return"`
+		Error *struct {
+			Desc string `json:"desc"`
+		} `json:"error"`
+	}
+	if err := json.NewDecoder(io.LimitReader(conn, slirp4netnsMaxReply)).Decode(&reply); err != nil {
+		return nil, fmt.Errorf("invalid slirp4netns api reply: %s", err)
+	}
+	if reply.Error != nil {
+		return nil, fmt.Errorf("slirp4netns api error: %s", reply.Error.Desc)
+	}
+	return reply.Return.Entries, nil
+}
+
+// slirp4netnsForwardings returns the forwardings of the given port forwards of a slirp4netns instance configuring
+// the given network. slirp4netns connects to the containers from the host address of that network, the second one,
+// and forwards to its guest address, the hundredth one, unless told otherwise. The returned slice is only empty if
+// no port is forwarded.
+func slirp4netnsForwardings(hostfwds []slirp4netnsHostfwd, network *net.IPNet) []Forwarding {
+	proxyIP, guestIP := nthIP(network, 2), nthIP(network, 100)
+
+	fwds := make([]Forwarding, 0, len(hostfwds))
+	for _, hostfwd := range hostfwds {
+		target := model.Addr{Ip: hostfwd.GuestAddr, Port: hostfwd.GuestPort}
+		if target.Ip == "" {
+			target.Ip = guestIP
+		}
+		fwds = append(fwds, Forwarding{
+			Proto:   hostfwd.Proto,
+			Host:    model.Addr{Ip: hostfwd.HostAddr, Port: hostfwd.HostPort},
+			Targets: []model.Addr{target},
+			ProxyIP: proxyIP,
+		})
+	}
+	return fwds
+}
+
+// nthIP returns the address of the given rank in the given IPv4 network
+func nthIP(network *net.IPNet, n uint32) string {
+	ip := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, binary.BigEndian.Uint32(network.IP.To4())+n)
+	return ip.String()
+}
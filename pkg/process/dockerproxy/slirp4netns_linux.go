@@ -0,0 +1,28 @@
+// +build linux
+
+package dockerproxy
+
+import (
+	"path/filepath"
+	"strconv"
+)
+
+// listSlirp4netnsForwards lists the port forwards of a slirp4netns process from its API socket. The socket is reached
+// through the root of the process, as the agent may run in another mount namespace, or through its working directory
+// if its path is relative.
+func listSlirp4netnsForwards(pid int32, cmdline []string) ([]Forwarding, error) {
+	apiSocket, network, err := parseSlirp4netnsCmdline(cmdline)
+	if err != nil || apiSocket == "" {
+		return nil, err
+	}
+
+	dir := "root"
+	if !filepath.IsAbs(apiSocket) {
+		dir = "cwd"
+	}
+	hostfwds, err := querySlirp4netnsHostfwds(filepath.Join(hostProc(), strconv.Itoa(int(pid)), dir, apiSocket))
+	if err != nil {
+		return nil, err
+	}
+	return slirp4netnsForwardings(hostfwds, network), nil
+}
@@ -0,0 +1,168 @@
+// +build linux
+
+package dockerproxy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	model "github.com/DataDog/agent-payload/process"
+	"github.com/DataDog/gopsutil/process"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeSlirp4netnsAPI serves the list_hostfwd requests of the slirp4netns API on a unix socket
+type fakeSlirp4netnsAPI struct {
+	mux      sync.Mutex
+	hostfwds []slirp4netnsHostfwd
+	err      string
+	listener net.Listener
+}
+
+func newFakeSlirp4netnsAPI(t *testing.T, path string) *fakeSlirp4netnsAPI {
+	listener, err := net.Listen("unix", path)
+	require.NoError(t, err)
+
+	api := &fakeSlirp4netnsAPI{hostfwds: []slirp4netnsHostfwd{}, listener: listener}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			api.serve(conn)
+		}
+	}()
+	return api
+}
+
+func (a *fakeSlirp4netnsAPI) serve(conn net.Conn) {
+	defer conn.Close()
+
+	var request struct {
+		Execute string `json:"execute"`
+	}
+	if err := json.NewDecoder(conn).Decode(&request); err != nil || request.Execute != "list_hostfwd" {
+		return
+	}
+
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	if a.err != "" {
+		_ = json.NewEncoder(conn).Encode(map[string]interface{}{"error": map[string]string{"desc": a.err}})
+		return
+	}
+	_ = json.NewEncoder(conn).Encode(map[string]interface{}{"return": map[string]interface{}{"entries": a.hostfwds}})
+}
+
+func (a *fakeSlirp4netnsAPI) set(hostfwds ...slirp4netnsHostfwd) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	a.hostfwds = append([]slirp4netnsHostfwd{}, hostfwds...)
+}
+
+func TestParseSlirp4netnsCmdline(t *testing.T) {
+	apiSocket, network, err := parseSlirp4netnsCmdline([]string{"slirp4netns", "--mtu", "65520", "-r", "3", "--disable-host-loopback",
+		"--api-socket", "/run/user/1000/dockerd-rootless/slirp4netns.sock", "--configure", "1234", "tap0"})
+	assert.NoError(t, err)
+	assert.Equal(t, "/run/user/1000/dockerd-rootless/slirp4netns.sock", apiSocket)
+	assert.Equal(t, "10.0.2.0/24", network.String())
+
+	apiSocket, network, err = parseSlirp4netnsCmdline([]string{"slirp4netns", "-c", "--cidr=10.41.0.0/16", "-a", "api.sock", "1234", "tap0"})
+	assert.NoError(t, err)
+	assert.Equal(t, "api.sock", apiSocket)
+	assert.Equal(t, "10.41.0.2", nthIP(network, 2))
+
+	// no API to list the port forwards from
+	apiSocket, _, err = parseSlirp4netnsCmdline([]string{"slirp4netns", "--configure", "1234", "tap0"})
+	assert.NoError(t, err)
+	assert.Empty(t, apiSocket)
+
+	_, _, err = parseSlirp4netnsCmdline([]string{"slirp4netns", "--cidr", "fd00::/64", "-a", "api.sock", "1234", "tap0"})
+	assert.Error(t, err)
+}
+
+func TestSlirp4netnsRecognizer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dockerproxy-slirp4netns")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	apiSocket := filepath.Join(dir, "api.sock")
+	api := newFakeSlirp4netnsAPI(t, apiSocket)
+	defer api.listener.Close()
+
+	// the API socket is reached through the root of the process
+	pid := int32(os.Getpid())
+	procs := map[int32]*process.FilledProcess{
+		pid: {Pid: pid, Exe: "/usr/bin/slirp4netns", Cmdline: []string{"slirp4netns", "--api-socket", apiSocket, "--configure", "1234", "tap0"}},
+	}
+	clientLegs := func() []*model.Connection {
+		return []*model.Connection{
+			{Pid: pid, Laddr: &model.Addr{Ip: "10.0.0.5", Port: 8080}, Raddr: &model.Addr{Ip: "10.0.0.42", Port: 50000}, Direction: model.ConnectionDirection_incoming},
+			{Pid: pid, Laddr: &model.Addr{Ip: "127.0.0.1", Port: 5353}, Raddr: &model.Addr{Ip: "127.0.0.1", Port: 50001}, Type: model.ConnectionType_udp},
+		}
+	}
+	payload := func() *model.Connections {
+		return &model.Connections{Conns: append(clientLegs(),
+			// the target leg seen in the namespace of the containers
+			&model.Connection{Pid: 100, Laddr: &model.Addr{Ip: "10.0.2.100", Port: 80}, Raddr: &model.Addr{Ip: "10.0.2.2", Port: 50002}, Direction: model.ConnectionDirection_incoming},
+			// a connection of a container relayed by slirp4netns
+			&model.Connection{Pid: pid, Laddr: &model.Addr{Ip: "10.0.0.5", Port: 40000}, Raddr: &model.Addr{Ip: "93.184.216.34", Port: 443}, Direction: model.ConnectionDirection_outgoing},
+		)}
+	}
+
+	// slirp4netns is tracked once it forwards a port, even with the negative cache
+	f := newFilter(WithNegativeCache())
+	f.LoadProxies(procs)
+	assert.Empty(t, f.proxyByPID)
+	api.set(
+		slirp4netnsHostfwd{Proto: "tcp", HostAddr: "0.0.0.0", HostPort: 8080, GuestAddr: "10.0.2.100", GuestPort: 80},
+		slirp4netnsHostfwd{Proto: "udp", HostAddr: "127.0.0.1", HostPort: 5353, GuestPort: 53},
+	)
+	f.Refresh(procs)
+	if proxies := f.Proxies(); assert.Len(t, proxies, 1) {
+		assert.Equal(t, pid, proxies[0].PID)
+		assert.Equal(t, "10.0.2.2", proxies[0].IP)
+		assert.Equal(t, model.Addr{Ip: "10.0.2.100", Port: 80}, proxies[0].Target)
+	}
+
+	p := payload()
+	assert.Equal(t, 3, f.Filter(p))
+	if assert.Len(t, p.Conns, 1) {
+		assert.Equal(t, int32(443), p.Conns[0].Raddr.Port)
+	}
+
+	// each client leg is translated to the target of its port forward
+	f = newFilter(WithMode(TranslateMode))
+	f.LoadProxies(procs)
+	p = payload()
+	f.Filter(p)
+	if assert.Len(t, p.Conns, 3) {
+		assert.Equal(t, model.Addr{Ip: "10.0.2.100", Port: 80}, *p.Conns[0].Laddr)
+		assert.Equal(t, model.Addr{Ip: "10.0.2.100", Port: 53}, *p.Conns[1].Laddr)
+	}
+
+	// the port forwards removed at runtime aren't matched anymore
+	api.set(slirp4netnsHostfwd{Proto: "udp", HostAddr: "127.0.0.1", HostPort: 5353, GuestPort: 53})
+	f.Refresh(procs)
+	p = &model.Connections{Conns: clientLegs()}
+	f.Filter(p)
+	if assert.Len(t, p.Conns, 2) {
+		assert.Equal(t, model.Addr{Ip: "10.0.0.5", Port: 8080}, *p.Conns[0].Laddr)
+		assert.Equal(t, model.Addr{Ip: "10.0.2.100", Port: 53}, *p.Conns[1].Laddr)
+	}
+
+	// the errors of the API are reported
+	api.mux.Lock()
+	api.err = "bad request"
+	api.mux.Unlock()
+	f.Refresh(procs)
+	if errors := f.RecentErrors(); assert.NotEmpty(t, errors) {
+		assert.Contains(t, errors[len(errors)-1].Message, "slirp4netns api error: bad request")
+	}
+}
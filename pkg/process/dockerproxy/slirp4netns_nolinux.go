@@ -0,0 +1,8 @@
+// +build !linux
+
+package dockerproxy
+
+// listSlirp4netnsForwards is only implemented on linux
+func listSlirp4netnsForwards(_ int32, _ []string) ([]Forwarding, error) {
+	return nil, ErrUnsupportedPlatform
+}
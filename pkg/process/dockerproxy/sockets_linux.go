@@ -0,0 +1,322 @@
+// +build linux
+
+package dockerproxy
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	model "github.com/DataDog/agent-payload/process"
+)
+
+// procfsSupported is true as the sockets of the processes can be read from procfs, see WithActiveDiscovery
+const procfsSupported = true
+
+// procSockets returns the TCP and UDP sockets opened by the process with the given PID, as listed in the
+// procfs mounted at procRoot. Only the sockets having a remote address are returned.
+func procSockets(procRoot string, pid int32) ([]socket, error) {
+	var sockets []socket
+	err := walkProcSockets(procRoot, pid, false, func(_ string, found []socket) {
+		sockets = append(sockets, found...)
+	})
+	return sockets, err
+}
+
+// procListeningSockets returns the TCP sockets listening and the UDP sockets bound without a remote address of
+// the process with the given PID, as listed in the procfs mounted at procRoot
+func procListeningSockets(procRoot string, pid int32) ([]listeningSocket, error) {
+	var listening []listeningSocket
+	err := walkProcSockets(procRoot, pid, true, func(proto string, found []socket) {
+		for _, s := range found {
+			listening = append(listening, listeningSocket{proto: proto, addr: s.laddr})
+		}
+	})
+	return listening, err
+}
+
+// walkProcSockets calls fn with the protocol and the sockets of every /proc/<pid>/net/{tcp,udp}[6] file opened by
+// the process with the given PID, the listening ones or the ones having a remote address
+func walkProcSockets(procRoot string, pid int32, listening bool, fn func(proto string, found []socket)) error {
+	procDir := filepath.Join(procRoot, strconv.Itoa(int(pid)))
+
+	inodes, err := socketInodes(filepath.Join(procDir, "fd"))
+	if err != nil {
+		return err
+	}
+
+	for _, file := range []string{"tcp", "tcp6", "udp", "udp6"} {
+		found, err := readProcNetSockets(filepath.Join(procDir, "net", file), inodes, listening)
+		if os.IsNotExist(err) {
+			// e.g. IPv6 is disabled
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		fn(strings.TrimSuffix(file, "6"), found)
+	}
+	return nil
+}
+
+// procNetNS returns the inode of the network namespace of the process with the given PID, which is the
+// namespace identifier of the connections
+func procNetNS(procRoot string, pid int32) (uint32, error) {
+	link, err := os.Readlink(filepath.Join(procRoot, strconv.Itoa(int(pid)), "ns", "net"))
+	if err != nil {
+		return 0, err
+	}
+
+	if !strings.HasPrefix(link, "net:[") || !strings.HasSuffix(link, "]") {
+		return 0, fmt.Errorf("invalid netns %q", link)
+	}
+	netns, err := strconv.ParseUint(link[len("net:["):len(link)-1], 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid netns %q", link)
+	}
+	return uint32(netns), nil
+}
+
+// procLocalAddrs returns the addresses of the network namespace of the process with the given PID, as listed in
+// the procfs mounted at procRoot: the IPv4 ones from net/fib_trie and the global IPv6 ones from net/if_inet6.
+// The addresses without a subnet, e.g. the loopback ones, are left out.
+func procLocalAddrs(procRoot string, pid int32) ([]localAddr, error) {
+	netDir := filepath.Join(procRoot, strconv.Itoa(int(pid)), "net")
+
+	addrs, err := readFibTrie(filepath.Join(netDir, "fib_trie"))
+	if err != nil {
+		return nil, err
+	}
+	addrs6, err := readIfInet6(filepath.Join(netDir, "if_inet6"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return append(addrs, addrs6...), nil
+}
+
+// procHostIPs returns the addresses of the network namespace of the init process in the procfs mounted at procRoot,
+// i.e. the ones of the host: the local IPv4 ones from net/fib_trie, the loopback ones included, and the global IPv6
+// ones from net/if_inet6
+func procHostIPs(procRoot string) ([]string, error) {
+	netDir := filepath.Join(procRoot, "1", "net")
+
+	locals, _, err := scanFibTrie(filepath.Join(netDir, "fib_trie"))
+	if err != nil {
+		return nil, err
+	}
+	addrs6, err := readIfInet6(filepath.Join(netDir, "if_inet6"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	ips := make([]string, 0, len(locals)+len(addrs6))
+	for _, ip := range locals {
+		ips = append(ips, ip.String())
+	}
+	for _, addr := range addrs6 {
+		ips = append(ips, addr.ip.String())
+	}
+	return ips, nil
+}
+
+// readFibTrie reads the local IPv4 addresses of a /proc/<pid>/net/fib_trie file, along with the subnet of the
+// longest link route holding them, see scanFibTrie. The addresses without a link route are left out.
+func readFibTrie(path string) ([]localAddr, error) {
+	locals, subnets, err := scanFibTrie(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var addrs []localAddr
+	for _, ip := range locals {
+		var best *net.IPNet
+		for _, subnet := range subnets {
+			if subnet.Contains(ip) && (best == nil || prefixLen(subnet) > prefixLen(best)) {
+				best = subnet
+			}
+		}
+		if best != nil {
+			addrs = append(addrs, localAddr{ip: ip, subnet: best})
+		}
+	}
+	return addrs, nil
+}
+
+// scanFibTrie returns the local IPv4 addresses and the link subnets of a /proc/<pid>/net/fib_trie file. Each leaf
+// of the trie is a `|-- <ip>` line followed by its routes, e.g. `/24 link UNICAST` for the 172.17.0.0/24 subnet of
+// docker0 and `/32 host LOCAL` for its 172.17.0.1 address.
+func scanFibTrie(path string) ([]net.IP, []*net.IPNet, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() { _ = f.Close() }()
+
+	var (
+		leaf    net.IP
+		locals  []net.IP
+		subnets []*net.IPNet
+		seen    = make(map[string]struct{})
+	)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "|-- ") {
+			leaf = net.ParseIP(line[len("|-- "):]).To4()
+			continue
+		}
+		// /<prefix length> <scope> <type>
+		fields := strings.Fields(line)
+		if leaf == nil || len(fields) != 3 || !strings.HasPrefix(fields[0], "/") {
+			continue
+		}
+		ones, err := strconv.Atoi(fields[0][1:])
+		if err != nil || ones < 0 || ones > 8*net.IPv4len {
+			continue
+		}
+
+		switch {
+		case fields[1] == "host" && fields[2] == "LOCAL" && ones == 8*net.IPv4len:
+			if _, ok := seen[leaf.String()]; !ok {
+				seen[leaf.String()] = struct{}{}
+				locals = append(locals, leaf)
+			}
+		case fields[1] == "link" && fields[2] == "UNICAST":
+			mask := net.CIDRMask(ones, 8*net.IPv4len)
+			subnets = append(subnets, &net.IPNet{IP: leaf.Mask(mask), Mask: mask})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	return locals, subnets, nil
+}
+
+// readIfInet6 reads the global IPv6 addresses of a /proc/<pid>/net/if_inet6 file, whose lines are made of the
+// address, the interface index, the prefix length, the scope and the flags in hex, followed by the interface name
+func readIfInet6(path string) ([]localAddr, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+
+	var addrs []localAddr
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 6 || fields[3] != "00" {
+			// not a global address
+			continue
+		}
+		raw, err := hex.DecodeString(fields[0])
+		if err != nil || len(raw) != net.IPv6len {
+			return nil, fmt.Errorf("invalid address %q", fields[0])
+		}
+		ones, err := strconv.ParseUint(fields[2], 16, 8)
+		if err != nil || ones > 8*net.IPv6len {
+			return nil, fmt.Errorf("invalid prefix length %q", fields[2])
+		}
+
+		ip, mask := net.IP(raw), net.CIDRMask(int(ones), 8*net.IPv6len)
+		addrs = append(addrs, localAddr{ip: ip, subnet: &net.IPNet{IP: ip.Mask(mask), Mask: mask}})
+	}
+	return addrs, scanner.Err()
+}
+
+// socketInodes returns the inodes of the sockets among the given file descriptors directory
+func socketInodes(fdDir string) (map[string]struct{}, error) {
+	fds, err := os.Open(fdDir)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = fds.Close() }()
+
+	names, err := fds.Readdirnames(-1)
+	if err != nil {
+		return nil, err
+	}
+
+	inodes := make(map[string]struct{})
+	for _, name := range names {
+		link, err := os.Readlink(filepath.Join(fdDir, name))
+		if err != nil {
+			// the file descriptor was closed in the meantime
+			continue
+		}
+		if strings.HasPrefix(link, "socket:[") && strings.HasSuffix(link, "]") {
+			inodes[link[len("socket:["):len(link)-1]] = struct{}{}
+		}
+	}
+	return inodes, nil
+}
+
+// readProcNetSockets reads the connected sockets of a /proc/<pid>/net/{tcp,udp}[6] file whose inode is among the given
+// ones, or the listening ones
+func readProcNetSockets(path string, inodes map[string]struct{}, listening bool) ([]socket, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+
+	var sockets []socket
+	scanner := bufio.NewScanner(f)
+	// skip the header line
+	scanner.Scan()
+	for scanner.Scan() {
+		// sl local_address rem_address st tx_queue:rx_queue tr:tm->when retrnsmt uid timeout inode ...
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 {
+			continue
+		}
+		if _, ok := inodes[fields[9]]; !ok {
+			continue
+		}
+
+		laddr, err := parseProcNetAddr(fields[1])
+		if err != nil {
+			return nil, err
+		}
+		raddr, err := parseProcNetAddr(fields[2])
+		if err != nil {
+			return nil, err
+		}
+		// a TCP socket without a remote address is listening unless closed (0A being TCP_LISTEN), a UDP one is unconnected
+		if (raddr.Port == 0) != listening || (listening && strings.HasPrefix(filepath.Base(path), "tcp") && fields[3] != "0A") {
+			continue
+		}
+
+		sockets = append(sockets, socket{laddr: laddr, raddr: raddr})
+	}
+	return sockets, scanner.Err()
+}
+
+// parseProcNetAddr parses an address of /proc/net/{tcp,udp}[6], e.g. `0100007F:0035` for 127.0.0.1:53.
+// The IP is made of 32-bit words in host byte order, which is assumed to be little-endian.
+func parseProcNetAddr(s string) (model.Addr, error) {
+	idx := strings.IndexByte(s, ':')
+	if idx < 0 {
+		return model.Addr{}, fmt.Errorf("invalid address %q", s)
+	}
+
+	raw, err := hex.DecodeString(s[:idx])
+	if err != nil || (len(raw) != net.IPv4len && len(raw) != net.IPv6len) {
+		return model.Addr{}, fmt.Errorf("invalid address %q", s)
+	}
+	port, err := strconv.ParseUint(s[idx+1:], 16, 16)
+	if err != nil {
+		return model.Addr{}, fmt.Errorf("invalid address %q", s)
+	}
+
+	ip := make(net.IP, len(raw))
+	for i := 0; i < len(raw); i += 4 {
+		ip[i], ip[i+1], ip[i+2], ip[i+3] = raw[i+3], raw[i+2], raw[i+1], raw[i]
+	}
+	return model.Addr{Ip: canonicalIP(ip.String()), Port: int32(port)}, nil
+}
@@ -0,0 +1,286 @@
+// +build linux
+
+package dockerproxy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	model "github.com/DataDog/agent-payload/process"
+	"github.com/DataDog/gopsutil/process"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	procNetHeader = "  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode\n"
+	procNetTCP    = procNetHeader +
+		// listening on 0.0.0.0:8080
+		"   0: 00000000:1F90 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 1000 1 0000000000000000 100 0 0 10 0\n" +
+		// 172.17.0.1:34567 -> 172.17.0.2:80
+		"   1: 010011AC:8707 020011AC:0050 01 00000000:00000000 00:00000000 00000000     0        0 1001 1 0000000000000000 20 4 30 10 -1\n" +
+		// 172.17.0.1:36864 -> 172.17.0.3:80, owned by another process
+		"   2: 010011AC:9000 030011AC:0050 01 00000000:00000000 00:00000000 00000000     0        0 2001 1 0000000000000000 20 4 30 10 -1\n"
+	procNetTCP6 = procNetHeader +
+		// [fd00::1]:34568 -> [fd00::2]:80
+		"   0: 000000FD000000000000000001000000:8708 000000FD000000000000000002000000:0050 01 00000000:00000000 00:00000000 00000000     0        0 1002 1 0000000000000000 20 4 30 10 -1\n"
+
+	procFibTrie = `Main:
+  +-- 0.0.0.0/0 3 0 5
+     |-- 0.0.0.0
+        /0 universe UNICAST
+     +-- 10.0.0.0/24 2 0 2
+        |-- 10.0.0.0
+           /24 link UNICAST
+        |-- 10.0.0.5
+           /32 host LOCAL
+     +-- 127.0.0.0/8 2 0 2
+        |-- 127.0.0.0
+           /8 host LOCAL
+        |-- 127.0.0.1
+           /32 host LOCAL
+     +-- 172.16.0.0/12 2 0 2
+        |-- 172.17.0.0
+           /16 link UNICAST
+        |-- 172.17.0.1
+           /32 host LOCAL
+        |-- 172.18.0.0
+           /16 link UNICAST
+        |-- 172.18.0.1
+           /32 host LOCAL
+Local:
+  +-- 0.0.0.0/0 3 0 5
+     |-- 172.17.0.1
+        /32 host LOCAL
+`
+	procIfInet6 = "fd000000000000000000000000000001 04 40 00 80   docker0\n" +
+		"00000000000000000000000000000001 01 80 10 80        lo\n" +
+		"fe800000000000000000000000000001 04 40 20 80   docker0\n"
+)
+
+// fakeProcRoot creates a procfs holding the sockets of the process with PID 1
+func fakeProcRoot(t *testing.T) string {
+	root, err := ioutil.TempDir("", "dockerproxy-proc")
+	require.NoError(t, err)
+
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "1", "fd"), 0755))
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "1", "net"), 0755))
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "1", "ns"), 0755))
+	require.NoError(t, os.Symlink("net:[4026532008]", filepath.Join(root, "1", "ns", "net")))
+	for fd, target := range map[string]string{"0": "/dev/null", "3": "socket:[1000]", "4": "socket:[1001]", "5": "socket:[1002]"} {
+		require.NoError(t, os.Symlink(target, filepath.Join(root, "1", "fd", fd)))
+	}
+	require.NoError(t, ioutil.WriteFile(filepath.Join(root, "1", "net", "tcp"), []byte(procNetTCP), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(root, "1", "net", "tcp6"), []byte(procNetTCP6), 0644))
+
+	// the process with PID 2 doesn't serve any client, it only has the addresses of its network namespace
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "2", "net"), 0755))
+	for _, pid := range []string{"1", "2"} {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(root, pid, "net", "fib_trie"), []byte(procFibTrie), 0644))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(root, pid, "net", "if_inet6"), []byte(procIfInet6), 0644))
+	}
+	return root
+}
+
+func TestProcSockets(t *testing.T) {
+	root := fakeProcRoot(t)
+	defer os.RemoveAll(root)
+
+	sockets, err := procSockets(root, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []socket{
+		{laddr: model.Addr{Ip: "172.17.0.1", Port: 34567}, raddr: model.Addr{Ip: "172.17.0.2", Port: 80}},
+		{laddr: model.Addr{Ip: "fd00::1", Port: 34568}, raddr: model.Addr{Ip: "fd00::2", Port: 80}},
+	}, sockets)
+
+	_, err = procSockets(root, 2)
+	assert.Error(t, err)
+}
+
+func TestProcListeningSockets(t *testing.T) {
+	root := fakeProcRoot(t)
+	defer os.RemoveAll(root)
+
+	listening, err := procListeningSockets(root, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []listeningSocket{{proto: "tcp", addr: model.Addr{Ip: "0.0.0.0", Port: 8080}}}, listening)
+
+	_, err = procListeningSockets(root, 2)
+	assert.Error(t, err)
+}
+
+func TestProcLocalAddrs(t *testing.T) {
+	root := fakeProcRoot(t)
+	defer os.RemoveAll(root)
+
+	addrs, err := procLocalAddrs(root, 2)
+	assert.NoError(t, err)
+	var found []string
+	for _, addr := range addrs {
+		found = append(found, addr.ip.String()+" "+addr.subnet.String())
+	}
+	// the loopback and link-local addresses are left out
+	assert.Equal(t, []string{"10.0.0.5 10.0.0.0/24", "172.17.0.1 172.17.0.0/16", "172.18.0.1 172.18.0.0/16", "fd00::1 fd00::/64"}, found)
+
+	_, err = procLocalAddrs(root, 3)
+	assert.Error(t, err)
+}
+
+func TestProcHostIPs(t *testing.T) {
+	root := fakeProcRoot(t)
+	defer os.RemoveAll(root)
+
+	ips, err := ProcHostIPs(root)()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.5", "127.0.0.1", "172.17.0.1", "172.18.0.1", "fd00::1"}, ips)
+
+	_, err = ProcHostIPs(filepath.Join(root, "2"))()
+	assert.Error(t, err)
+}
+
+func TestProcHostIPsContainerizedAgent(t *testing.T) {
+	root := fakeProcRoot(t)
+	defer os.RemoveAll(root)
+
+	procs := map[int32]*process.FilledProcess{
+		10: {Pid: 10, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-ip", "0.0.0.0", "-host-port", "8080", "-container-ip", "172.17.0.2", "-container-port", "80"}},
+	}
+	clientLeg := &model.Connection{Pid: 10, Laddr: &model.Addr{Ip: "10.0.0.5", Port: 8080}, Raddr: &model.Addr{Ip: "10.0.0.42", Port: 51234}}
+
+	// the interfaces of the network namespace of the agent are unrelated to the ones of the host
+	agentIPs := func() ([]string, error) { return []string{"172.20.0.3"}, nil }
+	f := newFilter(WithHostIPsFunc(agentIPs))
+	f.LoadProxies(procs)
+	assert.False(t, f.IsProxied(clientLeg))
+
+	// while the procfs lists the addresses of the host
+	f = newFilter(WithHostIPsFunc(ProcHostIPs(root)))
+	f.LoadProxies(procs)
+	assert.True(t, f.IsProxied(clientLeg))
+
+	// and the wildcard proxies match any address if they can't be read
+	f = newFilter(WithHostIPsFunc(ProcHostIPs(filepath.Join(root, "2"))))
+	f.LoadProxies(procs)
+	assert.True(t, f.IsProxied(clientLeg))
+	assert.True(t, f.IsProxied(&model.Connection{Pid: 10, Laddr: &model.Addr{Ip: "192.168.1.5", Port: 8080}, Raddr: &model.Addr{Ip: "10.0.0.42", Port: 51234}}))
+}
+
+func TestSourceIP(t *testing.T) {
+	root := fakeProcRoot(t)
+	defer os.RemoveAll(root)
+
+	addrs, err := procLocalAddrs(root, 2)
+	require.NoError(t, err)
+
+	assert.Equal(t, "172.17.0.1", sourceIP(addrs, "172.17.0.2"))
+	assert.Equal(t, "172.18.0.1", sourceIP(addrs, "172.18.0.2"))
+	assert.Equal(t, "fd00::1", sourceIP(addrs, "fd00::2"))
+	// the address of the namespace itself, off-subnet and loopback targets aren't reached from a subnet address
+	assert.Equal(t, "", sourceIP(addrs, "172.17.0.1"))
+	assert.Equal(t, "", sourceIP(addrs, "192.168.1.2"))
+	assert.Equal(t, "", sourceIP(addrs, "127.0.0.1"))
+}
+
+func TestProcNetNS(t *testing.T) {
+	root := fakeProcRoot(t)
+	defer os.RemoveAll(root)
+
+	netns, err := procNetNS(root, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(4026532008), netns)
+
+	_, err = procNetNS(root, 2)
+	assert.Error(t, err)
+}
+
+func TestParseProcNetAddr(t *testing.T) {
+	addr, err := parseProcNetAddr("0100007F:0035")
+	assert.NoError(t, err)
+	assert.Equal(t, model.Addr{Ip: "127.0.0.1", Port: 53}, addr)
+
+	// IPv4-mapped IPv6 address
+	addr, err = parseProcNetAddr("0000000000000000FFFF0000020011AC:0050")
+	assert.NoError(t, err)
+	assert.Equal(t, model.Addr{Ip: "172.17.0.2", Port: 80}, addr)
+
+	for _, invalid := range []string{"", "0100007F", "0100007F:", "01007F:0035", "0100007G:0035", "0100007F:10000"} {
+		_, err := parseProcNetAddr(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestActiveDiscovery(t *testing.T) {
+	root := fakeProcRoot(t)
+	defer os.RemoveAll(root)
+
+	procs := map[int32]*process.FilledProcess{
+		1: {Pid: 1, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-ip", "10.0.0.5", "-host-port", "8080",
+			"-container-ip", "172.17.0.2", "-container-port", "80", "-container-ip", "fd00::2", "-container-port", "80"}},
+	}
+	clientToProxy := &model.Connection{Pid: 1, Laddr: &model.Addr{Ip: "10.0.0.5", Port: 8080}, Raddr: &model.Addr{Ip: "10.0.0.42", Port: 51234}}
+	containerFromProxy := &model.Connection{Pid: 3, Laddr: &model.Addr{Ip: "172.17.0.2", Port: 80}, Raddr: &model.Addr{Ip: "172.17.0.1", Port: 34567}}
+	proxyToContainer := &model.Connection{Pid: 1, Laddr: &model.Addr{Ip: "172.17.0.1", Port: 34567}, Raddr: &model.Addr{Ip: "172.17.0.2", Port: 80}}
+
+	// the proxy leg seen by the container is filtered from the first payload on
+	f := newFilter(WithActiveDiscovery(root))
+	f.LoadProxies(procs)
+	payload := &model.Connections{Conns: []*model.Connection{clientToProxy, containerFromProxy}}
+	assert.Equal(t, 2, f.Filter(payload))
+	assert.Equal(t, "172.17.0.1", f.proxyByPID[1].ip)
+	assert.Equal(t, "fd00::1", f.proxyByPID[1].altIP)
+	assert.Equal(t, uint32(4026532008), f.proxyByPID[1].netns)
+
+	// without active discovery, the proxy IP is only discovered from the proxy -> container connection
+	f = newFilter()
+	f.LoadProxies(procs)
+	payload = &model.Connections{Conns: []*model.Connection{clientToProxy, containerFromProxy}}
+	assert.Equal(t, 1, f.Filter(payload))
+	assert.Equal(t, "", f.proxyByPID[1].ip)
+
+	payload = &model.Connections{Conns: []*model.Connection{clientToProxy, proxyToContainer, containerFromProxy}}
+	assert.Equal(t, 3, f.Filter(payload))
+	assert.Equal(t, "172.17.0.1", f.proxyByPID[1].ip)
+}
+
+func TestActiveDiscoveryAtLoad(t *testing.T) {
+	root := fakeProcRoot(t)
+	defer os.RemoveAll(root)
+
+	procs := map[int32]*process.FilledProcess{
+		// serving a client: the IPs are taken from its sockets
+		1: {Pid: 1, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-ip", "10.0.0.5", "-host-port", "8080",
+			"-container-ip", "172.17.0.2", "-container-port", "80", "-container-ip", "fd00::2", "-container-port", "80"}},
+		// idle, on a second bridge: the IP is taken from the address of its namespace on the subnet of its target
+		2: {Pid: 2, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-ip", "0.0.0.0", "-host-port", "8081",
+			"-container-ip", "172.18.0.2", "-container-port", "80"}},
+		// not in the procfs: left to the passive discovery
+		3: {Pid: 3, Cmdline: []string{"docker-proxy", "-proto", "tcp", "-host-ip", "0.0.0.0", "-host-port", "8082",
+			"-container-ip", "172.17.0.3", "-container-port", "80"}},
+	}
+
+	// the IPs are known before any payload is filtered
+	f, err := NewFilterWithError(&fakeProcessSource{procs: procs}, WithActiveDiscovery(root))
+	assert.NoError(t, err)
+	assert.Equal(t, "172.17.0.1", f.proxyByPID[1].ip)
+	assert.Equal(t, "fd00::1", f.proxyByPID[1].altIP)
+	assert.Equal(t, uint32(4026532008), f.proxyByPID[1].netns)
+	assert.Equal(t, "172.18.0.1", f.proxyByPID[2].ip)
+	assert.Equal(t, "", f.proxyByPID[3].ip)
+
+	// the container side of the idle proxy is filtered from the first payload on
+	containerFromProxy := &model.Connection{Pid: 4, Laddr: &model.Addr{Ip: "172.18.0.2", Port: 80}, Raddr: &model.Addr{Ip: "172.18.0.1", Port: 40000}}
+	assert.Equal(t, 1, f.Filter(&model.Connections{Conns: []*model.Connection{containerFromProxy}}))
+
+	// the passive heuristic still applies to the proxies whose IP wasn't found
+	proxyToContainer := &model.Connection{Pid: 3, Laddr: &model.Addr{Ip: "172.17.0.1", Port: 41000}, Raddr: &model.Addr{Ip: "172.17.0.3", Port: 80}}
+	assert.Equal(t, 1, f.Filter(&model.Connections{Conns: []*model.Connection{proxyToContainer}}))
+	assert.Equal(t, "172.17.0.1", f.proxyByPID[3].ip)
+
+	// without active discovery, nothing is known until the proxies connect to their targets
+	f = newFilter()
+	f.LoadProxies(procs)
+	assert.Equal(t, "", f.proxyByPID[1].ip)
+	assert.Equal(t, "", f.proxyByPID[2].ip)
+}
@@ -0,0 +1,26 @@
+// +build !linux
+
+package dockerproxy
+
+// procfsSupported is false as procfs is only read on linux, see WithActiveDiscovery
+const procfsSupported = false
+
+// procSockets is only implemented on linux
+func procSockets(_ string, _ int32) ([]socket, error) {
+	return nil, ErrUnsupportedPlatform
+}
+
+// procLocalAddrs is only implemented on linux
+func procLocalAddrs(_ string, _ int32) ([]localAddr, error) {
+	return nil, ErrUnsupportedPlatform
+}
+
+// procNetNS is only implemented on linux
+func procNetNS(_ string, _ int32) (uint32, error) {
+	return 0, ErrUnsupportedPlatform
+}
+
+// procHostIPs is only implemented on linux
+func procHostIPs(_ string) ([]string, error) {
+	return nil, ErrUnsupportedPlatform
+}